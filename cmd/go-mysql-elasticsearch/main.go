@@ -22,6 +22,8 @@ var server_id = flag.Int("server_id", 0, "MySQL server id, as a pseudo slave")
 var flavor = flag.String("flavor", "", "flavor: mysql or mariadb")
 var execution = flag.String("exec", "", "mysqldump execution path")
 var logLevel = flag.String("log_level", "info", "log level")
+var replay = flag.String("replay", "", "replay the row events recorded by record_file, then exit")
+var skipEvents = flag.Int64("skip_events", 0, "skip the first row events of the synced tables, to jump over a poison event")
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -76,11 +78,27 @@ func main() {
 		cfg.DumpExec = *execution
 	}
 
+	if len(*replay) > 0 {
+		r, err := river.NewReplayRiver(cfg)
+		if err != nil {
+			println(errors.ErrorStack(err))
+			return
+		}
+		if err = r.Replay(*replay); err != nil {
+			println(errors.ErrorStack(err))
+		}
+		r.Close()
+		return
+	}
+
 	r, err := river.NewRiver(cfg)
 	if err != nil {
 		println(errors.ErrorStack(err))
 		return
 	}
+	if *skipEvents > 0 {
+		r.SkipEvents(*skipEvents)
+	}
 
 	done := make(chan struct{}, 1)
 	go func() {
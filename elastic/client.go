@@ -2,12 +2,15 @@ package elastic
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/juju/errors"
 )
@@ -20,6 +23,20 @@ type Client struct {
 	Addr     string
 	User     string
 	Password string
+	APIKey   string
+
+	// BulkTimeout is the timeout of a bulk request, 0 means no timeout
+	BulkTimeout time.Duration
+
+	// BulkFilterPath is the filter_path of the bulk responses, empty means the whole response.
+	BulkFilterPath string
+
+	// BulkThrottle is called with the number of docs and the body size before
+	// a bulk request is sent, it may block to limit the rate, nil means no limit.
+	BulkThrottle func(docs int, size int) error
+
+	// Fault injects the faults into the bulk requests for testing, nil means no fault.
+	Fault *FaultInjector
 
 	c *http.Client
 }
@@ -30,6 +47,23 @@ type ClientConfig struct {
 	Addr     string
 	User     string
 	Password string
+	// APIKey is the base64 encoded "id:api_key", it is used instead of User and Password.
+	APIKey string
+
+	// HTTP transport settings, the defaults of http.DefaultTransport are used if not set,
+	// and the proxy is from the environment if Proxy is nil.
+	Proxy                 *url.URL
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// BulkTimeout is the timeout of a bulk request, 0 means no timeout
+	BulkTimeout time.Duration
+
+	// BulkFilterPath is the filter_path of the bulk responses, empty means the whole response.
+	BulkFilterPath string
 }
 
 // NewClient creates the Cient with configuration.
@@ -39,17 +73,37 @@ func NewClient(conf *ClientConfig) *Client {
 	c.Addr = conf.Addr
 	c.User = conf.User
 	c.Password = conf.Password
+	c.APIKey = conf.APIKey
+	c.BulkTimeout = conf.BulkTimeout
+	c.BulkFilterPath = conf.BulkFilterPath
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.Proxy != nil {
+		tr.Proxy = http.ProxyURL(conf.Proxy)
+	}
+	if conf.MaxIdleConns > 0 {
+		tr.MaxIdleConns = conf.MaxIdleConns
+	}
+	if conf.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	}
+	if conf.MaxConnsPerHost > 0 {
+		tr.MaxConnsPerHost = conf.MaxConnsPerHost
+	}
+	if conf.TLSHandshakeTimeout > 0 {
+		tr.TLSHandshakeTimeout = conf.TLSHandshakeTimeout
+	}
+	if conf.ResponseHeaderTimeout > 0 {
+		tr.ResponseHeaderTimeout = conf.ResponseHeaderTimeout
+	}
 
 	if conf.HTTPS {
 		c.Protocol = "https"
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		c.c = &http.Client{Transport: tr}
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	} else {
 		c.Protocol = "http"
-		c.c = &http.Client{}
 	}
+	c.c = &http.Client{Transport: tr}
 
 	return c
 }
@@ -80,77 +134,138 @@ const (
 
 // BulkRequest is used to send multi request in batch.
 type BulkRequest struct {
+	// Cluster is the name of the cluster the request is sent to by the river,
+	// empty is the default one, it is not in the bulk body.
+	Cluster string `json:",omitempty"`
+
 	Action   string
 	Index    string
 	Type     string
 	ID       string
 	Parent   string
 	Pipeline string
+	// Routing routes the doc to the shard of the value instead of the id if set.
+	Routing string `json:",omitempty"`
+
+	// Version with VersionType external or external_gte, 0 means no versioning.
+	Version     int64
+	VersionType string
+
+	// Upsert inserts Data if the doc doesn't exist for update.
+	Upsert bool
+	// Script updates the doc with the script instead of Data if set.
+	Script map[string]interface{}
 
 	Data map[string]interface{}
+
+	// Encoder writes Data with the fields of the rule in a fixed order if set.
+	Encoder *FieldEncoder `json:"-"`
 }
 
-func (r *BulkRequest) bulk(buf *bytes.Buffer) error {
-	meta := make(map[string]map[string]string)
-	metaData := make(map[string]string)
-	if len(r.Index) > 0 {
-		metaData["_index"] = r.Index
-	}
-	if len(r.Type) > 0 {
-		metaData["_type"] = r.Type
+func (r *BulkRequest) writeData(buf *bytes.Buffer) error {
+	if r.Encoder != nil {
+		return r.Encoder.writeObject(buf, r.Data)
 	}
+	return writeObject(buf, r.Data)
+}
 
+func (r *BulkRequest) bulk(buf *bytes.Buffer) error {
+	// the meta keys are in sorted order, same as json.Marshal
+	buf.WriteString(`{`)
+	writeString(buf, r.Action)
+	buf.WriteString(`:{`)
+	first := true
 	if len(r.ID) > 0 {
-		metaData["_id"] = r.ID
+		writeField(buf, first, "_id", r.ID)
+		first = false
+	}
+	if len(r.Index) > 0 {
+		writeField(buf, first, "_index", r.Index)
+		first = false
 	}
 	if len(r.Parent) > 0 {
-		metaData["_parent"] = r.Parent
+		writeField(buf, first, "_parent", r.Parent)
+		first = false
+	}
+	if len(r.Type) > 0 {
+		writeField(buf, first, "_type", r.Type)
+		first = false
 	}
 	if len(r.Pipeline) > 0 {
-		metaData["pipeline"] = r.Pipeline
+		writeField(buf, first, "pipeline", r.Pipeline)
+		first = false
 	}
-
-	meta[r.Action] = metaData
-
-	data, err := json.Marshal(meta)
-	if err != nil {
-		return errors.Trace(err)
+	if len(r.Routing) > 0 {
+		writeField(buf, first, "routing", r.Routing)
+		first = false
 	}
-
-	buf.Write(data)
-	buf.WriteByte('\n')
+	if r.Version > 0 {
+		// ES 7 rejects _version and _version_type, ES 6 accepts both forms
+		if !first {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"version":`)
+		buf.WriteString(strconv.FormatInt(r.Version, 10))
+		writeField(buf, false, "version_type", r.VersionType)
+	}
+	buf.WriteString("}}\n")
 
 	switch r.Action {
 	case ActionDelete:
 		//nothing to do
 	case ActionUpdate:
-		doc := map[string]interface{}{
-			"doc": r.Data,
-		}
-		data, err = json.Marshal(doc)
-		if err != nil {
-			return errors.Trace(err)
+		if r.Script != nil {
+			buf.WriteString(`{"script":`)
+			if err := writeObject(buf, r.Script); err != nil {
+				return errors.Trace(err)
+			}
+			if r.Upsert {
+				buf.WriteString(`,"upsert":`)
+				if err := r.writeData(buf); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		} else {
+			buf.WriteString(`{"doc":`)
+			if err := r.writeData(buf); err != nil {
+				return errors.Trace(err)
+			}
+			if r.Upsert {
+				buf.WriteString(`,"doc_as_upsert":true`)
+			}
 		}
-
-		buf.Write(data)
-		buf.WriteByte('\n')
+		buf.WriteString("}\n")
 	default:
 		//for create and index
-		data, err = json.Marshal(r.Data)
-		if err != nil {
+		if err := r.writeData(buf); err != nil {
 			return errors.Trace(err)
 		}
-
-		buf.Write(data)
 		buf.WriteByte('\n')
 	}
 
 	return nil
 }
 
+// EncodeBulk writes the items in the NDJSON format of the bulk API.
+func EncodeBulk(buf *bytes.Buffer, items []*BulkRequest) error {
+	for _, item := range items {
+		if err := item.bulk(buf); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// DefaultBulkFilterPath keeps only the errors and the status of the items in the bulk
+// responses, which are much smaller to parse than the whole ones.
+const DefaultBulkFilterPath = "errors,items.*.error,items.*.status"
+
 // BulkResponse is the response for the bulk request.
 type BulkResponse struct {
-	Code   int
+	Code int
+	// RetryAfter is the Retry-After header, 0 if not set
+	RetryAfter time.Duration
+
 	Took   int  `json:"took"`
 	Errors bool `json:"errors"`
 
@@ -186,12 +301,19 @@ type Mapping map[string]struct {
 
 // DoRequest sends a request with body to ES.
 func (c *Client) DoRequest(method string, url string, body *bytes.Buffer) (*http.Response, error) {
+	return c.doRequestContext(context.Background(), method, url, body)
+}
+
+func (c *Client) doRequestContext(ctx context.Context, method string, url string, body *bytes.Buffer) (*http.Response, error) {
 	req, err := http.NewRequest(method, url, body)
-	req.Header.Add("Content-Type", "application/json")
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	if len(c.User) > 0 && len(c.Password) > 0 {
+	req = req.WithContext(ctx)
+	req.Header.Add("Content-Type", "application/json")
+	if len(c.APIKey) > 0 {
+		req.Header.Set("Authorization", "ApiKey "+c.APIKey)
+	} else if len(c.User) > 0 && len(c.Password) > 0 {
 		req.SetBasicAuth(c.User, c.Password)
 	}
 	resp, err := c.c.Do(req)
@@ -234,24 +356,54 @@ func (c *Client) Do(method string, url string, body map[string]interface{}) (*Re
 }
 
 // DoBulk sends the bulk request to the ES.
-func (c *Client) DoBulk(url string, items []*BulkRequest) (*BulkResponse, error) {
-	var buf bytes.Buffer
+func (c *Client) DoBulk(reqURL string, items []*BulkRequest) (*BulkResponse, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
 
-	for _, item := range items {
-		if err := item.bulk(&buf); err != nil {
+	if err := EncodeBulk(buf, items); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if c.BulkThrottle != nil {
+		if err := c.BulkThrottle(len(items), buf.Len()); err != nil {
+			bufferPool.Put(buf)
 			return nil, errors.Trace(err)
 		}
 	}
 
-	resp, err := c.DoRequest("POST", url, &buf)
+	ctx := context.Background()
+	if c.BulkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.BulkTimeout)
+		defer cancel()
+	}
+
+	if len(c.BulkFilterPath) > 0 {
+		reqURL += "?filter_path=" + url.QueryEscape(c.BulkFilterPath)
+	}
+
+	if c.Fault != nil {
+		if ret, err := c.Fault.beforeBulk(ctx, reqURL); ret != nil || err != nil {
+			bufferPool.Put(buf)
+			return ret, err
+		}
+	}
+
+	resp, err := c.doRequestContext(ctx, "POST", reqURL, buf)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode/100 == 2 {
+		// ES has read the whole body, so the buffer is not used by the transport any more
+		bufferPool.Put(buf)
+	}
+
 	ret := new(BulkResponse)
 	ret.Code = resp.StatusCode
+	ret.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -261,10 +413,57 @@ func (c *Client) DoBulk(url string, items []*BulkRequest) (*BulkResponse, error)
 	if len(data) > 0 {
 		err = json.Unmarshal(data, &ret)
 	}
+	if err == nil {
+		ret.fillItems(items)
+	}
+
+	if err == nil && c.Fault != nil {
+		c.Fault.afterBulk(ret)
+	}
 
 	return ret, errors.Trace(err)
 }
 
+// fillItems fills the index, type and id of the items filtered out by filter_path
+// from the requests in the same order.
+func (r *BulkResponse) fillItems(reqs []*BulkRequest) {
+	if len(r.Items) != len(reqs) {
+		return
+	}
+	for i, req := range reqs {
+		for _, item := range r.Items[i] {
+			if item == nil {
+				continue
+			}
+			if len(item.Index) == 0 {
+				item.Index = req.Index
+			}
+			if len(item.Type) == 0 {
+				item.Type = req.Type
+			}
+			if len(item.ID) == 0 {
+				item.ID = req.ID
+			}
+		}
+	}
+}
+
+// parseRetryAfter parses the Retry-After header in seconds or HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if len(v) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
 // CreateMapping creates a ES mapping.
 func (c *Client) CreateMapping(index string, docType string, mapping map[string]interface{}) error {
 	reqURL := fmt.Sprintf("%s://%s/%s", c.Protocol, c.Addr,
@@ -294,6 +493,58 @@ func (c *Client) CreateMapping(index string, docType string, mapping map[string]
 	return errors.Trace(err)
 }
 
+// PutMapping adds the field properties to the mapping of the existing index.
+func (c *Client) PutMapping(index string, docType string, properties map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/%s/%s/_mapping", c.Protocol, c.Addr,
+		url.QueryEscape(index),
+		url.QueryEscape(docType))
+
+	r, err := c.Do("PUT", reqURL, map[string]interface{}{"properties": properties})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK || r.Code == http.StatusCreated {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// PutTemplate creates or updates the index template.
+func (c *Client) PutTemplate(name string, template map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/_template/%s", c.Protocol, c.Addr,
+		url.QueryEscape(name))
+
+	r, err := c.Do("PUT", reqURL, template)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK || r.Code == http.StatusCreated {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// PutILMPolicy creates or updates the ILM policy, the policy is the whole request body.
+func (c *Client) PutILMPolicy(name string, policy map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/_ilm/policy/%s", c.Protocol, c.Addr,
+		url.QueryEscape(name))
+
+	r, err := c.Do("PUT", reqURL, policy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK || r.Code == http.StatusCreated {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
 // GetMapping gets the mapping.
 func (c *Client) GetMapping(index string, docType string) (*MappingResponse, error) {
 	reqURL := fmt.Sprintf("%s://%s/%s/%s/_mapping", c.Protocol, c.Addr,
@@ -323,6 +574,77 @@ func (c *Client) GetMapping(index string, docType string) (*MappingResponse, err
 	return ret, errors.Trace(err)
 }
 
+// GetFieldTypes gets the types of the top level fields in the mappings of the index, the
+// objects are "object" if they have no type. The types are by the indices, as an alias
+// may have more. Both the typeless mappings and the ones of the doc types are supported,
+// the fields of all the types are merged. nil if the index doesn't exist.
+func (c *Client) GetFieldTypes(index string) (map[string]map[string]string, error) {
+	reqURL := fmt.Sprintf("%s://%s/%s/_mapping", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+	buf := bytes.NewBuffer(nil)
+	resp, err := c.DoRequest("GET", reqURL, buf)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Error: %s, code: %d", http.StatusText(resp.StatusCode), resp.StatusCode)
+	}
+
+	type properties map[string]struct {
+		Type string `json:"type"`
+	}
+	var ret map[string]struct {
+		Mappings map[string]json.RawMessage `json:"mappings"`
+	}
+	if err = json.Unmarshal(data, &ret); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	types := make(map[string]map[string]string, len(ret))
+	for name, m := range ret {
+		var raws []json.RawMessage
+		if raw, ok := m.Mappings["properties"]; ok {
+			raws = append(raws, raw)
+		} else {
+			// the mappings of the doc types before ES 7
+			for _, typeMapping := range m.Mappings {
+				var t struct {
+					Properties json.RawMessage `json:"properties"`
+				}
+				if err = json.Unmarshal(typeMapping, &t); err == nil && len(t.Properties) > 0 {
+					raws = append(raws, t.Properties)
+				}
+			}
+		}
+
+		fields := make(map[string]string)
+		for _, raw := range raws {
+			var props properties
+			if err = json.Unmarshal(raw, &props); err != nil {
+				return nil, errors.Trace(err)
+			}
+			for field, p := range props {
+				if len(p.Type) == 0 {
+					p.Type = "object"
+				}
+				fields[field] = p.Type
+			}
+		}
+		types[name] = fields
+	}
+	return types, nil
+}
+
 // DeleteIndex deletes the index.
 func (c *Client) DeleteIndex(index string) error {
 	reqURL := fmt.Sprintf("%s://%s/%s", c.Protocol, c.Addr,
@@ -340,6 +662,233 @@ func (c *Client) DeleteIndex(index string) error {
 	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
 }
 
+// Refresh makes the recent writes of the index searchable.
+func (c *Client) Refresh(index string) error {
+	reqURL := fmt.Sprintf("%s://%s/%s/_refresh", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+
+	r, err := c.Do("POST", reqURL, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK || r.Code == http.StatusNotFound {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// ExistsIndex checks whether the index exists or not.
+func (c *Client) ExistsIndex(index string) (bool, error) {
+	reqURL := fmt.Sprintf("%s://%s/%s", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+
+	r, err := c.Do("HEAD", reqURL, nil)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK {
+		return true, nil
+	} else if r.Code == http.StatusNotFound {
+		return false, nil
+	}
+
+	return false, errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// GetIndexSettings gets the index level settings of the index, like refresh_interval.
+func (c *Client) GetIndexSettings(index string) (map[string]interface{}, error) {
+	reqURL := fmt.Sprintf("%s://%s/%s/_settings", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+	buf := bytes.NewBuffer(nil)
+	resp, err := c.DoRequest("GET", reqURL, buf)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Error: %s, code: %d", http.StatusText(resp.StatusCode), resp.StatusCode)
+	}
+
+	var ret map[string]struct {
+		Settings struct {
+			Index map[string]interface{} `json:"index"`
+		} `json:"settings"`
+	}
+	if err = json.Unmarshal(data, &ret); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return ret[index].Settings.Index, nil
+}
+
+// PutIndexSettings updates the dynamic settings of the index, nil value resets the setting to default.
+func (c *Client) PutIndexSettings(index string, settings map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/%s/_settings", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+
+	r, err := c.Do("PUT", reqURL, map[string]interface{}{"index": settings})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// ExistsPipeline checks whether the ingest pipeline exists or not.
+func (c *Client) ExistsPipeline(id string) (bool, error) {
+	reqURL := fmt.Sprintf("%s://%s/_ingest/pipeline/%s", c.Protocol, c.Addr,
+		url.QueryEscape(id))
+
+	r, err := c.Do("GET", reqURL, nil)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK {
+		return true, nil
+	} else if r.Code == http.StatusNotFound {
+		return false, nil
+	}
+
+	return false, errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// ExistsAlias checks whether the alias is on the index or not.
+func (c *Client) ExistsAlias(index string, alias string) (bool, error) {
+	reqURL := fmt.Sprintf("%s://%s/%s/_alias/%s", c.Protocol, c.Addr,
+		url.QueryEscape(index),
+		url.QueryEscape(alias))
+
+	r, err := c.Do("HEAD", reqURL, nil)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK {
+		return true, nil
+	} else if r.Code == http.StatusNotFound {
+		return false, nil
+	}
+
+	return false, errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// UpdateAliases applies the alias actions like add and remove atomically.
+func (c *Client) UpdateAliases(actions []map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/_aliases", c.Protocol, c.Addr)
+
+	r, err := c.Do("POST", reqURL, map[string]interface{}{"actions": actions})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// CreateIndex creates the index with body like settings and mappings.
+func (c *Client) CreateIndex(index string, body map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/%s", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+
+	r, err := c.Do("PUT", reqURL, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK || r.Code == http.StatusCreated {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// DeleteByQuery deletes the items matching the query, docType may be empty.
+func (c *Client) DeleteByQuery(index string, docType string, query map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/%s/_delete_by_query?conflicts=proceed", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+	if len(docType) > 0 {
+		reqURL = fmt.Sprintf("%s://%s/%s/%s/_delete_by_query?conflicts=proceed", c.Protocol, c.Addr,
+			url.QueryEscape(index),
+			url.QueryEscape(docType))
+	}
+
+	r, err := c.Do("POST", reqURL, map[string]interface{}{"query": query})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK || r.Code == http.StatusNotFound {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// DeleteByQueryLimit deletes at most maxDocs items matching the query and returns the number
+// of the deleted ones, docType may be empty, maxDocs <= 0 means no limit. max_docs needs ES 7.3+.
+func (c *Client) DeleteByQueryLimit(index string, docType string, query map[string]interface{}, maxDocs int) (int64, error) {
+	reqURL := fmt.Sprintf("%s://%s/%s/_delete_by_query?conflicts=proceed", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+	if len(docType) > 0 {
+		reqURL = fmt.Sprintf("%s://%s/%s/%s/_delete_by_query?conflicts=proceed", c.Protocol, c.Addr,
+			url.QueryEscape(index),
+			url.QueryEscape(docType))
+	}
+
+	body := map[string]interface{}{"query": query}
+	if maxDocs > 0 {
+		body["max_docs"] = maxDocs
+	}
+	bodyData, err := json.Marshal(body)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	resp, err := c.DoRequest("POST", reqURL, bytes.NewBuffer(bodyData))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("Error: %s, code: %d", http.StatusText(resp.StatusCode), resp.StatusCode)
+	}
+
+	var ret struct {
+		Deleted int64 `json:"deleted"`
+	}
+	if err = json.Unmarshal(data, &ret); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return ret.Deleted, nil
+}
+
 // Get gets the item by id.
 func (c *Client) Get(index string, docType string, id string) (*Response, error) {
 	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
@@ -350,6 +899,57 @@ func (c *Client) Get(index string, docType string, id string) (*Response, error)
 	return c.Do("GET", reqURL, nil)
 }
 
+// MGet gets the docs of the requests by their index, type, id and routing in one request,
+// the items are in the order of the requests, and not found if the index doesn't exist.
+func (c *Client) MGet(items []*BulkRequest) ([]ResponseItem, error) {
+	reqURL := fmt.Sprintf("%s://%s/_mget", c.Protocol, c.Addr)
+
+	docs := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		doc := map[string]interface{}{"_index": item.Index, "_id": item.ID}
+		if len(item.Type) > 0 {
+			doc["_type"] = item.Type
+		}
+		if len(item.Routing) > 0 {
+			doc["routing"] = item.Routing
+		} else if len(item.Parent) > 0 {
+			doc["routing"] = item.Parent
+		}
+		docs = append(docs, doc)
+	}
+	bodyData, err := json.Marshal(map[string]interface{}{"docs": docs})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp, err := c.DoRequest("POST", reqURL, bytes.NewBuffer(bodyData))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Error: %s, code: %d", http.StatusText(resp.StatusCode), resp.StatusCode)
+	}
+
+	var ret struct {
+		Docs []ResponseItem `json:"docs"`
+	}
+	if err = json.Unmarshal(data, &ret); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(ret.Docs) != len(items) {
+		return nil, errors.Errorf("mget returns %d docs for %d requests", len(ret.Docs), len(items))
+	}
+	return ret.Docs, nil
+}
+
 // Update creates or updates the data
 func (c *Client) Update(index string, docType string, id string, data map[string]interface{}) error {
 	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
@@ -1,8 +1,14 @@
 package elastic
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	. "github.com/pingcap/check"
@@ -143,3 +149,125 @@ func (s *elasticTestSuite) TestParent(c *C) {
 	c.Assert(resp.Code, Equals, 200)
 	c.Assert(resp.Errors, Equals, false)
 }
+
+func (s *elasticTestSuite) TestBulkUpdateBody(c *C) {
+	req := &BulkRequest{Action: ActionUpdate, Index: "dummy", Type: "blog", ID: "1", Upsert: true,
+		Data: map[string]interface{}{"name": "abc"}}
+
+	var buf bytes.Buffer
+	c.Assert(req.bulk(&buf), IsNil)
+	c.Assert(buf.String(), Equals, `{"update":{"_id":"1","_index":"dummy","_type":"blog"}}
+{"doc":{"name":"abc"},"doc_as_upsert":true}
+`)
+
+	req.Script = map[string]interface{}{"source": "ctx._source.count += 1"}
+	buf.Reset()
+	c.Assert(req.bulk(&buf), IsNil)
+	c.Assert(buf.String(), Equals, `{"update":{"_id":"1","_index":"dummy","_type":"blog"}}
+{"script":{"source":"ctx._source.count += 1"},"upsert":{"name":"abc"}}
+`)
+
+	req = &BulkRequest{Action: ActionDelete, Index: "dummy", ID: "1", Routing: "7"}
+	buf.Reset()
+	c.Assert(req.bulk(&buf), IsNil)
+	c.Assert(buf.String(), Equals, `{"delete":{"_id":"1","_index":"dummy","routing":"7"}}
+`)
+
+	req.Version = 1 << 32
+	req.VersionType = "external"
+	buf.Reset()
+	c.Assert(req.bulk(&buf), IsNil)
+	c.Assert(buf.String(), Equals, `{"delete":{"_id":"1","_index":"dummy","routing":"7","version":4294967296,"version_type":"external"}}
+`)
+
+	req = &BulkRequest{Action: ActionIndex, Version: 7, VersionType: "external_gte", Data: map[string]interface{}{"name": "abc"}}
+	buf.Reset()
+	c.Assert(req.bulk(&buf), IsNil)
+	c.Assert(buf.String(), Equals, `{"index":{"version":7,"version_type":"external_gte"}}
+{"name":"abc"}
+`)
+}
+
+func (s *elasticTestSuite) TestBulkFilterPath(c *C) {
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`{"errors":true,"items":[{"index":{"status":201}},{"update":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`))
+	}))
+	defer ts.Close()
+
+	client := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), BulkFilterPath: DefaultBulkFilterPath})
+	items := []*BulkRequest{
+		{Action: ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"a": 1}},
+		{Action: ActionUpdate, Index: "t", Type: "_doc", ID: "2", Data: map[string]interface{}{"a": 2}},
+	}
+	resp, err := client.Bulk(items)
+	c.Assert(err, IsNil)
+	c.Assert(query.Get("filter_path"), Equals, DefaultBulkFilterPath)
+	c.Assert(resp.Errors, IsTrue)
+
+	// the fields filtered out are filled from the requests
+	item := resp.Items[1]["update"]
+	c.Assert(item.Status, Equals, http.StatusBadRequest)
+	c.Assert(item.Index, Equals, "t")
+	c.Assert(item.Type, Equals, "_doc")
+	c.Assert(item.ID, Equals, "2")
+	c.Assert(string(item.Error), Equals, `{"type":"mapper_parsing_exception"}`)
+
+	client.BulkFilterPath = ""
+	_, err = client.Bulk(items)
+	c.Assert(err, IsNil)
+	c.Assert(query.Get("filter_path"), Equals, "")
+}
+
+func (s *elasticTestSuite) TestGetFieldTypes(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/typeless/_mapping":
+			w.Write([]byte(`{"typeless":{"mappings":{"dynamic":"strict","properties":{"id":{"type":"long"},"meta":{"properties":{"a":{"type":"keyword"}}}}}}}`))
+		case "/alias/_mapping":
+			w.Write([]byte(`{"t-1":{"mappings":{"_doc":{"properties":{"id":{"type":"keyword"}}}}},"t-2":{"mappings":{"_doc":{"properties":{"id":{"type":"long"}}}}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"type":"index_not_found_exception"},"status":404}`))
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://")})
+	types, err := client.GetFieldTypes("typeless")
+	c.Assert(err, IsNil)
+	c.Assert(types, DeepEquals, map[string]map[string]string{"typeless": {"id": "long", "meta": "object"}})
+
+	types, err = client.GetFieldTypes("alias")
+	c.Assert(err, IsNil)
+	c.Assert(types, DeepEquals, map[string]map[string]string{"t-1": {"id": "keyword"}, "t-2": {"id": "long"}})
+
+	types, err = client.GetFieldTypes("missing")
+	c.Assert(err, IsNil)
+	c.Assert(types, IsNil)
+}
+
+func (s *elasticTestSuite) TestPutMapping(c *C) {
+	var method, path, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(data)
+		if strings.HasPrefix(r.URL.Path, "/missing/") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"type":"index_not_found_exception"},"status":404}`))
+			return
+		}
+		w.Write([]byte(`{"acknowledged":true}`))
+	}))
+	defer ts.Close()
+
+	client := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://")})
+	properties := map[string]interface{}{"age": map[string]interface{}{"type": "long"}}
+	c.Assert(client.PutMapping("t", "_doc", properties), IsNil)
+	c.Assert(method, Equals, "PUT")
+	c.Assert(path, Equals, "/t/_doc/_mapping")
+	c.Assert(body, Equals, `{"properties":{"age":{"type":"long"}}}`)
+
+	c.Assert(client.PutMapping("missing", "_doc", properties), ErrorMatches, "Error: Not Found, code: 404")
+}
@@ -0,0 +1,43 @@
+package elastic
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ParseCloudID returns the ES address of the Elastic Cloud ID, the ID is like
+// "name:base64(host$es_uuid$kibana_uuid)", and the address is "es_uuid.host:port",
+// the port is 443 if not in host.
+func ParseCloudID(cloudID string) (string, error) {
+	encoded := cloudID
+	if i := strings.LastIndex(cloudID, ":"); i >= 0 {
+		encoded = cloudID[i+1:]
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.Errorf("invalid cloud id %s, %v", cloudID, err)
+	}
+
+	parts := strings.Split(string(data), "$")
+	if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", errors.Errorf("invalid cloud id %s", cloudID)
+	}
+
+	host, port := parts[0], "443"
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host, port = host[:i], host[i+1:]
+	}
+	return parts[1] + "." + host + ":" + port, nil
+}
+
+// EncodeAPIKey encodes the API key id and key for the Authorization header,
+// the key which is encoded already is returned as it is.
+func EncodeAPIKey(key string) string {
+	if strings.Contains(key, ":") {
+		return base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return key
+}
@@ -0,0 +1,21 @@
+package elastic
+
+import (
+	. "github.com/pingcap/check"
+)
+
+func (s *elasticTestSuite) TestParseCloudID(c *C) {
+	addr, err := ParseCloudID("my-deployment:dXMtZWFzdC0xLmF3cy5mb3VuZC5pbyRjZWM2ZjI2MWE3NGJmMjRjZTMzYmI4ODExYjg0Mjk0ZiRjNmMyY2E2ZDA0MjI0OWFmMGNjN2Q3YTllOTYyNTc0Mw==")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "cec6f261a74bf24ce33bb8811b84294f.us-east-1.aws.found.io:443")
+
+	addr, err = ParseCloudID("dGVzdC5jbG91ZDo5MjQzJGVzJGtpYmFuYQ==")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "es.test.cloud:9243")
+
+	_, err = ParseCloudID("name:invalid")
+	c.Assert(err, NotNil)
+
+	c.Assert(EncodeAPIKey("id:key"), Equals, "aWQ6a2V5")
+	c.Assert(EncodeAPIKey("aWQ6a2V5"), Equals, "aWQ6a2V5")
+}
@@ -0,0 +1,271 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/juju/errors"
+)
+
+// The streaming encoder writes the bulk body into the buffer directly,
+// it handles the types produced by canal without reflection and
+// intermediate allocations, and falls back to json.Marshal for others.
+
+const hex = "0123456789abcdef"
+
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+			buf.WriteString(s[start:i])
+			switch b {
+			case '"', '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(b)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			default:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[b>>4])
+				buf.WriteByte(hex[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf.WriteString(s[start:i])
+			buf.WriteString(`\ufffd`)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are not valid in JavaScript strings
+		if c == '\u2028' || c == '\u2029' {
+			buf.WriteString(s[start:i])
+			buf.WriteString(`\u202`)
+			buf.WriteByte(hex[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf.WriteString(s[start:])
+	buf.WriteByte('"')
+}
+
+func writeFloat(buf *bytes.Buffer, f float64, bits int) error {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return errors.Errorf("unsupported float value %v", f)
+	}
+
+	// same format as encoding/json
+	var scratch [64]byte
+	abs := math.Abs(f)
+	format := byte('f')
+	if abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+	b := strconv.AppendFloat(scratch[:0], f, format, -1, bits)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	buf.Write(b)
+	return nil
+}
+
+func writeValue(buf *bytes.Buffer, v interface{}) error {
+	var scratch [64]byte
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case string:
+		writeString(buf, v)
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(v), 10))
+	case int8:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(v), 10))
+	case int16:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(v), 10))
+	case int32:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(v), 10))
+	case int64:
+		buf.Write(strconv.AppendInt(scratch[:0], v, 10))
+	case uint:
+		buf.Write(strconv.AppendUint(scratch[:0], uint64(v), 10))
+	case uint8:
+		buf.Write(strconv.AppendUint(scratch[:0], uint64(v), 10))
+	case uint16:
+		buf.Write(strconv.AppendUint(scratch[:0], uint64(v), 10))
+	case uint32:
+		buf.Write(strconv.AppendUint(scratch[:0], uint64(v), 10))
+	case uint64:
+		buf.Write(strconv.AppendUint(scratch[:0], v, 10))
+	case float32:
+		return writeFloat(buf, float64(v), 32)
+	case float64:
+		return writeFloat(buf, v, 64)
+	case []string:
+		buf.WriteByte('[')
+		for i, s := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeString(buf, s)
+		}
+		buf.WriteByte(']')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeValue(buf, e); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		return writeObject(buf, v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+// writeObject writes the map as a JSON object, the keys are not sorted.
+func writeObject(buf *bytes.Buffer, m map[string]interface{}) error {
+	if m == nil {
+		buf.WriteString("null")
+		return nil
+	}
+
+	buf.WriteByte('{')
+	first := true
+	for k, v := range m {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		writeString(buf, k)
+		buf.WriteByte(':')
+		if err := writeValue(buf, v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// FieldEncoder writes the objects with the known fields in a fixed order, the
+// keys are escaped once when it is made instead of for every object. The other
+// fields in the object are written after them like writeObject.
+type FieldEncoder struct {
+	fields []string
+	// the escaped keys with the colon, like `"name":`
+	keys  [][]byte
+	index map[string]struct{}
+}
+
+// NewFieldEncoder creates the encoder of the fields, the duplicated ones are ignored.
+func NewFieldEncoder(fields []string) *FieldEncoder {
+	e := &FieldEncoder{
+		fields: make([]string, 0, len(fields)),
+		keys:   make([][]byte, 0, len(fields)),
+		index:  make(map[string]struct{}, len(fields)),
+	}
+	var buf bytes.Buffer
+	for _, field := range fields {
+		if _, ok := e.index[field]; ok {
+			continue
+		}
+		e.index[field] = struct{}{}
+		e.fields = append(e.fields, field)
+
+		buf.Reset()
+		writeString(&buf, field)
+		buf.WriteByte(':')
+		e.keys = append(e.keys, append([]byte(nil), buf.Bytes()...))
+	}
+	return e
+}
+
+func (e *FieldEncoder) writeObject(buf *bytes.Buffer, m map[string]interface{}) error {
+	if m == nil {
+		buf.WriteString("null")
+		return nil
+	}
+
+	buf.WriteByte('{')
+	n := 0
+	for i, field := range e.fields {
+		v, ok := m[field]
+		if !ok {
+			continue
+		}
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		n++
+		buf.Write(e.keys[i])
+		if err := writeValue(buf, v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if n < len(m) {
+		for k, v := range m {
+			if _, ok := e.index[k]; ok {
+				continue
+			}
+			if n > 0 {
+				buf.WriteByte(',')
+			}
+			n++
+			writeString(buf, k)
+			buf.WriteByte(':')
+			if err := writeValue(buf, v); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// writeField writes the key and value of an object field, with the leading
+// comma if it is not the first field.
+func writeField(buf *bytes.Buffer, first bool, key string, value string) {
+	if !first {
+		buf.WriteByte(',')
+	}
+	writeString(buf, key)
+	buf.WriteByte(':')
+	writeString(buf, value)
+}
@@ -0,0 +1,63 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	. "github.com/pingcap/check"
+)
+
+func (s *elasticTestSuite) TestWriteValue(c *C) {
+	values := []interface{}{nil, true, int8(-1), int64(1) << 62, uint64(1) << 63, float32(1.5), 0.1, 1e-7, 1e21,
+		"a\"b\\c\n\t\x01<>&", "中文 ", "\xff", []string{"a", "b"}, []interface{}{1, "a", nil},
+		map[string]interface{}{"a": 1}}
+	for _, v := range values {
+		expected, err := json.Marshal(v)
+		c.Assert(err, IsNil)
+
+		var buf bytes.Buffer
+		c.Assert(writeValue(&buf, v), IsNil)
+		var decoded, expectedDecoded interface{}
+		c.Assert(json.Unmarshal(buf.Bytes(), &decoded), IsNil, Commentf("%s", buf.String()))
+		c.Assert(json.Unmarshal(expected, &expectedDecoded), IsNil)
+		c.Assert(decoded, DeepEquals, expectedDecoded, Commentf("%s != %s", buf.String(), expected))
+	}
+}
+
+func (s *elasticTestSuite) TestFieldEncoder(c *C) {
+	e := NewFieldEncoder([]string{"id", "na\"me", "id", "title"})
+	req := &BulkRequest{Action: ActionIndex, Index: "t", ID: "1", Encoder: e,
+		Data: map[string]interface{}{"title": "abc", "id": 1, "na\"me": nil, "extra": true}}
+
+	var buf bytes.Buffer
+	c.Assert(req.bulk(&buf), IsNil)
+	c.Assert(buf.String(), Equals, `{"index":{"_id":"1","_index":"t"}}
+{"id":1,"na\"me":null,"title":"abc","extra":true}
+`)
+
+	// the missing fields are omitted
+	req.Action = ActionUpdate
+	req.Data = map[string]interface{}{"title": "abc"}
+	buf.Reset()
+	c.Assert(req.bulk(&buf), IsNil)
+	c.Assert(buf.String(), Equals, `{"update":{"_id":"1","_index":"t"}}
+{"doc":{"title":"abc"}}
+`)
+
+	req.Data = map[string]interface{}{"a": 1, "b": 2}
+	buf.Reset()
+	c.Assert(e.writeObject(&buf, req.Data), IsNil)
+	var decoded map[string]interface{}
+	c.Assert(json.Unmarshal(buf.Bytes(), &decoded), IsNil)
+	c.Assert(decoded, DeepEquals, map[string]interface{}{"a": float64(1), "b": float64(2)})
+
+	buf.Reset()
+	c.Assert(e.writeObject(&buf, nil), IsNil)
+	c.Assert(buf.String(), Equals, "null")
+
+	// the encoder is not in the queued requests
+	data, err := json.Marshal(req)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), "Encoder"), IsFalse)
+}
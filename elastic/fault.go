@@ -0,0 +1,98 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go/sync2"
+)
+
+// FaultInjector fails, delays and rejects the bulk requests randomly, it is used to
+// test the retry and checkpoint logic, never enable it in production.
+// The rates are from 0 to 1, 0 means never.
+type FaultInjector struct {
+	// ErrorRate is the rate of the bulk requests failed with a network error without being sent.
+	ErrorRate float64
+	// FailRate is the rate of the bulk requests failed with 503 without being sent.
+	FailRate float64
+	// DelayRate is the rate of the bulk requests delayed by Delay before being sent,
+	// the bulk timeout includes the delay.
+	DelayRate float64
+	Delay     time.Duration
+	// RejectRate is the rate of the items rejected with 429 in the successful
+	// responses, the docs are written by ES, but they look like dropped to the client.
+	RejectRate float64
+
+	// the injected faults
+	ErrorNum  sync2.AtomicInt64
+	FailNum   sync2.AtomicInt64
+	DelayNum  sync2.AtomicInt64
+	RejectNum sync2.AtomicInt64
+
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// NewFaultInjector creates the FaultInjector with the random seed, the same seed
+// injects the same faults for the same requests.
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{r: rand.New(rand.NewSource(seed))}
+}
+
+func (f *FaultInjector) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	n := f.r.Float64()
+	f.mu.Unlock()
+	return n < rate
+}
+
+// beforeBulk injects the faults before the bulk request is sent,
+// a not nil response or error is returned instead of sending.
+func (f *FaultInjector) beforeBulk(ctx context.Context, u string) (*BulkResponse, error) {
+	if f.hit(f.ErrorRate) {
+		f.ErrorNum.Add(1)
+		return nil, errors.Trace(&url.Error{Op: "Post", URL: u, Err: errors.New("injected network error")})
+	}
+	if f.hit(f.FailRate) {
+		f.FailNum.Add(1)
+		return &BulkResponse{Code: http.StatusServiceUnavailable}, nil
+	}
+	if f.Delay > 0 && f.hit(f.DelayRate) {
+		f.DelayNum.Add(1)
+		select {
+		case <-time.After(f.Delay):
+		case <-ctx.Done():
+			// like the timeout of the HTTP client
+			return nil, errors.Trace(&url.Error{Op: "Post", URL: u, Err: ctx.Err()})
+		}
+	}
+	return nil, nil
+}
+
+var injectedRejection = json.RawMessage(`{"type":"es_rejected_execution_exception","reason":"injected rejection"}`)
+
+// afterBulk rejects the items of the successful response.
+func (f *FaultInjector) afterBulk(resp *BulkResponse) {
+	if resp.Code/100 != 2 || f.RejectRate <= 0 {
+		return
+	}
+	for _, item := range resp.Items {
+		for _, v := range item {
+			if v.Status/100 == 2 && f.hit(f.RejectRate) {
+				f.RejectNum.Add(1)
+				v.Status = http.StatusTooManyRequests
+				v.Error = injectedRejection
+				resp.Errors = true
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package elastic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+)
+
+func (s *elasticTestSuite) TestFaultInjector(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[{"index":{"_index":"t","_id":"1","status":201}},{"index":{"_index":"t","_id":"2","status":201}}]}`))
+	}))
+	defer ts.Close()
+
+	client := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://")})
+	items := []*BulkRequest{
+		{Action: ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"a": 1}},
+		{Action: ActionIndex, Index: "t", ID: "2", Data: map[string]interface{}{"a": 2}},
+	}
+
+	client.Fault = NewFaultInjector(1)
+	client.Fault.ErrorRate = 1
+	_, err := client.Bulk(items)
+	c.Assert(err, NotNil)
+	_, ok := errors.Cause(err).(*url.Error)
+	c.Assert(ok, IsTrue)
+
+	client.Fault = NewFaultInjector(1)
+	client.Fault.FailRate = 1
+	resp, err := client.Bulk(items)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Code, Equals, http.StatusServiceUnavailable)
+
+	client.Fault = NewFaultInjector(1)
+	client.Fault.RejectRate = 1
+	resp, err = client.Bulk(items)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Errors, IsTrue)
+	c.Assert(resp.Items[1]["index"].Status, Equals, http.StatusTooManyRequests)
+	c.Assert(client.Fault.RejectNum.Get(), Equals, int64(2))
+
+	client.Fault = NewFaultInjector(1)
+	client.Fault.DelayRate = 1
+	client.Fault.Delay = time.Second
+	client.BulkTimeout = 10 * time.Millisecond
+	_, err = client.Bulk(items)
+	c.Assert(err, NotNil)
+	c.Assert(client.Fault.DelayNum.Get(), Equals, int64(1))
+}
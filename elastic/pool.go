@@ -0,0 +1,56 @@
+package elastic
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Pools to reuse the requests, their data and the bulk body buffers,
+// it cuts the allocations during large transactions and dumps.
+var (
+	bulkRequestPool = sync.Pool{
+		New: func() interface{} { return new(BulkRequest) },
+	}
+	bulkDataPool = sync.Pool{
+		New: func() interface{} { return make(map[string]interface{}) },
+	}
+	bufferPool = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
+)
+
+// NewBulkRequest gets an empty BulkRequest from the pool.
+func NewBulkRequest() *BulkRequest {
+	return bulkRequestPool.Get().(*BulkRequest)
+}
+
+// NewBulkData gets an empty data map from the pool.
+func NewBulkData() map[string]interface{} {
+	return bulkDataPool.Get().(map[string]interface{})
+}
+
+// ReleaseBulkRequest puts the request and its data back to the pool,
+// they must not be used after release.
+func ReleaseBulkRequest(req *BulkRequest) {
+	ReleaseBulkData(req.Data)
+	*req = BulkRequest{}
+	bulkRequestPool.Put(req)
+}
+
+// ReleaseBulkRequests releases all the requests.
+func ReleaseBulkRequests(reqs []*BulkRequest) {
+	for _, req := range reqs {
+		ReleaseBulkRequest(req)
+	}
+}
+
+// ReleaseBulkData puts the data map back to the pool, nil is ignored.
+func ReleaseBulkData(data map[string]interface{}) {
+	if data == nil {
+		return
+	}
+	for k := range data {
+		delete(data, k)
+	}
+	bulkDataPool.Put(data)
+}
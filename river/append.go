@@ -0,0 +1,66 @@
+package river
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// How to make the doc id for the append_only rule.
+const (
+	// the binlog file, position and row of the insert, so replaying the binlog doesn't duplicate the docs,
+	// they are prefixed with the name of the upstream
+	AppendIDPosition = "position"
+	// generated by ES
+	AppendIDAuto = "auto"
+)
+
+// makeAppendRequest makes the index requests of the inserted rows for the append_only rule,
+// the updates and deletes are ignored, and the PK is not used. The dumped rows have no
+// binlog position, so their ids are always generated by ES.
+func (h *eventHandler) makeAppendRequest(rule *Rule, e *canal.RowsEvent, rows [][]interface{}) ([]*elastic.BulkRequest, error) {
+	if e.Action != canal.InsertAction || rule.ActionMapping[canal.InsertAction] == "" {
+		return nil, nil
+	}
+
+	reqs := make([]*elastic.BulkRequest, 0, len(rows))
+	for i, values := range rows {
+		id := ""
+		if rule.AppendID == AppendIDPosition && e.Header != nil {
+			id = fmt.Sprintf("%s-%d-%d", h.r.syncedPosition().Name, e.Header.LogPos, i)
+			if len(h.r.name) > 0 {
+				// the upstreams have the same binlog files and positions
+				id = h.r.name + "-" + id
+			}
+		}
+
+		parentID := ""
+		if len(rule.Parent) > 0 {
+			var err error
+			if parentID, err = h.r.getParentID(rule, values, rule.Parent); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		index, err := rule.rowIndex(values)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		routing, err := h.r.getRouting(rule, values)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		req := h.r.makeInsertReqData(rule, values, elastic.ActionIndex, id, parentID)
+		if req == nil {
+			continue
+		}
+		req.Index = index
+		req.Routing = routing
+		h.r.st.InsertNum.Add(1)
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
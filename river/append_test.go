@@ -0,0 +1,64 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestAppendOnly(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "events"}
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("value", "int(11)", "", "")
+
+	r := &River{c: &Config{}, st: &stat{}, replayPos: mysql.Position{Name: "mysql-bin.000002", Pos: 4}}
+	rule := &Rule{Schema: "test", Table: "events", Index: "events", TableInfo: ta, AppendOnly: true}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.AppendID, Equals, AppendIDPosition)
+	r.setFieldMapping(rule)
+	h := &eventHandler{r: r}
+
+	rows := [][]interface{}{{"click", int32(1)}, {"click", int32(1)}}
+	e := &canal.RowsEvent{Action: canal.InsertAction, Rows: rows, Header: &replication.EventHeader{LogPos: 120}}
+	reqs, err := h.makeAppendRequest(rule, e, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionIndex)
+	c.Assert(reqs[0].ID, Equals, "mysql-bin.000002-120-0")
+	c.Assert(reqs[1].ID, Equals, "mysql-bin.000002-120-1")
+
+	// the docs of the upstreams at the same positions don't collide
+	u := &River{c: r.c, st: r.st, replayPos: r.replayPos, name: "shard2", primary: r}
+	reqs, err = (&eventHandler{r: u}).makeAppendRequest(rule, e, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].ID, Equals, "shard2-mysql-bin.000002-120-0")
+	c.Assert(reqs[1].ID, Equals, "shard2-mysql-bin.000002-120-1")
+
+	// the same docs without id are not collapsed or versioned
+	rule.AppendID = AppendIDAuto
+	reqs, err = h.makeAppendRequest(rule, e, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].ID, Equals, "")
+	c.Assert(dedupRequests(reqs), HasLen, 2)
+	r.c.VersionType = VersionExternal
+	c.Assert(r.setVersion(reqs, 120), IsNil)
+	c.Assert(reqs[0].Version, Equals, int64(0))
+
+	// the dumped rows have no position
+	rule.AppendID = AppendIDPosition
+	reqs, err = h.makeAppendRequest(rule, &canal.RowsEvent{Action: canal.InsertAction, Rows: rows}, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].ID, Equals, "")
+
+	for _, action := range []string{canal.UpdateAction, canal.DeleteAction} {
+		reqs, err = h.makeAppendRequest(rule, &canal.RowsEvent{Action: action, Rows: rows}, rows)
+		c.Assert(err, IsNil)
+		c.Assert(reqs, HasLen, 0)
+	}
+
+	rule = &Rule{Schema: "test", Table: "events", Index: "events", AppendOnly: true, AppendID: "uuid"}
+	c.Assert(rule.prepare(), NotNil)
+}
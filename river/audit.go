@@ -0,0 +1,180 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// Reasons of the audited destructive operations.
+const (
+	AuditReasonDelete        = "delete"
+	AuditReasonPKChange      = "pk_change"
+	AuditReasonActionMapping = "action_mapping"
+	AuditReasonTruncate      = "truncate"
+	// the rows event is skipped by POST /skip or -skip_events
+	AuditReasonSkip = "skip"
+)
+
+type auditRecord struct {
+	Time       string `json:"@timestamp"`
+	Reason     string `json:"reason"`
+	Schema     string `json:"schema"`
+	Table      string `json:"table"`
+	Index      string `json:"index"`
+	Type       string `json:"type,omitempty"`
+	ID         string `json:"id,omitempty"`
+	Parent     string `json:"parent,omitempty"`
+	Truncate   string `json:"truncate,omitempty"`
+	Action     string `json:"action,omitempty"`
+	Rows       int    `json:"rows,omitempty"`
+	BinlogFile string `json:"binlog_file"`
+	BinlogPos  uint32 `json:"binlog_pos"`
+	GTID       string `json:"gtid,omitempty"`
+	// empty for the MySQL of my_addr
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// auditLog records the destructive operations into the append-only file,
+// and into the ES index with the requests, before they are sent.
+type auditLog struct {
+	f     *os.File
+	index string
+}
+
+func newAuditLog(c *Config) (*auditLog, error) {
+	if len(c.AuditFile) == 0 && len(c.AuditIndex) == 0 {
+		return nil, nil
+	}
+
+	a := &auditLog{index: c.AuditIndex}
+	if len(c.AuditFile) > 0 {
+		f, err := os.OpenFile(c.AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		a.f = f
+	}
+	return a, nil
+}
+
+// write writes the records, and returns the requests to index them.
+func (a *auditLog) write(records []*auditRecord) ([]*elastic.BulkRequest, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	if a.f != nil {
+		var buf []byte
+		for _, record := range records {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			buf = append(append(buf, data...), '\n')
+		}
+		if _, err := a.f.Write(buf); err != nil {
+			return nil, errors.Trace(err)
+		}
+		// the records must be durable before the docs are deleted
+		if err := a.f.Sync(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if len(a.index) == 0 {
+		return nil, nil
+	}
+	reqs := make([]*elastic.BulkRequest, 0, len(records))
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		req := elastic.NewBulkRequest()
+		req.Action = elastic.ActionIndex
+		req.Index = a.index
+		// replaying the binlog doesn't duplicate the records
+		req.ID = fmt.Sprintf("%s-%d-%s-%s-%s", record.BinlogFile, record.BinlogPos, record.Index, record.Reason, record.ID)
+		if len(record.Upstream) > 0 {
+			// the binlog positions of the upstreams may be the same
+			req.ID = record.Upstream + "-" + req.ID
+		}
+		req.Data = elastic.NewBulkData()
+		if err = json.Unmarshal(data, &req.Data); err != nil {
+			return nil, errors.Trace(err)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+func (a *auditLog) Close() error {
+	if a.f == nil {
+		return nil
+	}
+	return errors.Trace(a.f.Close())
+}
+
+// auditReason returns why the rows event deletes the docs of the rule.
+func auditReason(rule *Rule, action string) string {
+	switch {
+	case action == canal.DeleteAction && rule.ActionMapping[action] == elastic.ActionDelete:
+		return AuditReasonDelete
+	case rule.ActionMapping[action] == elastic.ActionDelete:
+		return AuditReasonActionMapping
+	default:
+		return AuditReasonPKChange
+	}
+}
+
+// auditDeletes records the delete requests of the rule made from the rows event.
+func (h *eventHandler) auditDeletes(rule *Rule, reqs []*elastic.BulkRequest, e *canal.RowsEvent) ([]*elastic.BulkRequest, error) {
+	var records []*auditRecord
+	for i, req := range reqs {
+		if req.Action != elastic.ActionDelete {
+			continue
+		}
+		if isReindexedDelete(reqs, i) {
+			continue
+		}
+		record := h.newAuditRecord(rule, auditReason(rule, e.Action))
+		record.Type = req.Type
+		record.ID = req.ID
+		record.Parent = req.Parent
+		if e.Header != nil {
+			record.BinlogPos = e.Header.LogPos
+		}
+		records = append(records, record)
+	}
+	return h.r.audit.write(records)
+}
+
+// auditTruncate records the truncate of the rule which deletes the docs.
+func (h *eventHandler) auditTruncate(rule *Rule, pos mysql.Position) ([]*elastic.BulkRequest, error) {
+	record := h.newAuditRecord(rule, AuditReasonTruncate)
+	record.Type = rule.Type
+	record.Truncate = rule.Truncate
+	record.BinlogFile = pos.Name
+	record.BinlogPos = pos.Pos
+	return h.r.audit.write([]*auditRecord{record})
+}
+
+func (h *eventHandler) newAuditRecord(rule *Rule, reason string) *auditRecord {
+	return &auditRecord{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		Reason:     reason,
+		Schema:     rule.Schema,
+		Table:      rule.Table,
+		Index:      rule.Index,
+		BinlogFile: h.r.syncedPosition().Name,
+		GTID:       h.gtid,
+		Upstream:   h.r.name,
+	}
+}
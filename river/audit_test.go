@@ -0,0 +1,42 @@
+package river
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestAuditLog(c *C) {
+	dir, err := ioutil.TempDir("", "river_audit")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	a, err := newAuditLog(&Config{AuditFile: dir + "/audit.log", AuditIndex: "audit"})
+	c.Assert(err, IsNil)
+	defer a.Close()
+
+	record := &auditRecord{Reason: AuditReasonDelete, Schema: "test", Table: "t", Index: "t", ID: "1",
+		BinlogFile: "mysql-bin.000001", BinlogPos: 120}
+	reqs, err := a.write([]*auditRecord{record})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Index, Equals, "audit")
+	c.Assert(reqs[0].ID, Equals, "mysql-bin.000001-120-t-delete-1")
+	c.Assert(reqs[0].Data["reason"], Equals, AuditReasonDelete)
+
+	data, err := ioutil.ReadFile(dir + "/audit.log")
+	c.Assert(err, IsNil)
+	c.Assert(strings.Count(string(data), "\n"), Equals, 1)
+	c.Assert(strings.Contains(string(data), `"id":"1"`), IsTrue)
+
+	rule := &Rule{Schema: "test", Table: "t"}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(auditReason(rule, canal.DeleteAction), Equals, AuditReasonDelete)
+	c.Assert(auditReason(rule, canal.UpdateAction), Equals, AuditReasonPKChange)
+	rule.ActionMapping[canal.UpdateAction] = elastic.ActionDelete
+	c.Assert(auditReason(rule, canal.UpdateAction), Equals, AuditReasonActionMapping)
+}
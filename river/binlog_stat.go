@@ -0,0 +1,180 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go/sync2"
+)
+
+// txnRowsBuckets are the upper bounds of the buckets of the transaction sizes in rows.
+var txnRowsBuckets = [...]int64{1, 10, 100, 1000, 10000, 100000}
+
+// binlogRateWindow is the number of the one second samples the binlog rates are averaged over.
+const binlogRateWindow = 10
+
+// txnHistogram counts the rows of the binlog transactions in the cumulative
+// buckets of the Prometheus histogram.
+type txnHistogram struct {
+	sync.Mutex
+	// the last one is +Inf
+	counts [len(txnRowsBuckets) + 1]int64
+	sum    int64
+	count  int64
+	max    int64
+}
+
+func (t *txnHistogram) observe(rows int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	i := 0
+	for i < len(txnRowsBuckets) && rows > txnRowsBuckets[i] {
+		i++
+	}
+	t.counts[i]++
+	t.sum += rows
+	t.count++
+	if rows > t.max {
+		t.max = rows
+	}
+}
+
+type txnHistogramData struct {
+	// cumulative count of every upper bound, the last one is +Inf
+	Buckets map[string]int64 `json:"buckets"`
+	Sum     int64            `json:"sum"`
+	Count   int64            `json:"count"`
+	Max     int64            `json:"max"`
+}
+
+func (t *txnHistogram) data() *txnHistogramData {
+	t.Lock()
+	defer t.Unlock()
+
+	d := &txnHistogramData{Buckets: make(map[string]int64, len(t.counts)), Sum: t.sum, Count: t.count, Max: t.max}
+	var n int64
+	for i, count := range t.counts {
+		n += count
+		if i < len(txnRowsBuckets) {
+			d.Buckets[fmt.Sprint(txnRowsBuckets[i])] = n
+		} else {
+			d.Buckets["+Inf"] = n
+		}
+	}
+	return d
+}
+
+// writeMetric writes the histogram in the Prometheus text format.
+func (t *txnHistogram) writeMetric(buf *bytes.Buffer, name string, help string) {
+	d := t.data()
+	buf.WriteString(fmt.Sprintf("# HELP %s %s\n", name, help))
+	buf.WriteString(fmt.Sprintf("# TYPE %s histogram\n", name))
+	for _, bound := range txnRowsBuckets {
+		le := fmt.Sprint(bound)
+		buf.WriteString(fmt.Sprintf("%s_bucket{le=\"%s\"} %d\n", name, le, d.Buckets[le]))
+	}
+	buf.WriteString(fmt.Sprintf("%s_bucket{le=\"+Inf\"} %d\n", name, d.Buckets["+Inf"]))
+	buf.WriteString(fmt.Sprintf("%s_sum %d\n", name, d.Sum))
+	buf.WriteString(fmt.Sprintf("%s_count %d\n", name, d.Count))
+}
+
+// binlogStat counts the events, rows and bytes read from the binlog. The events
+// are the ones handled by the river, the rows events of the tables not synced
+// are skipped by canal, but their bytes are counted with the positions.
+type binlogStat struct {
+	EventNum sync2.AtomicInt64
+	RowNum   sync2.AtomicInt64
+	Bytes    sync2.AtomicInt64
+
+	TxnRows txnHistogram
+
+	mu      sync.Mutex
+	samples [][3]int64
+	rates   [3]float64
+}
+
+// binlogCursor is the last position and the rows of the current transaction of
+// a binlog stream, only used in its canal goroutine.
+type binlogCursor struct {
+	lastPos uint32
+	txnRows int64
+}
+
+// advance counts the bytes up to the end position of the event in the same binlog file.
+func (b *binlogStat) advance(c *binlogCursor, pos uint32) {
+	if c.lastPos > 0 && pos > c.lastPos {
+		b.Bytes.Add(int64(pos - c.lastPos))
+	}
+	if pos > 0 {
+		c.lastPos = pos
+	}
+}
+
+// rotate starts counting the bytes from the position of the next binlog file.
+func (b *binlogStat) rotate(c *binlogCursor, pos uint32) {
+	b.EventNum.Add(1)
+	c.lastPos = pos
+}
+
+func (b *binlogStat) onEvent(c *binlogCursor, pos uint32) {
+	b.EventNum.Add(1)
+	b.advance(c, pos)
+}
+
+func (b *binlogStat) onRows(c *binlogCursor, pos uint32, rows int64) {
+	b.onEvent(c, pos)
+	b.RowNum.Add(rows)
+	c.txnRows += rows
+}
+
+// onXID ends the transaction.
+func (b *binlogStat) onXID(c *binlogCursor, pos uint32) {
+	b.onEvent(c, pos)
+	b.TxnRows.observe(c.txnRows)
+	c.txnRows = 0
+}
+
+// sample takes the counters of now, and updates the rates over the window.
+func (b *binlogStat) sample() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.samples = append(b.samples, [3]int64{b.EventNum.Get(), b.RowNum.Get(), b.Bytes.Get()})
+	if len(b.samples) > binlogRateWindow+1 {
+		b.samples = b.samples[1:]
+	}
+	first, last := b.samples[0], b.samples[len(b.samples)-1]
+	seconds := float64(len(b.samples) - 1)
+	for i := range b.rates {
+		if seconds > 0 {
+			b.rates[i] = float64(last[i]-first[i]) / seconds
+		}
+	}
+}
+
+// Rates returns the events, rows and bytes per second.
+func (b *binlogStat) Rates() (float64, float64, float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rates[0], b.rates[1], b.rates[2]
+}
+
+// runBinlogRates samples the binlog counters every second for the rates.
+func (r *River) runBinlogRates() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.st.Binlog.sample()
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
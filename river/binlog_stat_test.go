@@ -0,0 +1,67 @@
+package river
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestBinlogStat(c *C) {
+	r := &River{c: &Config{}, ctx: context.Background(), syncCh: make(chan interface{}, 16), st: &stat{}}
+	r.st.r = r
+	h := &eventHandler{r: r}
+
+	c.Assert(h.OnRotate(&replication.RotateEvent{NextLogName: []byte("mysql-bin.000001"), Position: 4}), IsNil)
+	e := &canal.RowsEvent{Action: canal.UpdateAction, Table: &schema.Table{Schema: "test", Name: "t"}, Rows: [][]interface{}{{1}, {2}, {3}, {4}}, Header: &replication.EventHeader{LogPos: 104}}
+	c.Assert(h.OnRow(e), IsNil)
+	e = &canal.RowsEvent{Action: canal.InsertAction, Table: &schema.Table{Schema: "test", Name: "t"}, Rows: [][]interface{}{{5}}, Header: &replication.EventHeader{LogPos: 204}}
+	c.Assert(h.OnRow(e), IsNil)
+	c.Assert(h.OnXID(mysql.Position{Name: "mysql-bin.000001", Pos: 304}), IsNil)
+	c.Assert(h.OnXID(mysql.Position{Name: "mysql-bin.000001", Pos: 404}), IsNil)
+
+	b := &r.st.Binlog
+	c.Assert(b.EventNum.Get(), Equals, int64(5))
+	c.Assert(b.RowNum.Get(), Equals, int64(3))
+	c.Assert(b.Bytes.Get(), Equals, int64(400))
+
+	d := b.TxnRows.data()
+	c.Assert(d.Count, Equals, int64(2))
+	c.Assert(d.Sum, Equals, int64(3))
+	c.Assert(d.Max, Equals, int64(3))
+	c.Assert(d.Buckets["1"], Equals, int64(1))
+	c.Assert(d.Buckets["10"], Equals, int64(2))
+	c.Assert(d.Buckets["+Inf"], Equals, int64(2))
+
+	b.sample()
+	b.EventNum.Add(10)
+	b.sample()
+	b.EventNum.Add(20)
+	b.sample()
+	events, rows, _ := b.Rates()
+	c.Assert(events, Equals, float64(15))
+	c.Assert(rows, Equals, float64(0))
+
+	w := httptest.NewRecorder()
+	r.st.serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	c.Assert(strings.Contains(body, "river_binlog_rows_total 3\n"), Equals, true)
+	c.Assert(strings.Contains(body, "river_binlog_events_per_second 15\n"), Equals, true)
+	c.Assert(strings.Contains(body, "# TYPE river_binlog_transaction_rows histogram\n"), Equals, true)
+	c.Assert(strings.Contains(body, "river_binlog_transaction_rows_bucket{le=\"10\"} 2\n"), Equals, true)
+	c.Assert(strings.Contains(body, "river_binlog_transaction_rows_count 2\n"), Equals, true)
+
+	w = httptest.NewRecorder()
+	r.st.serveVars(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars map[string]json.RawMessage
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &vars), IsNil)
+	var txnRows txnHistogramData
+	c.Assert(json.Unmarshal(vars["river_binlog_transaction_rows"], &txnRows), IsNil)
+	c.Assert(txnRows.Max, Equals, int64(3))
+}
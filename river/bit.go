@@ -0,0 +1,71 @@
+package river
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// decodeBit decodes the BIT value into the integer, it is int64 in the binlog,
+// and the big-endian bytes in the dump, like "\x01\x02" for b'100000010'.
+func decodeBit(value interface{}) (int64, bool) {
+	var b []byte
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return 0, false
+	}
+
+	if len(b) > 8 {
+		return 0, false
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	// BIT(64) with the highest bit set is negative like the binlog
+	return int64(n), true
+}
+
+// bitWidth returns M of BIT(M), which is 1 if not set.
+func bitWidth(col *schema.TableColumn) int {
+	rawType := strings.ToLower(col.RawType)
+	if !strings.HasPrefix(rawType, "bit(") {
+		return 1
+	}
+	end := strings.IndexByte(rawType, ')')
+	if end < 0 {
+		return 1
+	}
+	m, err := strconv.Atoi(rawType[len("bit("):end])
+	if err != nil || m < 1 || m > 64 {
+		return 1
+	}
+	return m
+}
+
+// makeBitColumnData converts the BIT column into the bit string padded to
+// the width of the column, like "00000101" for b'101' of BIT(8).
+func makeBitColumnData(col *schema.TableColumn, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	n, ok := decodeBit(value)
+	if !ok {
+		log.Warnf("convert field %s to %s fail, keep it raw", col.Name, BitFormatString)
+		return value
+	}
+
+	s := strconv.FormatUint(uint64(n), 2)
+	if w := bitWidth(col); len(s) < w {
+		s = strings.Repeat("0", w-len(s)) + s
+	}
+	return s
+}
@@ -0,0 +1,32 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestBit(c *C) {
+	r := &River{}
+	col := &schema.TableColumn{Name: "b", Type: schema.TYPE_BIT, RawType: "bit(12)"}
+	// binlog
+	c.Assert(r.makeReqColumnData(col, int64(0x102)), Equals, int64(0x102))
+	// dump
+	c.Assert(r.makeReqColumnData(col, "\x01\x02"), Equals, int64(0x102))
+	c.Assert(r.makeReqColumnData(col, "\x00"), Equals, int64(0))
+	c.Assert(r.makeReqColumnData(col, []byte{0x01}), Equals, int64(1))
+	c.Assert(r.makeReqColumnData(col, "\xff\xff\xff\xff\xff\xff\xff\xff"), Equals, int64(-1))
+	c.Assert(r.makeReqColumnData(col, "123456789"), IsNil)
+
+	c.Assert(bitWidth(col), Equals, 12)
+	c.Assert(bitWidth(&schema.TableColumn{RawType: "bit"}), Equals, 1)
+	c.Assert(makeBitColumnData(col, int64(5)), Equals, "000000000101")
+	c.Assert(makeBitColumnData(col, "\x01\x02"), Equals, "000100000010")
+	c.Assert(makeBitColumnData(&schema.TableColumn{RawType: "bit(1)"}, "\x01"), Equals, "1")
+	c.Assert(makeBitColumnData(col, nil), IsNil)
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", BitFormat: "hex"}
+	c.Assert(rule.prepare(), NotNil)
+	rule = &Rule{Schema: "test", Table: "t", Index: "t"}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.BitFormat, Equals, BitFormatInteger)
+}
@@ -0,0 +1,49 @@
+package river
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// isTinyint1 returns whether the column is TINYINT(1), the BOOL and BOOLEAN of MySQL.
+func isTinyint1(col *schema.TableColumn) bool {
+	return col.Type == schema.TYPE_NUMBER && strings.HasPrefix(strings.ToLower(col.RawType), "tinyint(1)")
+}
+
+// makeBoolColumnData converts the integer column into the boolean, 0 is false and the
+// others are true. It is int8 or uint8 in the binlog, and int64 in the dump.
+func makeBoolColumnData(col *schema.TableColumn, value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case int8:
+		return v != 0
+	case uint8:
+		return v != 0
+	case int16:
+		return v != 0
+	case uint16:
+		return v != 0
+	case int32:
+		return v != 0
+	case uint32:
+		return v != 0
+	case int64:
+		return v != 0
+	case uint64:
+		return v != 0
+	case int:
+		return v != 0
+	case uint:
+		return v != 0
+	case string:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n != 0
+		}
+	}
+	log.Warnf("convert field %s to %s fail, keep it raw", col.Name, fieldTypeBool)
+	return value
+}
@@ -0,0 +1,40 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestTinyintBool(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("active", "tinyint(1)", "", "")
+	ta.AddColumn("level", "tinyint(4)", "", "")
+	ta.AddColumn("deleted", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+
+	c.Assert((&Rule{Schema: "test", Table: "t", TinyintFormat: "boolean"}).prepare(), NotNil)
+
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.TinyintFormat, Equals, TinyintFormatInteger)
+	r.setFieldMapping(rule)
+	c.Assert(r.makeFieldData(rule, []interface{}{int32(1), int8(1), int8(1), int32(0)})["active"], Equals, int8(1))
+
+	// the binlog and the dump values, and the opt-in column of another type
+	rule = &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta, TinyintFormat: TinyintFormatBool,
+		FieldMapping: map[string]string{"deleted": ",bool"}}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+	c.Assert(r.makeFieldData(rule, []interface{}{int32(1), int8(1), int8(1), int32(0)}), DeepEquals,
+		map[string]interface{}{"id": int32(1), "active": true, "level": int8(1), "deleted": false})
+	c.Assert(r.makeFieldData(rule, []interface{}{int64(1), int64(0), int64(2), int64(3)}), DeepEquals,
+		map[string]interface{}{"id": int64(1), "active": false, "level": int64(2), "deleted": true})
+	c.Assert(r.makeFieldData(rule, []interface{}{int64(1), nil, nil, nil})["active"], IsNil)
+
+	properties := r.makeMappingProperties(rule, ta.Columns)
+	c.Assert(properties["active"], DeepEquals, map[string]interface{}{"type": "boolean"})
+	c.Assert(properties["level"], DeepEquals, map[string]interface{}{"type": "long"})
+	c.Assert(properties["deleted"], DeepEquals, map[string]interface{}{"type": "boolean"})
+}
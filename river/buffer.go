@@ -0,0 +1,52 @@
+package river
+
+import (
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// The rough overheads of the request, the map entry and the interface value in
+// bytes, the estimated size only needs to be proportional to the real memory.
+const (
+	requestOverhead  = 256
+	mapEntryOverhead = 48
+	valueOverhead    = 16
+)
+
+// requestsSize estimates the memory of the requests for max_buffer_size.
+func requestsSize(reqs []*elastic.BulkRequest) int64 {
+	var n int64
+	for _, req := range reqs {
+		n += requestOverhead + int64(len(req.Index)+len(req.Type)+len(req.ID)+len(req.Parent)+len(req.Routing))
+		n += valueSize(req.Data) + valueSize(req.Script)
+	}
+	return n
+}
+
+func valueSize(v interface{}) int64 {
+	switch v := v.(type) {
+	case string:
+		return valueOverhead + int64(len(v))
+	case []byte:
+		return valueOverhead + int64(len(v))
+	case map[string]interface{}:
+		n := int64(valueOverhead)
+		for key, value := range v {
+			n += mapEntryOverhead + int64(len(key)) + valueSize(value)
+		}
+		return n
+	case []interface{}:
+		n := int64(valueOverhead)
+		for _, value := range v {
+			n += valueSize(value)
+		}
+		return n
+	case []string:
+		n := int64(valueOverhead)
+		for _, s := range v {
+			n += valueOverhead + int64(len(s))
+		}
+		return n
+	default:
+		return valueOverhead
+	}
+}
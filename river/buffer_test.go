@@ -0,0 +1,81 @@
+package river
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestBufferBudget(c *C) {
+	small := []*elastic.BulkRequest{{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"a": "b"}}}
+	large := []*elastic.BulkRequest{{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"a": strings.Repeat("b", 1000)}}}
+	c.Assert(requestsSize(large)-requestsSize(small) >= 999, IsTrue)
+
+	bodies := make(chan string, 8)
+	release := make(chan struct{})
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if strings.Contains(string(body), `"slow"`) {
+			<-release
+		}
+		bodies <- string(body)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer es.Close()
+
+	// the requests are flushed in the middle of the transaction once they exceed the budget
+	cfg := &Config{BulkSize: 100, FlushBulkTime: TomlDuration{time.Hour}, MaxBufferSize: 2000}
+	r := &River{c: cfg, st: &stat{}, limits: newRateLimits(0, 0), syncCh: make(chan interface{}, 16)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	newReqs := func(index string, id string) []*elastic.BulkRequest {
+		return []*elastic.BulkRequest{{Action: elastic.ActionIndex, Index: index, ID: id, Data: map[string]interface{}{"a": strings.Repeat("b", 1000)}}}
+	}
+	r.syncCh <- newReqs("t", "1")
+	select {
+	case body := <-bodies:
+		c.Fatalf("unexpected bulk %s", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.syncCh <- newReqs("t", "2")
+	body := <-bodies
+	c.Assert(strings.Count(body, `"_id":`), Equals, 2)
+	r.cancel()
+	r.wg.Wait()
+	c.Assert(r.st.BufferFlushNum.Get(), Equals, int64(1))
+	c.Assert(r.st.BufferedBytes.Get(), Equals, int64(0))
+
+	// a bulk waits for the in-flight ones while the bytes exceed the budget
+	r = &River{c: &Config{MaxInflightBulks: 4}, st: &stat{}, limits: newRateLimits(0, 0)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	defer r.cancel()
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	t := newBulkTracker(r, r.c.MaxInflightBulks, 2000)
+
+	r.st.BufferedBytes.Add(1500)
+	c.Assert(t.send(newReqs("slow", "1"), 1500), IsNil)
+	r.st.BufferedBytes.Add(1500)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- t.send(newReqs("fast", "1"), 1500)
+	}()
+	select {
+	case <-sent:
+		c.Fatal("the bulk is sent while the buffered bytes exceed the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	c.Assert(<-sent, IsNil)
+	c.Assert(t.wait(), IsNil)
+	c.Assert(r.st.BufferWaitNum.Get(), Equals, int64(1))
+	c.Assert(r.st.BufferedBytes.Get(), Equals, int64(0))
+}
@@ -0,0 +1,119 @@
+package river
+
+import (
+	"strings"
+
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/schema"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// charsetEncodings are the multibyte charsets of MySQL decoded by x/text, gb2312 of MySQL
+// is EUC-CN, which is a subset of gbk. The invalid bytes are decoded as U+FFFD.
+var charsetEncodings = map[string]encoding.Encoding{
+	"gbk":     simplifiedchinese.GBK,
+	"gb2312":  simplifiedchinese.GBK,
+	"gb18030": simplifiedchinese.GB18030,
+	"big5":    traditionalchinese.Big5,
+}
+
+// latin1High is 0x80-0x9F of MySQL latin1, which is cp1252 with the undefined
+// bytes as the C1 controls, 0xA0-0xFF are the same as Unicode.
+var latin1High = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+func decodeLatin1(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + len(s)/2)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case c < 0xA0:
+			b.WriteRune(latin1High[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// columnCharset returns the charset of the string column from its collation
+// like latin1_swedish_ci, empty for the binary and not string columns.
+func columnCharset(col *schema.TableColumn) string {
+	if col.Type != schema.TYPE_STRING || len(col.Collation) == 0 {
+		return ""
+	}
+	charset := strings.ToLower(col.Collation)
+	if i := strings.IndexByte(charset, '_'); i >= 0 {
+		charset = charset[:i]
+	}
+	return charset
+}
+
+// transcodeRows converts the string columns of the binlog rows in the column charsets
+// to UTF-8 in place, the dumped rows are UTF-8 already.
+func (r *River) transcodeRows(table *schema.Table, rows [][]interface{}) {
+	for i := range table.Columns {
+		col := &table.Columns[i]
+		var decode func(string) (string, error)
+		switch charset := columnCharset(col); charset {
+		case "", "utf8", "utf8mb3", "utf8mb4", "ascii", "binary":
+			continue
+		case "latin1":
+			decode = func(s string) (string, error) { return decodeLatin1(s), nil }
+		default:
+			enc, ok := charsetEncodings[charset]
+			if !ok {
+				key := table.Schema + "." + table.Name + "." + col.Name
+				if _, warned := r.charsetWarned.LoadOrStore(key, true); !warned {
+					log.Warnf("charset %s of column %s is not supported, keep the bytes as they are", charset, key)
+				}
+				continue
+			}
+			decode = enc.NewDecoder().String
+		}
+
+		for _, row := range rows {
+			if i >= len(row) {
+				continue
+			}
+			switch v := row[i].(type) {
+			case string:
+				if !isASCII(v) {
+					row[i] = r.decodeColumn(table, col, decode, v)
+				}
+			case []byte:
+				if s := string(v); !isASCII(s) {
+					row[i] = []byte(r.decodeColumn(table, col, decode, s))
+				}
+			}
+		}
+	}
+}
+
+// decodeColumn decodes the value of the column, the value is kept if it fails.
+func (r *River) decodeColumn(table *schema.Table, col *schema.TableColumn, decode func(string) (string, error), s string) string {
+	d, err := decode(s)
+	if err != nil {
+		log.Warnf("decode column %s.%s.%s err %v, keep the bytes as they are", table.Schema, table.Name, col.Name, err)
+		return s
+	}
+	return d
+}
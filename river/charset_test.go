@@ -0,0 +1,38 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestTranscodeRows(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("latin", "varchar(32)", "latin1_swedish_ci", "")
+	ta.AddColumn("body", "text", "latin1_general_ci", "")
+	ta.AddColumn("utf", "varchar(32)", "utf8mb4_general_ci", "")
+	ta.AddColumn("gbk", "varchar(32)", "gbk_chinese_ci", "")
+	ta.AddColumn("bin", "varbinary(32)", "", "")
+	ta.AddColumn("big5", "text", "big5_chinese_ci", "")
+	ta.AddColumn("gb2312", "varchar(32)", "gb2312_chinese_ci", "")
+	ta.AddColumn("ujis", "varchar(32)", "ujis_japanese_ci", "")
+
+	rows := [][]interface{}{
+		// 你好 in gbk, 中文 in big5 and gb2312
+		{int64(1), "caf\xe9 \x80\x9d", []byte("na\xefve"), "café", "\xc4\xe3\xba\xc3", []byte{0xe9},
+			[]byte("\xa4\xa4\xa4\xe5 ok"), "\xd6\xd0\xce\xc4", "\xa4\xa2"},
+		// the invalid bytes are replaced
+		{int64(2), "plain", nil, nil, "a\xc4", nil, nil, nil, nil},
+	}
+	r := &River{}
+	r.transcodeRows(ta, rows)
+	c.Assert(rows[0], DeepEquals, []interface{}{int64(1), "café €\u009d", []byte("naïve"), "café", "你好", []byte{0xe9},
+		[]byte("中文 ok"), "中文", "\xa4\xa2"})
+	c.Assert(rows[1], DeepEquals, []interface{}{int64(2), "plain", nil, nil, "a\ufffd", nil, nil, nil, nil})
+
+	_, warned := r.charsetWarned.Load("test.t.ujis")
+	c.Assert(warned, IsTrue)
+	_, warned = r.charsetWarned.Load("test.t.gbk")
+	c.Assert(warned, IsFalse)
+	c.Assert(columnCharset(&ta.Columns[5]), Equals, "")
+}
@@ -0,0 +1,83 @@
+package river
+
+import (
+	"github.com/juju/errors"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// ClusterConfig is an ES cluster besides the default one of es_addr,
+// the rules with cluster = name are synced to it.
+type ClusterConfig struct {
+	Name       string `toml:"name"`
+	ESHttps    bool   `toml:"es_https"`
+	ESAddr     string `toml:"es_addr"`
+	ESUser     string `toml:"es_user"`
+	ESPassword string `toml:"es_pass"`
+	ESAPIKey   string `toml:"es_api_key"`
+}
+
+// prepareClusters creates the clients of the clusters, and checks the clusters of rules exist.
+func (r *River) prepareClusters() error {
+	r.clusters = make(map[string]*elastic.Client, len(r.c.Clusters))
+	for _, c := range r.c.Clusters {
+		if len(c.Name) == 0 {
+			return errors.Errorf("cluster name must be set")
+		} else if _, ok := r.clusters[c.Name]; ok {
+			return errors.Errorf("duplicate cluster %s", c.Name)
+		} else if len(c.ESAddr) == 0 {
+			return errors.Errorf("es_addr of cluster %s must be set", c.Name)
+		}
+
+		cfg := new(elastic.ClientConfig)
+		cfg.Addr = c.ESAddr
+		cfg.User = c.ESUser
+		cfg.Password = c.ESPassword
+		cfg.HTTPS = c.ESHttps
+		if len(c.ESAPIKey) > 0 {
+			cfg.APIKey = elastic.EncodeAPIKey(c.ESAPIKey)
+		}
+		if err := r.setESTransport(cfg); err != nil {
+			return errors.Trace(err)
+		}
+		client := elastic.NewClient(cfg)
+		client.BulkThrottle = r.throttleBulk
+		r.clusters[c.Name] = client
+	}
+
+	// the wildcard rules and the fan-out ones are made from the config rules
+	for _, rule := range r.c.Rules {
+		if _, ok := r.clusters[rule.Cluster]; len(rule.Cluster) > 0 && !ok {
+			return errors.Errorf("cluster %s of rule %s.%s is not defined", rule.Cluster, rule.Schema, rule.Table)
+		}
+	}
+	return nil
+}
+
+// esClient returns the client of the cluster, the default one for empty.
+func (r *River) esClient(cluster string) *elastic.Client {
+	if client, ok := r.clusters[cluster]; ok {
+		return client
+	}
+	return r.es
+}
+
+// clusterNames returns the default cluster "" and the defined ones.
+func (r *River) clusterNames() []string {
+	names := make([]string, 0, len(r.c.Clusters)+1)
+	names = append(names, "")
+	for _, c := range r.c.Clusters {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// clusterRules returns the rules synced to the cluster, including the fan-out ones.
+func (r *River) clusterRules(cluster string) []*Rule {
+	var rules []*Rule
+	for _, rule := range r.allRules() {
+		if rule.Cluster == cluster {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
@@ -0,0 +1,55 @@
+package river
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestClusters(c *C) {
+	bodies := make([]chan string, 2)
+	servers := make([]*httptest.Server, 2)
+	for i := range servers {
+		ch := make(chan string, 4)
+		bodies[i] = ch
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			ch <- string(body)
+			w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+		}))
+		defer servers[i].Close()
+	}
+
+	cfg := &Config{
+		Rules:    []*Rule{{Schema: "test", Table: "logs", Cluster: "analytics"}},
+		Clusters: []*ClusterConfig{{Name: "analytics", ESAddr: strings.TrimPrefix(servers[1].URL, "http://"), ESPassword: "secret"}},
+	}
+	r := &River{c: cfg, ctx: context.Background(), st: &stat{}, limits: newRateLimits(0, 0)}
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(servers[0].URL, "http://")})
+	c.Assert(r.prepareClusters(), IsNil)
+	c.Assert(r.esClient(""), Equals, r.es)
+	c.Assert(r.esClient("analytics"), Not(Equals), r.es)
+	c.Assert(r.clusterNames(), DeepEquals, []string{"", "analytics"})
+	c.Assert(cfg.Redacted().Clusters[0].ESPassword, Equals, redacted)
+	c.Assert(cfg.Clusters[0].ESPassword, Equals, "secret")
+
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"a": 1}},
+		{Cluster: "analytics", Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"a": 2}},
+	}
+	c.Assert(groupByIndex(reqs), HasLen, 2)
+	c.Assert(r.doBulk(reqs), IsNil)
+	c.Assert(<-bodies[0], Matches, `(?s).*"a":1.*`)
+	c.Assert(<-bodies[1], Matches, `(?s).*"a":2.*`)
+
+	cfg.Rules[0].Cluster = "search"
+	c.Assert(r.prepareClusters(), NotNil)
+	cfg.Rules[0].Cluster = ""
+	cfg.Clusters = append(cfg.Clusters, &ClusterConfig{Name: "analytics", ESAddr: "127.0.0.1:9200"})
+	c.Assert(r.prepareClusters(), NotNil)
+}
@@ -0,0 +1,36 @@
+package river
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// How to handle the transactions compressed by binlog_transaction_compression.
+const (
+	// decompress the transactions and sync the row events in them
+	BinlogCompressionDecompress = "decompress"
+	// close sync at the compressed transactions
+	BinlogCompressionReject = "reject"
+)
+
+// checkBinlogCompression fails if MySQL compresses the binlog transactions
+// while they are rejected, MariaDB and MySQL older than 8.0.20 have no such variable.
+func (r *River) checkBinlogCompression() error {
+	if r.c.Flavor == mysql.MariaDBFlavor {
+		return nil
+	}
+
+	res, err := r.canal.Execute(`SHOW GLOBAL VARIABLES LIKE "binlog_transaction_compression"`)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if res.RowNumber() == 0 {
+		return nil
+	}
+	if v, _ := res.GetString(0, 1); strings.EqualFold(v, "ON") {
+		return errors.Errorf("MySQL compresses binlog transactions, but binlog_compression is %s", r.c.BinlogCompression)
+	}
+	return nil
+}
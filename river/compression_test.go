@@ -0,0 +1,164 @@
+package river
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func makeBinlogEvent(tp replication.EventType, logPos uint32, body []byte) []byte {
+	data := make([]byte, replication.EventHeaderSize, replication.EventHeaderSize+len(body))
+	data[4] = byte(tp)
+	binary.LittleEndian.PutUint32(data[9:], uint32(len(data)+len(body)))
+	binary.LittleEndian.PutUint32(data[13:], logPos)
+	return append(data, body...)
+}
+
+// newTestBinlogParser returns the parser of the binlog without checksum, the
+// table ids are 6 bytes.
+func newTestBinlogParser(c *C) *replication.BinlogParser {
+	fde := []byte{4, 0}
+	fde = append(fde, make([]byte, 50)...)
+	copy(fde[2:], "8.0.32")
+	fde = append(fde, 0, 0, 0, 0, replication.EventHeaderSize)
+	fde = append(fde, bytes.Repeat([]byte{8}, 40)...)
+	// no checksum
+	fde = append(fde, replication.BINLOG_CHECKSUM_ALG_OFF, 0, 0, 0, 0)
+
+	p := replication.NewBinlogParser()
+	_, err := p.Parse(makeBinlogEvent(replication.FORMAT_DESCRIPTION_EVENT, 0, fde))
+	c.Assert(err, IsNil)
+	return p
+}
+
+// makePayloadEvent makes the transaction payload event of the events compressed by zstd.
+func makePayloadEvent(c *C, logPos uint32, events ...[]byte) []byte {
+	inner := bytes.Join(events, nil)
+	enc, err := zstd.NewWriter(nil)
+	c.Assert(err, IsNil)
+	frame := enc.EncodeAll(inner, nil)
+
+	body := []byte{replication.OTW_PAYLOAD_SIZE_FIELD, 3, 0xfc, 0, 0}
+	binary.LittleEndian.PutUint16(body[3:], uint16(len(frame)))
+	body = append(body, replication.OTW_PAYLOAD_COMPRESSION_TYPE_FIELD, 1, replication.ZSTD)
+	body = append(body, replication.OTW_PAYLOAD_UNCOMPRESSED_SIZE_FIELD, 3, 0xfc, 0, 0)
+	binary.LittleEndian.PutUint16(body[len(body)-2:], uint16(len(inner)))
+	body = append(body, replication.OTW_PAYLOAD_HEADER_END_MARK)
+	return makeBinlogEvent(replication.TRANSACTION_PAYLOAD_EVENT, logPos, append(body, frame...))
+}
+
+func (s *unitTestSuite) TestTransactionPayload(c *C) {
+
+	xid := make([]byte, 8)
+	binary.LittleEndian.PutUint64(xid, 7)
+	inner := makeBinlogEvent(replication.XID_EVENT, 0, xid)
+
+	// a zstd frame of a raw block
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, byte(len(inner))}
+	block := uint32(len(inner))<<3 | 1
+	frame = append(frame, byte(block), byte(block>>8), byte(block>>16))
+	frame = append(frame, inner...)
+
+	body := []byte{
+		replication.OTW_PAYLOAD_SIZE_FIELD, 1, byte(len(frame)),
+		replication.OTW_PAYLOAD_COMPRESSION_TYPE_FIELD, 1, replication.ZSTD,
+		replication.OTW_PAYLOAD_UNCOMPRESSED_SIZE_FIELD, 1, byte(len(inner)),
+		replication.OTW_PAYLOAD_HEADER_END_MARK,
+	}
+	body = append(body, frame...)
+
+	p := newTestBinlogParser(c)
+	ev, err := p.Parse(makeBinlogEvent(replication.TRANSACTION_PAYLOAD_EVENT, 1000, body))
+	c.Assert(err, IsNil)
+	payload, ok := ev.Event.(*replication.TransactionPayloadEvent)
+	c.Assert(ok, Equals, true)
+	c.Assert(payload.UncompressedSize, Equals, uint64(len(inner)))
+	c.Assert(payload.Events, HasLen, 1)
+	c.Assert(payload.Events[0].Event.(*replication.XIDEvent).XID, Equals, uint64(7))
+
+	// the payload is truncated
+	body = body[:len(body)-4]
+	_, err = p.Parse(makeBinlogEvent(replication.TRANSACTION_PAYLOAD_EVENT, 1000, body))
+	c.Assert(err, NotNil)
+}
+
+func (s *unitTestSuite) TestTransactionPayloadPositions(c *C) {
+	// test.t (id INT, name VARCHAR(255)) of table id 1
+	tableMap := []byte{1, 0, 0, 0, 0, 0, 0, 0, 4, 't', 'e', 's', 't', 0, 1, 't', 0,
+		2, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR, 2, 255, 0, 0}
+	update := func(before, after string) []byte {
+		body := []byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 2, 3, 3}
+		for _, name := range []string{before, after} {
+			body = append(body, 0, 1, 0, 0, 0, byte(len(name)))
+			body = append(body, name...)
+		}
+		return makeBinlogEvent(replication.UPDATE_ROWS_EVENTv2, 0, body)
+	}
+	xid := makeBinlogEvent(replication.XID_EVENT, 0, make([]byte, 8))
+
+	// the row is updated twice in one compressed transaction
+	p := newTestBinlogParser(c)
+	data := makePayloadEvent(c, 0, makeBinlogEvent(replication.TABLE_MAP_EVENT, 0, tableMap),
+		update("a", "b"), update("b", "c"), xid)
+	end := uint32(1000 + len(data))
+	binary.LittleEndian.PutUint32(data[13:], end)
+	ev, err := p.Parse(data)
+	c.Assert(err, IsNil)
+	events := ev.Event.(*replication.TransactionPayloadEvent).Events
+	c.Assert(events, HasLen, 4)
+	// the events have increasing positions in the payload, the last one ends with it
+	for i, event := range events {
+		c.Assert(event.Header.LogPos > 1000, IsTrue)
+		if i > 0 {
+			c.Assert(event.Header.LogPos > events[i-1].Header.LogPos, IsTrue)
+		}
+	}
+	c.Assert(events[3].Header.LogPos, Equals, end)
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(255)", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+	appendRule := &Rule{Schema: "test", Table: "t", Index: "events", TableInfo: ta, AppendOnly: true}
+	c.Assert(appendRule.prepare(), IsNil)
+
+	r := &River{c: &Config{VersionType: VersionExternal}, ctx: context.Background(), st: &stat{},
+		syncCh: make(chan interface{}, 4), limits: newRateLimits(0, 0),
+		rules:     map[string]*Rule{ruleKey("test", "t"): rule},
+		replayPos: mysql.Position{Name: "mysql-bin.000002"}}
+	r.setFieldMapping(rule)
+	r.setFieldMapping(appendRule)
+	h := &eventHandler{r: r}
+
+	// the second update of the row has a greater version, so it isn't rejected as a stale one
+	var versions []int64
+	var ids []string
+	for _, event := range events[1:3] {
+		rows := event.Event.(*replication.RowsEvent)
+		e := &canal.RowsEvent{Table: ta, Action: canal.UpdateAction, Rows: rows.Rows, Header: event.Header}
+		c.Assert(h.OnRow(e), IsNil)
+		reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+		c.Assert(reqs, HasLen, 1)
+		c.Assert(reqs[0].ID, Equals, "1")
+		versions = append(versions, reqs[0].Version)
+
+		// the append docs of the two events don't overwrite each other
+		e.Action = canal.InsertAction
+		e.Rows = rows.Rows[1:]
+		reqs, err = h.makeAppendRequest(appendRule, e, e.Rows)
+		c.Assert(err, IsNil)
+		ids = append(ids, reqs[0].ID)
+	}
+	c.Assert(versions[1] > versions[0], IsTrue)
+	c.Assert(ids[0], Not(Equals), ids[1])
+}
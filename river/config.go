@@ -2,6 +2,8 @@ package river
 
 import (
 	"io/ioutil"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -10,8 +12,12 @@ import (
 
 // SourceConfig is the configs for source
 type SourceConfig struct {
+	// Schema can be a regex matching the whole names of the tenant schemas, like tenant_\d+
 	Schema string   `toml:"schema"`
 	Tables []string `toml:"tables"`
+	// Tables of the schema not synced, in the same format as tables,
+	// like exclude = ["migrations", "tmp_.*"] for tables = ["*"]
+	Exclude []string `toml:"exclude"`
 }
 
 // Config is the configuration
@@ -21,13 +27,70 @@ type Config struct {
 	MyPassword string `toml:"my_pass"`
 	MyCharset  string `toml:"my_charset"`
 
+	// The secrets like my_pass, es_pass, es_api_key and es_secondary_pass are read from
+	// the files in the *_file options if set, or from the environment like "$__env{NAME}",
+	// or from Vault like "$__vault{secret/data/river#es_pass}".
+	MyPasswordFile          string `toml:"my_pass_file"`
+	ESPasswordFile          string `toml:"es_pass_file"`
+	ESAPIKeyFile            string `toml:"es_api_key_file"`
+	ESSecondaryPasswordFile string `toml:"es_secondary_pass_file"`
+
+	// Vault for the secrets, VAULT_ADDR and VAULT_TOKEN are used if not set.
+	VaultAddr      string `toml:"vault_addr"`
+	VaultToken     string `toml:"vault_token"`
+	VaultTokenFile string `toml:"vault_token_file"`
+
+	// TLS for the MySQL replication and query connections,
+	// it is enabled if any of the below is set.
+	MySSLCA         string `toml:"my_ssl_ca"`
+	MySSLCert       string `toml:"my_ssl_cert"`
+	MySSLKey        string `toml:"my_ssl_key"`
+	MySSLSkipVerify bool   `toml:"my_ssl_skip_verify"`
+
 	ESHttps    bool   `toml:"es_https"`
 	ESAddr     string `toml:"es_addr"`
 	ESUser     string `toml:"es_user"`
 	ESPassword string `toml:"es_pass"`
 
+	// Elastic Cloud ID, es_addr and es_https are derived from it if set.
+	ESCloudID string `toml:"es_cloud_id"`
+	// API key, "id:api_key" or the base64 encoded one, used instead of es_user and es_pass.
+	ESAPIKey string `toml:"es_api_key"`
+
+	// HTTP transport settings of the ES clients, the proxy is from the environment
+	// like HTTPS_PROXY if es_proxy is not set.
+	ESProxy                 string       `toml:"es_proxy"`
+	ESMaxIdleConns          int          `toml:"es_max_idle_conns"`
+	ESMaxIdleConnsPerHost   int          `toml:"es_max_idle_conns_per_host"`
+	ESMaxConnsPerHost       int          `toml:"es_max_conns_per_host"`
+	ESTLSHandshakeTimeout   TomlDuration `toml:"es_tls_handshake_timeout"`
+	ESResponseHeaderTimeout TomlDuration `toml:"es_response_header_timeout"`
+
+	// Write every bulk to the secondary cluster too during migration,
+	// the failures of the secondary cluster are logged but not fatal.
+	ESSecondaryHttps    bool   `toml:"es_secondary_https"`
+	ESSecondaryAddr     string `toml:"es_secondary_addr"`
+	ESSecondaryUser     string `toml:"es_secondary_user"`
+	ESSecondaryPassword string `toml:"es_secondary_pass"`
+
+	// The other ES clusters, the rules with cluster = name are synced to them
+	// instead of the default one above.
+	Clusters []*ClusterConfig `toml:"cluster"`
+
 	StatAddr string `toml:"stat_addr"`
 
+	// TLS of the stat HTTP server, the client certificates are required and
+	// verified with stat_ssl_ca if set.
+	StatSSLCert string `toml:"stat_ssl_cert"`
+	StatSSLKey  string `toml:"stat_ssl_key"`
+	StatSSLCA   string `toml:"stat_ssl_ca"`
+
+	// Users of the stat HTTP server, every request is allowed if not set.
+	StatAuth []*StatAuth `toml:"stat_auth"`
+
+	// The gRPC control API, with the TLS and the users of the stat HTTP server.
+	GRPCAddr string `toml:"grpc_addr"`
+
 	ServerID uint32 `toml:"server_id"`
 	Flavor   string `toml:"flavor"`
 	DataDir  string `toml:"data_dir"`
@@ -35,15 +98,208 @@ type Config struct {
 	DumpExec       string `toml:"mysqldump"`
 	SkipMasterData bool   `toml:"skip_master_data"`
 
+	// Set refresh_interval -1 and number_of_replicas 0 for the indices while dumping,
+	// and restore the original values after the dump is done.
+	DumpTuneIndex bool `toml:"dump_tune_index"`
+
 	Sources []SourceConfig `toml:"source"`
 
+	// The other MySQL servers synced into the same indices, like the shards, with the
+	// same sources and rules, their positions are saved in data_dir/<name>.
+	Upstreams []*UpstreamConfig `toml:"upstream"`
+
+	// DDL matching any regex in skip_ddl_regex is skipped, tables in ignore_schemas
+	// or matching any regex in ignore_tables are not synced and their DDL is skipped,
+	// like the ghost tables of pt-online-schema-change and gh-ost.
+	SkipDDLRegex  []string `toml:"skip_ddl_regex"`
+	IgnoreSchemas []string `toml:"ignore_schemas"`
+	IgnoreTables  []string `toml:"ignore_tables"`
+
+	// Only apply the binlog events in the time window, the events before ignore_before_ts
+	// or after ignore_after_ts are ignored, like ignore_before_ts = 2026-10-01T00:00:00Z,
+	// no limit if not set. The window can be changed by the /timewindow API of stat_addr.
+	IgnoreBeforeTS time.Time `toml:"ignore_before_ts"`
+	IgnoreAfterTS  time.Time `toml:"ignore_after_ts"`
+
+	// Tables not synced in all the sources, like "app.sessions", the table is in
+	// the same format as the source tables, like "app.tmp_.*".
+	ExcludeTables []string `toml:"exclude_tables"`
+
+	// Split the tables of the sources among partition_count instances by the hash of
+	// the names, this instance only syncs the tables of partition_index from 0,
+	// the other tables are ignored like ignore_tables. 0 or 1 means no partition.
+	PartitionCount int `toml:"partition_count"`
+	PartitionIndex int `toml:"partition_index"`
+
+	// Split the tables among the instances with the same etcd_prefix in the etcd of
+	// etcd_endpoints instead, every instance joins by its server_id with a lease of
+	// etcd_ttl, default is 10s, and the tables are rebalanced when the instances join
+	// or leave, the tables moved to this instance are re-dumped.
+	EtcdEndpoints []string     `toml:"etcd_endpoints"`
+	EtcdPrefix    string       `toml:"etcd_prefix"`
+	EtcdUser      string       `toml:"etcd_user"`
+	EtcdPassword  string       `toml:"etcd_pass"`
+	EtcdTTL       TomlDuration `toml:"etcd_ttl"`
+
 	Rules []*Rule `toml:"rule"`
 
+	// The options inherited by all the rules which don't set them.
+	RuleDefaults *RuleDefaults `toml:"rule_defaults"`
+
+	// Record the row events of the synced tables with the table metadata into the file,
+	// they can be replayed through the rules without MySQL, see NewReplayRiver.
+	RecordFile string `toml:"record_file"`
+
+	// Record every delete, and the update or truncate causing deletes into the
+	// append-only file and the ES index before they are sent, not recorded if both empty.
+	AuditFile  string `toml:"audit_file"`
+	AuditIndex string `toml:"audit_index"`
+
+	// Record the DDL of the synced tables with the actions taken for them into
+	// the append-only file and the ES index, not recorded if both empty.
+	DDLLogFile  string `toml:"ddl_log_file"`
+	DDLLogIndex string `toml:"ddl_log_index"`
+
+	// Where the bulk requests are sent, es, file or shadow, default is es.
+	// The bulk bodies are written to the rotating NDJSON files in sink_dir with file,
+	// default is data_dir/sink, and a new file is used after sink_file_size bytes.
+	// The docs are fetched from ES and the diffs against them are logged with shadow.
+	Sink         string `toml:"sink"`
+	SinkDir      string `toml:"sink_dir"`
+	SinkFileSize int64  `toml:"sink_file_size"`
+
+	// Where the docs over the field_limit of the dlq policy, the docs rejected by the mapping
+	// with mapping_conflict drop_field and the docs rejected by ES with bulk_client_error dlq
+	// are written, default is data_dir/dlq
+	DLQDir string `toml:"dlq_dir"`
+
+	// Publish the doc operations of every bulk written to ES to kafka_topic through
+	// the Kafka REST proxy of kafka_rest_addr, the sync fails if they are not published.
+	KafkaRestAddr     string       `toml:"kafka_rest_addr"`
+	KafkaRestUser     string       `toml:"kafka_rest_user"`
+	KafkaRestPassword string       `toml:"kafka_rest_pass"`
+	KafkaTopic        string       `toml:"kafka_topic"`
+	KafkaTimeout      TomlDuration `toml:"kafka_timeout"`
+
+	// The webhooks of the rules are signed by HMAC-SHA256 with webhook_secret if set,
+	// and retried webhook_max_retries times, default is 3, with the timeout of webhook_timeout,
+	// default is 10s.
+	WebhookSecret     string       `toml:"webhook_secret"`
+	WebhookMaxRetries int          `toml:"webhook_max_retries"`
+	WebhookTimeout    TomlDuration `toml:"webhook_timeout"`
+
+	// Delete the redis_keys of the rules in the Redis of redis_addr when the rows change,
+	// by UNLINK with redis_unlink or DEL, the timeout is redis_timeout, default is 3s.
+	RedisAddr     string       `toml:"redis_addr"`
+	RedisPassword string       `toml:"redis_pass"`
+	RedisDB       int          `toml:"redis_db"`
+	RedisUnlink   bool         `toml:"redis_unlink"`
+	RedisTimeout  TomlDuration `toml:"redis_timeout"`
+
+	// Queue the flushed bulks on disk in queue_dir, default is data_dir/queue, and drain
+	// them to ES, so the binlog is still read while ES is down. The binlog is not read
+	// after queue_max_size bytes, default is 1GB, and a warning is logged after
+	// queue_alert_size, default is 80% of queue_max_size.
+	DiskQueue        bool   `toml:"disk_queue"`
+	QueueDir         string `toml:"queue_dir"`
+	QueueMaxSize     int64  `toml:"queue_max_size"`
+	QueueSegmentSize int64  `toml:"queue_segment_size"`
+	QueueAlertSize   int64  `toml:"queue_alert_size"`
+
 	BulkSize int `toml:"bulk_size"`
 
+	// Max retries for the docs rejected by ES with 429 or 503, or the bulk failed with
+	// network errors like timeout, default is 3
+	BulkMaxRetries int `toml:"bulk_max_retries"`
+	// Max time a bulk may be retried before it is failed, 0 means no limit
+	BulkMaxRetryTime TomlDuration `toml:"bulk_max_retry_time"`
+	// Timeout of a bulk HTTP request, 0 means no timeout
+	BulkTimeout TomlDuration `toml:"bulk_timeout"`
+	// filter_path of the bulk responses, default keeps only the errors and the status
+	// of the items, "none" parses the whole responses
+	BulkFilterPath string `toml:"bulk_filter_path"`
+	// What to do with the docs rejected by the mapping, skip or drop_field, default is skip.
+	// drop_field writes the doc to the dlq and sends it again without the rejected field.
+	MappingConflict string `toml:"mapping_conflict"`
+	// What to do with the docs rejected by ES with the other 4xx errors, dlq or skip,
+	// default is dlq if dlq_dir or data_dir is set. dlq writes the action, the doc and
+	// the error to the rejected files in dlq_dir.
+	BulkClientError string `toml:"bulk_client_error"`
+	// Max bulks sent to ES concurrently, the position is saved after all the bulks
+	// before it are done, default is 1
+	MaxInflightBulks int `toml:"max_inflight_bulks"`
+	// Max estimated bytes of the requests buffered in the sync loop and in flight,
+	// they are flushed even in the middle of a transaction when it is exceeded, 0 means no limit
+	MaxBufferSize int64 `toml:"max_buffer_size"`
+
+	// Inject the faults into the bulk requests to ES to test the retry and checkpoint logic,
+	// never enable them in production. The rates are from 0 to 1, fault_delay_rate of the
+	// bulks are delayed by fault_delay, fault_error_rate fail with a network error,
+	// fault_fail_rate fail with 503, and fault_reject_rate of the items are rejected with 429.
+	// The same fault_seed injects the same faults, default is the current time.
+	FaultErrorRate  float64      `toml:"fault_error_rate"`
+	FaultFailRate   float64      `toml:"fault_fail_rate"`
+	FaultDelayRate  float64      `toml:"fault_delay_rate"`
+	FaultDelay      TomlDuration `toml:"fault_delay"`
+	FaultRejectRate float64      `toml:"fault_reject_rate"`
+	FaultSeed       int64        `toml:"fault_seed"`
+
+	// Max docs and bytes sent to ES per second, 0 means no limit,
+	// they can be changed at runtime by the /ratelimit API of stat_addr.
+	RateLimitDocs  int64 `toml:"rate_limit_docs"`
+	RateLimitBytes int64 `toml:"rate_limit_bytes"`
+
+	// Lower the rate limits or pause the dump in the time windows, like in business hours,
+	// the first window containing the current local time is used.
+	ThrottleSchedule []*ThrottleWindow `toml:"throttle_schedule"`
+
 	FlushBulkTime TomlDuration `toml:"flush_bulk_time"`
 
+	// Collapse the requests of the same doc in a flush to its final state,
+	// the intermediate states of the doc are never visible in ES then.
+	BulkDedup bool `toml:"bulk_dedup"`
+
 	SkipNoPkTable bool `toml:"skip_no_pk_table"`
+
+	// How often the expired docs of the rules with ttl are deleted, default is 1h,
+	// and the max docs deleted of an index each time, default is 10000, -1 means no limit.
+	TTLInterval TomlDuration `toml:"ttl_interval"`
+	TTLMaxDocs  int          `toml:"ttl_max_docs"`
+
+	// Verify verify_rows rows, default is 100, from a random PK of a rule against their docs
+	// every verify_interval if the sync is idle in it, no verification if not set.
+	VerifyInterval TomlDuration `toml:"verify_interval"`
+	VerifyRows     int          `toml:"verify_rows"`
+
+	// Create the not existing indices before syncing, with the mappings
+	// inferred from the MySQL column types and overridden by the rule mapping.
+	AutoCreateIndex bool `toml:"auto_create_index"`
+
+	// Compare the field types of the rules with the mappings of the existing indices on start,
+	// warn logs the conflicts, error fails the start, off skips it, default is warn.
+	MappingCheck string `toml:"mapping_check"`
+
+	// Version the docs with the binlog position, external or external_gte, so replaying
+	// the binlog after a crash never regresses docs, no versioning if not set.
+	VersionType string `toml:"version_type"`
+
+	// How to handle the partial rows with binlog_row_image MINIMAL or NOBLOB,
+	// update or fetch, binlog_row_image must be FULL if not set.
+	PartialRowImage string `toml:"partial_row_image"`
+
+	// How to handle the transactions compressed by binlog_transaction_compression
+	// of MySQL 8.0.20+, decompress or reject, decompress if not set.
+	BinlogCompression string `toml:"binlog_compression"`
+
+	// Let MySQL send heartbeat events to keep the binlog connection alive,
+	// the connection is treated as dead if nothing is read in 3x period.
+	HeartbeatPeriod TomlDuration `toml:"heartbeat_period"`
+
+	// Write heartbeats into table "schema.table" and measure the lag when they
+	// come back from binlog, close sync if no heartbeat comes back in timeout.
+	HeartbeatTable    string       `toml:"heartbeat_table"`
+	HeartbeatInterval TomlDuration `toml:"heartbeat_interval"`
+	HeartbeatTimeout  TomlDuration `toml:"heartbeat_timeout"`
 }
 
 // NewConfigWithFile creates a Config from file.
@@ -73,9 +329,23 @@ type TomlDuration struct {
 	time.Duration
 }
 
-// UnmarshalText implementes TOML UnmarshalText
+// MarshalText implements TOML and JSON MarshalText
+func (d TomlDuration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// UnmarshalText implementes TOML UnmarshalText, the days like "30d" are supported too.
 func (d *TomlDuration) UnmarshalText(text []byte) error {
+	s := string(text)
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err == nil {
+			d.Duration = time.Duration(days * float64(24*time.Hour))
+			return nil
+		}
+	}
+
 	var err error
-	d.Duration, err = time.ParseDuration(string(text))
+	d.Duration, err = time.ParseDuration(s)
 	return err
 }
@@ -0,0 +1,22 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestBulkFilterPath(c *C) {
+	r := &River{c: &Config{}}
+	cfg := new(elastic.ClientConfig)
+	c.Assert(r.setESTransport(cfg), IsNil)
+	c.Assert(cfg.BulkFilterPath, Equals, elastic.DefaultBulkFilterPath)
+
+	r.c.BulkFilterPath = BulkFilterPathNone
+	cfg = new(elastic.ClientConfig)
+	c.Assert(r.setESTransport(cfg), IsNil)
+	c.Assert(cfg.BulkFilterPath, Equals, "")
+
+	r.c.BulkFilterPath = "errors,items.*.status"
+	c.Assert(r.setESTransport(cfg), IsNil)
+	c.Assert(cfg.BulkFilterPath, Equals, "errors,items.*.status")
+}
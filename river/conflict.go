@@ -0,0 +1,114 @@
+package river
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// What to do with the docs rejected by the mapping of the index, like a new field of
+// a strict mapping or a string in a long field.
+const (
+	// log and skip the doc like the other client errors
+	MappingConflictSkip = "skip"
+	// write the doc to the dlq, and send it again without the rejected field
+	MappingConflictDropField = "drop_field"
+)
+
+// the error types of the docs rejected by the mapping, document_parsing_exception is of ES 8
+var mappingConflictTypes = map[string]bool{
+	"strict_dynamic_mapping_exception": true,
+	"mapper_parsing_exception":         true,
+	"document_parsing_exception":       true,
+}
+
+// matches "failed to parse field [age] of type [long]", "failed to parse [age]" of ES 6,
+// and "dynamic introduction of [tag] within [_doc] is not allowed"
+var conflictFieldRe = regexp.MustCompile(`(?:parse (?:field )?|dynamic introduction of )\[([^\]]+)\](?: within \[([^\]]+)\])?`)
+
+type bulkItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// conflictField returns the field of the doc rejected by the mapping, empty if it is
+// not a mapping conflict or the field is not found in the error.
+func conflictField(req *elastic.BulkRequest, item *elastic.BulkResponseItem) string {
+	var e bulkItemError
+	if len(item.Error) == 0 || json.Unmarshal(item.Error, &e) != nil || !mappingConflictTypes[e.Type] {
+		return ""
+	}
+	m := conflictFieldRe.FindStringSubmatch(e.Reason)
+	if m == nil {
+		return ""
+	}
+	field := m[1]
+	// the new field of a strict object is within the object
+	if parent := m[2]; len(parent) > 0 && parent != "_doc" && parent != req.Type && !strings.HasPrefix(field, parent+".") {
+		field = parent + "." + field
+	}
+	return field
+}
+
+// withoutField returns a copy of the doc without the field, the dotted field is looked up
+// in the objects if it is not a key of the doc. false if the doc has no such field.
+func withoutField(data map[string]interface{}, field string) (map[string]interface{}, bool) {
+	if _, ok := data[field]; ok {
+		doc := make(map[string]interface{}, len(data))
+		for k, v := range data {
+			if k != field {
+				doc[k] = v
+			}
+		}
+		return doc, true
+	}
+
+	dot := strings.IndexByte(field, '.')
+	if dot < 0 {
+		return nil, false
+	}
+	object, ok := data[field[:dot]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	object, ok = withoutField(object, field[dot+1:])
+	if !ok {
+		return nil, false
+	}
+	doc := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		doc[k] = v
+	}
+	doc[field[:dot]] = object
+	return doc, true
+}
+
+// dropConflictField returns the request without the field rejected by the mapping, and
+// writes the whole doc to the dlq. nil if the field is not found in the doc.
+// The request is copied, as it may be sent to the secondary cluster at the same time.
+func (r *River) dropConflictField(req *elastic.BulkRequest, item *elastic.BulkResponseItem) (*elastic.BulkRequest, error) {
+	field := conflictField(req, item)
+	if len(field) == 0 {
+		return nil, nil
+	}
+	data, ok := withoutField(req.Data, field)
+	if !ok {
+		return nil, nil
+	}
+
+	if err := r.dlq.write([]*elastic.BulkRequest{req}); err != nil {
+		return nil, errors.Annotatef(err, "write doc %s of index %s to dlq", req.ID, req.Index)
+	}
+	r.st.DeadLetterNum.Add(1)
+	r.st.MappingConflictNum.Add(1)
+	log.Warnf("field %s of doc %s is rejected by the mapping of index %s, send the doc again without it: %s",
+		field, req.ID, req.Index, item.Error)
+
+	fixed := *req
+	fixed.Data = data
+	return &fixed, nil
+}
@@ -0,0 +1,95 @@
+package river
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestMappingConflict(c *C) {
+	dir, err := ioutil.TempDir("", "river_dlq")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	req := &elastic.BulkRequest{Index: "t", Type: "_doc", ID: "1"}
+	conflicts := map[string]string{
+		`{"type":"mapper_parsing_exception","reason":"failed to parse field [age] of type [long] in document with id '1'"}`:                              "age",
+		`{"type":"mapper_parsing_exception","reason":"failed to parse [age]"}`:                                                                           "age",
+		`{"type":"document_parsing_exception","reason":"[1:10] failed to parse field [meta.age] of type [long]"}`:                                        "meta.age",
+		`{"type":"strict_dynamic_mapping_exception","reason":"mapping set to strict, dynamic introduction of [tag] within [_doc] is not allowed"}`:       "tag",
+		`{"type":"strict_dynamic_mapping_exception","reason":"[1:2] mapping set to strict, dynamic introduction of [tag] within [meta] is not allowed"}`: "meta.tag",
+		`{"type":"version_conflict_engine_exception","reason":"[1]: version conflict"}`:                                                                  "",
+	}
+	for e, field := range conflicts {
+		c.Assert(conflictField(req, &elastic.BulkResponseItem{Error: json.RawMessage(e)}), Equals, field, Commentf(e))
+	}
+
+	data := map[string]interface{}{"id": 1, "meta": map[string]interface{}{"age": "x", "tag": "a"}}
+	fixed, ok := withoutField(data, "meta.age")
+	c.Assert(ok, IsTrue)
+	c.Assert(fixed, DeepEquals, map[string]interface{}{"id": 1, "meta": map[string]interface{}{"tag": "a"}})
+	// the doc is copied
+	c.Assert(data["meta"], HasLen, 2)
+	_, ok = withoutField(data, "meta.name")
+	c.Assert(ok, IsFalse)
+	_, ok = withoutField(data, "id.name")
+	c.Assert(ok, IsFalse)
+
+	var bodies []string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.Write([]byte(`{"errors":true,"items":[` +
+				`{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [age] of type [long]"}}},` +
+				`{"index":{"status":201}},{"index":{"status":200}},` +
+				`{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [other] of type [long]"}}}]}`))
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[{"index":{"status":200}},{"index":{"status":200}}]}`))
+	}))
+	defer es.Close()
+
+	cfg := &Config{DataDir: dir, MappingConflict: MappingConflictDropField}
+	r := &River{c: cfg, ctx: context.Background(), st: &stat{}}
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	r.dlq, err = newDeadLetters(cfg)
+	c.Assert(err, IsNil)
+
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"age": "abc", "name": "a"}},
+		{Action: elastic.ActionIndex, Index: "t", ID: "2", Data: map[string]interface{}{"age": 2}},
+		{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"name": "b"}},
+		// the field is not in the doc, it is skipped
+		{Action: elastic.ActionIndex, Index: "t", ID: "3", Data: map[string]interface{}{"age": 3}},
+	}
+	c.Assert(r.sendBulk(reqs), IsNil)
+	c.Assert(bodies, HasLen, 2)
+	// the fixed doc is sent again with the following request of the same doc
+	c.Assert(bodies[1], Equals, "{\"index\":{\"_id\":\"1\",\"_index\":\"t\"}}\n{\"name\":\"a\"}\n"+
+		"{\"index\":{\"_id\":\"1\",\"_index\":\"t\"}}\n{\"name\":\"b\"}\n")
+	c.Assert(reqs[0].Data, HasLen, 2)
+	c.Assert(r.st.MappingConflictNum.Get(), Equals, int64(1))
+	c.Assert(r.st.BulkClientErrorNum.Get(), Equals, int64(1))
+	c.Assert(r.dlq.Close(), IsNil)
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "dlq"))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	body, err := ioutil.ReadFile(filepath.Join(dir, "dlq", files[0].Name()))
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0], Equals, `{"index":{"_id":"1","_index":"t"}}`)
+	var doc map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(lines[1]), &doc), IsNil)
+	c.Assert(doc, DeepEquals, map[string]interface{}{"age": "abc", "name": "a"})
+}
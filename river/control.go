@@ -0,0 +1,347 @@
+package river
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// readOnlyMethods are the methods of the control API which a read_only user of
+// stat_auth can call.
+var readOnlyMethods = map[string]bool{
+	controlpb.Control_GetStatus_FullMethodName: true,
+	controlpb.Control_ListRules_FullMethodName: true,
+	controlpb.Control_GetRule_FullMethodName:   true,
+}
+
+// controlServer serves the gRPC control API on grpc_addr, like the HTTP API of stat_addr.
+type controlServer struct {
+	controlpb.UnimplementedControlServer
+
+	r   *River
+	srv *grpc.Server
+}
+
+func newControlServer(r *River) (*controlServer, error) {
+	s := &controlServer{r: r}
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(s.authorize)}
+	tlsConfig, err := r.st.newStatTLSConfig()
+	if err != nil {
+		return nil, errors.Trace(err)
+	} else if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s.srv = grpc.NewServer(opts...)
+	controlpb.RegisterControlServer(s.srv, s)
+	return s, nil
+}
+
+func (s *controlServer) Run(addr string) {
+	log.Infof("run control gRPC server %s", addr)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Errorf("listen grpc addr %s err %v", addr, err)
+		return
+	}
+	if err = s.srv.Serve(l); err != nil {
+		log.Errorf("serve grpc addr %s err %v", addr, err)
+	}
+}
+
+func (s *controlServer) Close() {
+	s.srv.Stop()
+}
+
+// authorize checks the users in stat_auth by the authorization metadata like
+// "Bearer <token>", every call is allowed if not set.
+func (s *controlServer) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if users := s.r.c.StatAuth; len(users) > 0 {
+		md, _ := metadata.FromIncomingContext(ctx)
+		r := &http.Request{Header: make(http.Header)}
+		for _, auth := range md.Get("authorization") {
+			r.Header.Add("Authorization", auth)
+		}
+
+		var user *StatAuth
+		for _, a := range users {
+			if a.match(r) {
+				user = a
+				break
+			}
+		}
+		if user == nil {
+			return nil, status.Error(codes.Unauthenticated, "invalid authorization")
+		} else if user.ReadOnly && !readOnlyMethods[info.FullMethod] {
+			return nil, status.Errorf(codes.PermissionDenied, "read only user can't call %s", info.FullMethod)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// controlError converts the error to the status of the gRPC code.
+func controlError(err error) error {
+	switch {
+	case errors.IsNotFound(err):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.IsAlreadyExists(err):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.IsNotValid(err):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.IsNotSupported(err):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// remoteAddr returns the address of the client for the logs.
+func remoteAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// river returns the river of the upstream, the primary one if name is empty.
+func (s *controlServer) river(name string) (*River, error) {
+	if len(name) == 0 {
+		return s.r, nil
+	}
+	for _, u := range s.r.upstreams {
+		if u.name == name {
+			return u, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "upstream %s not found", name)
+}
+
+func controlPosition(pos binlogPosition) *controlpb.Position {
+	return &controlpb.Position{File: pos.File, Pos: pos.Pos}
+}
+
+func (s *controlServer) GetStatus(ctx context.Context, req *controlpb.GetStatusRequest) (*controlpb.Status, error) {
+	st := s.r.st
+	d := st.positionData()
+	resp := &controlpb.Status{
+		SavedPosition:   controlPosition(d.SavedPosition),
+		ReadPosition:    controlPosition(d.ReadPosition),
+		GtidSet:         d.GTIDSet,
+		Paused:          s.r.paused.Get(),
+		Redumping:       s.r.redumping.Get(),
+		InsertNum:       st.InsertNum.Get(),
+		UpdateNum:       st.UpdateNum.Get(),
+		DeleteNum:       st.DeleteNum.Get(),
+		PendingRequests: d.PendingRequests,
+		InflightBulks:   d.InflightBulks,
+	}
+	if s.r.coord != nil {
+		resp.ClusterMembers = s.r.coord.Members()
+	}
+	for _, u := range d.Upstreams {
+		resp.Upstreams = append(resp.Upstreams, &controlpb.UpstreamStatus{
+			Name:          u.Name,
+			SavedPosition: controlPosition(u.SavedPosition),
+			ReadPosition:  controlPosition(u.ReadPosition),
+			GtidSet:       u.GTIDSet,
+		})
+	}
+	return resp, nil
+}
+
+// controlRule returns the rule with its TOML.
+func controlRule(rule *Rule) (*controlpb.Rule, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(rule); err != nil {
+		return nil, errors.Annotatef(err, "encode rule %s.%s", rule.Schema, rule.Table)
+	}
+	resp := &controlpb.Rule{
+		Schema:  rule.Schema,
+		Table:   rule.Table,
+		Index:   rule.Index,
+		Type:    rule.Type,
+		Cluster: rule.Cluster,
+		Toml:    buf.String(),
+	}
+	for _, target := range rule.fanout {
+		resp.FanoutIndices = append(resp.FanoutIndices, target.Index)
+	}
+	return resp, nil
+}
+
+func (s *controlServer) ListRules(ctx context.Context, req *controlpb.ListRulesRequest) (*controlpb.ListRulesResponse, error) {
+	keys := s.r.ruleKeys()
+	sort.Strings(keys)
+	resp := &controlpb.ListRulesResponse{Rules: make([]*controlpb.Rule, 0, len(keys))}
+	for _, key := range keys {
+		rule, ok := s.r.getRule(key)
+		if !ok {
+			// deleted meanwhile
+			continue
+		}
+		r, err := controlRule(rule)
+		if err != nil {
+			return nil, controlError(err)
+		}
+		resp.Rules = append(resp.Rules, r)
+	}
+	return resp, nil
+}
+
+func (s *controlServer) GetRule(ctx context.Context, req *controlpb.GetRuleRequest) (*controlpb.Rule, error) {
+	rule, ok := s.r.getRule(ruleKey(req.Schema, req.Table))
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "rule of %s.%s not found", req.Schema, req.Table)
+	}
+	resp, err := controlRule(rule)
+	if err != nil {
+		return nil, controlError(err)
+	}
+	return resp, nil
+}
+
+func (s *controlServer) PutRule(ctx context.Context, req *controlpb.PutRuleRequest) (*controlpb.Rule, error) {
+	rule, err := s.r.putRule(req.Toml, req.Redump)
+	if err != nil {
+		return nil, controlError(err)
+	}
+	log.Infof("put rule of %s.%s by %s", rule.Schema, rule.Table, remoteAddr(ctx))
+	resp, err := controlRule(rule)
+	if err != nil {
+		return nil, controlError(err)
+	}
+	return resp, nil
+}
+
+func (s *controlServer) DeleteRule(ctx context.Context, req *controlpb.DeleteRuleRequest) (*controlpb.DeleteRuleResponse, error) {
+	key := ruleKey(req.Schema, req.Table)
+	if _, ok := s.r.getRule(key); !ok {
+		return nil, status.Errorf(codes.NotFound, "rule of %s.%s not found", req.Schema, req.Table)
+	}
+	for _, r := range append([]*River{s.r}, s.r.upstreams...) {
+		r.deleteRule(key)
+	}
+	log.Infof("delete rule of %s.%s by %s", req.Schema, req.Table, remoteAddr(ctx))
+	return &controlpb.DeleteRuleResponse{}, nil
+}
+
+func (s *controlServer) Pause(ctx context.Context, req *controlpb.PauseRequest) (*controlpb.PauseResponse, error) {
+	log.Infof("pause sync by %s", remoteAddr(ctx))
+	s.r.paused.Set(true)
+	return &controlpb.PauseResponse{}, nil
+}
+
+func (s *controlServer) Resume(ctx context.Context, req *controlpb.ResumeRequest) (*controlpb.ResumeResponse, error) {
+	log.Infof("resume sync by %s", remoteAddr(ctx))
+	s.r.paused.Set(false)
+	return &controlpb.ResumeResponse{}, nil
+}
+
+func (s *controlServer) Redump(ctx context.Context, req *controlpb.RedumpRequest) (*controlpb.RedumpResponse, error) {
+	r, err := s.river(req.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.startRedump(req.Schema, req.Table); err != nil {
+		return nil, controlError(err)
+	}
+	log.Infof("re-dump %s.%s by %s", req.Schema, req.Table, remoteAddr(ctx))
+	return &controlpb.RedumpResponse{}, nil
+}
+
+func (s *controlServer) SetPosition(ctx context.Context, req *controlpb.SetPositionRequest) (*controlpb.SetPositionResponse, error) {
+	r, err := s.river(req.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if req.Position == nil || len(req.Position.File) == 0 || req.Position.Pos < 4 {
+		return nil, status.Error(codes.InvalidArgument, "position must have the file and the pos from 4")
+	}
+	// the events in flight would save their positions after it
+	if !s.r.paused.Get() {
+		return nil, status.Error(codes.FailedPrecondition, "sync must be paused to set the position")
+	}
+
+	pos := mysql.Position{Name: req.Position.File, Pos: req.Position.Pos}
+	if err = r.master.Override(pos); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	log.Warnf("set position %s by %s, close to restart from it", pos, remoteAddr(ctx))
+	s.r.cancel()
+	return &controlpb.SetPositionResponse{}, nil
+}
+
+// putRule adds the rule of a table in TOML like a [[rule]] in the config, or replaces
+// the rule of the table, for the MySQL servers of my_addr and the upstreams.
+func (r *River) putRule(data string, redump bool) (*Rule, error) {
+	rule := new(Rule)
+	if _, err := toml.Decode(data, rule); err != nil {
+		return nil, errors.NewNotValid(err, "invalid rule")
+	}
+	r.c.RuleDefaults.apply(rule)
+	switch {
+	case len(rule.Schema) == 0 || len(rule.Table) == 0:
+		return nil, errors.NotValidf("rule without schema or table")
+	case regexp.QuoteMeta(rule.Table) != rule.Table || isSchemaRegex(rule.Schema):
+		return nil, errors.NotSupportedf("wildcard rule %s.%s", rule.Schema, rule.Table)
+	case r.isIgnoredTable(rule.Schema, rule.Table):
+		return nil, errors.NotSupportedf("rule of the ignored table %s.%s", rule.Schema, rule.Table)
+	case len(rule.Cluster) > 0 && r.clusters[rule.Cluster] == nil:
+		return nil, errors.NotValidf("cluster %s of rule %s.%s", rule.Cluster, rule.Schema, rule.Table)
+	}
+	rivers := append([]*River{r}, r.upstreams...)
+	rules := make([]*Rule, len(rivers))
+	for i := range rivers {
+		// the upstreams have their own table info
+		if i == 0 {
+			rules[i] = rule
+		} else {
+			rules[i] = rule.clone()
+		}
+		if err := rules[i].prepare(); err != nil {
+			return nil, errors.NewNotValid(err, "invalid rule")
+		}
+	}
+
+	for i, u := range rivers {
+		err := u.addRule(rule.Schema, rule.Table, rules[i])
+		if errors.Cause(err) == schema.ErrTableNotExist {
+			err = errors.NotFoundf("table %s.%s", rule.Schema, rule.Table)
+		}
+		if err != nil && len(u.name) > 0 {
+			return nil, errors.Annotatef(err, "upstream %s", u.name)
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if redump {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			for i, u := range rivers {
+				if err := u.redumpTable(rules[i]); err != nil {
+					log.Errorf("re-dump %s.%s of the put rule err %v", rule.Schema, rule.Table, err)
+					u.st.addError("re-dump %s.%s of the put rule err %v", rule.Schema, rule.Table, err)
+				}
+			}
+		}()
+	}
+	return rule, nil
+}
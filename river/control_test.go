@@ -0,0 +1,279 @@
+package river
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newControlClient serves the control API of the river on a local port.
+func newControlClient(c *C, r *River) (controlpb.ControlClient, func()) {
+	s, err := newControlServer(r)
+	c.Assert(err, IsNil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go s.srv.Serve(l)
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	c.Assert(err, IsNil)
+	return controlpb.NewControlClient(conn), func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+func newControlRiver() *River {
+	r := &River{c: &Config{}, rules: make(map[string]*Rule), syncCh: make(chan interface{}, 16)}
+	r.st = &stat{r: r}
+	r.master = &masterInfo{}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+func assertCode(c *C, err error, code codes.Code) {
+	c.Assert(err, NotNil)
+	c.Assert(status.Code(err), Equals, code, Commentf("%v", err))
+}
+
+func (s *unitTestSuite) TestControlStatus(c *C) {
+	r := newControlRiver()
+	r.master = &masterInfo{Name: "mysql-bin.000003", Pos: 4588}
+	r.replayPos = mysql.Position{Name: "mysql-bin.000003", Pos: 9120}
+	r.st.InsertNum.Set(3)
+	r.st.UpdateNum.Set(2)
+	r.st.DeleteNum.Set(1)
+	r.st.PendingReqNum.Set(12)
+	r.redumping.Set("test.t")
+	r.coord = &coordinator{members: []string{"1", "2"}}
+	client, closeClient := newControlClient(c, r)
+	defer closeClient()
+
+	st, err := client.GetStatus(context.Background(), &controlpb.GetStatusRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(st.SavedPosition.File, Equals, "mysql-bin.000003")
+	c.Assert(st.SavedPosition.Pos, Equals, uint32(4588))
+	c.Assert(st.ReadPosition.Pos, Equals, uint32(9120))
+	c.Assert(st.InsertNum, Equals, int64(3))
+	c.Assert(st.UpdateNum, Equals, int64(2))
+	c.Assert(st.DeleteNum, Equals, int64(1))
+	c.Assert(st.PendingRequests, Equals, int64(12))
+	c.Assert(st.Redumping, Equals, "test.t")
+	c.Assert(st.ClusterMembers, DeepEquals, []string{"1", "2"})
+	c.Assert(st.Paused, IsFalse)
+
+	_, err = client.Pause(context.Background(), &controlpb.PauseRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(r.paused.Get(), IsTrue)
+	st, err = client.GetStatus(context.Background(), &controlpb.GetStatusRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(st.Paused, IsTrue)
+
+	_, err = client.Resume(context.Background(), &controlpb.ResumeRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(r.paused.Get(), IsFalse)
+}
+
+func (s *unitTestSuite) TestControlAuth(c *C) {
+	r := newControlRiver()
+	r.c.StatAuth = []*StatAuth{
+		{User: "admin", Password: "secret"},
+		{Token: "metrics", ReadOnly: true},
+	}
+	client, closeClient := newControlClient(c, r)
+	defer closeClient()
+
+	auth := func(value string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", value)
+	}
+	_, err := client.GetStatus(context.Background(), &controlpb.GetStatusRequest{})
+	assertCode(c, err, codes.Unauthenticated)
+	_, err = client.GetStatus(auth("Bearer wrong"), &controlpb.GetStatusRequest{})
+	assertCode(c, err, codes.Unauthenticated)
+
+	// the read only user can't change anything
+	_, err = client.ListRules(auth("Bearer metrics"), &controlpb.ListRulesRequest{})
+	c.Assert(err, IsNil)
+	_, err = client.Pause(auth("Bearer metrics"), &controlpb.PauseRequest{})
+	assertCode(c, err, codes.PermissionDenied)
+	c.Assert(r.paused.Get(), IsFalse)
+
+	admin := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+	_, err = client.Pause(auth(admin), &controlpb.PauseRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(r.paused.Get(), IsTrue)
+}
+
+func (s *unitTestSuite) TestControlRules(c *C) {
+	r := newControlRiver()
+	r.c.IgnoreSchemas = []string{"mysql"}
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t_index", Type: "_doc", TableInfo: ta,
+		FieldMapping: map[string]string{"id": "es_id"}}
+	c.Assert(rule.prepare(), IsNil)
+	rule.fanout = []*Rule{{Schema: "test", Table: "t", Index: "t_search", Type: "_doc"}}
+	r.rules[ruleKey("test", "t")] = rule
+	noPK := &Rule{Schema: "test", Table: "log", Index: "log", Type: "_doc"}
+	c.Assert(noPK.prepare(), IsNil)
+	r.rules[ruleKey("test", "log")] = noPK
+
+	u := newControlRiver()
+	u.name = "shard1"
+	u.primary = r
+	u.rules[ruleKey("test", "t")] = rule.clone()
+	r.upstreams = []*River{u}
+	client, closeClient := newControlClient(c, r)
+	defer closeClient()
+	ctx := context.Background()
+
+	resp, err := client.ListRules(ctx, &controlpb.ListRulesRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Rules, HasLen, 2)
+	c.Assert(resp.Rules[0].Table, Equals, "log")
+	c.Assert(resp.Rules[1].Index, Equals, "t_index")
+	c.Assert(resp.Rules[1].FanoutIndices, DeepEquals, []string{"t_search"})
+
+	// the TOML is a [[rule]] in the config
+	got, err := client.GetRule(ctx, &controlpb.GetRuleRequest{Schema: "test", Table: "t"})
+	c.Assert(err, IsNil)
+	var decoded Rule
+	_, err = toml.Decode(got.Toml, &decoded)
+	c.Assert(err, IsNil)
+	c.Assert(decoded.Index, Equals, "t_index")
+	c.Assert(decoded.FieldMapping, DeepEquals, map[string]string{"id": "es_id"})
+	c.Assert(decoded.TableInfo, IsNil)
+
+	_, err = client.GetRule(ctx, &controlpb.GetRuleRequest{Schema: "test", Table: "other"})
+	assertCode(c, err, codes.NotFound)
+
+	// the rules are checked before any table is read
+	for _, t := range []struct {
+		toml string
+		code codes.Code
+	}{
+		{`schema = "test`, codes.InvalidArgument},
+		{`schema = "test"`, codes.InvalidArgument},
+		{`schema = "test"` + "\n" + `table = "t_[0-9]{4}"`, codes.FailedPrecondition},
+		{`schema = "tenant_(\\d+)"` + "\n" + `table = "t"`, codes.FailedPrecondition},
+		{`schema = "mysql"` + "\n" + `table = "user"`, codes.FailedPrecondition},
+		{`schema = "test"` + "\n" + `table = "t"` + "\n" + `id_hash = "md5"`, codes.InvalidArgument},
+		{`schema = "test"` + "\n" + `table = "t"` + "\n" + `cluster = "logs"`, codes.InvalidArgument},
+	} {
+		_, err = client.PutRule(ctx, &controlpb.PutRuleRequest{Toml: t.toml})
+		assertCode(c, err, t.code)
+	}
+
+	// only one table is re-dumped at a time
+	_, err = client.Redump(ctx, &controlpb.RedumpRequest{Schema: "test", Table: "other"})
+	assertCode(c, err, codes.NotFound)
+	_, err = client.Redump(ctx, &controlpb.RedumpRequest{Schema: "test", Table: "log"})
+	assertCode(c, err, codes.FailedPrecondition)
+	_, err = client.Redump(ctx, &controlpb.RedumpRequest{Schema: "test", Table: "t", Upstream: "shard2"})
+	assertCode(c, err, codes.NotFound)
+	r.redumping.Set("test.log")
+	_, err = client.Redump(ctx, &controlpb.RedumpRequest{Schema: "test", Table: "t", Upstream: "shard1"})
+	assertCode(c, err, codes.AlreadyExists)
+
+	// the rule is deleted for the upstreams too
+	_, err = client.DeleteRule(ctx, &controlpb.DeleteRuleRequest{Schema: "test", Table: "t"})
+	c.Assert(err, IsNil)
+	_, ok := r.getRule(ruleKey("test", "t"))
+	c.Assert(ok, IsFalse)
+	_, ok = u.getRule(ruleKey("test", "t"))
+	c.Assert(ok, IsFalse)
+	_, err = client.DeleteRule(ctx, &controlpb.DeleteRuleRequest{Schema: "test", Table: "t"})
+	assertCode(c, err, codes.NotFound)
+}
+
+func (s *unitTestSuite) TestControlSetPosition(c *C) {
+	dir, err := ioutil.TempDir("", "river_control")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	r := newControlRiver()
+	r.master, err = loadMasterInfo(dir)
+	c.Assert(err, IsNil)
+	u := newControlRiver()
+	u.name = "shard1"
+	u.master, err = loadMasterInfo(filepath.Join(dir, "shard1"))
+	c.Assert(err, IsNil)
+	r.upstreams = []*River{u}
+	client, closeClient := newControlClient(c, r)
+	defer closeClient()
+	ctx := context.Background()
+
+	pos := &controlpb.Position{File: "mysql-bin.000005", Pos: 120}
+	_, err = client.SetPosition(ctx, &controlpb.SetPositionRequest{Position: pos})
+	assertCode(c, err, codes.FailedPrecondition)
+	r.paused.Set(true)
+	_, err = client.SetPosition(ctx, &controlpb.SetPositionRequest{Position: &controlpb.Position{File: "mysql-bin.000005"}})
+	assertCode(c, err, codes.InvalidArgument)
+	_, err = client.SetPosition(ctx, &controlpb.SetPositionRequest{Position: pos, Upstream: "shard2"})
+	assertCode(c, err, codes.NotFound)
+
+	// the position of the upstream is saved, and the river is closed to restart from it
+	_, err = client.SetPosition(ctx, &controlpb.SetPositionRequest{Position: pos, Upstream: "shard1"})
+	c.Assert(err, IsNil)
+	c.Assert(r.ctx.Err(), NotNil)
+	c.Assert(r.master.Position().Name, Equals, "")
+
+	// the positions synced later are not saved
+	c.Assert(u.master.Save(mysql.Position{Name: "mysql-bin.000004", Pos: 4}), IsNil)
+	c.Assert(u.master.Close(), IsNil)
+	m, err := loadMasterInfo(filepath.Join(dir, "shard1"))
+	c.Assert(err, IsNil)
+	c.Assert(m.Position(), Equals, mysql.Position{Name: "mysql-bin.000005", Pos: 120})
+
+	// data_dir must be set
+	r.master = &masterInfo{}
+	_, err = client.SetPosition(ctx, &controlpb.SetPositionRequest{Position: pos})
+	assertCode(c, err, codes.FailedPrecondition)
+}
+
+func (s *riverTestSuite) TestControlPutRule(c *C) {
+	s.testExecute(c, "DROP TABLE IF EXISTS test_control")
+	s.testExecute(c, "CREATE TABLE test_control (id INT, title VARCHAR(256), PRIMARY KEY(id)) ENGINE=INNODB")
+	client, closeClient := newControlClient(c, s.r)
+	defer closeClient()
+	ctx := context.Background()
+
+	rule, err := client.PutRule(ctx, &controlpb.PutRuleRequest{Toml: `
+schema = "test"
+table = "test_control"
+index = "river_control"
+
+[field]
+title = "es_title"
+`})
+	c.Assert(err, IsNil)
+	c.Assert(rule.Index, Equals, "river_control")
+	added, ok := s.r.getRule(ruleKey("test", "test_control"))
+	c.Assert(ok, IsTrue)
+	c.Assert(added.TableInfo.Name, Equals, "test_control")
+	c.Assert(added.TableInfo.PKColumns, DeepEquals, []int{0})
+
+	_, err = client.PutRule(ctx, &controlpb.PutRuleRequest{Toml: "schema = \"test\"\ntable = \"test_none\""})
+	assertCode(c, err, codes.NotFound)
+
+	_, err = client.DeleteRule(ctx, &controlpb.DeleteRuleRequest{Schema: "test", Table: "test_control"})
+	c.Assert(err, IsNil)
+	_, ok = s.r.getRule(ruleKey("test", "test_control"))
+	c.Assert(ok, IsFalse)
+	c.Assert(s.r.es.DeleteIndex("river_control"), IsNil)
+}
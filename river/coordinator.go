@@ -0,0 +1,229 @@
+package river
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+const defaultEtcdTTL = 10 * time.Second
+
+// coordinator splits the tables among the instances in etcd, every instance puts
+// its member key with a lease, and the tables are assigned to the members by
+// rendezvous hashing, so the tables of the other members are not moved when an
+// instance joins or leaves.
+type coordinator struct {
+	r      *River
+	etcd   *etcdClient
+	prefix string
+	member string
+	ttl    time.Duration
+	lease  string
+	// the start of the last renewal of the lease, zero after the lease is lost
+	renewed time.Time
+
+	mu      sync.RWMutex
+	members []string
+
+	// redumps the tables moved to this instance, by their rule keys
+	redump func(keys []string)
+}
+
+func newCoordinator(r *River) *coordinator {
+	ttl := r.c.EtcdTTL.Duration
+	if ttl == 0 {
+		ttl = defaultEtcdTTL
+	}
+	c := &coordinator{
+		r:      r,
+		etcd:   newEtcdClient(r.c),
+		prefix: r.c.EtcdPrefix + "members/",
+		member: fmt.Sprintf("%d", r.c.ServerID),
+		ttl:    ttl,
+	}
+	c.redump = c.redumpTables
+	return c
+}
+
+// owns checks whether the table is assigned to this instance.
+func (c *coordinator) owns(schema, table string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return rendezvousOwner(c.members, ruleKey(schema, table)) == c.member
+}
+
+// Members returns the members in the cluster.
+func (c *coordinator) Members() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.members...)
+}
+
+// join puts the member key of this instance with a new lease, and loads the members.
+func (c *coordinator) join() error {
+	if err := c.register(); err != nil {
+		return errors.Trace(err)
+	}
+	_, err := c.refresh()
+	return errors.Trace(err)
+}
+
+// register puts the member key of this instance with a new lease.
+func (c *coordinator) register() error {
+	start := time.Now()
+	lease, err := c.etcd.grant(c.ttl)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = c.etcd.put(c.prefix+c.member, c.r.c.StatAddr, lease); err != nil {
+		return errors.Trace(err)
+	}
+	c.lease = lease
+	c.renewed = start
+	log.Infof("join the cluster in etcd %s as member %s", c.prefix, c.member)
+	return nil
+}
+
+// refresh loads the members, and returns the rule keys moved to this instance.
+func (c *coordinator) refresh() ([]string, error) {
+	kvs, err := c.etcd.list(c.prefix)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	members := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		members = append(members, strings.TrimPrefix(kv.Key, c.prefix))
+	}
+	sort.Strings(members)
+
+	c.mu.Lock()
+	old := c.members
+	c.members = members
+	c.mu.Unlock()
+	if strings.Join(old, ",") == strings.Join(members, ",") {
+		return nil, nil
+	}
+
+	var gained []string
+	owned := 0
+	keys := c.r.ruleKeys()
+	for _, key := range keys {
+		owner := rendezvousOwner(members, key)
+		if owner != c.member {
+			continue
+		}
+		owned++
+		if old != nil && rendezvousOwner(old, key) != c.member {
+			gained = append(gained, key)
+		}
+	}
+	sort.Strings(gained)
+	log.Infof("cluster members %v, sync %d of %d tables, %d tables are moved here", members, owned, len(keys), len(gained))
+	return gained, nil
+}
+
+// run keeps the lease alive, and rebalances the tables when the members change.
+func (c *coordinator) run() {
+	defer c.r.wg.Done()
+
+	ticker := time.NewTicker(c.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.r.ctx.Done():
+			return
+		}
+
+		if err := c.keepAlive(); err != nil {
+			log.Errorf("keep the lease of etcd member %s err %v", c.member, err)
+			c.r.st.addError("keep the lease of etcd member %s err %v", c.member, err)
+			if !c.renewed.IsZero() && time.Since(c.renewed) >= c.ttl {
+				c.drop()
+			}
+			continue
+		}
+		gained, err := c.refresh()
+		if err != nil {
+			log.Errorf("load the etcd members err %v", err)
+			c.r.st.addError("load the etcd members err %v", err)
+			continue
+		}
+		if len(gained) > 0 {
+			c.redump(gained)
+		}
+	}
+}
+
+// keepAlive renews the lease, or joins again with a new one if it is expired or lost.
+func (c *coordinator) keepAlive() error {
+	if c.renewed.IsZero() {
+		log.Warnf("the lease of etcd member %s is lost, join again", c.member)
+		return errors.Trace(c.register())
+	}
+	start := time.Now()
+	alive, err := c.etcd.keepAlive(c.lease)
+	if err != nil {
+		return errors.Trace(err)
+	} else if alive {
+		c.renewed = start
+		return nil
+	}
+	log.Warnf("the lease of etcd member %s is expired, join again", c.member)
+	return errors.Trace(c.register())
+}
+
+// drop stops syncing all the tables when the lease can't be renewed in its ttl, as it may
+// be expired in etcd and the tables are moved to the other members. The members are empty
+// but not nil, so all the tables assigned here after joining again are re-dumped.
+func (c *coordinator) drop() {
+	log.Errorf("the lease of etcd member %s is not renewed in %v, stop syncing the tables until it joins again", c.member, c.ttl)
+	c.r.st.addError("the lease of etcd member %s is not renewed in %v, stop syncing the tables", c.member, c.ttl)
+	c.renewed = time.Time{}
+	c.mu.Lock()
+	c.members = []string{}
+	c.mu.Unlock()
+}
+
+// leave revokes the lease, so the tables are moved to the other instances at once.
+func (c *coordinator) leave() {
+	if len(c.lease) == 0 {
+		return
+	}
+	if err := c.etcd.revoke(c.lease); err != nil {
+		log.Errorf("leave the cluster in etcd err %v", err)
+		return
+	}
+	log.Infof("leave the cluster in etcd %s", c.prefix)
+}
+
+// redumpTables re-dumps the tables moved to this instance in the background, their
+// changes before the position of this instance may be only synced by the old owner.
+func (c *coordinator) redumpTables(keys []string) {
+	rivers := append([]*River{c.r}, c.r.upstreams...)
+	c.r.wg.Add(1)
+	go func() {
+		defer c.r.wg.Done()
+		for _, key := range keys {
+			for _, r := range rivers {
+				rule, ok := r.getRule(key)
+				if !ok {
+					continue
+				}
+				if !c.owns(rule.Schema, rule.Table) {
+					// moved again
+					break
+				}
+				if err := r.redumpTable(rule); err != nil {
+					log.Errorf("re-dump %s.%s moved here err %v", rule.Schema, rule.Table, err)
+					r.st.addError("re-dump %s.%s moved here err %v", rule.Schema, rule.Table, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,211 @@
+package river
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func newCoordinatedRiver(c *C, e *fakeEtcd, serverID uint32, tables int) (*River, chan []string) {
+	cfg := &Config{ServerID: serverID, EtcdEndpoints: []string{e.URL}, EtcdPrefix: "/test"}
+	c.Assert(cfg.checkPartition(), IsNil)
+	c.Assert(cfg.EtcdPrefix, Equals, "/test/")
+
+	r := &River{c: cfg, st: &stat{}, rules: make(map[string]*Rule)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for i := 0; i < tables; i++ {
+		table := fmt.Sprintf("t_%d", i)
+		r.rules[ruleKey("test", table)] = &Rule{Schema: "test", Table: table}
+	}
+	r.coord = newCoordinator(r)
+	redumped := make(chan []string, 16)
+	r.coord.redump = func(keys []string) {
+		redumped <- keys
+	}
+	return r, redumped
+}
+
+// ownedKeys returns the rule keys assigned to the river.
+func ownedKeys(r *River) []string {
+	var keys []string
+	for key, rule := range r.rules {
+		if r.assignsTable(rule.Schema, rule.Table) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *unitTestSuite) TestCoordinator(c *C) {
+	e := newFakeEtcd()
+	defer e.Close()
+
+	r1, redumped1 := newCoordinatedRiver(c, e, 1, 50)
+	r2, redumped2 := newCoordinatedRiver(c, e, 2, 50)
+	c.Assert(r1.coord.ttl, Equals, defaultEtcdTTL)
+
+	// the first member syncs all the tables
+	c.Assert(r1.coord.join(), IsNil)
+	c.Assert(r1.coord.Members(), DeepEquals, []string{"1"})
+	c.Assert(ownedKeys(r1), HasLen, 50)
+
+	// no re-dump for the tables at the start
+	c.Assert(r2.coord.join(), IsNil)
+	c.Assert(r2.coord.Members(), DeepEquals, []string{"1", "2"})
+	owned2 := ownedKeys(r2)
+	c.Assert(len(owned2) > 0 && len(owned2) < 50, IsTrue)
+
+	// the tables moved to the new member are not re-dumped by the old one
+	gained, err := r1.coord.refresh()
+	c.Assert(err, IsNil)
+	c.Assert(gained, HasLen, 0)
+	owned1 := ownedKeys(r1)
+	c.Assert(len(owned1)+len(owned2), Equals, 50)
+	for _, key := range owned2 {
+		c.Assert(r1.assignsTable("test", r1.rules[key].Table), IsFalse)
+	}
+	gained, err = r1.coord.refresh()
+	c.Assert(err, IsNil)
+	c.Assert(gained, HasLen, 0)
+
+	// the tables of the member which leaves are moved to the others, and re-dumped
+	r2.coord.leave()
+	gained, err = r1.coord.refresh()
+	c.Assert(err, IsNil)
+	c.Assert(gained, DeepEquals, owned2)
+	c.Assert(ownedKeys(r1), HasLen, 50)
+
+	// the member joins again with a new lease if its lease is expired
+	lease := r1.coord.lease
+	e.expire(lease)
+	kvs, err := r1.coord.etcd.list("/test/")
+	c.Assert(err, IsNil)
+	c.Assert(kvs, HasLen, 0)
+	c.Assert(r1.coord.keepAlive(), IsNil)
+	c.Assert(r1.coord.lease, Not(Equals), lease)
+	kvs, err = r1.coord.etcd.list("/test/")
+	c.Assert(err, IsNil)
+	c.Assert(kvs, DeepEquals, []etcdKV{{Key: "/test/members/1"}})
+
+	// the running members rebalance the tables when the others join or leave
+	r1.coord.ttl = 30 * time.Millisecond
+	r1.wg.Add(1)
+	go r1.coord.run()
+	c.Assert(r2.coord.join(), IsNil)
+	r2.coord.ttl = 30 * time.Millisecond
+	r2.wg.Add(1)
+	go r2.coord.run()
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(ownedKeys(r1), DeepEquals, owned1)
+	c.Assert(ownedKeys(r2), DeepEquals, owned2)
+
+	r1.cancel()
+	r1.wg.Wait()
+	r1.coord.leave()
+	select {
+	case keys := <-redumped2:
+		c.Assert(keys, DeepEquals, owned1)
+	case <-time.After(time.Second):
+		c.Fatal("the tables of the member which leaves are not re-dumped")
+	}
+	c.Assert(ownedKeys(r2), HasLen, 50)
+	r2.cancel()
+	r2.wg.Wait()
+	c.Assert(redumped1, HasLen, 0)
+	c.Assert(redumped2, HasLen, 0)
+}
+
+func (s *unitTestSuite) TestCoordinatorPartition(c *C) {
+	e := newFakeEtcd()
+	defer e.Close()
+
+	r1, redumped1 := newCoordinatedRiver(c, e, 1, 50)
+	r2, _ := newCoordinatedRiver(c, e, 2, 50)
+	c.Assert(r1.coord.join(), IsNil)
+	c.Assert(r2.coord.join(), IsNil)
+	_, err := r1.coord.refresh()
+	c.Assert(err, IsNil)
+	owned1 := ownedKeys(r1)
+	c.Assert(len(owned1) > 0 && len(owned1) < 50, IsTrue)
+
+	r1.coord.ttl = 60 * time.Millisecond
+	r1.wg.Add(1)
+	go r1.coord.run()
+
+	// the tables are kept in a short failure, but not after the lease may be expired
+	lease := r1.coord.lease
+	e.partition(true)
+	time.Sleep(30 * time.Millisecond)
+	c.Assert(ownedKeys(r1), DeepEquals, owned1)
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(ownedKeys(r1), HasLen, 0)
+	c.Assert(r1.coord.Members(), HasLen, 0)
+	c.Assert(r1.assignsTable("test", "t_0"), IsFalse)
+	e.expire(lease)
+
+	// the member joins again with a new lease, and re-dumps its tables synced by the others meanwhile
+	e.partition(false)
+	select {
+	case keys := <-redumped1:
+		c.Assert(keys, DeepEquals, owned1)
+	case <-time.After(time.Second):
+		c.Fatal("the tables are not re-dumped after joining again")
+	}
+	c.Assert(r1.coord.lease, Not(Equals), lease)
+	c.Assert(r1.coord.Members(), DeepEquals, []string{"1", "2"})
+	c.Assert(ownedKeys(r1), DeepEquals, owned1)
+	c.Assert(r1.st.dash.errors, Not(HasLen), 0)
+
+	r1.cancel()
+	r1.wg.Wait()
+}
+
+func (s *unitTestSuite) TestCoordinatedRows(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+
+	r := &River{c: &Config{}, ctx: context.Background(), st: &stat{}, syncCh: make(chan interface{}, 16),
+		limits: newRateLimits(0, 0), rules: make(map[string]*Rule)}
+	r.coord = &coordinator{member: "1", members: []string{"1", "2"}}
+	var owned, other *schema.Table
+	for i := 0; owned == nil || other == nil; i++ {
+		table := &schema.Table{Schema: "test", Name: fmt.Sprintf("t_%d", i), Columns: ta.Columns, PKColumns: ta.PKColumns}
+		rule := &Rule{Schema: "test", Table: table.Name, Index: table.Name, Type: "_doc", TableInfo: table}
+		c.Assert(rule.prepare(), IsNil)
+		r.setFieldMapping(rule)
+		r.rules[ruleKey("test", table.Name)] = rule
+		if r.assignsTable("test", table.Name) {
+			owned = table
+		} else {
+			other = table
+		}
+	}
+	h := &eventHandler{r: r}
+
+	// the dumped and the binlog rows of the tables of the other members are skipped
+	for _, header := range []*replication.EventHeader{nil, {LogPos: 120}} {
+		c.Assert(h.OnRow(&canal.RowsEvent{Action: canal.InsertAction, Table: other, Header: header,
+			Rows: [][]interface{}{{int32(1)}}}), IsNil)
+		c.Assert(r.syncCh, HasLen, 0)
+		c.Assert(h.OnRow(&canal.RowsEvent{Action: canal.InsertAction, Table: owned, Header: header,
+			Rows: [][]interface{}{{int32(1)}}}), IsNil)
+		reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+		c.Assert(reqs, HasLen, 1)
+		c.Assert(reqs[0].Index, Equals, owned.Name)
+	}
+
+	// the tables are synced by the new owner after the rebalance
+	r.coord.members = []string{"2"}
+	c.Assert(h.OnRow(&canal.RowsEvent{Action: canal.InsertAction, Table: owned, Header: &replication.EventHeader{LogPos: 240},
+		Rows: [][]interface{}{{int32(2)}}}), IsNil)
+	c.Assert(r.syncCh, HasLen, 0)
+}
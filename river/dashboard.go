@@ -0,0 +1,320 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go/sync2"
+)
+
+// maxRecentErrors is the number of the recent errors shown in the dashboard.
+const maxRecentErrors = 20
+
+type recentError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// dashboardStat is the stat shown in the dashboard besides the counters.
+type dashboardStat struct {
+	sync.RWMutex
+
+	// docs synced by every rule, the key is like "test.t -> t"
+	ruleDocs map[string]*sync2.AtomicInt64
+	errors   []recentError
+}
+
+func dashboardRuleName(rule *Rule) string {
+	return fmt.Sprintf("%s.%s -> %s", rule.Schema, rule.Table, rule.Index)
+}
+
+func (s *stat) addRuleDocs(rule *Rule, n int) {
+	if n == 0 {
+		return
+	}
+	name := dashboardRuleName(rule)
+
+	s.dash.RLock()
+	docs, ok := s.dash.ruleDocs[name]
+	s.dash.RUnlock()
+	if !ok {
+		s.dash.Lock()
+		if s.dash.ruleDocs == nil {
+			s.dash.ruleDocs = make(map[string]*sync2.AtomicInt64)
+		}
+		if docs, ok = s.dash.ruleDocs[name]; !ok {
+			docs = new(sync2.AtomicInt64)
+			s.dash.ruleDocs[name] = docs
+		}
+		s.dash.Unlock()
+	}
+	docs.Add(int64(n))
+}
+
+// addError keeps the error for the dashboard, only the recent ones are kept.
+func (s *stat) addError(format string, args ...interface{}) {
+	s.dash.Lock()
+	defer s.dash.Unlock()
+
+	s.dash.errors = append(s.dash.errors, recentError{Time: time.Now(), Error: fmt.Sprintf(format, args...)})
+	if n := len(s.dash.errors); n > maxRecentErrors {
+		s.dash.errors = append(s.dash.errors[:0], s.dash.errors[n-maxRecentErrors:]...)
+	}
+}
+
+// waitSyncResumed blocks the row events while the sync is paused by the /pause API
+// or the control API, the binlog is not read then, so the position is kept.
+func (r *River) waitSyncResumed() error {
+	r = r.root()
+	if !r.paused.Get() {
+		return nil
+	}
+
+	log.Infof("sync is paused")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for r.paused.Get() {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+	log.Infof("sync is resumed")
+	return nil
+}
+
+// servePause pauses the sync with POST.
+func (s *stat) servePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	log.Infof("pause sync by %s", r.RemoteAddr)
+	s.r.paused.Set(true)
+	w.Write([]byte("paused\n"))
+}
+
+// serveResume resumes the paused sync with POST.
+func (s *stat) serveResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	log.Infof("resume sync by %s", r.RemoteAddr)
+	s.r.paused.Set(false)
+	w.Write([]byte("resumed\n"))
+}
+
+type dashboardRule struct {
+	Rule string `json:"rule"`
+	Docs int64  `json:"docs"`
+}
+
+type dashboardData struct {
+	Time          time.Time `json:"time"`
+	ReadPosition  string    `json:"read_position"`
+	SavedPosition string    `json:"saved_position"`
+	// the heartbeat lag, empty if heartbeat_table is not set
+	Lag       string          `json:"lag,omitempty"`
+	Paused    bool            `json:"paused"`
+	InsertNum int64           `json:"insert_num"`
+	UpdateNum int64           `json:"update_num"`
+	DeleteNum int64           `json:"delete_num"`
+	RetryNum  int64           `json:"bulk_retry_num"`
+	Rules     []dashboardRule `json:"rules"`
+	Errors    []recentError   `json:"errors"`
+	// the table being re-dumped, empty if none
+	Redump string `json:"redump"`
+	// the dead letter files, nil if no dlq
+	DLQ *dashboardDLQ `json:"dlq,omitempty"`
+}
+
+type dashboardDLQ struct {
+	Dir   string `json:"dir"`
+	Docs  int64  `json:"docs"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+func (s *stat) dashboardData() *dashboardData {
+	d := &dashboardData{
+		Time:          time.Now(),
+		ReadPosition:  s.r.syncedPosition().String(),
+		SavedPosition: s.r.master.Position().String(),
+		Paused:        s.r.paused.Get(),
+		InsertNum:     s.InsertNum.Get(),
+		UpdateNum:     s.UpdateNum.Get(),
+		DeleteNum:     s.DeleteNum.Get(),
+		RetryNum:      s.BulkRetryNum.Get(),
+	}
+	if s.r.hb != nil {
+		d.Lag = s.r.hb.Lag().String()
+	}
+	d.Redump = s.r.redumping.Get()
+	if s.r.dlq != nil {
+		d.DLQ = &dashboardDLQ{Dir: s.r.dlq.sink.dir, Docs: s.DeadLetterNum.Get()}
+		var err error
+		if d.DLQ.Files, d.DLQ.Size, err = s.r.dlq.usage(); err != nil {
+			log.Errorf("read dlq dir %s err %v", d.DLQ.Dir, err)
+		}
+	}
+
+	s.dash.RLock()
+	d.Rules = make([]dashboardRule, 0, len(s.dash.ruleDocs))
+	for name, docs := range s.dash.ruleDocs {
+		d.Rules = append(d.Rules, dashboardRule{Rule: name, Docs: docs.Get()})
+	}
+	d.Errors = append([]recentError{}, s.dash.errors...)
+	s.dash.RUnlock()
+
+	sort.Slice(d.Rules, func(i, j int) bool { return d.Rules[i].Rule < d.Rules[j].Rule })
+	return d
+}
+
+// serveDashboard serves the dashboard page, and its data in JSON for /dashboard/data.
+func (s *stat) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/", "/dashboard":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dashboardHTML))
+	case "/dashboard/data":
+		data, err := json.Marshal(s.dashboardData())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("marshal dashboard error %v", err)))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// dashboardHTML polls /dashboard/data, and draws the throughput of the rules
+// from the differences of their docs.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>go-mysql-elasticsearch</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #222; }
+table { border-collapse: collapse; margin-bottom: 20px; }
+td, th { border: 1px solid #ddd; padding: 4px 8px; text-align: left; }
+canvas { border: 1px solid #ddd; vertical-align: middle; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h2>go-mysql-elasticsearch</h2>
+<table>
+<tr><th>read binlog</th><td id="read"></td></tr>
+<tr><th>saved binlog</th><td id="saved"></td></tr>
+<tr><th>lag</th><td id="lag"></td></tr>
+<tr><th>insert / update / delete</th><td id="rows"></td></tr>
+<tr><th>bulk retries</th><td id="retries"></td></tr>
+<tr><th>sync</th><td><span id="state"></span> <button id="pause">pause</button> <button id="resume">resume</button></td></tr>
+<tr><th>dead letters</th><td id="dlq"></td></tr>
+<tr><th>re-dump</th><td><span id="redumping"></span> <input id="table" placeholder="schema.table"> <button id="redump">re-dump</button></td></tr>
+</table>
+<h3>Throughput (docs/s)</h3>
+<table id="rules"><tr><th>rule</th><th>docs</th><th>docs/s</th><th></th></tr></table>
+<h3>Recent errors</h3>
+<table id="errors"><tr><th>time</th><th>error</th></tr></table>
+<script>
+var ruleRates = {}, last = null, points = 60;
+
+function text(id, v) { document.getElementById(id).textContent = v; }
+
+function row(table, cells) {
+	var tr = table.insertRow();
+	cells.forEach(function(c) {
+		var td = tr.insertCell();
+		if (c instanceof Node) { td.appendChild(c); } else { td.textContent = c; }
+	});
+	return tr;
+}
+
+function clear(table) {
+	while (table.rows.length > 1) { table.deleteRow(1); }
+}
+
+function draw(rates) {
+	var canvas = document.createElement("canvas");
+	canvas.width = 240; canvas.height = 40;
+	var ctx = canvas.getContext("2d"), max = Math.max.apply(null, rates.concat([1]));
+	ctx.strokeStyle = "#36c";
+	ctx.beginPath();
+	rates.forEach(function(v, i) {
+		var x = i * canvas.width / (points - 1), y = canvas.height - v / max * (canvas.height - 2) - 1;
+		if (i == 0) { ctx.moveTo(x, y); } else { ctx.lineTo(x, y); }
+	});
+	ctx.stroke();
+	return canvas;
+}
+
+function update(d) {
+	text("read", d.read_position);
+	text("saved", d.saved_position);
+	text("lag", d.lag || "set heartbeat_table to measure the lag");
+	text("rows", d.insert_num + " / " + d.update_num + " / " + d.delete_num);
+	text("retries", d.bulk_retry_num);
+	text("state", d.paused ? "paused" : "running");
+	text("dlq", d.dlq ? d.dlq.docs + " docs, " + d.dlq.files + " files, " + d.dlq.size + " bytes in " + d.dlq.dir : "no dlq");
+	text("redumping", d.redump ? "re-dumping " + d.redump : "");
+
+	var rules = document.getElementById("rules"), t = new Date(d.time).getTime();
+	clear(rules);
+	d.rules.forEach(function(r) {
+		var h = ruleRates[r.rule] || (ruleRates[r.rule] = {docs: r.docs, rates: []});
+		if (last != null && t > last) {
+			h.rates.push(Math.max(0, (r.docs - h.docs) * 1000 / (t - last)));
+			if (h.rates.length > points) { h.rates.shift(); }
+		}
+		h.docs = r.docs;
+		var rate = h.rates.length ? h.rates[h.rates.length - 1].toFixed(1) : "";
+		row(rules, [r.rule, r.docs, rate, draw(h.rates)]);
+	});
+	last = t;
+
+	var errors = document.getElementById("errors");
+	clear(errors);
+	d.errors.slice().reverse().forEach(function(e) {
+		row(errors, [new Date(e.time).toLocaleString(), e.error]).className = "error";
+	});
+}
+
+function refresh() {
+	fetch("dashboard/data", {credentials: "same-origin"}).then(function(resp) {
+		return resp.json();
+	}).then(update).catch(function(err) { text("state", "error: " + err); });
+}
+
+function post(path) {
+	fetch(path, {method: "POST", credentials: "same-origin"}).then(function(resp) {
+		if (!resp.ok) {
+			resp.text().then(function(t) { alert(path + ": " + resp.status + " " + t); });
+		}
+		refresh();
+	});
+}
+
+document.getElementById("pause").onclick = function() { post("pause"); };
+document.getElementById("resume").onclick = function() { post("resume"); };
+document.getElementById("redump").onclick = function() {
+	var table = document.getElementById("table").value;
+	if (table && confirm("re-dump " + table + "?")) { post("redump?table=" + encodeURIComponent(table)); }
+};
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,71 @@
+package river
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/pingcap/check"
+)
+
+func (s *unitTestSuite) TestDashboard(c *C) {
+	r := &River{master: new(masterInfo)}
+	st := &stat{r: r}
+	r.st = st
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t"}
+	st.addRuleDocs(rule, 2)
+	st.addRuleDocs(rule, 3)
+	st.addRuleDocs(&Rule{Schema: "test", Table: "a", Index: "a"}, 1)
+	for i := 0; i < maxRecentErrors+5; i++ {
+		st.addError("err %d", i)
+	}
+
+	w := httptest.NewRecorder()
+	st.serveDashboard(w, httptest.NewRequest("GET", "/dashboard/data", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var d dashboardData
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &d), IsNil)
+	c.Assert(d.Rules, DeepEquals, []dashboardRule{{"test.a -> a", 1}, {"test.t -> t", 5}})
+	c.Assert(d.Errors, HasLen, maxRecentErrors)
+	c.Assert(d.Errors[0].Error, Equals, "err 5")
+	c.Assert(d.Paused, IsFalse)
+	c.Assert(d.DLQ, IsNil)
+	c.Assert(d.Redump, Equals, "")
+
+	dir, err := ioutil.TempDir("", "river_dashboard")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	r.dlq, err = newDeadLetters(&Config{DLQDir: dir, BulkClientError: BulkClientErrorDLQ})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "bulk-1.ndjson"), []byte("{}\n{}\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "rejected-1.ndjson"), []byte("{}\n"), 0644), IsNil)
+	st.DeadLetterNum.Add(2)
+	r.redumping.Set("test.t")
+	w = httptest.NewRecorder()
+	st.serveDashboard(w, httptest.NewRequest("GET", "/dashboard/data", nil))
+	d = dashboardData{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &d), IsNil)
+	c.Assert(d.DLQ, DeepEquals, &dashboardDLQ{Dir: dir, Docs: 2, Files: 2, Size: 9})
+	c.Assert(d.Redump, Equals, "test.t")
+
+	w = httptest.NewRecorder()
+	st.servePause(w, httptest.NewRequest("GET", "/pause", nil))
+	c.Assert(w.Code, Equals, http.StatusMethodNotAllowed)
+	st.servePause(httptest.NewRecorder(), httptest.NewRequest("POST", "/pause", nil))
+	c.Assert(r.paused.Get(), IsTrue)
+	st.serveResume(httptest.NewRecorder(), httptest.NewRequest("POST", "/resume", nil))
+	c.Assert(r.paused.Get(), IsFalse)
+
+	w = httptest.NewRecorder()
+	st.serveDashboard(w, httptest.NewRequest("GET", "/", nil))
+	c.Assert(strings.Contains(w.Body.String(), "dashboard/data"), IsTrue)
+	c.Assert(strings.Contains(w.Body.String(), "redump?table="), IsTrue)
+	w = httptest.NewRecorder()
+	st.serveDashboard(w, httptest.NewRequest("GET", "/unknown", nil))
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
@@ -0,0 +1,151 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// Actions taken for the DDL of the synced tables.
+const (
+	DDLActionAddRule       = "add_rule"
+	DDLActionUpdateRule    = "update_rule"
+	DDLActionUpdateMapping = "update_mapping"
+	DDLActionRenameRule    = "rename_rule"
+	DDLActionTruncate      = "truncate"
+	DDLActionSkip          = "skip"
+	DDLActionNone          = "none"
+)
+
+type ddlRecord struct {
+	Time           string   `json:"@timestamp"`
+	Schema         string   `json:"schema"`
+	Table          string   `json:"table"`
+	Statement      string   `json:"statement"`
+	Actions        []string `json:"actions"`
+	Truncate       string   `json:"truncate,omitempty"`
+	AddedColumns   []string `json:"added_columns,omitempty"`
+	DroppedColumns []string `json:"dropped_columns,omitempty"`
+	BinlogFile     string   `json:"binlog_file"`
+	BinlogPos      uint32   `json:"binlog_pos"`
+	GTID           string   `json:"gtid,omitempty"`
+	// empty for the MySQL of my_addr
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// ddlLog records the DDL of the synced tables and the actions taken for them
+// into the append-only file and the ES index.
+type ddlLog struct {
+	f     *os.File
+	index string
+}
+
+func newDDLLog(c *Config) (*ddlLog, error) {
+	if len(c.DDLLogFile) == 0 && len(c.DDLLogIndex) == 0 {
+		return nil, nil
+	}
+
+	l := &ddlLog{index: c.DDLLogIndex}
+	if len(c.DDLLogFile) > 0 {
+		f, err := os.OpenFile(c.DDLLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		l.f = f
+	}
+	return l, nil
+}
+
+// write writes the record, and returns the request to index it.
+func (l *ddlLog) write(record *ddlRecord) (*elastic.BulkRequest, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if l.f != nil {
+		if _, err = l.f.Write(append(data, '\n')); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if len(l.index) == 0 {
+		return nil, nil
+	}
+	req := elastic.NewBulkRequest()
+	req.Action = elastic.ActionIndex
+	req.Index = l.index
+	// replaying the binlog doesn't duplicate the records
+	req.ID = fmt.Sprintf("%s-%d-%s-%s", record.BinlogFile, record.BinlogPos, record.Schema, record.Table)
+	if len(record.Upstream) > 0 {
+		// the binlog positions of the upstreams may be the same
+		req.ID = record.Upstream + "-" + req.ID
+	}
+	req.Data = elastic.NewBulkData()
+	if err = json.Unmarshal(data, &req.Data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return req, nil
+}
+
+func (l *ddlLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return errors.Trace(l.f.Close())
+}
+
+// diffColumns returns the columns added and dropped from before to after.
+func diffColumns(before, after *schema.Table) ([]string, []string) {
+	if before == nil || after == nil {
+		return nil, nil
+	}
+
+	var added, dropped []string
+	for _, col := range after.Columns {
+		if before.FindColumn(col.Name) < 0 {
+			added = append(added, col.Name)
+		}
+	}
+	for _, col := range before.Columns {
+		if after.FindColumn(col.Name) < 0 {
+			dropped = append(dropped, col.Name)
+		}
+	}
+	return added, dropped
+}
+
+// logDDL writes the record of the current DDL if its table is synced, and sends
+// the request to index it before the position is saved.
+func (h *eventHandler) logDDL(nextPos mysql.Position, query []byte) error {
+	record := h.ddl
+	h.ddl = nil
+	if record == nil {
+		return nil
+	}
+
+	record.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	record.Statement = string(query)
+	record.BinlogFile = nextPos.Name
+	record.BinlogPos = nextPos.Pos
+	record.GTID = h.gtid
+	record.Upstream = h.r.name
+	if len(record.Actions) == 0 {
+		record.Actions = []string{DDLActionNone}
+	}
+
+	req, err := h.r.ddlLog.write(record)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if req != nil {
+		h.r.syncCh <- []*elastic.BulkRequest{req}
+	}
+	return nil
+}
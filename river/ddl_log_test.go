@@ -0,0 +1,58 @@
+package river
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestDDLLog(c *C) {
+	before := &schema.Table{Schema: "test", Name: "t"}
+	before.AddColumn("id", "int(11)", "", "")
+	before.AddColumn("old", "int(11)", "", "")
+	after := &schema.Table{Schema: "test", Name: "t"}
+	after.AddColumn("id", "int(11)", "", "")
+	after.AddColumn("name", "varchar(256)", "", "")
+	added, dropped := diffColumns(before, after)
+	c.Assert(added, DeepEquals, []string{"name"})
+	c.Assert(dropped, DeepEquals, []string{"old"})
+
+	dir, err := ioutil.TempDir("", "ddl_log")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{DDLLogFile: filepath.Join(dir, "ddl.log"), DDLLogIndex: "river-ddl"}
+	r := &River{c: cfg, syncCh: make(chan interface{}, 1)}
+	r.ddlLog, err = newDDLLog(cfg)
+	c.Assert(err, IsNil)
+	defer r.ddlLog.Close()
+	h := &eventHandler{r: r, gtid: "uuid:1"}
+
+	// not synced
+	c.Assert(h.logDDL(mysql.Position{Name: "mysql-bin.000001", Pos: 100}, []byte("DROP TABLE x")), IsNil)
+	c.Assert(r.syncCh, HasLen, 0)
+
+	h.ddl = &ddlRecord{Schema: "test", Table: "t", Actions: []string{DDLActionUpdateRule}, AddedColumns: added}
+	c.Assert(h.logDDL(mysql.Position{Name: "mysql-bin.000001", Pos: 200}, []byte("ALTER TABLE t ADD name varchar(256)")), IsNil)
+	c.Assert(h.ddl, IsNil)
+	reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Index, Equals, "river-ddl")
+	c.Assert(reqs[0].ID, Equals, "mysql-bin.000001-200-test-t")
+	c.Assert(reqs[0].Data["added_columns"], DeepEquals, []interface{}{"name"})
+
+	data, err := ioutil.ReadFile(cfg.DDLLogFile)
+	c.Assert(err, IsNil)
+	var record ddlRecord
+	c.Assert(json.Unmarshal(data, &record), IsNil)
+	c.Assert(record.Statement, Equals, "ALTER TABLE t ADD name varchar(256)")
+	c.Assert(record.Actions, DeepEquals, []string{DDLActionUpdateRule})
+	c.Assert(record.BinlogPos, Equals, uint32(200))
+	c.Assert(record.GTID, Equals, "uuid:1")
+}
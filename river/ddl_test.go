@@ -0,0 +1,38 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+)
+
+func (s *unitTestSuite) TestParseRenameTable(c *C) {
+	tbls := []struct {
+		query string
+		pairs [][2][2]string
+	}{
+		{"RENAME TABLE t1 TO t2", [][2][2]string{{{"test", "t1"}, {"test", "t2"}}}},
+		{"rename table `test`.`t1` to `test2`.`t2`, t3 TO t4;", [][2][2]string{
+			{{"test", "t1"}, {"test2", "t2"}},
+			{{"test", "t3"}, {"test", "t4"}},
+		}},
+		{"ALTER TABLE t1 RENAME TO t2", [][2][2]string{{{"test", "t1"}, {"test", "t2"}}}},
+		{"ALTER TABLE `t1` RENAME `test2`.`t2`", [][2][2]string{{{"test", "t1"}, {"test2", "t2"}}}},
+		{"ALTER TABLE t1 RENAME COLUMN a TO b", nil},
+		{"ALTER TABLE t1 ADD COLUMN a INT", nil},
+	}
+
+	for _, t := range tbls {
+		c.Assert(parseRenameTable("test", t.query), DeepEquals, t.pairs, Commentf("query %s", t.query))
+	}
+}
+
+func (s *unitTestSuite) TestTruncateTable(c *C) {
+	mb := expTruncateTable.FindStringSubmatch("TRUNCATE TABLE `test`.`t1`")
+	c.Assert(mb, HasLen, 3)
+	c.Assert(mb[1], Equals, "test")
+	c.Assert(mb[2], Equals, "t1")
+
+	mb = expTruncateTable.FindStringSubmatch("truncate t2")
+	c.Assert(mb, HasLen, 3)
+	c.Assert(mb[1], Equals, "")
+	c.Assert(mb[2], Equals, "t2")
+}
@@ -0,0 +1,72 @@
+package river
+
+import (
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+type docKey struct {
+	cluster string
+	index   string
+	typ     string
+	id      string
+	parent  string
+	routing string
+}
+
+// dedupRequests collapses the requests of the same doc to its final state, the index
+// and delete requests supersede all the earlier ones, and the partial updates are merged
+// into the earlier index or partial update. The scripted updates and the others are kept,
+// so are the requests without id.
+// The result is a new slice, the requests are still in reqs to be released.
+func dedupRequests(reqs []*elastic.BulkRequest) []*elastic.BulkRequest {
+	out := make([]*elastic.BulkRequest, 0, len(reqs))
+	// positions in out of the kept requests of the doc
+	docs := make(map[docKey][]int, len(reqs))
+	removed := 0
+
+	for _, req := range reqs {
+		if len(req.ID) == 0 {
+			// the ids are generated by ES, every request is a new doc
+			out = append(out, req)
+			continue
+		}
+		key := docKey{req.Cluster, req.Index, req.Type, req.ID, req.Parent, req.Routing}
+		kept := docs[key]
+
+		switch {
+		case len(kept) == 0:
+		case req.Action == elastic.ActionIndex || req.Action == elastic.ActionDelete:
+			for _, i := range kept {
+				out[i] = nil
+			}
+			removed += len(kept)
+			kept = kept[:0]
+		case req.Action == elastic.ActionUpdate && req.Script == nil:
+			last := out[kept[len(kept)-1]]
+			if last.Action == elastic.ActionIndex ||
+				last.Action == elastic.ActionUpdate && last.Script == nil &&
+					last.Upsert == req.Upsert && last.Pipeline == req.Pipeline {
+				for k, v := range req.Data {
+					last.Data[k] = v
+				}
+				continue
+			}
+		}
+
+		docs[key] = append(kept, len(out))
+		out = append(out, req)
+	}
+
+	if removed == 0 {
+		return out
+	}
+
+	n := 0
+	for _, req := range out {
+		if req != nil {
+			out[n] = req
+			n++
+		}
+	}
+	return out[:n]
+}
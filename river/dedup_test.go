@@ -0,0 +1,38 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestDedupRequests(c *C) {
+	index := func(id string, data map[string]interface{}) *elastic.BulkRequest {
+		return &elastic.BulkRequest{Action: elastic.ActionIndex, Index: "t", ID: id, Data: data}
+	}
+	update := func(id string, data map[string]interface{}) *elastic.BulkRequest {
+		return &elastic.BulkRequest{Action: elastic.ActionUpdate, Index: "t", ID: id, Data: data}
+	}
+	del := &elastic.BulkRequest{Action: elastic.ActionDelete, Index: "t", ID: "2"}
+	script := &elastic.BulkRequest{Action: elastic.ActionUpdate, Index: "t", ID: "3", Script: map[string]interface{}{"source": ""}}
+
+	reqs := []*elastic.BulkRequest{
+		index("1", map[string]interface{}{"a": 1, "b": 1}),
+		update("1", map[string]interface{}{"a": 2}),
+		index("2", map[string]interface{}{"a": 1}),
+		update("3", map[string]interface{}{"a": 1}),
+		update("1", map[string]interface{}{"b": 3}),
+		del,
+		script,
+		update("3", map[string]interface{}{"b": 1}),
+	}
+	out := dedupRequests(reqs)
+	c.Assert(out, HasLen, 5)
+	c.Assert(out[0].ID, Equals, "1")
+	c.Assert(out[0].Data, DeepEquals, map[string]interface{}{"a": 2, "b": 3})
+	c.Assert(out[1].ID, Equals, "3")
+	c.Assert(out[1].Data, DeepEquals, map[string]interface{}{"a": 1})
+	c.Assert(out[2], Equals, del)
+	c.Assert(out[3], Equals, script)
+	// the update after the script is not merged before it
+	c.Assert(out[4], Equals, reqs[7])
+}
@@ -0,0 +1,97 @@
+package river
+
+import (
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+// DeleteByQueryAction in [rule.action] maps the MySQL delete to a delete_by_query of the docs
+// matching the delete_query columns of the deleted row, for the rules whose doc id is not the PK.
+const DeleteByQueryAction = "delete_by_query"
+
+// deleteQueries are sent after the requests of the same rows event, the requests before
+// them are sent first, so the deleted docs are not written again by the earlier bulks.
+type deleteQueries []*deleteQuery
+
+// deleteQuery is a delete_by_query of the deleted rows of a rule, it is queued as it is.
+type deleteQuery struct {
+	Cluster string                 `json:"cluster,omitempty"`
+	Index   string                 `json:"index"`
+	Type    string                 `json:"type"`
+	Query   map[string]interface{} `json:"query"`
+}
+
+// deletesByQuery returns true if the deletes of the rule are mapped to delete_by_query.
+func (r *Rule) deletesByQuery() bool {
+	return r.ActionMapping[canal.DeleteAction] == DeleteByQueryAction
+}
+
+// makeDeleteQuery makes the query of the docs of the deleted rows, a doc matches if all
+// the fields of the delete_query columns are the values of a row.
+func (r *River) makeDeleteQuery(rule *Rule, rows [][]interface{}) (*deleteQuery, error) {
+	fields := make([]*ruleField, 0, len(rule.DeleteQuery))
+	for _, column := range rule.DeleteQuery {
+		var field *ruleField
+		for i := range rule.fields {
+			f := &rule.fields[i]
+			if f.compute == nil && !f.derived && rule.TableInfo.Columns[f.column].Name == column {
+				field = f
+				break
+			}
+		}
+		if field == nil {
+			return nil, errors.Errorf("column %s of delete_query is not synced for rule %s.%s", column, rule.Schema, rule.Table)
+		}
+		fields = append(fields, field)
+	}
+
+	should := make([]interface{}, 0, len(rows))
+	for _, values := range rows {
+		filter := make([]interface{}, 0, len(fields))
+		for _, f := range fields {
+			value := f.label(f.value(rule, values))
+			if value == nil {
+				// a null column matches no doc by term, the doc has no such field
+				filter = append(filter, map[string]interface{}{
+					"bool": map[string]interface{}{
+						"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": f.esField}},
+					},
+				})
+				continue
+			}
+			filter = append(filter, map[string]interface{}{"term": map[string]interface{}{f.esField: value}})
+		}
+		should = append(should, map[string]interface{}{"bool": map[string]interface{}{"filter": filter}})
+	}
+
+	return &deleteQuery{
+		Cluster: rule.Cluster,
+		Index:   rule.indexPattern(),
+		Type:    rule.Type,
+		Query: map[string]interface{}{
+			"bool": map[string]interface{}{"should": should, "minimum_should_match": 1},
+		},
+	}, nil
+}
+
+// doDeleteQueries deletes the docs of the deleted rows by the queries.
+func (r *River) doDeleteQueries(queries []*deleteQuery) error {
+	if r.sink != nil {
+		log.Warnf("skip %d delete_by_query, they are not supported with sink %s", len(queries), r.c.Sink)
+		return nil
+	}
+
+	for _, q := range queries {
+		es := r.esClient(q.Cluster)
+		// the docs written by the bulks before are not searched until the refresh
+		if err := es.Refresh(q.Index); err != nil {
+			return errors.Annotatef(err, "refresh index %s", q.Index)
+		}
+		if err := es.DeleteByQuery(q.Index, q.Type, q.Query); err != nil {
+			return errors.Annotatef(err, "delete_by_query of index %s", q.Index)
+		}
+		r.st.DeleteNum.Add(1)
+	}
+	return nil
+}
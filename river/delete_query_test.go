@@ -0,0 +1,86 @@
+package river
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestDeleteByQuery(c *C) {
+	var reqs []string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		reqs = append(reqs, req.Method+" "+req.URL.Path+" "+string(body))
+	}))
+	defer es.Close()
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("user_id", "int(11)", "", "")
+	ta.AddColumn("day", "varchar(10)", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "t", Index: "daily", Type: "_doc", TableInfo: ta,
+		ActionMapping: map[string]string{canal.DeleteAction: DeleteByQueryAction},
+		FieldMapping:  map[string]string{"user_id": "user"}, DeleteQuery: []string{"user_id", "day"}}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.deletesByQuery(), IsTrue)
+
+	r := &River{c: &Config{}, ctx: context.Background(), st: &stat{}, syncCh: make(chan interface{}, 4),
+		rules: map[string]*Rule{ruleKey("test", "t"): rule}, limits: newRateLimits(0, 0)}
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	r.setFieldMapping(rule)
+
+	// the deletes are sent after the other requests of the event, no doc is deleted by id
+	h := &eventHandler{r: r}
+	e := &canal.RowsEvent{Action: canal.DeleteAction, Table: ta,
+		Rows: [][]interface{}{{int32(1), int32(7), "2024-01-02"}, {int32(2), int32(8), nil}}, Header: &replication.EventHeader{LogPos: 120}}
+	c.Assert(h.OnRow(e), IsNil)
+	c.Assert(r.syncCh, HasLen, 1)
+	queries, ok := (<-r.syncCh).(deleteQueries)
+	c.Assert(ok, IsTrue)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].Index, Equals, "daily")
+
+	c.Assert(r.doDeleteQueries(queries), IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0], Equals, "POST /daily/_refresh ")
+	c.Assert(reqs[1], Matches, "POST /daily/_doc/_delete_by_query .*")
+	var body map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(strings.SplitN(reqs[1], " ", 3)[2]), &body), IsNil)
+	expected := `{"query":{"bool":{"minimum_should_match":1,"should":[` +
+		`{"bool":{"filter":[{"term":{"user":7}},{"term":{"day":"2024-01-02"}}]}},` +
+		`{"bool":{"filter":[{"term":{"user":8}},{"bool":{"must_not":{"exists":{"field":"day"}}}}]}}]}}}`
+	data, _ := json.Marshal(body)
+	c.Assert(string(data), Equals, expected)
+	c.Assert(r.st.DeleteNum.Get(), Equals, int64(1))
+
+	// the inserts are still indexed by id
+	e = &canal.RowsEvent{Action: canal.InsertAction, Table: ta, Rows: [][]interface{}{{int32(3), int32(9), "2024-01-03"}},
+		Header: &replication.EventHeader{LogPos: 160}}
+	c.Assert(h.OnRow(e), IsNil)
+	_, ok = (<-r.syncCh).([]*elastic.BulkRequest)
+	c.Assert(ok, IsTrue)
+
+	// the columns must be synced
+	rule.DeleteQuery = []string{"missing"}
+	_, err := r.makeDeleteQuery(rule, e.Rows)
+	c.Assert(err, NotNil)
+
+	for _, bad := range []*Rule{
+		{Schema: "test", Table: "t", ActionMapping: map[string]string{canal.DeleteAction: DeleteByQueryAction}},
+		{Schema: "test", Table: "t", ActionMapping: map[string]string{canal.UpdateAction: DeleteByQueryAction}, DeleteQuery: []string{"id"}},
+		{Schema: "test", Table: "t", ActionMapping: map[string]string{canal.DeleteAction: DeleteByQueryAction}, DeleteQuery: []string{"id"},
+			DeleteMode: DeleteModeTombstone},
+	} {
+		c.Assert(bad.prepare(), NotNil)
+	}
+}
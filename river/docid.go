@@ -0,0 +1,260 @@
+package river
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash"
+	"github.com/juju/errors"
+	"github.com/satori/go.uuid"
+)
+
+// How to hash the doc id for the rule.
+const (
+	IDHashSHA1   = "sha1"
+	IDHashXXHash = "xxhash"
+)
+
+// How to encode the doc id for the rule.
+const (
+	IDEncodingHex       = "hex"
+	IDEncodingBase64URL = "base64url"
+)
+
+// How to format the binary id and parent columns for the rule.
+const (
+	IDFormatHex       = "hex"
+	IDFormatUUID      = "uuid"
+	IDFormatBase64URL = "base64url"
+)
+
+// idTemplatePart is a literal or a column of the id template.
+type idTemplatePart struct {
+	literal string
+	column  string
+}
+
+// parseIDTemplate parses the id template like "{tenant_id}-{order_id}".
+func parseIDTemplate(tmpl string) ([]idTemplatePart, error) {
+	var parts []idTemplatePart
+	for len(tmpl) > 0 {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			if strings.IndexByte(tmpl, '}') >= 0 {
+				return nil, errors.Errorf("unexpected } in id template")
+			}
+			parts = append(parts, idTemplatePart{literal: tmpl})
+			break
+		}
+		if start > 0 {
+			if strings.IndexByte(tmpl[:start], '}') >= 0 {
+				return nil, errors.Errorf("unexpected } in id template")
+			}
+			parts = append(parts, idTemplatePart{literal: tmpl[:start]})
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			return nil, errors.Errorf("unclosed { in id template")
+		}
+		column := tmpl[start+1 : start+end]
+		if len(column) == 0 || strings.IndexByte(column, '{') >= 0 {
+			return nil, errors.Errorf("invalid column %q in id template", column)
+		}
+		parts = append(parts, idTemplatePart{column: column})
+		tmpl = tmpl[start+end+1:]
+	}
+	if len(parts) == 0 {
+		return nil, errors.Errorf("empty id template")
+	}
+	return parts, nil
+}
+
+// idBufferPool reuses the buffers to build the doc ids, which is hot in the dump.
+var idBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func (r *River) getDocID(rule *Rule, row []interface{}) (string, error) {
+	buf := idBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer idBufferPool.Put(buf)
+
+	if len(rule.idTemplate) > 0 {
+		for _, part := range rule.idTemplate {
+			if len(part.column) == 0 {
+				buf.WriteString(part.literal)
+				continue
+			}
+			value, err := rule.TableInfo.GetColumnValue(part.column, row)
+			if err != nil {
+				return "", err
+			}
+			if value == nil {
+				return "", errors.Errorf("The id column %s value is nil", part.column)
+			}
+			if err = writeIDValue(buf, rule, part.column, value); err != nil {
+				return "", errors.Trace(err)
+			}
+		}
+	} else if rule.ID == nil {
+		ta := rule.TableInfo
+		if len(ta.PKColumns) == 0 {
+			return "", errors.Errorf("table %s has no PK", ta)
+		} else if len(ta.Columns) != len(row) {
+			return "", errors.Errorf("table %s has %d columns, but row data %v len is %d", ta,
+				len(ta.Columns), row, len(row))
+		}
+		for i, index := range ta.PKColumns {
+			if row[index] == nil {
+				return "", errors.Errorf("The %ds id or PK value is nil", i)
+			}
+			if i > 0 {
+				buf.WriteString(rule.IDSeparator)
+			}
+			if err := writeIDValue(buf, rule, ta.Columns[index].Name, row[index]); err != nil {
+				return "", errors.Trace(err)
+			}
+		}
+	} else {
+		for i, column := range rule.ID {
+			value, err := rule.TableInfo.GetColumnValue(column, row)
+			if err != nil {
+				return "", err
+			}
+			if value == nil {
+				return "", errors.Errorf("The %ds id or PK value is nil", i)
+			}
+			if i > 0 {
+				buf.WriteString(rule.IDSeparator)
+			}
+			if err = writeIDValue(buf, rule, column, value); err != nil {
+				return "", errors.Trace(err)
+			}
+		}
+	}
+
+	id := buf.Bytes()
+	switch rule.IDHash {
+	case IDHashSHA1:
+		sum := sha1.Sum(id)
+		id = sum[:]
+	case IDHashXXHash:
+		sum := xxhash.Sum64(id)
+		id = []byte{byte(sum >> 56), byte(sum >> 48), byte(sum >> 40), byte(sum >> 32),
+			byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+	}
+
+	switch rule.IDEncoding {
+	case IDEncodingHex:
+		return hex.EncodeToString(id), nil
+	case IDEncodingBase64URL:
+		return base64.RawURLEncoding.EncodeToString(id), nil
+	default:
+		return string(id), nil
+	}
+}
+
+func (r *River) getParentID(rule *Rule, row []interface{}, columnName string) (string, error) {
+	index := rule.TableInfo.FindColumn(columnName)
+	if index < 0 {
+		return "", errors.Errorf("parent id not found %s(%s)", rule.TableInfo.Name, columnName)
+	}
+
+	if row[index] == nil {
+		return fmt.Sprint(row[index]), nil
+	}
+	buf := idBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer idBufferPool.Put(buf)
+	if err := writeIDValue(buf, rule, columnName, row[index]); err != nil {
+		return "", errors.Trace(err)
+	}
+	return buf.String(), nil
+}
+
+// getRouting returns the routing of the row, empty if the rule has no routing or it is NULL.
+func (r *River) getRouting(rule *Rule, row []interface{}) (string, error) {
+	if len(rule.Routing) == 0 {
+		return "", nil
+	}
+	index := rule.TableInfo.FindColumn(rule.Routing)
+	if index < 0 {
+		return "", errors.Errorf("routing column not found %s(%s)", rule.TableInfo.Name, rule.Routing)
+	} else if row[index] == nil {
+		return "", nil
+	}
+	return r.getParentID(rule, row, rule.Routing)
+}
+
+// writePlainIDValue writes the value same as fmt "%v", the common types of the
+// PK are written without fmt.
+func writePlainIDValue(buf *bytes.Buffer, value interface{}) {
+	var scratch [20]byte
+	switch v := value.(type) {
+	case string:
+		buf.WriteString(v)
+	case int:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(v), 10))
+	case int8:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(v), 10))
+	case int16:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(v), 10))
+	case int32:
+		buf.Write(strconv.AppendInt(scratch[:0], int64(v), 10))
+	case int64:
+		buf.Write(strconv.AppendInt(scratch[:0], v, 10))
+	case uint:
+		buf.Write(strconv.AppendUint(scratch[:0], uint64(v), 10))
+	case uint8:
+		buf.Write(strconv.AppendUint(scratch[:0], uint64(v), 10))
+	case uint16:
+		buf.Write(strconv.AppendUint(scratch[:0], uint64(v), 10))
+	case uint32:
+		buf.Write(strconv.AppendUint(scratch[:0], uint64(v), 10))
+	case uint64:
+		buf.Write(strconv.AppendUint(scratch[:0], v, 10))
+	default:
+		// like the []byte written as "[49 50]", the ids must not change
+		fmt.Fprintf(buf, "%v", value)
+	}
+}
+
+// writeIDValue writes the id or parent column value in the format of id_format,
+// the binary values like BINARY(16) UUID are unreadable without a format.
+func writeIDValue(buf *bytes.Buffer, rule *Rule, column string, value interface{}) error {
+	format := rule.IDFormat[column]
+	if len(format) == 0 {
+		writePlainIDValue(buf, value)
+		return nil
+	}
+
+	var b []byte
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.Errorf("id column %s value %v is not binary for id_format %s", column, value, format)
+	}
+
+	switch format {
+	case IDFormatHex:
+		buf.WriteString(hex.EncodeToString(b))
+	case IDFormatBase64URL:
+		buf.WriteString(base64.RawURLEncoding.EncodeToString(b))
+	case IDFormatUUID:
+		u, err := uuid.FromBytes(b)
+		if err != nil {
+			return errors.Errorf("id column %s value is not a binary UUID: %v", column, err)
+		}
+		buf.WriteString(u.String())
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+
+	. "github.com/pingcap/check"
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestPlainIDValue(c *C) {
+	values := []interface{}{"abc", int(-1), int8(-8), int16(16), int32(-32), int64(-1) << 63, uint(1), uint8(255),
+		uint16(16), uint32(32), uint64(1) << 63, []byte("12"), 1.5, decimal.New(125, -1)}
+	for _, v := range values {
+		var buf bytes.Buffer
+		writePlainIDValue(&buf, v)
+		c.Assert(buf.String(), Equals, fmt.Sprintf("%v", v))
+	}
+
+	// the buffers are reused
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "bigint(20)", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+	r := new(River)
+	for i := int64(0); i < 3; i++ {
+		id, err := r.getDocID(rule, []interface{}{i})
+		c.Assert(err, IsNil)
+		c.Assert(id, Equals, fmt.Sprint(i))
+	}
+	_, err := r.getDocID(rule, []interface{}{nil})
+	c.Assert(err, NotNil)
+	_, err = r.getDocID(rule, []interface{}{1, 2})
+	c.Assert(err, NotNil)
+}
+
+func (s *unitTestSuite) TestDocID(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("tenant_id", "int(11)", "", "")
+	ta.AddColumn("order_id", "int(11)", "", "")
+	ta.PKColumns = []int{0, 1}
+	row := []interface{}{int32(3), int32(42)}
+
+	r := new(River)
+	rule := &Rule{Schema: "test", Table: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+	id, err := r.getDocID(rule, row)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "3:42")
+
+	rule.IDTemplate = "{tenant_id}-{order_id}"
+	c.Assert(rule.prepare(), IsNil)
+	id, err = r.getDocID(rule, row)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "3-42")
+
+	rule.IDHash = IDHashSHA1
+	c.Assert(rule.prepare(), IsNil)
+	id, err = r.getDocID(rule, row)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "593e9d994264b9013341a7dab0b20f78ef5ed05c")
+
+	rule.IDHash = IDHashXXHash
+	rule.IDEncoding = IDEncodingBase64URL
+	c.Assert(rule.prepare(), IsNil)
+	id, err = r.getDocID(rule, row)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "lQvnkPnckog")
+
+	ta = &schema.Table{Schema: "test", Name: "u"}
+	ta.AddColumn("uuid", "binary(16)", "", "")
+	ta.AddColumn("parent", "binary(16)", "", "")
+	ta.PKColumns = []int{0}
+	b := "\x6b\xa7\xb8\x10\x9d\xad\x11\xd1\x80\xb4\x00\xc0\x4f\xd4\x30\xc8"
+	row = []interface{}{b, []byte(b)}
+	rule = &Rule{Schema: "test", Table: "u", TableInfo: ta, IDFormat: map[string]string{"uuid": IDFormatUUID, "parent": IDFormatHex}}
+	c.Assert(rule.prepare(), IsNil)
+	id, err = r.getDocID(rule, row)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	id, err = r.getParentID(rule, row, "parent")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "6ba7b8109dad11d180b400c04fd430c8")
+
+	rule.IDFormat["uuid"] = "base32"
+	c.Assert(rule.prepare(), NotNil)
+
+	for _, tmpl := range []string{"{tenant_id", "tenant_id}", "{}", "{a{b}"} {
+		_, err = parseIDTemplate(tmpl)
+		c.Assert(err, NotNil, Commentf("%s", tmpl))
+	}
+}
@@ -0,0 +1,75 @@
+package river
+
+import (
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// dumpCleanup is sent after all the dumped rows, the docs which are not
+// written by the dump are deleted from the indices then.
+type dumpCleanup struct {
+	indices []*dumpCleanupIndex
+}
+
+// dumpCleanupIndex is an index of the dump_cleanup rules, it is queued as it is.
+type dumpCleanupIndex struct {
+	Cluster    string `json:"cluster,omitempty"`
+	Index      string `json:"index"`
+	Type       string `json:"type"`
+	Field      string `json:"field"`
+	Generation int64  `json:"generation"`
+}
+
+// dumpCleanupIndices returns the indices of the dump_cleanup rules, one for the rules with
+// the same index, type and generation field.
+func (r *River) dumpCleanupIndices() []*dumpCleanupIndex {
+	var indices []*dumpCleanupIndex
+	seen := make(map[dumpCleanupIndex]bool)
+	for _, rule := range r.allRules() {
+		if !rule.DumpCleanup {
+			continue
+		}
+		index := dumpCleanupIndex{rule.Cluster, rule.indexPattern(), rule.Type, rule.DumpGenerationField, r.dumpGeneration}
+		if seen[index] {
+			continue
+		}
+		seen[index] = true
+		indices = append(indices, &index)
+	}
+	return indices
+}
+
+// tagDumpGeneration sets the generation of the dump to the docs of the dumped rows.
+func (r *River) tagDumpGeneration(rule *Rule, reqs []*elastic.BulkRequest) {
+	for _, req := range reqs {
+		if req.Action == elastic.ActionDelete || req.Data == nil {
+			continue
+		}
+		req.Data[rule.DumpGenerationField] = r.dumpGeneration
+	}
+}
+
+// doDumpCleanup deletes the docs of the older dumps, which are not updated by this dump,
+// so their rows were deleted in MySQL while the river was down.
+func (r *River) doDumpCleanup(indices []*dumpCleanupIndex) error {
+	if r.sink != nil {
+		log.Warnf("the dump is done, but dump_cleanup is not supported with sink %s", r.c.Sink)
+		return nil
+	}
+
+	for _, index := range indices {
+		log.Infof("dump is done, delete the docs of the older dumps in index %s, type %s", index.Index, index.Type)
+		query := map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must_not": map[string]interface{}{
+					"term": map[string]interface{}{index.Field: index.Generation},
+				},
+			},
+		}
+		if err := r.esClient(index.Cluster).DeleteByQuery(index.Index, index.Type, query); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
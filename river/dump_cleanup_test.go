@@ -0,0 +1,58 @@
+package river
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestDumpCleanup(c *C) {
+	bodies := make(chan string, 4)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- req.URL.Path + " " + string(body)
+		w.Write([]byte(`{"deleted":1}`))
+	}))
+	defer es.Close()
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.PKColumns = []int{0}
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", Type: "t", TableInfo: ta, DumpCleanup: true}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.DumpGenerationField, Equals, "dump_generation")
+	other := &Rule{Schema: "test", Table: "t", Index: "t", Type: "t", TableInfo: ta, DumpCleanup: true}
+	c.Assert(other.prepare(), IsNil)
+	rule.fanout = []*Rule{other, {Schema: "test", Table: "t", Index: "t2"}}
+
+	r := &River{c: &Config{}, st: &stat{}, ctx: context.Background(), syncCh: make(chan interface{}, 4),
+		rules: map[string]*Rule{ruleKey("test", "t"): rule}, dumpGeneration: 1500000000000}
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	r.setFieldMapping(rule)
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int32(1), "a"}})
+	c.Assert(err, IsNil)
+	r.tagDumpGeneration(rule, reqs)
+	c.Assert(reqs[0].Data["dump_generation"], Equals, int64(1500000000000))
+	c.Assert(r.makeRuleMapping(rule)["dump_generation"], DeepEquals, map[string]interface{}{"type": "long"})
+
+	// the cleanup is sent once after the dump, the rules with the same index are merged
+	h := &eventHandler{r: r}
+	c.Assert(h.OnPosSynced(mysql.Position{Name: "mysql-bin.000001", Pos: 4}, true), IsNil)
+	c.Assert(h.OnPosSynced(mysql.Position{Name: "mysql-bin.000001", Pos: 4}, true), IsNil)
+	c.Assert(r.syncCh, HasLen, 1)
+	cleanup := (<-r.syncCh).(dumpCleanup)
+	c.Assert(cleanup.indices, HasLen, 1)
+
+	c.Assert(r.doDumpCleanup(cleanup.indices), IsNil)
+	c.Assert(<-bodies, Equals, `/t/t/_delete_by_query {"query":{"bool":{"must_not":{"term":{"dump_generation":1500000000000}}}}}`)
+}
@@ -0,0 +1,37 @@
+package river
+
+import (
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/dump"
+)
+
+type dumpColumnsHandler struct {
+	columns [][]string
+	values  [][]string
+}
+
+func (h *dumpColumnsHandler) BinLog(name string, pos uint64) error {
+	return nil
+}
+
+func (h *dumpColumnsHandler) Data(schema string, table string, values []string) error {
+	return h.DataColumns(schema, table, nil, values)
+}
+
+func (h *dumpColumnsHandler) DataColumns(schema string, table string, columns []string, values []string) error {
+	h.columns = append(h.columns, columns)
+	h.values = append(h.values, values)
+	return nil
+}
+
+func (s *unitTestSuite) TestDumpInvisibleColumns(c *C) {
+	data := "USE `test`;\n" +
+		"INSERT INTO `t` VALUES (1,'a');\n" +
+		"INSERT INTO `t` (`id`,`name`,`hidden``col`) VALUES (2,'b',3);\n"
+	h := &dumpColumnsHandler{}
+	c.Assert(dump.Parse(strings.NewReader(data), h, false), IsNil)
+	c.Assert(h.columns, DeepEquals, [][]string{nil, {"id", "name", "hidden`col"}})
+	c.Assert(h.values, DeepEquals, [][]string{{"1", "'a'"}, {"2", "'b'", "3"}})
+}
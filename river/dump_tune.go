@@ -0,0 +1,153 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go/ioutil2"
+)
+
+// indexSettings is the original settings of an index tuned for dump,
+// empty value means the setting is not set and uses the default.
+type indexSettings struct {
+	RefreshInterval  string `toml:"refresh_interval"`
+	NumberOfReplicas string `toml:"number_of_replicas"`
+}
+
+// dumpTuner tunes the indices for bulk loading while dumping, the original
+// settings are saved in data dir, so they are restored correctly even if
+// the river is restarted in the middle of dump.
+type dumpTuner struct {
+	r       *River
+	cluster string
+
+	filePath string
+	Indices  map[string]*indexSettings `toml:"indices"`
+}
+
+func newDumpTuner(r *River, cluster string) (*dumpTuner, error) {
+	t := new(dumpTuner)
+	t.r = r
+	t.cluster = cluster
+	t.Indices = make(map[string]*indexSettings)
+
+	if len(r.c.DataDir) == 0 {
+		return t, nil
+	}
+
+	name := "dump_index.info"
+	if len(cluster) > 0 {
+		name = fmt.Sprintf("dump_index_%s.info", cluster)
+	}
+	t.filePath = path.Join(r.c.DataDir, name)
+	if _, err := toml.DecodeFile(t.filePath, t); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Trace(err)
+	}
+	return t, nil
+}
+
+// willDump returns true if canal will dump, same as the check in canal.
+func (r *River) willDump() bool {
+	pos := r.master.Position()
+	return len(r.c.DumpExec) > 0 && (len(pos.Name) == 0 || pos.Pos == 0)
+}
+
+func (t *dumpTuner) save() error {
+	if len(t.filePath) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(t); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil2.WriteFileAtomic(t.filePath, buf.Bytes(), 0644))
+}
+
+// tune saves the original settings of the existing indices and sets them for bulk loading.
+func (t *dumpTuner) tune() error {
+	for _, rule := range t.r.clusterRules(t.cluster) {
+		if _, ok := t.Indices[rule.Index]; ok {
+			// tuned already, maybe by the last run which is not finished
+			continue
+		}
+
+		exists, err := t.r.esClient(t.cluster).ExistsIndex(rule.Index)
+		if err != nil {
+			return errors.Trace(err)
+		} else if !exists {
+			log.Warnf("index %s doesn't exist, skip tuning it for dump", rule.Index)
+			continue
+		}
+
+		settings, err := t.r.esClient(t.cluster).GetIndexSettings(rule.Index)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		s := new(indexSettings)
+		s.RefreshInterval, _ = settings["refresh_interval"].(string)
+		s.NumberOfReplicas, _ = settings["number_of_replicas"].(string)
+		t.Indices[rule.Index] = s
+
+		// save before changing the settings, so they can always be restored
+		if err = t.save(); err != nil {
+			return errors.Trace(err)
+		}
+
+		log.Infof("tune index %s for dump, the original settings are %+v", rule.Index, *s)
+		err = t.r.esClient(t.cluster).PutIndexSettings(rule.Index, map[string]interface{}{
+			"refresh_interval":   "-1",
+			"number_of_replicas": 0,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// restore restores the original settings of the tuned indices.
+func (t *dumpTuner) restore() error {
+	for index, s := range t.Indices {
+		settings := map[string]interface{}{
+			"refresh_interval":   nil,
+			"number_of_replicas": nil,
+		}
+		if len(s.RefreshInterval) > 0 {
+			settings["refresh_interval"] = s.RefreshInterval
+		}
+		if len(s.NumberOfReplicas) > 0 {
+			settings["number_of_replicas"] = s.NumberOfReplicas
+		}
+
+		log.Infof("restore index %s settings %+v after dump", index, *s)
+		if err := t.r.esClient(t.cluster).PutIndexSettings(index, settings); err != nil {
+			return errors.Trace(err)
+		}
+		delete(t.Indices, index)
+		if err := t.save(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// run restores the settings after dump is done or the river is closed.
+func (t *dumpTuner) run() {
+	defer t.r.wg.Done()
+
+	select {
+	case <-t.r.canal.WaitDumpDone():
+	case <-t.r.ctx.Done():
+	}
+
+	if err := t.restore(); err != nil {
+		log.Errorf("restore index settings after dump err %v, restore them manually, the original settings are in %s",
+			err, t.filePath)
+	}
+}
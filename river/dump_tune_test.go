@@ -0,0 +1,95 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	. "github.com/pingcap/check"
+)
+
+func (s *unitTestSuite) TestDumpTune(c *C) {
+	dir, err := ioutil.TempDir("", "river_dump_tune")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	es := newFakeES(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "HEAD /a", "HEAD /b", "HEAD /broken", "PUT /a/_settings", "PUT /b/_settings":
+			w.Write([]byte(`{"acknowledged":true}`))
+		case "GET /a/_settings":
+			w.Write([]byte(`{"a":{"settings":{"index":{"refresh_interval":"5s","number_of_replicas":"2"}}}}`))
+		case "GET /b/_settings":
+			w.Write([]byte(`{"b":{"settings":{"index":{"number_of_shards":"1"}}}}`))
+		case "GET /broken/_settings":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer es.Close()
+
+	r := &River{c: &Config{DataDir: dir, DumpExec: "mysqldump"}, es: es.client(), master: &masterInfo{}}
+	c.Assert(r.willDump(), IsTrue)
+	r.master.Name, r.master.Pos = "mysql-bin.000001", 4
+	c.Assert(r.willDump(), IsFalse)
+
+	r.rules = map[string]*Rule{
+		"a": {Schema: "test", Table: "a", Index: "a"},
+		"b": {Schema: "test", Table: "b", Index: "b"},
+		// the missing indices are skipped
+		"m": {Schema: "test", Table: "m", Index: "missing"},
+	}
+	t, err := newDumpTuner(r, "")
+	c.Assert(err, IsNil)
+	c.Assert(t.tune(), IsNil)
+	c.Assert(t.Indices, DeepEquals, map[string]*indexSettings{
+		"a": {RefreshInterval: "5s", NumberOfReplicas: "2"},
+		"b": {},
+	})
+	var puts []string
+	for _, req := range es.takeRequests() {
+		if req[:4] == "PUT " {
+			puts = append(puts, req)
+		}
+	}
+	sort.Strings(puts)
+	c.Assert(puts, DeepEquals, []string{
+		`PUT /a/_settings {"index":{"number_of_replicas":0,"refresh_interval":"-1"}}`,
+		`PUT /b/_settings {"index":{"number_of_replicas":0,"refresh_interval":"-1"}}`,
+	})
+
+	// the original settings are loaded after a restart, and the tuned indices are not tuned again
+	t, err = newDumpTuner(r, "")
+	c.Assert(err, IsNil)
+	c.Assert(t.Indices, HasLen, 2)
+	c.Assert(t.tune(), IsNil)
+	for _, req := range es.takeRequests() {
+		c.Assert(req, Equals, "HEAD /missing")
+	}
+
+	// the settings not set are reset to the default
+	c.Assert(t.restore(), IsNil)
+	puts = es.takeRequests()
+	sort.Strings(puts)
+	c.Assert(puts, DeepEquals, []string{
+		`PUT /a/_settings {"index":{"number_of_replicas":"2","refresh_interval":"5s"}}`,
+		`PUT /b/_settings {"index":{"number_of_replicas":null,"refresh_interval":null}}`,
+	})
+	t, err = newDumpTuner(r, "")
+	c.Assert(err, IsNil)
+	c.Assert(t.Indices, HasLen, 0)
+
+	// the tuner of a cluster has its own file
+	t, err = newDumpTuner(r, "logs")
+	c.Assert(err, IsNil)
+	c.Assert(t.filePath, Equals, filepath.Join(dir, "dump_index_logs.info"))
+
+	r.rules = map[string]*Rule{"x": {Schema: "test", Table: "x", Index: "broken"}}
+	t, err = newDumpTuner(r, "")
+	c.Assert(err, IsNil)
+	c.Assert(t.tune(), ErrorMatches, ".*code: 500")
+	c.Assert(t.Indices, HasLen, 0)
+}
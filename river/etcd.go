@@ -0,0 +1,202 @@
+package river
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const defaultEtcdTimeout = 5 * time.Second
+
+// etcdClient talks to etcd v3 by the JSON gateway, the endpoints are tried in order.
+type etcdClient struct {
+	c         *http.Client
+	endpoints []string
+	user      string
+	password  string
+	token     string
+}
+
+type etcdKV struct {
+	Key   string
+	Value string
+}
+
+func newEtcdClient(c *Config) *etcdClient {
+	endpoints := make([]string, 0, len(c.EtcdEndpoints))
+	for _, endpoint := range c.EtcdEndpoints {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		endpoints = append(endpoints, strings.TrimSuffix(endpoint, "/"))
+	}
+	return &etcdClient{
+		c:         &http.Client{Timeout: defaultEtcdTimeout},
+		endpoints: endpoints,
+		user:      c.EtcdUser,
+		password:  c.EtcdPassword,
+	}
+}
+
+// call posts the request to the path of the first endpoint which works, and decodes the response.
+func (e *etcdClient) call(path string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var lastErr error
+	for _, endpoint := range e.endpoints {
+		data, code, err := e.post(endpoint+path, body)
+		if err == nil && code == http.StatusUnauthorized && len(e.user) > 0 {
+			// the token is expired
+			if err = e.authenticate(endpoint); err == nil {
+				data, code, err = e.post(endpoint+path, body)
+			}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if code != http.StatusOK {
+			return errors.Errorf("etcd %s err: code %d, %s", path, code, bytes.TrimSpace(data))
+		}
+		return errors.Trace(json.Unmarshal(data, resp))
+	}
+	return errors.Annotatef(lastErr, "etcd %s", path)
+}
+
+func (e *etcdClient) post(url string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(e.token) > 0 {
+		req.Header.Set("Authorization", e.token)
+	}
+
+	resp, err := e.c.Do(req)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, resp.StatusCode, errors.Trace(err)
+}
+
+func (e *etcdClient) authenticate(endpoint string) error {
+	body, err := json.Marshal(map[string]string{"name": e.user, "password": e.password})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	e.token = ""
+	data, code, err := e.post(endpoint+"/v3/auth/authenticate", body)
+	if err != nil {
+		return errors.Trace(err)
+	} else if code != http.StatusOK {
+		return errors.Errorf("etcd authenticate err: code %d, %s", code, bytes.TrimSpace(data))
+	}
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return errors.Trace(err)
+	}
+	e.token = resp.Token
+	return nil
+}
+
+// grant grants a lease of the TTL, and returns its ID.
+func (e *etcdClient) grant(ttl time.Duration) (string, error) {
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	err := e.call("/v3/lease/grant", map[string]interface{}{"TTL": int64(ttl / time.Second)}, &resp)
+	if err != nil {
+		return "", errors.Trace(err)
+	} else if len(resp.ID) == 0 {
+		return "", errors.New("etcd grants no lease")
+	}
+	return resp.ID, nil
+}
+
+// keepAlive renews the lease, and returns whether it is still alive.
+func (e *etcdClient) keepAlive(lease string) (bool, error) {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := e.call("/v3/lease/keepalive", map[string]string{"ID": lease}, &resp); err != nil {
+		return false, errors.Trace(err)
+	}
+	// no TTL for the expired lease
+	return len(resp.Result.TTL) > 0 && resp.Result.TTL != "0" && !strings.HasPrefix(resp.Result.TTL, "-"), nil
+}
+
+func (e *etcdClient) revoke(lease string) error {
+	var resp struct{}
+	return errors.Trace(e.call("/v3/lease/revoke", map[string]string{"ID": lease}, &resp))
+}
+
+// put puts the key with the lease, which deletes the key when it expires.
+func (e *etcdClient) put(key string, value string, lease string) error {
+	var resp struct{}
+	return errors.Trace(e.call("/v3/kv/put", map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(key)),
+		"value": base64.StdEncoding.EncodeToString([]byte(value)),
+		"lease": lease,
+	}, &resp))
+}
+
+// list returns the keys with the prefix in order.
+func (e *etcdClient) list(prefix string) ([]etcdKV, error) {
+	var resp struct {
+		Kvs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	err := e.call("/v3/kv/range", map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd(prefix)),
+	}, &resp)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	kvs := make([]etcdKV, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		kvs = append(kvs, etcdKV{Key: string(key), Value: string(value)})
+	}
+	return kvs, nil
+}
+
+// prefixEnd returns the end of the range of the keys with the prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// all the keys
+	return []byte{0}
+}
@@ -0,0 +1,198 @@
+package river
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+
+	. "github.com/pingcap/check"
+)
+
+// fakeEtcd serves the leases and the keys of the etcd v3 JSON gateway in memory.
+type fakeEtcd struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	kvs    map[string][2]string // key -> value, lease
+	leases map[string]bool
+	grants int
+	// the token of the user root with the password secret is required if set
+	token string
+	calls []string
+	// all the requests fail if set, like a network partition
+	down bool
+}
+
+func newFakeEtcd() *fakeEtcd {
+	e := &fakeEtcd{kvs: make(map[string][2]string), leases: make(map[string]bool)}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serve))
+	return e
+}
+
+func decodeEtcdKey(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return string(b)
+}
+
+func (e *fakeEtcd) serve(w http.ResponseWriter, req *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(req.Body).Decode(&body)
+	str := func(name string) string {
+		s, _ := body[name].(string)
+		return s
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls = append(e.calls, req.URL.Path)
+	if e.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if req.URL.Path == "/v3/auth/authenticate" {
+		if str("name") != "root" || str("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": e.token})
+		return
+	}
+	if len(e.token) > 0 && req.Header.Get("Authorization") != e.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"invalid auth token"}`))
+		return
+	}
+
+	var resp interface{}
+	switch req.URL.Path {
+	case "/v3/lease/grant":
+		e.grants++
+		id := fmt.Sprintf("%d", 7587000000+e.grants)
+		e.leases[id] = true
+		resp = map[string]string{"ID": id, "TTL": fmt.Sprintf("%v", body["TTL"])}
+	case "/v3/lease/keepalive":
+		result := map[string]string{"ID": str("ID")}
+		if e.leases[str("ID")] {
+			result["TTL"] = "10"
+		}
+		resp = map[string]interface{}{"result": result}
+	case "/v3/lease/revoke":
+		e.expireLocked(str("ID"))
+		resp = map[string]string{}
+	case "/v3/kv/put":
+		if lease := str("lease"); len(lease) > 0 && !e.leases[lease] {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"etcdserver: requested lease not found"}`))
+			return
+		}
+		e.kvs[decodeEtcdKey(str("key"))] = [2]string{decodeEtcdKey(str("value")), str("lease")}
+		resp = map[string]string{}
+	case "/v3/kv/range":
+		start, end := decodeEtcdKey(str("key")), decodeEtcdKey(str("range_end"))
+		var keys []string
+		for key := range e.kvs {
+			if key >= start && key < end {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		kvs := make([]map[string]string, 0, len(keys))
+		for _, key := range keys {
+			kvs = append(kvs, map[string]string{
+				"key":   base64.StdEncoding.EncodeToString([]byte(key)),
+				"value": base64.StdEncoding.EncodeToString([]byte(e.kvs[key][0])),
+			})
+		}
+		resp = map[string]interface{}{"kvs": kvs, "count": fmt.Sprintf("%d", len(kvs))}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// expire expires the lease and deletes its keys.
+func (e *fakeEtcd) expire(lease string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expireLocked(lease)
+}
+
+func (e *fakeEtcd) expireLocked(lease string) {
+	delete(e.leases, lease)
+	for key, kv := range e.kvs {
+		if kv[1] == lease {
+			delete(e.kvs, key)
+		}
+	}
+}
+
+// partition makes all the requests fail, or succeed again.
+func (e *fakeEtcd) partition(down bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.down = down
+}
+
+func (e *fakeEtcd) takeCalls() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	calls := e.calls
+	e.calls = nil
+	return calls
+}
+
+func (s *unitTestSuite) TestEtcdClient(c *C) {
+	e := newFakeEtcd()
+	defer e.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	// the endpoints which are down are skipped
+	client := newEtcdClient(&Config{EtcdEndpoints: []string{down.URL, e.Listener.Addr().String()}})
+	c.Assert(client.endpoints[1], Equals, e.URL)
+
+	lease, err := client.grant(defaultEtcdTTL)
+	c.Assert(err, IsNil)
+	c.Assert(client.put("/a/members/1", "v1", lease), IsNil)
+	c.Assert(client.put("/a/members/2", "v2", ""), IsNil)
+	c.Assert(client.put("/ab/members/3", "v3", ""), IsNil)
+	kvs, err := client.list("/a/")
+	c.Assert(err, IsNil)
+	c.Assert(kvs, DeepEquals, []etcdKV{{Key: "/a/members/1", Value: "v1"}, {Key: "/a/members/2", Value: "v2"}})
+
+	alive, err := client.keepAlive(lease)
+	c.Assert(err, IsNil)
+	c.Assert(alive, IsTrue)
+	c.Assert(client.revoke(lease), IsNil)
+	alive, err = client.keepAlive(lease)
+	c.Assert(err, IsNil)
+	c.Assert(alive, IsFalse)
+	c.Assert(client.put("/a/members/1", "v1", lease), ErrorMatches, ".*code 404.*lease not found.*")
+	kvs, err = client.list("/a/")
+	c.Assert(err, IsNil)
+	c.Assert(kvs, HasLen, 1)
+
+	// the token is got again when it is expired
+	e.token = "token1"
+	_, err = client.list("/a/")
+	c.Assert(err, ErrorMatches, ".*code 401.*")
+	client = newEtcdClient(&Config{EtcdEndpoints: []string{e.URL}, EtcdUser: "root", EtcdPassword: "secret"})
+	e.takeCalls()
+	kvs, err = client.list("/a/")
+	c.Assert(err, IsNil)
+	c.Assert(kvs, HasLen, 1)
+	c.Assert(e.takeCalls(), DeepEquals, []string{"/v3/kv/range", "/v3/auth/authenticate", "/v3/kv/range"})
+	_, err = client.list("/a/")
+	c.Assert(err, IsNil)
+	c.Assert(e.takeCalls(), DeepEquals, []string{"/v3/kv/range"})
+
+	c.Assert(string(prefixEnd("/a/")), Equals, "/a0")
+	c.Assert(prefixEnd("a\xff"), DeepEquals, []byte("b"))
+	c.Assert(prefixEnd("\xff"), DeepEquals, []byte{0})
+}
@@ -0,0 +1,250 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// What to do with the string fields over max_length or max_bytes of field_limit.
+const (
+	// cut the value to the limit on a character boundary
+	FieldLimitTruncate = "truncate"
+	// remove the field from the doc
+	FieldLimitDrop = "drop"
+	// write the doc to the dead letter files in dlq_dir instead of ES
+	FieldLimitDLQ = "dlq"
+)
+
+// FieldLimit limits the size of a string field of the docs.
+type FieldLimit struct {
+	// Max characters of the value, no limit if 0
+	MaxLength int `toml:"max_length"`
+	// Max bytes of the UTF-8 value, no limit if 0
+	MaxBytes int `toml:"max_bytes"`
+	// truncate, drop or dlq, default is truncate
+	Policy string `toml:"policy"`
+}
+
+func (l *FieldLimit) prepare(rule *Rule, field string) error {
+	if l.MaxLength < 0 || l.MaxBytes < 0 || l.MaxLength == 0 && l.MaxBytes == 0 {
+		return errors.Errorf("max_length or max_bytes must be positive for field_limit %s of rule %s.%s", field, rule.Schema, rule.Table)
+	}
+	switch l.Policy {
+	case "":
+		l.Policy = FieldLimitTruncate
+	case FieldLimitTruncate, FieldLimitDrop, FieldLimitDLQ:
+	default:
+		return errors.Errorf("invalid policy %s of field_limit %s for rule %s.%s", l.Policy, field, rule.Schema, rule.Table)
+	}
+	return nil
+}
+
+func (l *FieldLimit) exceeds(s string) bool {
+	if l.MaxBytes > 0 && len(s) > l.MaxBytes {
+		return true
+	}
+	// a string has no more characters than bytes
+	return l.MaxLength > 0 && len(s) > l.MaxLength && utf8.RuneCountInString(s) > l.MaxLength
+}
+
+// truncate cuts the value to the limits, a character is never split.
+func (l *FieldLimit) truncate(s string) string {
+	if l.MaxLength > 0 && len(s) > l.MaxLength {
+		n := 0
+		for i := range s {
+			if n == l.MaxLength {
+				s = s[:i]
+				break
+			}
+			n++
+		}
+	}
+	if l.MaxBytes > 0 && len(s) > l.MaxBytes {
+		i := l.MaxBytes
+		for i > 0 && !utf8.RuneStart(s[i]) {
+			i--
+		}
+		s = s[:i]
+	}
+	return s
+}
+
+// fieldLimit returns the limit of the field, the limit of "*" is for the fields without their own.
+func (r *Rule) fieldLimit(field string) *FieldLimit {
+	if l, ok := r.FieldLimit[field]; ok {
+		return l
+	}
+	return r.FieldLimit["*"]
+}
+
+// What to do with the docs rejected by ES with the other 4xx errors.
+const (
+	// write the doc with the error to the rejected files in dlq_dir
+	BulkClientErrorDLQ = "dlq"
+	// log and skip the doc
+	BulkClientErrorSkip = "skip"
+)
+
+// hasDLQ returns true if any docs are written to the dead letter files, by field_limit
+// of the rules, by mapping_conflict or by bulk_client_error.
+func hasDLQ(c *Config) bool {
+	if c.MappingConflict == MappingConflictDropField || c.BulkClientError == BulkClientErrorDLQ {
+		return true
+	}
+	for _, rule := range c.Rules {
+		for _, l := range rule.FieldLimit {
+			if l.Policy == FieldLimitDLQ {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deadLetters writes the docs over the field limits and the docs rejected by the mapping
+// to the rotating files in dlq_dir, they are the bulk bodies like the file sink, so they
+// can be replayed after the fix. The docs rejected by ES with the other 4xx errors are
+// written to the rejected files with the errors.
+type deadLetters struct {
+	// the upstreams share the files
+	mu       sync.Mutex
+	sink     *fileSink
+	rejected *fileSink
+	buf      bytes.Buffer
+}
+
+// rejectedDoc is a line of the rejected files, the bulk body is the action and the doc
+// lines, like jq -c '.action, .doc | select(. != null)'.
+type rejectedDoc struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error,omitempty"`
+	Action json.RawMessage `json:"action"`
+	Doc    json.RawMessage `json:"doc,omitempty"`
+}
+
+// newDeadLetters returns nil if no docs are written to the dead letter files.
+func newDeadLetters(c *Config) (*deadLetters, error) {
+	if !hasDLQ(c) {
+		return nil, nil
+	}
+
+	dir := c.DLQDir
+	if len(dir) == 0 {
+		if len(c.DataDir) == 0 {
+			return nil, errors.Errorf("dlq_dir or data_dir must be set for the dlq")
+		}
+		dir = path.Join(c.DataDir, "dlq")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &deadLetters{
+		sink:     &fileSink{dir: dir, maxSize: defaultSinkFileSize},
+		rejected: &fileSink{dir: dir, maxSize: defaultSinkFileSize, prefix: "rejected"},
+	}, nil
+}
+
+func (d *deadLetters) write(reqs []*elastic.BulkRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return errors.Trace(d.sink.write(reqs))
+}
+
+// writeRejected writes the request rejected by ES with the error of the bulk item.
+func (d *deadLetters) writeRejected(req *elastic.BulkRequest, item *elastic.BulkResponseItem) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.buf.Reset()
+	if err := elastic.EncodeBulk(&d.buf, []*elastic.BulkRequest{req}); err != nil {
+		return errors.Trace(err)
+	}
+	lines := bytes.SplitN(bytes.TrimSuffix(d.buf.Bytes(), []byte("\n")), []byte("\n"), 2)
+	doc := rejectedDoc{Status: item.Status, Error: item.Error, Action: lines[0]}
+	if len(lines) > 1 {
+		doc.Doc = lines[1]
+	}
+	line, err := json.Marshal(doc)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(d.rejected.writeBody(append(line, '\n')))
+}
+
+// usage returns the number and the total size of the files in dlq_dir.
+func (d *deadLetters) usage() (int, int64, error) {
+	files, err := ioutil.ReadDir(d.sink.dir)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	var size int64
+	for _, f := range files {
+		size += f.Size()
+	}
+	return len(files), size, nil
+}
+
+// Close closes the current files.
+func (d *deadLetters) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.sink.Close()
+	if rerr := d.rejected.Close(); err == nil {
+		err = rerr
+	}
+	return errors.Trace(err)
+}
+
+// limitFields applies the field limits of the rule to the docs of the requests, the
+// requests of the docs written to the dead letter files are removed.
+func (r *River) limitFields(rule *Rule, reqs []*elastic.BulkRequest) ([]*elastic.BulkRequest, error) {
+	var dead []*elastic.BulkRequest
+	kept := reqs[:0]
+	for _, req := range reqs {
+		over := ""
+		for field, value := range req.Data {
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			l := rule.fieldLimit(field)
+			if l == nil || !l.exceeds(s) {
+				continue
+			}
+			switch l.Policy {
+			case FieldLimitTruncate:
+				req.Data[field] = l.truncate(s)
+				r.st.FieldTruncateNum.Add(1)
+			case FieldLimitDrop:
+				log.Warnf("drop field %s of %d bytes from doc %s of index %s", field, len(s), req.ID, req.Index)
+				delete(req.Data, field)
+				r.st.FieldDropNum.Add(1)
+			case FieldLimitDLQ:
+				over = field
+			}
+		}
+		if len(over) > 0 {
+			log.Warnf("write doc %s of index %s to dlq, field %s is over the limit", req.ID, req.Index, over)
+			dead = append(dead, req)
+			continue
+		}
+		kept = append(kept, req)
+	}
+
+	if len(dead) > 0 {
+		if err := r.dlq.write(dead); err != nil {
+			return nil, errors.Annotatef(err, "write %d docs to dlq", len(dead))
+		}
+		r.st.DeadLetterNum.Add(int64(len(dead)))
+	}
+	return kept, nil
+}
@@ -0,0 +1,104 @@
+package river
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestFieldLimit(c *C) {
+	dir, err := ioutil.TempDir("", "river_dlq")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("title", "varchar(255)", "", "")
+	ta.AddColumn("body", "text", "", "")
+	ta.PKColumns = []int{0}
+
+	c.Assert((&Rule{Schema: "test", Table: "t", FieldLimit: map[string]*FieldLimit{"body": {}}}).prepare(), NotNil)
+	c.Assert((&Rule{Schema: "test", Table: "t", FieldLimit: map[string]*FieldLimit{"body": {MaxBytes: 1, Policy: "skip"}}}).prepare(), NotNil)
+
+	l := &FieldLimit{MaxLength: 3}
+	c.Assert(l.exceeds("中文字"), IsFalse)
+	c.Assert(l.exceeds("中文字符"), IsTrue)
+	c.Assert(l.truncate("中文字符"), Equals, "中文字")
+	// a character is never split
+	l = &FieldLimit{MaxBytes: 5}
+	c.Assert(l.truncate("中文字"), Equals, "中")
+	c.Assert(l.truncate("abcdef"), Equals, "abcde")
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", Type: "t", TableInfo: ta, FieldLimit: map[string]*FieldLimit{
+		"title": {MaxLength: 4},
+		"body":  {MaxBytes: 8, Policy: FieldLimitDrop},
+		"*":     {MaxBytes: 16, Policy: FieldLimitDLQ},
+	}}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.FieldLimit["title"].Policy, Equals, FieldLimitTruncate)
+
+	cfg := &Config{DataDir: dir, Rules: []*Rule{rule}}
+	r := &River{c: cfg, ctx: context.Background(), st: &stat{}, syncCh: make(chan interface{}, 4),
+		rules: map[string]*Rule{ruleKey("test", "t"): rule}, limits: newRateLimits(0, 0)}
+	r.setFieldMapping(rule)
+	r.dlq, err = newDeadLetters(cfg)
+	c.Assert(err, IsNil)
+	h := &eventHandler{r: r}
+
+	e := &canal.RowsEvent{Action: canal.InsertAction, Table: ta, Rows: [][]interface{}{
+		{int32(1), "abcdef", "short"},
+		{int32(2), "abc", "long body text"},
+	}, Header: &replication.EventHeader{LogPos: 120}}
+	c.Assert(h.OnRow(e), IsNil)
+	reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "title": "abcd", "body": "short"})
+	c.Assert(reqs[1].Data, DeepEquals, map[string]interface{}{"id": int32(2), "title": "abc"})
+	c.Assert(r.st.FieldTruncateNum.Get(), Equals, int64(1))
+	c.Assert(r.st.FieldDropNum.Get(), Equals, int64(1))
+
+	// the doc over the limit of "*" is written to the dlq, the fields with their own limit are not checked with it
+	ta.AddColumn("note", "text", "", "")
+	r.setFieldMapping(rule)
+	e.Rows = [][]interface{}{
+		{int32(3), "abc", "body", "a note longer than 16 bytes"},
+		{int32(4), "abc", "body", "note"},
+	}
+	c.Assert(h.OnRow(e), IsNil)
+	reqs = (<-r.syncCh).([]*elastic.BulkRequest)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].ID, Equals, "4")
+	c.Assert(r.st.DeadLetterNum.Get(), Equals, int64(1))
+
+	// the upstreams write to the dlq of the primary river
+	u := &River{c: cfg, ctx: context.Background(), syncCh: r.syncCh, rules: r.rules, primary: r, name: "shard2"}
+	u.shareOutput(r)
+	e.Rows = [][]interface{}{
+		{int32(5), "abc", "body", "another note longer than 16 bytes"},
+	}
+	c.Assert((&eventHandler{r: u}).OnRow(e), IsNil)
+	c.Assert(r.st.DeadLetterNum.Get(), Equals, int64(2))
+	c.Assert(r.syncCh, HasLen, 0)
+	c.Assert(r.dlq.Close(), IsNil)
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "dlq"))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dlq", files[0].Name()))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "{\"index\":{\"_id\":\"3\",\"_index\":\"t\",\"_type\":\"t\"}}\n"+
+		"{\"id\":3,\"title\":\"abc\",\"body\":\"body\",\"note\":\"a note longer than 16 bytes\"}\n"+
+		"{\"index\":{\"_id\":\"5\",\"_index\":\"t\",\"_type\":\"t\"}}\n"+
+		"{\"id\":5,\"title\":\"abc\",\"body\":\"body\",\"note\":\"another note longer than 16 bytes\"}\n")
+
+	// the dlq needs a directory
+	_, err = newDeadLetters(&Config{Rules: []*Rule{rule}})
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,189 @@
+package river
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// The helpers of func_field.
+const (
+	// concat(first_name, last_name, ' ') joins the non-empty columns with the separator
+	fieldFuncConcat = "concat"
+	// split(tags, ',') splits the column into the trimmed non-empty values
+	fieldFuncSplit = "split"
+)
+
+// fieldFunc is a parsed helper of func_field.
+type fieldFunc struct {
+	name    string
+	columns []string
+	sep     string
+}
+
+// fieldFuncArg is an argument of the helper, a column or a quoted string.
+type fieldFuncArg struct {
+	value  string
+	quoted bool
+}
+
+// parseFieldFunc parses the helper like "concat(first_name, last_name, ' ')",
+// the separator is the last quoted argument, the others are the columns.
+func parseFieldFunc(s string) (*fieldFunc, error) {
+	s = strings.TrimSpace(s)
+	start := strings.IndexByte(s, '(')
+	if start <= 0 || !strings.HasSuffix(s, ")") {
+		return nil, errors.Errorf("invalid helper %q", s)
+	}
+	args, err := parseFieldFuncArgs(s[start+1 : len(s)-1])
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid helper %q", s)
+	}
+
+	fn := &fieldFunc{name: strings.ToLower(strings.TrimSpace(s[:start]))}
+	if n := len(args); n > 0 && args[n-1].quoted {
+		fn.sep = args[n-1].value
+		args = args[:n-1]
+	} else if fn.name == fieldFuncSplit {
+		fn.sep = ","
+	}
+	for _, arg := range args {
+		if arg.quoted {
+			return nil, errors.Errorf("invalid helper %q, only the last argument can be quoted", s)
+		}
+		fn.columns = append(fn.columns, arg.value)
+	}
+
+	switch fn.name {
+	case fieldFuncConcat:
+		if len(fn.columns) == 0 {
+			return nil, errors.Errorf("invalid helper %q, concat needs the columns", s)
+		}
+	case fieldFuncSplit:
+		if len(fn.columns) != 1 || len(fn.sep) == 0 {
+			return nil, errors.Errorf("invalid helper %q, split needs a column and a separator", s)
+		}
+	default:
+		return nil, errors.Errorf("unknown helper %s", fn.name)
+	}
+	return fn, nil
+}
+
+func parseFieldFuncArgs(s string) ([]fieldFuncArg, error) {
+	var args []fieldFuncArg
+	for {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			return nil, errors.Errorf("empty argument")
+		}
+
+		var arg fieldFuncArg
+		if quote := s[0]; quote == '\'' || quote == '"' {
+			end := strings.IndexByte(s[1:], quote)
+			if end < 0 {
+				return nil, errors.Errorf("unclosed %c", quote)
+			}
+			arg = fieldFuncArg{value: s[1 : end+1], quoted: true}
+			s = strings.TrimSpace(s[end+2:])
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			arg.value = strings.TrimSpace(s[:end])
+			if strings.ContainsAny(arg.value, `'"() `) {
+				return nil, errors.Errorf("invalid column %q", arg.value)
+			}
+			s = s[end:]
+		}
+		args = append(args, arg)
+
+		if len(s) == 0 {
+			return args, nil
+		} else if s[0] != ',' {
+			return nil, errors.Errorf("unexpected %q", s)
+		}
+		s = s[1:]
+	}
+}
+
+// makeFuncField compiles the helper of the field, false if any column is dropped or skipped.
+func (r *River) makeFuncField(rule *Rule, esField string, fn *fieldFunc) (ruleField, bool) {
+	indexes := make([]int, 0, len(fn.columns))
+	for _, column := range fn.columns {
+		index, ok := rule.TableFields[column]
+		if !ok || rule.GeneratedColumns == GeneratedSkip && rule.generated[column] {
+			return ruleField{}, false
+		}
+		indexes = append(indexes, index)
+	}
+
+	f := ruleField{column: indexes[0], columns: indexes, esField: esField, derived: true}
+	f.compute = func(values []interface{}) interface{} {
+		strs := make([]string, 0, len(indexes))
+		for _, index := range indexes {
+			if s, ok := r.funcColumnString(&rule.TableInfo.Columns[index], values[index]); ok {
+				strs = append(strs, s)
+			}
+		}
+		if fn.name == fieldFuncSplit {
+			if len(strs) == 0 {
+				return nil
+			}
+			return splitValues(strs[0], fn.sep)
+		}
+		return concatValues(strs, fn.sep)
+	}
+	return f, true
+}
+
+// funcColumnString returns the column value as a string, false for NULL.
+func (r *River) funcColumnString(col *schema.TableColumn, value interface{}) (string, bool) {
+	if value == nil {
+		return "", false
+	}
+	switch v := r.makeReqColumnData(col, value).(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	default:
+		var buf bytes.Buffer
+		writePlainIDValue(&buf, v)
+		return buf.String(), true
+	}
+}
+
+// concatValues joins the non-empty values, nil if there are none.
+func concatValues(values []string, sep string) interface{} {
+	var buf bytes.Buffer
+	for _, v := range values {
+		if len(v) == 0 {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString(sep)
+		}
+		buf.WriteString(v)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	return buf.String()
+}
+
+// splitValues splits the value, the values are trimmed and the empty ones are removed.
+func splitValues(value string, sep string) []string {
+	parts := strings.Split(value, sep)
+	values := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); len(part) > 0 {
+			values = append(values, part)
+		}
+	}
+	return values
+}
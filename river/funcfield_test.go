@@ -0,0 +1,57 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestFuncField(c *C) {
+	for _, bad := range []string{"concat", "upper(name)", "concat()", "concat('a', name)", "split(a, b, ',')", "split(tags, '')", "concat(name, ' )"} {
+		_, err := parseFieldFunc(bad)
+		c.Assert(err, NotNil, Commentf("%s", bad))
+	}
+	fn, err := parseFieldFunc(`split(tags)`)
+	c.Assert(err, IsNil)
+	c.Assert(fn, DeepEquals, &fieldFunc{name: fieldFuncSplit, columns: []string{"tags"}, sep: ","})
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("first_name", "varchar(32)", "", "")
+	ta.AddColumn("middle_name", "varchar(32)", "", "")
+	ta.AddColumn("last_name", "varchar(32)", "", "")
+	ta.AddColumn("tags", "varchar(256)", "", "")
+	ta.PKColumns = []int{0}
+
+	c.Assert((&Rule{Schema: "test", Table: "t", FuncField: map[string]string{"x": "trim(tags)"}}).prepare(), NotNil)
+
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta,
+		Filter: []string{"id", "tags"},
+		FuncField: map[string]string{
+			"full_name": "concat(first_name, middle_name, last_name, ' ')",
+			"code":      `concat(id, last_name, "-")`,
+			"tag_list":  "split(tags, ',')",
+			"gone":      "concat(dropped)",
+		},
+		Where: map[string]interface{}{"tags": "a, ,b,"}}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+	c.Assert(rule.fields, HasLen, 5)
+
+	data := r.makeFieldData(rule, []interface{}{int32(7), "Ada", nil, "Lovelace", "a, ,b,"})
+	c.Assert(data, DeepEquals, map[string]interface{}{
+		"id":        int32(7),
+		"code":      "7-Lovelace",
+		"full_name": "Ada Lovelace",
+		"tags":      "a, ,b,",
+		"tag_list":  []string{"a", "b"},
+	})
+	data = r.makeFieldData(rule, []interface{}{int32(8), nil, "", nil, "a, ,b,"})
+	c.Assert(data["full_name"], IsNil)
+	c.Assert(r.makeFieldData(rule, []interface{}{int32(8), nil, nil, nil, "c"}), IsNil)
+
+	properties := r.makeMappingProperties(rule, ta.Columns)
+	c.Assert(properties["tag_list"], DeepEquals, map[string]interface{}{"type": "keyword"})
+	_, ok := properties["full_name"]
+	c.Assert(ok, IsFalse)
+}
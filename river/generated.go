@@ -0,0 +1,95 @@
+package river
+
+import (
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+// loadGeneratedColumns loads the generated columns of the rule table from
+// information_schema, the VIRTUAL and STORED ones, they are not loaded for keep.
+func (r *River) loadGeneratedColumns(rule *Rule) error {
+	rule.generated = nil
+	if rule.GeneratedColumns != GeneratedSkip && rule.GeneratedColumns != GeneratedFetch {
+		return nil
+	}
+
+	res, err := r.canal.Execute("SELECT COLUMN_NAME FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND EXTRA LIKE '%GENERATED%'", rule.Schema, rule.Table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	generated := make(map[string]bool, res.RowNumber())
+	for i := 0; i < res.RowNumber(); i++ {
+		name, err := res.GetString(i, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if rule.TableInfo.FindColumn(name) < 0 {
+			continue
+		}
+		generated[name] = true
+	}
+	if len(generated) > 0 {
+		log.Infof("table %s.%s has generated columns %v, %s them", rule.Schema, rule.Table, generated, rule.GeneratedColumns)
+	}
+	rule.generated = generated
+	return nil
+}
+
+// fetchGeneratedRows fills the generated columns of the insert rows and the
+// update after rows by selecting the current row from MySQL by PK, like
+// fetchPartialRows, the values are the latest but not the ones at the event.
+func (r *River) fetchGeneratedRows(rule *Rule, action string, rows [][]interface{}) ([][]interface{}, error) {
+	if action == canal.DeleteAction {
+		return rows, nil
+	}
+
+	var target *Rule
+	for _, t := range rule.targets() {
+		if t.GeneratedColumns == GeneratedFetch && len(t.generated) > 0 {
+			target = t
+			break
+		}
+	}
+	if target == nil {
+		return rows, nil
+	}
+
+	columns := make([]int, 0, len(target.generated))
+	for i, col := range target.TableInfo.Columns {
+		if target.generated[col.Name] {
+			columns = append(columns, i)
+		}
+	}
+
+	filled := make([][]interface{}, len(rows))
+	copy(filled, rows)
+
+	start, step := 0, 1
+	if action == canal.UpdateAction {
+		start, step = 1, 2
+	}
+	for i := start; i < len(filled); i += step {
+		current, err := r.selectRow(target, filled[i])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if current == nil {
+			log.Warnf("row of %s.%s is not found when fetching the generated columns, it may be deleted", target.Schema, target.Table)
+			continue
+		}
+
+		row := make([]interface{}, len(filled[i]))
+		copy(row, filled[i])
+		for _, j := range columns {
+			if j < len(row) && j < len(current) {
+				row[j] = current[j]
+			}
+		}
+		filled[i] = row
+	}
+
+	return filled, nil
+}
@@ -0,0 +1,37 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestGeneratedColumns(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("price", "int(11)", "", "")
+	ta.AddColumn("total", "int(11)", "", "VIRTUAL GENERATED")
+	ta.PKColumns = []int{0}
+
+	r := new(River)
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta, GeneratedColumns: GeneratedSkip}
+	c.Assert(rule.prepare(), IsNil)
+	rule.generated = map[string]bool{"total": true}
+	r.setFieldMapping(rule)
+	c.Assert(rule.fields, HasLen, 2)
+	c.Assert(r.makeFieldData(rule, []interface{}{int32(1), int32(2), nil}), DeepEquals,
+		map[string]interface{}{"id": int32(1), "price": int32(2)})
+	c.Assert(r.makeMappingProperties(rule, ta.Columns), HasLen, 2)
+
+	// nothing to fetch for keep
+	rule.GeneratedColumns = GeneratedKeep
+	rows := [][]interface{}{{int32(1), int32(2), nil}}
+	fetched, err := r.fetchGeneratedRows(rule, canal.InsertAction, rows)
+	c.Assert(err, IsNil)
+	c.Assert(fetched, DeepEquals, rows)
+	c.Assert(r.loadGeneratedColumns(rule), IsNil)
+	c.Assert(rule.generated, IsNil)
+
+	rule = &Rule{Schema: "test", Table: "t", Index: "t", GeneratedColumns: "compute"}
+	c.Assert(rule.prepare(), NotNil)
+}
@@ -0,0 +1,236 @@
+package river
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/juju/errors"
+)
+
+// The WKB geometry types.
+const (
+	wkbPoint              = 1
+	wkbLineString         = 2
+	wkbPolygon            = 3
+	wkbMultiPoint         = 4
+	wkbMultiLineString    = 5
+	wkbMultiPolygon       = 6
+	wkbGeometryCollection = 7
+)
+
+// maxWKBDepth limits the nested geometry collections.
+const maxWKBDepth = 32
+
+type wkbReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (r *wkbReader) uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errors.New("unexpected end of WKB")
+	}
+	v := r.order.Uint32(r.data)
+	r.data = r.data[4:]
+	return v, nil
+}
+
+func (r *wkbReader) float64() (float64, error) {
+	if len(r.data) < 8 {
+		return 0, errors.New("unexpected end of WKB")
+	}
+	v := math.Float64frombits(r.order.Uint64(r.data))
+	r.data = r.data[8:]
+	return v, nil
+}
+
+// count reads the number of the following items of at least size bytes each,
+// so the invalid count doesn't allocate too much.
+func (r *wkbReader) count(size int) (int, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return 0, err
+	}
+	if int64(n)*int64(size) > int64(len(r.data)) {
+		return 0, errors.Errorf("invalid WKB count %d", n)
+	}
+	return int(n), nil
+}
+
+func (r *wkbReader) point() ([]float64, error) {
+	x, err := r.float64()
+	if err != nil {
+		return nil, err
+	}
+	y, err := r.float64()
+	if err != nil {
+		return nil, err
+	}
+	return []float64{x, y}, nil
+}
+
+func (r *wkbReader) points() ([][]float64, error) {
+	n, err := r.count(16)
+	if err != nil {
+		return nil, err
+	}
+	points := make([][]float64, 0, n)
+	for i := 0; i < n; i++ {
+		p, err := r.point()
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func (r *wkbReader) rings() ([][][]float64, error) {
+	n, err := r.count(4)
+	if err != nil {
+		return nil, err
+	}
+	rings := make([][][]float64, 0, n)
+	for i := 0; i < n; i++ {
+		ring, err := r.points()
+		if err != nil {
+			return nil, err
+		}
+		rings = append(rings, ring)
+	}
+	return rings, nil
+}
+
+// geometry reads a WKB geometry, the coordinates of the multi geometries are
+// returned for the expected type, and the GeoJSON object for any type with 0.
+func (r *wkbReader) geometry(expected uint32, depth int) (uint32, interface{}, error) {
+	if depth > maxWKBDepth {
+		return 0, nil, errors.New("too deep WKB geometry collection")
+	}
+	if len(r.data) < 1 {
+		return 0, nil, errors.New("unexpected end of WKB")
+	}
+	switch r.data[0] {
+	case 0:
+		r.order = binary.BigEndian
+	case 1:
+		r.order = binary.LittleEndian
+	default:
+		return 0, nil, errors.Errorf("invalid WKB byte order %d", r.data[0])
+	}
+	r.data = r.data[1:]
+
+	tp, err := r.uint32()
+	if err != nil {
+		return 0, nil, err
+	}
+	if expected != 0 && tp != expected {
+		return 0, nil, errors.Errorf("unexpected WKB type %d in multi geometry, %d expected", tp, expected)
+	}
+
+	var coordinates interface{}
+	switch tp {
+	case wkbPoint:
+		coordinates, err = r.point()
+	case wkbLineString:
+		coordinates, err = r.points()
+	case wkbPolygon:
+		coordinates, err = r.rings()
+	case wkbMultiPoint, wkbMultiLineString, wkbMultiPolygon:
+		var n int
+		if n, err = r.count(5); err != nil {
+			return 0, nil, err
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			// the multi geometries have the items of the single type
+			_, item, err := r.geometry(tp-3, depth+1)
+			if err != nil {
+				return 0, nil, err
+			}
+			items = append(items, item)
+		}
+		coordinates = items
+	case wkbGeometryCollection:
+		var n int
+		if n, err = r.count(5); err != nil {
+			return 0, nil, err
+		}
+		geometries := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			_, g, err := r.geometry(0, depth+1)
+			if err != nil {
+				return 0, nil, err
+			}
+			geometries = append(geometries, g)
+		}
+		return tp, map[string]interface{}{"type": "GeometryCollection", "geometries": geometries}, nil
+	default:
+		return 0, nil, errors.Errorf("unsupported WKB type %d", tp)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if expected != 0 {
+		return tp, coordinates, nil
+	}
+	return tp, map[string]interface{}{"type": geoJSONTypes[tp], "coordinates": coordinates}, nil
+}
+
+var geoJSONTypes = map[uint32]string{
+	wkbPoint:           "Point",
+	wkbLineString:      "LineString",
+	wkbPolygon:         "Polygon",
+	wkbMultiPoint:      "MultiPoint",
+	wkbMultiLineString: "MultiLineString",
+	wkbMultiPolygon:    "MultiPolygon",
+}
+
+// parseGeometry parses the MySQL geometry value, which is the 4 bytes SRID and
+// the WKB, and returns the WKB type and the GeoJSON object.
+func parseGeometry(value interface{}) (uint32, map[string]interface{}, error) {
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		// the dumped value
+		data = []byte(v)
+	default:
+		return 0, nil, errors.Errorf("invalid geometry value %v", value)
+	}
+	if len(data) < 4 {
+		return 0, nil, errors.New("geometry value is too short")
+	}
+
+	r := &wkbReader{data: data[4:]}
+	tp, g, err := r.geometry(0, 0)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	if len(r.data) > 0 {
+		return 0, nil, errors.Errorf("%d bytes after WKB geometry", len(r.data))
+	}
+	return tp, g.(map[string]interface{}), nil
+}
+
+// makeGeoShape converts the geometry value to GeoJSON for geo_shape.
+func makeGeoShape(value interface{}) (interface{}, error) {
+	_, g, err := parseGeometry(value)
+	return g, errors.Trace(err)
+}
+
+// makeGeoPoint converts the POINT value to geo_point, x is the longitude
+// and y is the latitude.
+func makeGeoPoint(value interface{}) (interface{}, error) {
+	tp, g, err := parseGeometry(value)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if tp != wkbPoint {
+		return nil, errors.Errorf("geo_point must be POINT, but %s", g["type"])
+	}
+	p := g["coordinates"].([]float64)
+	return map[string]interface{}{"lon": p[0], "lat": p[1]}, nil
+}
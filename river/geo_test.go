@@ -0,0 +1,77 @@
+package river
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func wkb(order binary.ByteOrder, tp uint32, body ...interface{}) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(&buf, order, tp)
+	for _, v := range body {
+		if b, ok := v.([]byte); ok {
+			buf.Write(b)
+		} else {
+			binary.Write(&buf, order, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+func (s *unitTestSuite) TestGeometry(c *C) {
+	le := binary.LittleEndian
+	srid := []byte{0xe6, 0x10, 0, 0}
+	point := wkb(le, wkbPoint, 1.5, -2.0)
+
+	v, err := makeGeoPoint(string(append(srid, point...)))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, map[string]interface{}{"lon": 1.5, "lat": -2.0})
+
+	v, err = makeGeoShape(append(srid, wkb(binary.BigEndian, wkbPoint, 3.0, 4.0)...))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, map[string]interface{}{"type": "Point", "coordinates": []float64{3, 4}})
+
+	polygon := wkb(le, wkbPolygon, uint32(1), uint32(4), 0.0, 0.0, 1.0, 0.0, 1.0, 1.0, 0.0, 0.0)
+	v, err = makeGeoShape(append(srid, polygon...))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, map[string]interface{}{"type": "Polygon",
+		"coordinates": [][][]float64{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}}})
+
+	multi := wkb(le, wkbMultiPoint, uint32(2), point, wkb(le, wkbPoint, 5.0, 6.0))
+	v, err = makeGeoShape(append(srid, multi...))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, map[string]interface{}{"type": "MultiPoint",
+		"coordinates": []interface{}{[]float64{1.5, -2}, []float64{5, 6}}})
+
+	collection := wkb(le, wkbGeometryCollection, uint32(2), point, wkb(le, wkbLineString, uint32(2), 0.0, 0.0, 1.0, 1.0))
+	v, err = makeGeoShape(append(srid, collection...))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, map[string]interface{}{"type": "GeometryCollection", "geometries": []interface{}{
+		map[string]interface{}{"type": "Point", "coordinates": []float64{1.5, -2}},
+		map[string]interface{}{"type": "LineString", "coordinates": [][]float64{{0, 0}, {1, 1}}},
+	}})
+
+	_, err = makeGeoPoint(append(srid, polygon...))
+	c.Assert(err, NotNil)
+	_, err = makeGeoShape(append(srid, point[:10]...))
+	c.Assert(err, NotNil)
+	_, err = makeGeoShape(append(srid, wkb(le, wkbMultiPoint, uint32(1), polygon)...))
+	c.Assert(err, NotNil)
+	_, err = makeGeoShape(append(srid, wkb(le, wkbLineString, uint32(1000000))...))
+	c.Assert(err, NotNil)
+
+	r := &River{}
+	col := &schema.TableColumn{Name: "location", Type: schema.TYPE_STRING, RawType: "point"}
+	c.Assert(r.getFieldValue(col, fieldTypeGeoPoint, append(srid, point...)), DeepEquals, map[string]interface{}{"lon": 1.5, "lat": -2.0})
+	c.Assert(r.getFieldValue(col, fieldTypeGeoShape, nil), IsNil)
+	c.Assert(r.getFieldValue(col, fieldTypeGeoShape, []byte{1}), IsNil)
+	c.Assert(inferFieldMapping(col, fieldTypeGeoShape), DeepEquals, map[string]interface{}{"type": "geo_shape"})
+}
@@ -0,0 +1,134 @@
+package river
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go/sync2"
+)
+
+// heartbeat writes the current time into a tiny table periodically,
+// when the write comes back from the binlog, we know the real lag
+// between MySQL and us, and if nothing comes back in time, the
+// replication connection may be dead silently.
+type heartbeat struct {
+	r *River
+
+	schema string
+	table  string
+
+	interval time.Duration
+	timeout  time.Duration
+
+	lastSeen sync2.AtomicInt64
+	lag      sync2.AtomicDuration
+}
+
+func newHeartbeat(r *River) (*heartbeat, error) {
+	seps := strings.Split(r.c.HeartbeatTable, ".")
+	if len(seps) != 2 || len(seps[0]) == 0 || len(seps[1]) == 0 {
+		return nil, errors.Errorf("invalid heartbeat table %s, must be schema.table", r.c.HeartbeatTable)
+	}
+
+	h := new(heartbeat)
+	h.r = r
+	h.schema = seps[0]
+	h.table = seps[1]
+
+	h.interval = r.c.HeartbeatInterval.Duration
+	if h.interval == 0 {
+		h.interval = time.Second
+	}
+	h.timeout = r.c.HeartbeatTimeout.Duration
+	h.lastSeen.Set(time.Now().UnixNano())
+
+	return h, nil
+}
+
+func (h *heartbeat) prepare() error {
+	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s` (server_id INT UNSIGNED NOT NULL, ts BIGINT NOT NULL, PRIMARY KEY(server_id)) ENGINE=INNODB",
+		h.schema, h.table)
+	_, err := h.r.canal.Execute(sql)
+	return errors.Trace(err)
+}
+
+func (h *heartbeat) match(schema, table string) bool {
+	return strings.EqualFold(schema, h.schema) && strings.EqualFold(table, h.table)
+}
+
+func (h *heartbeat) write() error {
+	sql := fmt.Sprintf("REPLACE INTO `%s`.`%s` (server_id, ts) VALUES (?, ?)", h.schema, h.table)
+	_, err := h.r.canal.Execute(sql, h.r.c.ServerID, time.Now().UnixNano())
+	return errors.Trace(err)
+}
+
+// onRow handles the heartbeat rows read from binlog.
+func (h *heartbeat) onRow(e *canal.RowsEvent) {
+	if e.Action == canal.DeleteAction {
+		return
+	}
+
+	now := time.Now()
+	for _, row := range e.Rows {
+		if len(row) < 2 {
+			continue
+		}
+		serverID, ok := row[0].(uint32)
+		if ok && serverID != h.r.c.ServerID {
+			// written by another river
+			continue
+		}
+		if ts, ok := row[1].(int64); ok {
+			h.lag.Set(now.Sub(time.Unix(0, ts)))
+			h.lastSeen.Set(now.UnixNano())
+		}
+	}
+}
+
+// Lag returns the duration between the last heartbeat write and its arrival.
+func (h *heartbeat) Lag() time.Duration {
+	return h.lag.Get()
+}
+
+func (h *heartbeat) run() {
+	defer h.r.wg.Done()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	dumped := false
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.write(); err != nil {
+				log.Errorf("write heartbeat to %s.%s err %v", h.schema, h.table, err)
+			}
+
+			if !dumped {
+				// binlog is not read until dump is done
+				select {
+				case <-h.r.canal.WaitDumpDone():
+					dumped = true
+					h.lastSeen.Set(time.Now().UnixNano())
+				default:
+				}
+				continue
+			}
+
+			if h.timeout > 0 {
+				last := time.Unix(0, h.lastSeen.Get())
+				if d := time.Since(last); d > h.timeout {
+					log.Errorf("no heartbeat received from binlog for %s, close sync", d)
+					h.r.cancel()
+					return
+				}
+			}
+		case <-h.r.ctx.Done():
+			return
+		}
+	}
+}
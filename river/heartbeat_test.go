@@ -0,0 +1,64 @@
+package river
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestHeartbeat(c *C) {
+	for _, table := range []string{"heartbeat", "test.", ".heartbeat", "a.b.c"} {
+		_, err := newHeartbeat(&River{c: &Config{HeartbeatTable: table}})
+		c.Assert(err, NotNil, Commentf("%s", table))
+	}
+
+	r := &River{c: &Config{ServerID: 1001, HeartbeatTable: "test.heartbeat"}, ctx: context.Background(),
+		master: new(masterInfo), rules: make(map[string]*Rule)}
+	r.st = &stat{r: r}
+	var err error
+	r.hb, err = newHeartbeat(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.hb.interval, Equals, time.Second)
+	c.Assert(r.hb.match("TEST", "Heartbeat"), IsTrue)
+
+	ta := &schema.Table{Schema: "test", Name: "heartbeat"}
+	ta.AddColumn("server_id", "int(10) unsigned", "", "")
+	ta.AddColumn("ts", "bigint(20)", "", "")
+	ta.PKColumns = []int{0}
+	h := &eventHandler{r: r}
+	header := &replication.EventHeader{LogPos: 120}
+
+	// the lag is from the write time in the row to its arrival
+	lastSeen := r.hb.lastSeen.Get()
+	written := time.Now().Add(-2 * time.Second).UnixNano()
+	c.Assert(h.OnRow(&canal.RowsEvent{Action: canal.UpdateAction, Table: ta, Header: header,
+		Rows: [][]interface{}{{uint32(1001), written - int64(time.Second)}, {uint32(1001), written}}}), IsNil)
+	lag := r.hb.Lag()
+	c.Assert(lag >= 2*time.Second && lag < 3*time.Second, IsTrue, Commentf("%s", lag))
+	c.Assert(r.hb.lastSeen.Get() > lastSeen, IsTrue)
+
+	// the heartbeats of the other rivers and the deletes are skipped
+	c.Assert(h.OnRow(&canal.RowsEvent{Action: canal.InsertAction, Table: ta, Header: header,
+		Rows: [][]interface{}{{uint32(1002), time.Now().UnixNano()}}}), IsNil)
+	c.Assert(h.OnRow(&canal.RowsEvent{Action: canal.DeleteAction, Table: ta, Header: header,
+		Rows: [][]interface{}{{uint32(1001), time.Now().UnixNano()}}}), IsNil)
+	c.Assert(r.hb.Lag(), Equals, lag)
+	// the heartbeat rows are counted in the binlog stat, but not synced
+	c.Assert(r.st.Binlog.RowNum.Get(), Equals, int64(3))
+	c.Assert(r.st.InsertNum.Get(), Equals, int64(0))
+
+	c.Assert(r.st.dashboardData().Lag, Equals, lag.String())
+	w := httptest.NewRecorder()
+	r.st.serveVars(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars map[string]json.RawMessage
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &vars), IsNil)
+	var river map[string]float64
+	c.Assert(json.Unmarshal(vars["river"], &river), IsNil)
+	c.Assert(river["river_heartbeat_lag_seconds"], Equals, lag.Seconds())
+}
@@ -0,0 +1,221 @@
+package river
+
+import (
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// inflightBulk is a bulk being sent by a worker.
+type inflightBulk struct {
+	seq  uint64
+	docs map[[3]string]bool
+	// the estimated bytes of the requests with max_buffer_size
+	size int64
+	done chan struct{}
+	err  error
+}
+
+// pendingPos is a position of the upstream to save after the bulks up to seq are done.
+type pendingPos struct {
+	seq    uint64
+	pos    mysql.Position
+	master *masterInfo
+}
+
+// bulkTracker sends the bulks concurrently with at most max_inflight_bulks in flight,
+// and tracks the outstanding ones, so a position is saved only after all the bulks
+// sent before it are done, not just the latest one. The bulks of the same docs are
+// still sent in order. It is only used in the sync loop, except the workers.
+type bulkTracker struct {
+	r   *River
+	sem chan struct{}
+	// max_buffer_size, the sends wait for the bulks while the buffered bytes exceed it
+	maxBuffer int64
+	// notified when a bulk is done
+	doneCh chan struct{}
+
+	// seq of the last bulk sent
+	seq uint64
+	// in the seq order
+	inflight  []*inflightBulk
+	positions []pendingPos
+	// the first error of the bulks, no position is saved after it
+	err error
+}
+
+func newBulkTracker(r *River, max int, maxBuffer int64) *bulkTracker {
+	return &bulkTracker{
+		r:         r,
+		sem:       make(chan struct{}, max),
+		maxBuffer: maxBuffer,
+		doneCh:    make(chan struct{}, 1),
+	}
+}
+
+// bulkDocKey returns the doc of the request, the docs with the ES generated ids
+// are never written again, so they are not ordered.
+func bulkDocKey(req *elastic.BulkRequest) ([3]string, bool) {
+	if len(req.ID) == 0 {
+		return [3]string{}, false
+	}
+	return [3]string{req.Cluster, req.Index, req.ID}, true
+}
+
+// send sends the bulk in a worker after the in-flight bulks of the same docs are done,
+// it blocks if max_inflight_bulks are in flight, or the buffered bytes exceed max_buffer_size.
+// The requests and their size bytes are released by the worker.
+func (t *bulkTracker) send(reqs []*elastic.BulkRequest, size int64) error {
+	if err := t.reap(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if t.maxBuffer > 0 && len(t.inflight) > 0 && t.r.st.BufferedBytes.Get() > t.maxBuffer {
+		// stop reading the binlog until the oldest bulks are done
+		log.Infof("buffered requests of %d bytes exceed max_buffer_size %d, wait for %d in-flight bulks",
+			t.r.st.BufferedBytes.Get(), t.maxBuffer, len(t.inflight))
+		t.r.st.BufferWaitNum.Add(1)
+		for len(t.inflight) > 0 && t.r.st.BufferedBytes.Get() > t.maxBuffer {
+			if err := t.waitBulk(t.inflight[0]); err != nil {
+				t.reap()
+				return errors.Trace(err)
+			}
+			if err := t.reap(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	docs := make(map[[3]string]bool, len(reqs))
+	for _, req := range reqs {
+		if key, ok := bulkDocKey(req); ok {
+			docs[key] = true
+		}
+	}
+	for _, b := range t.inflight {
+		for key := range docs {
+			if b.docs[key] {
+				if err := t.waitBulk(b); err != nil {
+					return errors.Trace(err)
+				}
+				break
+			}
+		}
+	}
+
+	select {
+	case t.sem <- struct{}{}:
+	case <-t.r.ctx.Done():
+		return errors.Trace(t.r.ctx.Err())
+	}
+
+	t.seq++
+	b := &inflightBulk{seq: t.seq, docs: docs, size: size, done: make(chan struct{})}
+	t.inflight = append(t.inflight, b)
+	t.r.st.InflightBulkNum.Add(1)
+
+	go func() {
+		b.err = t.r.doBulk(reqs)
+		if b.err == nil {
+			elastic.ReleaseBulkRequests(reqs)
+		}
+		t.r.st.BufferedBytes.Add(-b.size)
+		t.r.st.InflightBulkNum.Add(-1)
+		<-t.sem
+		close(b.done)
+
+		select {
+		case t.doneCh <- struct{}{}:
+		default:
+		}
+	}()
+	return nil
+}
+
+func (t *bulkTracker) waitBulk(b *inflightBulk) error {
+	select {
+	case <-b.done:
+		return errors.Trace(b.err)
+	case <-t.r.ctx.Done():
+		return errors.Trace(t.r.ctx.Err())
+	}
+}
+
+// reap removes the bulks done, and returns the first error of them.
+func (t *bulkTracker) reap() error {
+	inflight := t.inflight[:0]
+	for _, b := range t.inflight {
+		select {
+		case <-b.done:
+			if b.err != nil && t.err == nil {
+				t.err = b.err
+			}
+		default:
+			inflight = append(inflight, b)
+		}
+	}
+	t.inflight = inflight
+	return t.err
+}
+
+// wait waits for all the in-flight bulks.
+func (t *bulkTracker) wait() error {
+	for _, b := range t.inflight {
+		if err := t.waitBulk(b); err != nil {
+			t.reap()
+			return errors.Trace(err)
+		}
+	}
+	return t.reap()
+}
+
+// savePos saves the position of the upstream after the bulks sent so far are done.
+func (t *bulkTracker) savePos(master *masterInfo, pos mysql.Position) {
+	t.positions = append(t.positions, pendingPos{t.seq, pos, master})
+}
+
+// completedPos returns the latest position of every upstream whose bulks are all done.
+func (t *bulkTracker) completedPos() []pendingPos {
+	if t.err != nil {
+		return nil
+	}
+
+	oldest := t.seq + 1
+	if len(t.inflight) > 0 {
+		oldest = t.inflight[0].seq
+	}
+	n := 0
+	for n < len(t.positions) && t.positions[n].seq < oldest {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	var done []pendingPos
+	for i := n - 1; i >= 0; i-- {
+		latest := true
+		for _, p := range done {
+			if p.master == t.positions[i].master {
+				latest = false
+				break
+			}
+		}
+		if latest {
+			done = append(done, t.positions[i])
+		}
+	}
+	t.positions = t.positions[n:]
+	return done
+}
+
+// close waits for the workers even if the sync is closed, and returns the
+// latest positions whose bulks are all done.
+func (t *bulkTracker) close() []pendingPos {
+	for _, b := range t.inflight {
+		<-b.done
+	}
+	t.reap()
+	return t.completedPos()
+}
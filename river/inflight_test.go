@@ -0,0 +1,77 @@
+package river
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestInflightBulks(c *C) {
+	release := make(chan struct{})
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if strings.Contains(string(body), `"slow"`) {
+			<-release
+		}
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer es.Close()
+
+	r := &River{c: &Config{MaxInflightBulks: 2}, st: &stat{}, limits: newRateLimits(0, 0)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	defer r.cancel()
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	t := newBulkTracker(r, r.c.MaxInflightBulks, 0)
+
+	newReqs := func(index string, id string) []*elastic.BulkRequest {
+		return []*elastic.BulkRequest{{Action: elastic.ActionIndex, Index: index, ID: id, Data: map[string]interface{}{"a": 1}}}
+	}
+	// the positions of the primary and an upstream
+	master, upstream := new(masterInfo), new(masterInfo)
+	c.Assert(t.send(newReqs("slow", "1"), 0), IsNil)
+	t.savePos(master, mysql.Position{Name: "mysql-bin.000001", Pos: 100})
+	t.savePos(upstream, mysql.Position{Name: "mysql-bin.000009", Pos: 900})
+	c.Assert(t.send(newReqs("fast", "1"), 0), IsNil)
+	t.savePos(master, mysql.Position{Name: "mysql-bin.000001", Pos: 200})
+
+	// the later bulk is done, but the position waits for the earlier one
+	for t.r.st.InflightBulkNum.Get() > 1 {
+		<-t.doneCh
+	}
+	c.Assert(t.reap(), IsNil)
+	c.Assert(t.completedPos(), HasLen, 0)
+
+	close(release)
+	c.Assert(t.wait(), IsNil)
+	saved := t.completedPos()
+	c.Assert(saved, HasLen, 2)
+	c.Assert(saved[0].master, Equals, master)
+	c.Assert(saved[0].pos.Pos, Equals, uint32(200))
+	c.Assert(saved[1].master, Equals, upstream)
+	c.Assert(saved[1].pos.Pos, Equals, uint32(900))
+	c.Assert(t.inflight, HasLen, 0)
+
+	// the bulks of the same docs are in order
+	release = make(chan struct{})
+	c.Assert(t.send(newReqs("slow", "2"), 0), IsNil)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- t.send(newReqs("slow", "2"), 0)
+	}()
+	select {
+	case <-sent:
+		c.Fatal("the bulk of the same doc is sent before the in-flight one is done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	c.Assert(<-sent, IsNil)
+	c.Assert(t.close(), HasLen, 0)
+	c.Assert(t.r.st.InflightBulkNum.Get(), Equals, int64(0))
+}
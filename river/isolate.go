@@ -0,0 +1,341 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go/sync2"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// the requests buffered by an isolated rule are up to this times of its bulk size by default,
+// the sync loop waits for its bulk after that
+const defaultIsolateMaxPendingBulks = 16
+
+// isolatedLane sends the batches of a rule with isolate in its own worker, so a slow index
+// doesn't block the flushes of the other rules. One bulk of the rule is in flight at a time,
+// the requests are buffered in the batch meanwhile, and sent in the next bulk after it.
+type isolatedLane struct {
+	batch *ruleBatch
+	// max requests buffered, see isolate_max_pending
+	maxPending int
+	// the estimated bytes of the buffered requests with max_buffer_size
+	size int64
+
+	// the bulk in flight, only used in the sync loop except the worker
+	busy         bool
+	done         chan struct{}
+	err          error
+	inflightReqs int
+
+	// requests taken in and done, the positions wait for them
+	queued    uint64
+	completed uint64
+
+	// for the status, read by the stat server
+	name string
+	// requests buffered and in flight
+	pending sync2.AtomicInt64
+	// the start time of the bulk in flight in nanoseconds, 0 if no bulk
+	inflightSince sync2.AtomicInt64
+	// duration of the last bulk in nanoseconds
+	lastBulkTime sync2.AtomicInt64
+}
+
+// isolatedPos is a position of the upstream to save after the isolated lanes are done
+// with the requests taken in before it.
+type isolatedPos struct {
+	pendingPos
+	queued map[*isolatedLane]uint64
+}
+
+// isolation tracks the isolated lanes of the sync loop, it is only used in the sync loop,
+// except the workers. The bulks of the lanes are not in max_inflight_bulks.
+type isolation struct {
+	r         *River
+	bulkSize  int
+	interval  time.Duration
+	maxBuffer int64
+	// notified when a bulk is done
+	doneCh chan struct{}
+
+	lanes     map[*Rule]*isolatedLane
+	positions []isolatedPos
+	// the first error of the bulks, no position is saved after it
+	err error
+}
+
+func newIsolation(r *River, bulkSize int, interval time.Duration, maxBuffer int64) *isolation {
+	return &isolation{
+		r:         r,
+		bulkSize:  bulkSize,
+		interval:  interval,
+		maxBuffer: maxBuffer,
+		doneCh:    make(chan struct{}, 1),
+		lanes:     make(map[*Rule]*isolatedLane),
+	}
+}
+
+// add buffers the requests of the rule, and sends them if the lane is idle and the batch is full.
+// It waits for the bulk in flight if the rule has isolate_max_pending requests buffered.
+func (iso *isolation) add(rule *Rule, reqs []*elastic.BulkRequest) error {
+	l, ok := iso.lanes[rule]
+	if !ok {
+		l = &isolatedLane{batch: newRuleBatch(rule, iso.bulkSize, iso.interval), name: dashboardRuleName(rule)}
+		l.maxPending = rule.IsolateMaxPending
+		if l.maxPending == 0 {
+			l.maxPending = defaultIsolateMaxPendingBulks * l.batch.size
+		}
+		iso.lanes[rule] = l
+		iso.r.st.addIsolatedLane(l)
+		log.Infof("isolate the requests of rule %s", l.name)
+	}
+
+	l.batch.reqs = append(l.batch.reqs, reqs...)
+	if iso.maxBuffer > 0 {
+		n := requestsSize(reqs)
+		l.size += n
+		iso.r.st.BufferedBytes.Add(n)
+	}
+	l.queued += uint64(len(reqs))
+	l.pending.Add(int64(len(reqs)))
+
+	for l.busy && len(l.batch.reqs) >= l.maxPending {
+		log.Warnf("rule %s has %d requests buffered, wait for its bulk", l.name, len(l.batch.reqs))
+		select {
+		case <-l.done:
+		case <-iso.r.ctx.Done():
+			return errors.Trace(iso.r.ctx.Err())
+		}
+		if err := iso.reap(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if !l.busy && len(l.batch.reqs) >= l.batch.size {
+		iso.send(l)
+	}
+	return nil
+}
+
+// send sends the buffered requests of the lane in the worker.
+func (iso *isolation) send(l *isolatedLane) {
+	reqs := l.batch.reqs
+	size := l.size
+	l.batch.reqs = make([]*elastic.BulkRequest, 0, cap(reqs))
+	l.batch.lastFlushTime = time.Now()
+	l.size = 0
+
+	l.busy = true
+	l.inflightReqs = len(reqs)
+	l.err = nil
+	done := make(chan struct{})
+	l.done = done
+	start := time.Now()
+	l.inflightSince.Set(start.UnixNano())
+
+	go func() {
+		err := iso.r.doBulk(reqs)
+		if err == nil {
+			elastic.ReleaseBulkRequests(reqs)
+		}
+		iso.r.st.BufferedBytes.Add(-size)
+		l.lastBulkTime.Set(int64(time.Since(start)))
+		l.err = err
+		close(done)
+
+		select {
+		case iso.doneCh <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// reap marks the bulks done, sends the requests buffered meanwhile, and returns the first error.
+func (iso *isolation) reap() error {
+	for _, l := range iso.lanes {
+		if l.busy && iso.markDone(l) && len(l.batch.reqs) > 0 && iso.err == nil {
+			iso.send(l)
+		}
+	}
+	return iso.err
+}
+
+// markDone marks the bulk of the lane done if it is, false if it is still in flight.
+func (iso *isolation) markDone(l *isolatedLane) bool {
+	select {
+	case <-l.done:
+	default:
+		return false
+	}
+	l.busy = false
+	l.inflightSince.Set(0)
+	if l.err != nil {
+		if iso.err == nil {
+			iso.err = errors.Annotatef(l.err, "isolated rule %s", l.name)
+		}
+		return true
+	}
+	l.completed += uint64(l.inflightReqs)
+	l.pending.Add(-int64(l.inflightReqs))
+	return true
+}
+
+// flush sends the buffered requests of the idle lanes, all of them or the ones
+// reaching flush_bulk_time.
+func (iso *isolation) flush(all bool) {
+	now := time.Now()
+	for _, l := range iso.lanes {
+		if l.busy || len(l.batch.reqs) == 0 {
+			continue
+		}
+		if all || now.Sub(l.batch.lastFlushTime) >= l.batch.interval {
+			iso.send(l)
+		}
+	}
+}
+
+// wait sends all the buffered requests, and waits for them to be done.
+func (iso *isolation) wait() error {
+	for _, l := range iso.lanes {
+		for l.busy || len(l.batch.reqs) > 0 {
+			if !l.busy {
+				iso.send(l)
+			}
+			select {
+			case <-l.done:
+			case <-iso.r.ctx.Done():
+				return errors.Trace(iso.r.ctx.Err())
+			}
+			if err := iso.reap(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return iso.reap()
+}
+
+// holds returns true if a position must wait for the lanes, the positions are saved in order.
+func (iso *isolation) holds() bool {
+	if len(iso.positions) > 0 {
+		return true
+	}
+	for _, l := range iso.lanes {
+		if l.completed < l.queued {
+			return true
+		}
+	}
+	return false
+}
+
+// savePos saves the position of the upstream after the requests taken in so far are done.
+func (iso *isolation) savePos(master *masterInfo, pos mysql.Position) {
+	queued := make(map[*isolatedLane]uint64, len(iso.lanes))
+	for _, l := range iso.lanes {
+		if l.completed < l.queued {
+			queued[l] = l.queued
+		}
+	}
+	iso.positions = append(iso.positions, isolatedPos{pendingPos{pos: pos, master: master}, queued})
+}
+
+// completedPos returns the positions whose requests of the lanes are all done, in order.
+func (iso *isolation) completedPos() []pendingPos {
+	if iso.err != nil {
+		return nil
+	}
+	n := 0
+positions:
+	for ; n < len(iso.positions); n++ {
+		for l, queued := range iso.positions[n].queued {
+			if l.completed < queued {
+				break positions
+			}
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	done := make([]pendingPos, 0, n)
+	for _, p := range iso.positions[:n] {
+		done = append(done, p.pendingPos)
+	}
+	iso.positions = iso.positions[n:]
+	return done
+}
+
+// close waits for the bulks in flight even if the sync is closed, and returns the
+// positions whose requests are all done.
+func (iso *isolation) close() []pendingPos {
+	for _, l := range iso.lanes {
+		if l.busy {
+			<-l.done
+			iso.markDone(l)
+		}
+	}
+	return iso.completedPos()
+}
+
+// pendingReqs returns the requests buffered and in flight of the lanes.
+func (iso *isolation) pendingReqs() int {
+	n := 0
+	for _, l := range iso.lanes {
+		n += int(l.pending.Get())
+	}
+	return n
+}
+
+func (s *stat) addIsolatedLane(l *isolatedLane) {
+	s.isolatedMu.Lock()
+	s.isolatedLanes = append(s.isolatedLanes, l)
+	s.isolatedMu.Unlock()
+}
+
+// isolatedStatus returns the isolated lanes by the rule names.
+func (s *stat) isolatedStatus() []*isolatedLane {
+	s.isolatedMu.Lock()
+	lanes := append([]*isolatedLane(nil), s.isolatedLanes...)
+	s.isolatedMu.Unlock()
+	sort.Slice(lanes, func(i, j int) bool { return lanes[i].name < lanes[j].name })
+	return lanes
+}
+
+// inflightSeconds returns how long the bulk has been in flight, 0 if no bulk.
+func (l *isolatedLane) inflightSeconds() float64 {
+	since := l.inflightSince.Get()
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since)).Seconds()
+}
+
+// writeIsolatedMetrics writes the metrics of the isolated lanes with the rule label.
+func (s *stat) writeIsolatedMetrics(buf *bytes.Buffer) {
+	lanes := s.isolatedStatus()
+	if len(lanes) == 0 {
+		return
+	}
+	metrics := []struct {
+		name  string
+		help  string
+		value func(l *isolatedLane) float64
+	}{
+		{"river_isolated_pending_requests", "Requests buffered and in flight of the isolated rule.",
+			func(l *isolatedLane) float64 { return float64(l.pending.Get()) }},
+		{"river_isolated_inflight_seconds", "How long the bulk of the isolated rule has been in flight.",
+			func(l *isolatedLane) float64 { return l.inflightSeconds() }},
+		{"river_isolated_last_bulk_seconds", "Duration of the last bulk of the isolated rule.",
+			func(l *isolatedLane) float64 { return time.Duration(l.lastBulkTime.Get()).Seconds() }},
+	}
+	for _, m := range metrics {
+		buf.WriteString(fmt.Sprintf("# HELP %s %s\n", m.name, m.help))
+		buf.WriteString(fmt.Sprintf("# TYPE %s %s\n", m.name, metricGauge))
+		for _, l := range lanes {
+			buf.WriteString(fmt.Sprintf("%s{rule=%q} %g\n", m.name, l.name, m.value(l)))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package river
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestIsolatedRule(c *C) {
+	bodies := make(chan string, 8)
+	release := make(chan struct{})
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if strings.Contains(string(body), `"slow"`) {
+			<-release
+		}
+		bodies <- string(body)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer es.Close()
+
+	slow := &Rule{Schema: "test", Table: "slow", Index: "slow", Isolate: true}
+	c.Assert(slow.prepare(), IsNil)
+	c.Assert(slow.hasOwnBatch(), IsTrue)
+
+	r := &River{c: &Config{}, st: &stat{}, limits: newRateLimits(0, 0)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	defer r.cancel()
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	iso := newIsolation(r, 1, time.Hour, 0)
+
+	newReqs := func(index string, id string) []*elastic.BulkRequest {
+		return []*elastic.BulkRequest{{Action: elastic.ActionIndex, Index: index, ID: id, Data: map[string]interface{}{"a": 1}}}
+	}
+	master := new(masterInfo)
+	c.Assert(iso.add(slow, newReqs("slow", "1")), IsNil)
+	c.Assert(iso.holds(), IsTrue)
+	iso.savePos(master, mysql.Position{Name: "mysql-bin.000001", Pos: 100})
+
+	// the other rules are not blocked by the bulk in flight
+	c.Assert(r.doBulk(newReqs("fast", "1")), IsNil)
+	c.Assert(<-bodies, Matches, `(?s).*"fast".*`)
+
+	// the requests are buffered until the bulk is done, and the position waits for them
+	c.Assert(iso.add(slow, newReqs("slow", "2")), IsNil)
+	c.Assert(iso.pendingReqs(), Equals, 2)
+	c.Assert(iso.reap(), IsNil)
+	c.Assert(iso.completedPos(), HasLen, 0)
+
+	var metrics bytes.Buffer
+	r.st.writeIsolatedMetrics(&metrics)
+	c.Assert(metrics.String(), Matches, `(?s).*river_isolated_pending_requests\{rule="test.slow -> slow"\} 2\n.*`)
+
+	close(release)
+	c.Assert(iso.wait(), IsNil)
+	c.Assert(strings.Count(<-bodies+<-bodies, `"slow"`), Equals, 2)
+	saved := iso.completedPos()
+	c.Assert(saved, HasLen, 1)
+	c.Assert(saved[0].pos.Pos, Equals, uint32(100))
+	c.Assert(iso.holds(), IsFalse)
+	c.Assert(iso.pendingReqs(), Equals, 0)
+	c.Assert(r.st.isolatedStatus(), HasLen, 1)
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", Isolate: true, Webhook: "http://127.0.0.1/purge"}
+	c.Assert(rule.prepare(), NotNil)
+	rule = &Rule{Schema: "test", Table: "t", Index: "t", IsolateMaxPending: -1}
+	c.Assert(rule.prepare(), NotNil)
+}
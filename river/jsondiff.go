@@ -0,0 +1,286 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// jsonDiffScript applies the partial JSON updates params.diffs to the doc after
+// merging the changed fields params.doc, every diff has the op, the path steps
+// with the ES field first and the new value.
+const jsonDiffScript = `ctx._source.putAll(params.doc);
+for (d in params.diffs) {
+  def o = ctx._source;
+  for (int i = 0; i < d.path.length - 1; i++) { o = o[d.path[i]]; }
+  def k = d.path[d.path.length - 1];
+  if (d.op == 'remove') { o.remove(k); }
+  else if (o instanceof List && (d.op == 'insert' || k == o.size())) { o.add(k, d.value); }
+  else { o[k] = d.value; }
+}`
+
+func jsonDiffOp(op replication.JsonDiffOperation) string {
+	return strings.ToLower(op.String())
+}
+
+// parseJSONPath parses the MySQL JSON path of a diff like $.a."b c"[1] into
+// the steps, the object keys are strings and the array indices are ints.
+func parseJSONPath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.Errorf("invalid JSON path %s", path)
+	}
+
+	var steps []interface{}
+	for i := 1; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+			if i < len(path) && path[i] == '"' {
+				// the quoted key is a JSON string
+				end := i + 1
+				for end < len(path) && path[end] != '"' {
+					if path[end] == '\\' {
+						end++
+					}
+					end++
+				}
+				if end >= len(path) {
+					return nil, errors.Errorf("invalid JSON path %s", path)
+				}
+				var key string
+				if err := json.Unmarshal([]byte(path[i:end+1]), &key); err != nil {
+					return nil, errors.Errorf("invalid JSON path %s", path)
+				}
+				steps = append(steps, key)
+				i = end + 1
+			} else {
+				end := i
+				for end < len(path) && path[end] != '.' && path[end] != '[' {
+					end++
+				}
+				if end == i {
+					return nil, errors.Errorf("invalid JSON path %s", path)
+				}
+				steps = append(steps, path[i:end])
+				i = end
+			}
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, errors.Errorf("invalid JSON path %s", path)
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(path[i+1 : i+end]))
+			if err != nil || n < 0 {
+				return nil, errors.Errorf("invalid JSON path %s", path)
+			}
+			steps = append(steps, n)
+			i += end + 1
+		case ' ':
+			i++
+		default:
+			return nil, errors.Errorf("invalid JSON path %s", path)
+		}
+	}
+	return steps, nil
+}
+
+func decodeJSONValue(s string) (interface{}, error) {
+	d := json.NewDecoder(strings.NewReader(s))
+	// keep the big integers as they are when encoding the doc again
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return v, nil
+}
+
+// applyJSONDiff applies the op to the value at the path steps of v, and returns the new v.
+func applyJSONDiff(v interface{}, steps []interface{}, op replication.JsonDiffOperation, value interface{}) (interface{}, error) {
+	if len(steps) == 0 {
+		if op == replication.JsonDiffOperationRemove {
+			return nil, errors.New("can't remove the JSON document")
+		}
+		return value, nil
+	}
+
+	last := len(steps) == 1
+	switch step := steps[0].(type) {
+	case string:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("key %s of non JSON object", step)
+		}
+		if last {
+			if op == replication.JsonDiffOperationRemove {
+				delete(m, step)
+			} else {
+				m[step] = value
+			}
+			return m, nil
+		}
+		child, err := applyJSONDiff(m[step], steps[1:], op, value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		m[step] = child
+		return m, nil
+	case int:
+		a, ok := v.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("index %d of non JSON array", step)
+		}
+		if last {
+			switch {
+			case op == replication.JsonDiffOperationRemove && step < len(a):
+				return append(a[:step], a[step+1:]...), nil
+			case op == replication.JsonDiffOperationInsert && step < len(a):
+				a = append(a, nil)
+				copy(a[step+1:], a[step:])
+				a[step] = value
+				return a, nil
+			case op != replication.JsonDiffOperationRemove && step == len(a):
+				return append(a, value), nil
+			case op == replication.JsonDiffOperationReplace && step < len(a):
+				a[step] = value
+				return a, nil
+			}
+			return nil, errors.Errorf("index %d out of JSON array of %d", step, len(a))
+		}
+		if step >= len(a) {
+			return nil, errors.Errorf("index %d out of JSON array of %d", step, len(a))
+		}
+		child, err := applyJSONDiff(a[step], steps[1:], op, value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		a[step] = child
+		return a, nil
+	}
+	return nil, errors.Errorf("invalid JSON path step %v", steps[0])
+}
+
+// applyJSONDiffs applies the diffs to the JSON text before, and returns the new JSON text.
+func applyJSONDiffs(before interface{}, diffs []*replication.JsonDiff) (string, error) {
+	var text string
+	switch v := before.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return "", errors.Errorf("invalid JSON value %v", before)
+	}
+
+	doc, err := decodeJSONValue(text)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	for _, diff := range diffs {
+		steps, err := parseJSONPath(diff.Path)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		var value interface{}
+		if diff.Op != replication.JsonDiffOperationRemove {
+			if value, err = decodeJSONValue(diff.Value); err != nil {
+				return "", errors.Trace(err)
+			}
+		}
+		if doc, err = applyJSONDiff(doc, steps, diff.Op, value); err != nil {
+			return "", errors.Annotatef(err, "apply %s %s", diff.Op, diff.Path)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(doc); err != nil {
+		return "", errors.Trace(err)
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// resolveJSONDiffs replaces the partial JSON updates of MySQL 8 in the after images
+// with the whole JSON texts made from the before images. If the before image has no
+// such column, like with binlog_row_image MINIMAL, the column is marked missing in
+// the after image to be fetched, and the diffs are kept for the partial updates.
+func (r *River) resolveJSONDiffs(e *canal.RowsEvent) error {
+	if e.Action != canal.UpdateAction {
+		return nil
+	}
+
+	var bitmap []byte
+	for i := 0; i+1 < len(e.Rows); i += 2 {
+		before, after := e.Rows[i], e.Rows[i+1]
+		for j := range after {
+			diffs, ok := after[j].([]*replication.JsonDiff)
+			if !ok {
+				continue
+			}
+
+			var err error
+			if isColumnPresent(e.ColumnBitmap1, j) && before[j] != nil {
+				var text string
+				if text, err = applyJSONDiffs(before[j], diffs); err == nil {
+					after[j] = text
+					continue
+				}
+			} else {
+				err = errors.New("no JSON value in the before image")
+			}
+
+			name := e.Table.Columns[j].Name
+			if len(r.c.PartialRowImage) == 0 {
+				return errors.Errorf("partial JSON update of %s.%s.%s err %v", e.Table.Schema, e.Table.Name, name, err)
+			}
+			log.Debugf("partial JSON update of %s.%s.%s is not applied, %v", e.Table.Schema, e.Table.Name, name, err)
+			if bitmap == nil {
+				// the bitmap is in the event data, don't change it
+				bitmap = append([]byte(nil), e.ColumnBitmap2...)
+				e.ColumnBitmap2 = bitmap
+			}
+			if j>>3 < len(bitmap) {
+				bitmap[j>>3] &^= 1 << (uint(j) & 7)
+			}
+		}
+	}
+	return nil
+}
+
+// makeJSONDiffParams makes the script params of the partial JSON updates of the row
+// for the partial update, returns nil if there are none.
+func (r *River) makeJSONDiffParams(rule *Rule, after []interface{}) ([]interface{}, error) {
+	var params []interface{}
+	for _, f := range rule.fields {
+		diffs, ok := after[f.column].([]*replication.JsonDiff)
+		if !ok || f.compute != nil || rule.TableInfo.Columns[f.column].Type != schema.TYPE_JSON {
+			continue
+		}
+		for _, diff := range diffs {
+			steps, err := parseJSONPath(diff.Path)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			var value interface{}
+			if diff.Op != replication.JsonDiffOperationRemove {
+				if value, err = decodeJSONValue(diff.Value); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+			params = append(params, map[string]interface{}{
+				"op":    jsonDiffOp(diff.Op),
+				"path":  append([]interface{}{f.esField}, steps...),
+				"value": value,
+			})
+		}
+	}
+	return params, nil
+}
@@ -0,0 +1,64 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestPartialJSON(c *C) {
+	steps, err := parseJSONPath(`$.a."b c"[2]`)
+	c.Assert(err, IsNil)
+	c.Assert(steps, DeepEquals, []interface{}{"a", "b c", 2})
+	_, err = parseJSONPath(`$.a[*]`)
+	c.Assert(err, NotNil)
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("doc", "json", "", "")
+	ta.PKColumns = []int{0}
+
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+
+	diffs := []*replication.JsonDiff{
+		{Op: replication.JsonDiffOperationReplace, Path: "$.a", Value: "2"},
+		{Op: replication.JsonDiffOperationInsert, Path: "$.l[0]", Value: `"x"`},
+		{Op: replication.JsonDiffOperationRemove, Path: "$.b"},
+	}
+
+	// applied to the before image of the full row image
+	e := &canal.RowsEvent{Table: ta, Action: canal.UpdateAction, Header: &replication.EventHeader{},
+		ColumnBitmap1: []byte{0x03}, ColumnBitmap2: []byte{0x03},
+		Rows: [][]interface{}{{int32(1), `{"a":1,"b":true,"l":["y"]}`}, {int32(1), diffs}}}
+	c.Assert(r.resolveJSONDiffs(e), IsNil)
+	c.Assert(e.Rows[1][1], Equals, `{"a":2,"l":["x","y"]}`)
+
+	// kept for the partial update script without the before image
+	r.c.PartialRowImage = PartialRowUpdate
+	bitmap := []byte{0x03}
+	e = &canal.RowsEvent{Table: ta, Action: canal.UpdateAction, Header: &replication.EventHeader{},
+		ColumnBitmap1: []byte{0x01}, ColumnBitmap2: bitmap,
+		Rows: [][]interface{}{{int32(1), nil}, {int32(1), diffs}}}
+	c.Assert(r.resolveJSONDiffs(e), IsNil)
+	c.Assert(bitmap[0], Equals, byte(0x03))
+	c.Assert(e.ColumnBitmap2[0], Equals, byte(0x01))
+	c.Assert(isPartialRowsEvent(e), Equals, true)
+
+	reqs, err := r.makePartialUpdateRequest(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Script["source"], Equals, jsonDiffScript)
+	params := reqs[0].Script["params"].(map[string]interface{})
+	ops := params["diffs"].([]interface{})
+	c.Assert(ops, HasLen, 3)
+	c.Assert(ops[1], DeepEquals, map[string]interface{}{"op": "insert", "path": []interface{}{"doc", "l", 0}, "value": "x"})
+
+	// the full row image must be applied
+	r.c.PartialRowImage = ""
+	e.Rows[1][1] = diffs
+	c.Assert(r.resolveJSONDiffs(e), NotNil)
+}
@@ -0,0 +1,158 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+const (
+	kafkaContentType    = "application/vnd.kafka.json.v2+json"
+	defaultKafkaTimeout = 30 * time.Second
+)
+
+// kafkaMirror publishes the doc operations of the bulks to a Kafka topic through
+// the REST proxy, like Confluent REST Proxy, so other consumers can reuse the changes.
+type kafkaMirror struct {
+	c *http.Client
+
+	url      string
+	user     string
+	password string
+}
+
+// docOp is a doc operation of the bulk requests for Kafka and the webhooks.
+type docOp struct {
+	Action  string                 `json:"action"`
+	Index   string                 `json:"index"`
+	Type    string                 `json:"type,omitempty"`
+	ID      string                 `json:"id,omitempty"`
+	Parent  string                 `json:"parent,omitempty"`
+	Routing string                 `json:"routing,omitempty"`
+	Upsert  bool                   `json:"upsert,omitempty"`
+	Script  map[string]interface{} `json:"script,omitempty"`
+	Doc     map[string]interface{} `json:"doc,omitempty"`
+}
+
+type kafkaRecord struct {
+	// the docs are partitioned by the key, so the operations of a doc are in order
+	Key   string `json:"key,omitempty"`
+	Value *docOp `json:"value"`
+}
+
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		Partition int     `json:"partition"`
+		Offset    int64   `json:"offset"`
+		ErrorCode *int    `json:"error_code"`
+		Error     *string `json:"error"`
+	} `json:"offsets"`
+}
+
+// newKafkaMirror returns nil if kafka_rest_addr is not set.
+func newKafkaMirror(c *Config) (*kafkaMirror, error) {
+	if len(c.KafkaRestAddr) == 0 {
+		return nil, nil
+	}
+	if len(c.KafkaTopic) == 0 {
+		return nil, errors.Errorf("kafka_topic must be set with kafka_rest_addr")
+	}
+
+	addr := c.KafkaRestAddr
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	timeout := c.KafkaTimeout.Duration
+	if timeout == 0 {
+		timeout = defaultKafkaTimeout
+	}
+	return &kafkaMirror{
+		c:        &http.Client{Timeout: timeout},
+		url:      fmt.Sprintf("%s/topics/%s", strings.TrimRight(addr, "/"), url.PathEscape(c.KafkaTopic)),
+		user:     c.KafkaRestUser,
+		password: c.KafkaRestPassword,
+	}, nil
+}
+
+func newDocOp(req *elastic.BulkRequest) *docOp {
+	return &docOp{
+		Action:  req.Action,
+		Index:   req.Index,
+		Type:    req.Type,
+		ID:      req.ID,
+		Parent:  req.Parent,
+		Routing: req.Routing,
+		Upsert:  req.Upsert,
+		Script:  req.Script,
+		Doc:     req.Data,
+	}
+}
+
+func newKafkaRecord(req *elastic.BulkRequest) *kafkaRecord {
+	rec := &kafkaRecord{Value: newDocOp(req)}
+	if len(req.ID) > 0 {
+		rec.Key = req.Index + "/" + req.ID
+	}
+	return rec
+}
+
+// publish publishes the requests in order, it fails if any of them is not published.
+func (k *kafkaMirror) publish(reqs []*elastic.BulkRequest) error {
+	records := make([]*kafkaRecord, 0, len(reqs))
+	for _, req := range reqs {
+		records = append(records, newKafkaRecord(req))
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	req, err := http.NewRequest("POST", k.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if len(k.user) > 0 {
+		req.SetBasicAuth(k.user, k.password)
+	}
+
+	resp, err := k.c.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("publish %d messages to kafka err: %s, code: %d, %s", len(records),
+			http.StatusText(resp.StatusCode), resp.StatusCode, data)
+	}
+
+	var ret kafkaProduceResponse
+	if err = json.Unmarshal(data, &ret); err != nil {
+		return errors.Trace(err)
+	}
+	for _, offset := range ret.Offsets {
+		if offset.ErrorCode != nil {
+			msg := ""
+			if offset.Error != nil {
+				msg = *offset.Error
+			}
+			return errors.Errorf("publish messages to kafka partition %d err: %s, code: %d",
+				offset.Partition, msg, *offset.ErrorCode)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package river
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go/sync2"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestKafkaMirror(c *C) {
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer es.Close()
+
+	bodies := make(chan string, 4)
+	var failed sync2.AtomicBool
+	kafka := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, Equals, "/topics/river")
+		c.Check(req.Header.Get("Content-Type"), Equals, kafkaContentType)
+		user, pass, _ := req.BasicAuth()
+		c.Check(user+":"+pass, Equals, "river:secret")
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+		if failed.Get() {
+			w.Write([]byte(`{"offsets":[{"partition":0,"offset":null,"error_code":50003,"error":"timeout"}]}`))
+			return
+		}
+		w.Write([]byte(`{"offsets":[{"partition":0,"offset":1,"error_code":null,"error":null}]}`))
+	}))
+	defer kafka.Close()
+
+	_, err := newKafkaMirror(&Config{KafkaRestAddr: kafka.URL})
+	c.Assert(err, ErrorMatches, "kafka_topic must be set.*")
+
+	cfg := &Config{KafkaRestAddr: kafka.URL + "/", KafkaRestUser: "river", KafkaRestPassword: "secret", KafkaTopic: "river"}
+	r := &River{c: cfg, st: &stat{}, limits: newRateLimits(0, 0)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	defer r.cancel()
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	r.kafka, err = newKafkaMirror(cfg)
+	c.Assert(err, IsNil)
+
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionIndex, Index: "order", ID: "1", Data: map[string]interface{}{"status": "paid"}},
+		{Action: elastic.ActionDelete, Index: "order", ID: "2"},
+	}
+	c.Assert(r.doBulk(reqs), IsNil)
+	c.Assert(<-bodies, Equals, `{"records":[{"key":"order/1","value":{"action":"index","index":"order","id":"1","doc":{"status":"paid"}}},`+
+		`{"key":"order/2","value":{"action":"delete","index":"order","id":"2"}}]}`)
+	c.Assert(r.st.KafkaMessageNum.Get(), Equals, int64(2))
+
+	failed.Set(true)
+	c.Assert(r.doBulk(reqs), ErrorMatches, ".*kafka partition 0 err: timeout, code: 50003")
+	<-bodies
+	c.Assert(r.st.KafkaMessageNum.Get(), Equals, int64(2))
+}
@@ -0,0 +1,244 @@
+package river
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// max digits after the decimal point which can be kept by scaled_float,
+// decimal with larger scale is mapped to keyword.
+const maxScaledFloatScale = 6
+
+// inferFieldMapping infers the ES field mapping from the MySQL column type
+// and the field type in rule, nil means letting ES map it dynamically.
+func inferFieldMapping(col *schema.TableColumn, fieldType string) map[string]interface{} {
+	switch fieldType {
+	case fieldTypeList, fieldTypeString:
+		return map[string]interface{}{"type": "keyword"}
+	case fieldTypeDate:
+		return map[string]interface{}{"type": "date"}
+	case fieldTypeBool:
+		return map[string]interface{}{"type": "boolean"}
+	case filedTypeTimestamp:
+		return map[string]interface{}{"type": "long"}
+	case fieldTypeGeoShape, fieldTypeGeoPoint:
+		return map[string]interface{}{"type": fieldType}
+	}
+
+	rawType := strings.ToLower(col.RawType)
+	switch col.Type {
+	case schema.TYPE_NUMBER:
+		return map[string]interface{}{"type": "long"}
+	case schema.TYPE_FLOAT:
+		if strings.HasPrefix(rawType, "decimal") {
+			scale := decimalScale(rawType)
+			if scale > maxScaledFloatScale {
+				return map[string]interface{}{"type": "keyword"}
+			}
+			return map[string]interface{}{"type": "scaled_float", "scaling_factor": math.Pow10(scale)}
+		}
+		if strings.HasPrefix(rawType, "float") {
+			return map[string]interface{}{"type": "float"}
+		}
+		return map[string]interface{}{"type": "double"}
+	case schema.TYPE_ENUM, schema.TYPE_SET, schema.TYPE_TIME:
+		return map[string]interface{}{"type": "keyword"}
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		return map[string]interface{}{"type": "date"}
+	case schema.TYPE_BIT:
+		return map[string]interface{}{"type": "long"}
+	case schema.TYPE_JSON:
+		return nil
+	default:
+		if strings.Contains(rawType, "blob") || strings.Contains(rawType, "binary") {
+			return map[string]interface{}{"type": "binary"}
+		}
+		return map[string]interface{}{
+			"type": "text",
+			"fields": map[string]interface{}{
+				"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+			},
+		}
+	}
+}
+
+// decimalScale returns the scale s of decimal(p,s).
+func decimalScale(rawType string) int {
+	start := strings.Index(rawType, ",")
+	end := strings.Index(rawType, ")")
+	if start < 0 || end < start {
+		return 0
+	}
+	scale, err := strconv.Atoi(strings.TrimSpace(rawType[start+1 : end]))
+	if err != nil {
+		return 0
+	}
+	return scale
+}
+
+// makeMappingProperties makes the ES mapping properties for the columns,
+// only the columns which are synced by the rule are included.
+func (r *River) makeMappingProperties(rule *Rule, columns []schema.TableColumn) map[string]interface{} {
+	properties := make(map[string]interface{}, len(columns))
+	for i := range columns {
+		col := &columns[i]
+		value, ok := rule.FieldMapping[col.Name]
+		if !ok || rule.GeneratedColumns == GeneratedSkip && rule.generated[col.Name] {
+			continue
+		}
+		_, esField, fieldType := r.getFieldParts(col.Name, value)
+		if len(rule.ValueMap[col.Name]) > 0 {
+			properties[esField] = map[string]interface{}{"type": "keyword"}
+		} else if m := columnFieldMapping(rule, col, fieldType); m != nil {
+			properties[esField] = m
+		}
+	}
+	for esField, value := range rule.CopyField {
+		_, column, fieldType := r.getFieldParts("", value)
+		for i := range columns {
+			col := &columns[i]
+			if col.Name != column || rule.GeneratedColumns == GeneratedSkip && rule.generated[col.Name] {
+				continue
+			}
+			if m := columnFieldMapping(rule, col, fieldType); m != nil {
+				properties[esField] = m
+			}
+		}
+	}
+	// the concatenated strings are mapped dynamically, like text with a keyword sub-field
+	for esField, fn := range rule.funcFields {
+		if fn.name != fieldFuncSplit {
+			continue
+		}
+		for i := range columns {
+			if columns[i].Name == fn.columns[0] {
+				properties[esField] = map[string]interface{}{"type": "keyword"}
+			}
+		}
+	}
+	return properties
+}
+
+// columnFieldMapping returns the mapping of the field of the column converted by fieldType.
+func columnFieldMapping(rule *Rule, col *schema.TableColumn, fieldType string) map[string]interface{} {
+	if col.Type == schema.TYPE_TIME && rule.TimeFormat == TimeFormatSeconds && fieldType == "" {
+		return timeSecondsMapping(col)
+	} else if col.Type == schema.TYPE_BIT && rule.BitFormat == BitFormatString && fieldType == "" {
+		return map[string]interface{}{"type": "keyword"}
+	} else if isTinyint1(col) && rule.TinyintFormat == TinyintFormatBool && fieldType == "" {
+		return map[string]interface{}{"type": "boolean"}
+	}
+	return inferFieldMapping(col, fieldType)
+}
+
+// makeRuleMapping makes the ES mapping properties for all the columns of the rule,
+// merged with the rule mapping.
+func (r *River) makeRuleMapping(rule *Rule) map[string]interface{} {
+	properties := r.makeMappingProperties(rule, rule.TableInfo.Columns)
+	if rule.DeleteMode == DeleteModeTombstone {
+		properties[rule.TombstoneField] = map[string]interface{}{"type": "boolean"}
+		properties[rule.TombstoneTimeField] = map[string]interface{}{"type": "date"}
+	}
+	if rule.DumpCleanup {
+		properties[rule.DumpGenerationField] = map[string]interface{}{"type": "long"}
+	}
+	for field, m := range rule.Mapping {
+		properties[field] = m
+	}
+	return properties
+}
+
+// createsIndex returns true if the index of the rule is created when it doesn't exist.
+func (r *River) createsIndex(rule *Rule) bool {
+	// the tenant indices are created by ES with the template
+	if len(rule.IndexSuffixColumn) > 0 {
+		return false
+	}
+	return rule.MissingIndex == MissingIndexCreate || len(rule.MissingIndex) == 0 && r.c.AutoCreateIndex
+}
+
+// ensureIndices handles the missing indices of the rules in the cluster by missing_index,
+// they are created with create, fail the start with require, and the rules are skipped
+// with ignore.
+func (r *River) ensureIndices(cluster string) error {
+	if err := r.createIndices(cluster); err != nil {
+		return errors.Trace(err)
+	}
+
+	es := r.esClient(cluster)
+	exists := make(map[string]bool)
+	for _, rule := range r.clusterRules(cluster) {
+		if rule.MissingIndex != MissingIndexRequire && rule.MissingIndex != MissingIndexIgnore {
+			continue
+		}
+		ok, checked := exists[rule.Index]
+		if !checked {
+			var err error
+			if ok, err = es.ExistsIndex(rule.Index); err != nil {
+				return errors.Trace(err)
+			}
+			exists[rule.Index] = ok
+		}
+
+		rule.indexMissing = false
+		if ok {
+			continue
+		} else if rule.MissingIndex == MissingIndexRequire {
+			return errors.Errorf("index %s of rule %s.%s doesn't exist", rule.Index, rule.Schema, rule.Table)
+		}
+		log.Warnf("index %s of rule %s.%s doesn't exist, skip the rule", rule.Index, rule.Schema, rule.Table)
+		rule.indexMissing = true
+	}
+	return nil
+}
+
+// createIndices creates the indices of the cluster which don't exist for the rules
+// creating them, rules with the same index and type are merged into one mapping.
+func (r *River) createIndices(cluster string) error {
+	es := r.esClient(cluster)
+	// index -> type -> properties
+	indices := make(map[string]map[string]map[string]interface{})
+	for _, rule := range r.clusterRules(cluster) {
+		if !r.createsIndex(rule) {
+			continue
+		}
+		types, ok := indices[rule.Index]
+		if !ok {
+			types = make(map[string]map[string]interface{})
+			indices[rule.Index] = types
+		}
+		properties, ok := types[rule.Type]
+		if !ok {
+			properties = make(map[string]interface{})
+			types[rule.Type] = properties
+		}
+		for field, m := range r.makeRuleMapping(rule) {
+			properties[field] = m
+		}
+	}
+
+	for index, types := range indices {
+		exists, err := es.ExistsIndex(index)
+		if err != nil {
+			return errors.Trace(err)
+		} else if exists {
+			continue
+		}
+
+		mappings := make(map[string]interface{}, len(types))
+		for docType, properties := range types {
+			mappings[docType] = map[string]interface{}{"properties": properties}
+		}
+
+		log.Infof("create index %s", index)
+		if err = es.CreateIndex(index, map[string]interface{}{"mappings": mappings}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package river
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestInferFieldMapping(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "bigint(20) unsigned", "", "")
+	ta.AddColumn("price", "decimal(10,2)", "", "")
+	ta.AddColumn("rate", "decimal(30,10)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("created", "datetime", "", "")
+	ta.AddColumn("info", "json", "", "")
+
+	c.Assert(inferFieldMapping(&ta.Columns[0], ""), DeepEquals, map[string]interface{}{"type": "long"})
+	c.Assert(inferFieldMapping(&ta.Columns[1], ""), DeepEquals, map[string]interface{}{"type": "scaled_float", "scaling_factor": float64(100)})
+	c.Assert(inferFieldMapping(&ta.Columns[2], ""), DeepEquals, map[string]interface{}{"type": "keyword"})
+	c.Assert(inferFieldMapping(&ta.Columns[3], "")["type"], Equals, "text")
+	c.Assert(inferFieldMapping(&ta.Columns[3], fieldTypeList), DeepEquals, map[string]interface{}{"type": "keyword"})
+	c.Assert(inferFieldMapping(&ta.Columns[4], ""), DeepEquals, map[string]interface{}{"type": "date"})
+	c.Assert(inferFieldMapping(&ta.Columns[5], ""), IsNil)
+}
+
+func (s *unitTestSuite) TestMissingIndex(c *C) {
+	var reqs []string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqs = append(reqs, req.Method+" "+req.URL.Path)
+		if req.Method == "HEAD" && req.URL.Path != "/a" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer es.Close()
+
+	c.Assert((&Rule{Schema: "test", Table: "t", MissingIndex: "skip"}).prepare(), NotNil)
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+	newRule := func(table, index, missing string) *Rule {
+		rule := &Rule{Schema: "test", Table: table, Index: index, Type: "_doc", TableInfo: ta, MissingIndex: missing}
+		c.Assert(rule.prepare(), IsNil)
+		return rule
+	}
+	required := newRule("t1", "a", MissingIndexRequire)
+	ignored := newRule("t2", "b", MissingIndexIgnore)
+	created := newRule("t3", "c", MissingIndexCreate)
+	other := newRule("t4", "d", "")
+
+	r := &River{c: &Config{}, ctx: context.Background(), st: &stat{}, syncCh: make(chan interface{}, 4),
+		rules: map[string]*Rule{ruleKey("test", "t1"): required, ruleKey("test", "t2"): ignored,
+			ruleKey("test", "t3"): created, ruleKey("test", "t4"): other}, limits: newRateLimits(0, 0)}
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	for _, rule := range r.rules {
+		r.setFieldMapping(rule)
+	}
+
+	// the index of the rule without missing_index is left to ES
+	c.Assert(r.ensureIndices(""), IsNil)
+	sort.Strings(reqs)
+	c.Assert(reqs, DeepEquals, []string{"HEAD /a", "HEAD /b", "HEAD /c", "PUT /c"})
+	c.Assert(required.indexMissing, IsFalse)
+	c.Assert(ignored.indexMissing, IsTrue)
+
+	// the rows of the skipped rule are not synced
+	h := &eventHandler{r: r}
+	e := &canal.RowsEvent{Action: canal.InsertAction, Table: &schema.Table{Schema: "test", Name: "t2"},
+		Rows: [][]interface{}{{int32(1)}}, Header: &replication.EventHeader{LogPos: 120}}
+	c.Assert(h.OnRow(e), IsNil)
+	c.Assert(r.syncCh, HasLen, 0)
+
+	// auto_create_index creates the index of the rule without missing_index
+	reqs = nil
+	r.c.AutoCreateIndex = true
+	c.Assert(r.createIndices(""), IsNil)
+	sort.Strings(reqs)
+	c.Assert(reqs, DeepEquals, []string{"HEAD /c", "HEAD /d", "PUT /c", "PUT /d"})
+
+	required.Index = "b"
+	err := r.ensureIndices("")
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, "index b of rule test.t1 doesn't exist")
+}
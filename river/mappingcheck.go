@@ -0,0 +1,125 @@
+package river
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// How to handle the fields of the rules conflicting with the mappings of the existing indices on start.
+const (
+	MappingCheckWarn  = "warn"
+	MappingCheckError = "error"
+	MappingCheckOff   = "off"
+)
+
+// the families of the ES field types, the fields in the same family take the same values
+var fieldTypeFamilies = map[string]string{
+	"long":             "number",
+	"integer":          "number",
+	"short":            "number",
+	"byte":             "number",
+	"double":           "number",
+	"float":            "number",
+	"half_float":       "number",
+	"scaled_float":     "number",
+	"unsigned_long":    "number",
+	"text":             "string",
+	"keyword":          "string",
+	"constant_keyword": "string",
+	"wildcard":         "string",
+	"match_only_text":  "string",
+	"date":             "date",
+	"date_nanos":       "date",
+	"object":           "object",
+	"nested":           "object",
+	"flattened":        "object",
+}
+
+func fieldTypeFamily(t string) string {
+	if family, ok := fieldTypeFamilies[t]; ok {
+		return family
+	}
+	return t
+}
+
+// isFieldTypeConflict returns true if the values of the field type of the rule may be
+// rejected by the existing field type, like strings into a long field. The scalar values
+// can be indexed into the string fields, and the numbers into the date fields as epoch
+// milliseconds, so they are not conflicts.
+func isFieldTypeConflict(ruleType string, indexType string) bool {
+	ruleFamily, indexFamily := fieldTypeFamily(ruleType), fieldTypeFamily(indexType)
+	switch {
+	case ruleFamily == indexFamily:
+		return false
+	case indexFamily == "string":
+		return ruleFamily == "object" || ruleFamily == "geo_point" || ruleFamily == "geo_shape"
+	case indexFamily == "date":
+		return ruleFamily != "number"
+	}
+	return true
+}
+
+// checkMappings compares the field types of the rules in the cluster with the mappings
+// of the existing indices, the conflicts are logged, or fail the start with mapping_check error.
+func (r *River) checkMappings(cluster string) error {
+	if r.c.MappingCheck == MappingCheckOff {
+		return nil
+	}
+
+	es := r.esClient(cluster)
+	// index -> field types of the indices, an alias may have more
+	fetched := make(map[string]map[string]map[string]string)
+	var conflicts []string
+	for _, rule := range r.clusterRules(cluster) {
+		index := rule.indexPattern()
+		indices, ok := fetched[index]
+		if !ok {
+			var err error
+			if indices, err = es.GetFieldTypes(index); err != nil {
+				if r.c.MappingCheck == MappingCheckError {
+					return errors.Annotatef(err, "get mapping of index %s", index)
+				}
+				log.Warnf("get mapping of index %s err %v, skip the check", index, err)
+			}
+			fetched[index] = indices
+		}
+		names := make([]string, 0, len(indices))
+		for name := range indices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		properties := r.makeRuleMapping(rule)
+		fields := make([]string, 0, len(properties))
+		for field := range properties {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			m, _ := properties[field].(map[string]interface{})
+			ruleType, _ := m["type"].(string)
+			if len(ruleType) == 0 {
+				continue
+			}
+			for _, name := range names {
+				indexType, ok := indices[name][field]
+				if !ok || !isFieldTypeConflict(ruleType, indexType) {
+					continue
+				}
+				conflict := fmt.Sprintf("field %s of rule %s.%s is %s, but %s in the mapping of index %s",
+					field, rule.Schema, rule.Table, ruleType, indexType, name)
+				log.Warnf("%s", conflict)
+				conflicts = append(conflicts, conflict)
+			}
+		}
+	}
+
+	if len(conflicts) > 0 && r.c.MappingCheck == MappingCheckError {
+		return errors.Errorf("%d fields conflict with the mappings, the first one: %s", len(conflicts), conflicts[0])
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestMappingCheck(c *C) {
+	c.Assert(isFieldTypeConflict("text", "long"), IsTrue)
+	c.Assert(isFieldTypeConflict("long", "integer"), IsFalse)
+	c.Assert(isFieldTypeConflict("long", "keyword"), IsFalse)
+	c.Assert(isFieldTypeConflict("long", "date"), IsFalse)
+	c.Assert(isFieldTypeConflict("date", "keyword"), IsFalse)
+	c.Assert(isFieldTypeConflict("keyword", "date"), IsTrue)
+	c.Assert(isFieldTypeConflict("boolean", "long"), IsTrue)
+	c.Assert(isFieldTypeConflict("geo_point", "keyword"), IsTrue)
+
+	var paths []string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.Path)
+		switch req.URL.Path {
+		case "/t/_mapping":
+			w.Write([]byte(`{"t":{"mappings":{"properties":{"id":{"type":"long"},"name":{"type":"long"},"created":{"type":"date"}}}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer es.Close()
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("created", "datetime", "", "")
+	ta.PKColumns = []int{0}
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", Type: "_doc", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+	other := &Rule{Schema: "test", Table: "t2", Index: "t2", Type: "_doc", TableInfo: ta}
+	c.Assert(other.prepare(), IsNil)
+
+	r := &River{c: &Config{MappingCheck: MappingCheckError}, st: &stat{},
+		rules: map[string]*Rule{ruleKey("test", "t"): rule, ruleKey("test", "t2"): other}}
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	r.setFieldMapping(rule)
+	r.setFieldMapping(other)
+
+	// the missing index t2 is not checked
+	err := r.checkMappings("")
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, "1 fields conflict with the mappings, the first one: field name of rule test.t is text, but long in the mapping of index t")
+
+	r.c.MappingCheck = MappingCheckWarn
+	c.Assert(r.checkMappings(""), IsNil)
+
+	// the rule mapping overrides the inferred one
+	rule.Mapping = map[string]interface{}{"name": map[string]interface{}{"type": "long"}}
+	r.c.MappingCheck = MappingCheckError
+	c.Assert(r.checkMappings(""), IsNil)
+
+	paths = nil
+	r.c.MappingCheck = MappingCheckOff
+	c.Assert(r.checkMappings(""), IsNil)
+	c.Assert(paths, HasLen, 0)
+}
@@ -22,6 +22,9 @@ type masterInfo struct {
 
 	filePath     string
 	lastSaveTime time.Time
+	// set by the control API, the sync restarts from the position, so the
+	// positions synced later are not saved
+	overridden bool
 }
 
 func loadMasterInfo(dataDir string) (*masterInfo, error) {
@@ -56,6 +59,10 @@ func (m *masterInfo) Save(pos mysql.Position) error {
 	m.Lock()
 	defer m.Unlock()
 
+	if m.overridden {
+		return nil
+	}
+
 	m.Name = pos.Name
 	m.Pos = pos.Pos
 
@@ -69,6 +76,27 @@ func (m *masterInfo) Save(pos mysql.Position) error {
 	}
 
 	m.lastSaveTime = n
+	return errors.Trace(m.write())
+}
+
+// Override saves the position at once, and ignores the positions saved later.
+func (m *masterInfo) Override(pos mysql.Position) error {
+	log.Infof("override position %s", pos)
+
+	m.Lock()
+	defer m.Unlock()
+
+	if len(m.filePath) == 0 {
+		return errors.New("data_dir must be set to override the position")
+	}
+	m.Name = pos.Name
+	m.Pos = pos.Pos
+	m.overridden = true
+	m.lastSaveTime = time.Now()
+	return errors.Trace(m.write())
+}
+
+func (m *masterInfo) write() error {
 	var buf bytes.Buffer
 	e := toml.NewEncoder(&buf)
 
@@ -0,0 +1,100 @@
+package river
+
+import (
+	"net"
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// makeMeta makes the source metadata of the rows event, the binlog position,
+// GTID and timestamp are absent for the dumped rows.
+func (h *eventHandler) makeMeta(rule *Rule, e *canal.RowsEvent) map[string]interface{} {
+	meta := map[string]interface{}{
+		"schema": rule.Schema,
+		"table":  rule.Table,
+		"action": e.Action,
+	}
+	if e.Header == nil {
+		return meta
+	}
+
+	meta["binlog_file"] = h.r.syncedPosition().Name
+	meta["binlog_pos"] = e.Header.LogPos
+	meta["timestamp"] = time.Unix(int64(e.Header.Timestamp), 0).UTC().Format(time.RFC3339)
+	if len(h.gtid) > 0 {
+		meta["gtid"] = h.gtid
+	}
+	return meta
+}
+
+// setMeta adds the source metadata field to the docs of the requests,
+// the scripted updates only have it in the upsert doc.
+func (h *eventHandler) setMeta(rule *Rule, reqs []*elastic.BulkRequest, e *canal.RowsEvent) {
+	var meta map[string]interface{}
+	for _, req := range reqs {
+		if req.Action == elastic.ActionDelete || req.Data == nil {
+			continue
+		}
+		if meta == nil {
+			meta = h.makeMeta(rule, e)
+		}
+		req.Data[rule.MetaField] = meta
+	}
+}
+
+// makeECS makes the source metadata fields of the rows event in ECS, the dumped
+// rows have the time of the dump as @timestamp, and no log or labels fields.
+func (h *eventHandler) makeECS(rule *Rule, e *canal.RowsEvent) map[string]interface{} {
+	now := time.Now().UTC()
+	event := map[string]interface{}{
+		"kind":    "event",
+		"module":  "mysql",
+		"dataset": rule.Schema + "." + rule.Table,
+		"action":  e.Action,
+		"created": now.Format(time.RFC3339Nano),
+	}
+	host, _, err := net.SplitHostPort(h.r.c.MyAddr)
+	if err != nil {
+		host = h.r.c.MyAddr
+	}
+	fields := map[string]interface{}{
+		"@timestamp": now.Format(time.RFC3339),
+		"event":      event,
+		"host":       map[string]interface{}{"name": host},
+	}
+	if e.Header == nil {
+		return fields
+	}
+
+	fields["@timestamp"] = time.Unix(int64(e.Header.Timestamp), 0).UTC().Format(time.RFC3339)
+	fields["log"] = map[string]interface{}{
+		"file":   map[string]interface{}{"path": h.r.syncedPosition().Name},
+		"offset": e.Header.LogPos,
+	}
+	if len(h.gtid) > 0 {
+		fields["labels"] = map[string]interface{}{"gtid": h.gtid}
+	}
+	return fields
+}
+
+// setECS adds the ECS fields to the docs of the requests, @timestamp is kept if
+// the doc has it, like a column mapped to it in [rule.field].
+func (h *eventHandler) setECS(rule *Rule, reqs []*elastic.BulkRequest, e *canal.RowsEvent) {
+	var fields map[string]interface{}
+	for _, req := range reqs {
+		if req.Action == elastic.ActionDelete || req.Data == nil {
+			continue
+		}
+		if fields == nil {
+			fields = h.makeECS(rule, e)
+		}
+		for key, value := range fields {
+			if _, ok := req.Data[key]; ok && key == "@timestamp" {
+				continue
+			}
+			req.Data[key] = value
+		}
+	}
+}
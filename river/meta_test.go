@@ -0,0 +1,93 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestFieldPresetECS(c *C) {
+	c.Assert((&Rule{Schema: "test", Table: "t", FieldPreset: "otel"}).prepare(), NotNil)
+	rule := &Rule{Schema: "test", Table: "t", FieldPreset: FieldPresetECS}
+	c.Assert(rule.prepare(), IsNil)
+
+	r := &River{c: &Config{MyAddr: "db1:3306"}, replayPos: mysql.Position{Name: "mysql-bin.000003", Pos: 4}}
+	h := &eventHandler{r: r, gtid: "uuid:1"}
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"id": 1}},
+		{Action: elastic.ActionIndex, Index: "t", ID: "2", Data: map[string]interface{}{"id": 2, "@timestamp": "2026-01-02T03:04:05Z"}},
+		{Action: elastic.ActionDelete, Index: "t", ID: "3"},
+	}
+	e := &canal.RowsEvent{Action: canal.InsertAction, Table: &schema.Table{Schema: "test", Name: "t"},
+		Header: &replication.EventHeader{Timestamp: 1792051200, LogPos: 4588}}
+	h.setECS(rule, reqs, e)
+
+	doc := reqs[0].Data
+	c.Assert(doc["@timestamp"], Equals, "2026-10-15T08:00:00Z")
+	event := doc["event"].(map[string]interface{})
+	c.Assert(event["kind"], Equals, "event")
+	c.Assert(event["module"], Equals, "mysql")
+	c.Assert(event["dataset"], Equals, "test.t")
+	c.Assert(event["action"], Equals, canal.InsertAction)
+	c.Assert(event["created"], NotNil)
+	c.Assert(doc["host"], DeepEquals, map[string]interface{}{"name": "db1"})
+	c.Assert(doc["log"], DeepEquals, map[string]interface{}{
+		"file":   map[string]interface{}{"path": "mysql-bin.000003"},
+		"offset": uint32(4588),
+	})
+	c.Assert(doc["labels"], DeepEquals, map[string]interface{}{"gtid": "uuid:1"})
+	// the mapped @timestamp is kept, and the deletes have no doc
+	c.Assert(reqs[1].Data["@timestamp"], Equals, "2026-01-02T03:04:05Z")
+	c.Assert(reqs[1].Data["event"], NotNil)
+	c.Assert(reqs[2].Data, IsNil)
+
+	// no binlog position for the dumped rows
+	reqs = []*elastic.BulkRequest{{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"id": 1}}}
+	e.Header = nil
+	h.setECS(rule, reqs, e)
+	c.Assert(reqs[0].Data["@timestamp"], NotNil)
+	c.Assert(reqs[0].Data["log"], IsNil)
+	c.Assert(reqs[0].Data["labels"], IsNil)
+
+	defaults := &RuleDefaults{FieldPreset: FieldPresetECS}
+	c.Assert(defaults.apply(&Rule{Schema: "test", Table: "u"}).FieldPreset, Equals, FieldPresetECS)
+}
+
+func (s *unitTestSuite) TestSetMeta(c *C) {
+	rule := &Rule{Schema: "test", Table: "t", MetaField: "_source_meta"}
+	r := &River{c: &Config{}, replayPos: mysql.Position{Name: "mysql-bin.000003", Pos: 4}}
+	h := &eventHandler{r: r, gtid: "uuid:7"}
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"id": 1}},
+		// the scripted update has the meta in the upsert doc
+		{Action: elastic.ActionUpdate, Index: "t", ID: "2", Data: map[string]interface{}{"id": 2},
+			Script: map[string]interface{}{"source": "ctx._source.n += 1"}},
+		{Action: elastic.ActionDelete, Index: "t", ID: "3"},
+		{Action: elastic.ActionUpdate, Index: "t", ID: "4"},
+	}
+	e := &canal.RowsEvent{Action: canal.UpdateAction, Table: &schema.Table{Schema: "test", Name: "t"},
+		Header: &replication.EventHeader{Timestamp: 1792051200, LogPos: 4588}}
+	h.setMeta(rule, reqs, e)
+
+	meta := map[string]interface{}{
+		"schema":      "test",
+		"table":       "t",
+		"action":      canal.UpdateAction,
+		"binlog_file": "mysql-bin.000003",
+		"binlog_pos":  uint32(4588),
+		"timestamp":   "2026-10-15T08:00:00Z",
+		"gtid":        "uuid:7",
+	}
+	c.Assert(reqs[0].Data["_source_meta"], DeepEquals, meta)
+	c.Assert(reqs[1].Data["_source_meta"], DeepEquals, meta)
+	c.Assert(reqs[2].Data, IsNil)
+	c.Assert(reqs[3].Data, IsNil)
+
+	// the dumped rows have no binlog position
+	reqs = []*elastic.BulkRequest{{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"id": 1}}}
+	h.setMeta(rule, reqs, &canal.RowsEvent{Action: canal.InsertAction, Table: e.Table})
+	c.Assert(reqs[0].Data["_source_meta"], DeepEquals, map[string]interface{}{"schema": "test", "table": "t", "action": canal.InsertAction})
+}
@@ -0,0 +1,145 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+type metricType string
+
+const (
+	metricCounter metricType = "counter"
+	metricGauge   metricType = "gauge"
+)
+
+// txnRowsMetric is the histogram of the binlog transaction sizes in rows.
+const txnRowsMetric = "river_binlog_transaction_rows"
+
+type metric struct {
+	name  string
+	typ   metricType
+	help  string
+	value float64
+}
+
+// metrics are the counters of the river and the Go runtime stats for capacity planning,
+// served in the Prometheus text format by /metrics and in JSON by /debug/vars.
+func (s *stat) metrics() []metric {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	var lastPause time.Duration
+	if m.NumGC > 0 {
+		lastPause = time.Duration(m.PauseNs[(m.NumGC+255)%256])
+	}
+
+	metrics := []metric{
+		{"go_goroutines", metricGauge, "Number of goroutines.", float64(runtime.NumGoroutine())},
+		{"go_memstats_heap_alloc_bytes", metricGauge, "Bytes of allocated heap objects.", float64(m.HeapAlloc)},
+		{"go_memstats_heap_inuse_bytes", metricGauge, "Bytes in in-use heap spans.", float64(m.HeapInuse)},
+		{"go_memstats_heap_objects", metricGauge, "Number of allocated heap objects.", float64(m.HeapObjects)},
+		{"go_memstats_sys_bytes", metricGauge, "Bytes of memory obtained from the OS.", float64(m.Sys)},
+		{"go_gc_cycles_total", metricCounter, "Number of completed GC cycles.", float64(m.NumGC)},
+		{"go_gc_pause_seconds_total", metricCounter, "Total GC stop-the-world pause time.", time.Duration(m.PauseTotalNs).Seconds()},
+		{"go_gc_last_pause_seconds", metricGauge, "Pause time of the last GC.", lastPause.Seconds()},
+
+		{"river_insert_total", metricCounter, "Inserted docs.", float64(s.InsertNum.Get())},
+		{"river_update_total", metricCounter, "Updated docs.", float64(s.UpdateNum.Get())},
+		{"river_delete_total", metricCounter, "Deleted docs.", float64(s.DeleteNum.Get())},
+		{"river_noop_update_total", metricCounter, "Updates skipped by noop_update.", float64(s.NoopUpdateNum.Get())},
+		{"river_time_window_skipped_events_total", metricCounter, "Row events out of the time window.", float64(s.TimeWindowSkipNum.Get())},
+		{"river_bulk_client_error_total", metricCounter, "Bulk items failed with 4xx.", float64(s.BulkClientErrorNum.Get())},
+		{"river_bulk_server_error_total", metricCounter, "Bulk items failed with 5xx.", float64(s.BulkServerErrorNum.Get())},
+		{"river_bulk_retry_total", metricCounter, "Bulk items retried with 429 and 503.", float64(s.BulkRetryNum.Get())},
+		{"river_kafka_messages_total", metricCounter, "Doc operations published to Kafka.", float64(s.KafkaMessageNum.Get())},
+		{"river_webhook_operations_total", metricCounter, "Doc operations posted to the webhooks.", float64(s.WebhookNum.Get())},
+		{"river_webhook_retries_total", metricCounter, "Webhook posts retried.", float64(s.WebhookRetryNum.Get())},
+		{"river_redis_deleted_keys_total", metricCounter, "Cache keys deleted in Redis.", float64(s.RedisKeyNum.Get())},
+		{"river_field_truncated_total", metricCounter, "String fields truncated with field_limit.", float64(s.FieldTruncateNum.Get())},
+		{"river_field_dropped_total", metricCounter, "String fields dropped with field_limit.", float64(s.FieldDropNum.Get())},
+		{"river_dead_letters_total", metricCounter, "Docs written to the dlq.", float64(s.DeadLetterNum.Get())},
+		{"river_mapping_conflicts_total", metricCounter, "Docs sent again without the field rejected by the mapping.", float64(s.MappingConflictNum.Get())},
+		{"river_shadow_docs_total", metricCounter, "Docs compared with ES by the shadow sink.", float64(s.ShadowDocNum.Get())},
+		{"river_shadow_diffs_total", metricCounter, "Docs differing from ES in the shadow sink.", float64(s.ShadowDiffNum.Get())},
+		{"river_verify_docs_total", metricCounter, "Docs verified with verify_interval.", float64(s.VerifyDocNum.Get())},
+		{"river_verify_divergent_docs_total", metricCounter, "Docs missing or different in ES found with verify_interval.", float64(s.VerifyDivergeNum.Get())},
+		{"river_binlog_events_total", metricCounter, "Binlog events read.", float64(s.Binlog.EventNum.Get())},
+		{"river_binlog_rows_total", metricCounter, "Binlog rows read.", float64(s.Binlog.RowNum.Get())},
+		{"river_binlog_bytes_total", metricCounter, "Binlog bytes read.", float64(s.Binlog.Bytes.Get())},
+		{"river_inflight_bulks", metricGauge, "Bulks in flight with max_inflight_bulks.", float64(s.InflightBulkNum.Get())},
+		{"river_buffered_bytes", metricGauge, "Estimated bytes of the requests buffered and in flight with max_buffer_size.", float64(s.BufferedBytes.Get())},
+		{"river_buffer_flush_total", metricCounter, "Flushes as the buffered requests exceed max_buffer_size.", float64(s.BufferFlushNum.Get())},
+		{"river_buffer_wait_total", metricCounter, "Waits for the in-flight bulks as the buffered requests exceed max_buffer_size.", float64(s.BufferWaitNum.Get())},
+		{"river_sync_chan_length", metricGauge, "Requests waiting in the sync channel.", float64(len(s.r.syncCh))},
+		{"river_sync_chan_capacity", metricGauge, "Capacity of the sync channel.", float64(cap(s.r.syncCh))},
+	}
+	eventRate, rowRate, byteRate := s.Binlog.Rates()
+	metrics = append(metrics,
+		metric{"river_binlog_events_per_second", metricGauge, "Binlog events read per second.", eventRate},
+		metric{"river_binlog_rows_per_second", metricGauge, "Binlog rows read per second.", rowRate},
+		metric{"river_binlog_bytes_per_second", metricGauge, "Binlog bytes read per second.", byteRate},
+		metric{"river_binlog_transaction_rows_max", metricGauge, "Rows of the largest binlog transaction.", float64(s.Binlog.TxnRows.data().Max)},
+	)
+	paused := 0.0
+	if s.r.paused.Get() {
+		paused = 1
+	}
+	metrics = append(metrics, metric{"river_paused", metricGauge, "Whether the sync is paused.", paused})
+	if s.r.queue != nil {
+		metrics = append(metrics, metric{"river_queue_size", metricGauge, "Entries in the disk queue.", float64(s.r.queue.Size())})
+	}
+	if s.r.hb != nil {
+		metrics = append(metrics, metric{"river_heartbeat_lag_seconds", metricGauge, "Lag of the heartbeats.", s.r.hb.Lag().Seconds()})
+	}
+	return metrics
+}
+
+// serveMetrics serves the metrics in the Prometheus text format.
+func (s *stat) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, m := range s.metrics() {
+		buf.WriteString(fmt.Sprintf("# HELP %s %s\n", m.name, m.help))
+		buf.WriteString(fmt.Sprintf("# TYPE %s %s\n", m.name, m.typ))
+		buf.WriteString(fmt.Sprintf("%s %g\n", m.name, m.value))
+	}
+	s.Binlog.TxnRows.writeMetric(&buf, txnRowsMetric, "Rows of the binlog transactions.")
+	s.writeIsolatedMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// serveVars serves the expvar vars like cmdline and memstats, the metrics in "river"
+// and the transaction histogram, without publishing them as the global expvar vars.
+func (s *stat) serveVars(w http.ResponseWriter, r *http.Request) {
+	metrics := s.metrics()
+	vars := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		vars[m.name] = m.value
+	}
+	data, err := json.Marshal(vars)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("marshal vars error %v", err)))
+		return
+	}
+	txnRows, err := json.Marshal(s.Binlog.TxnRows.data())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("marshal vars error %v", err)))
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		buf.WriteString(fmt.Sprintf("%q: %s,\n", kv.Key, kv.Value))
+	})
+	buf.WriteString(fmt.Sprintf("%q: %s,\n", txnRowsMetric, txnRows))
+	buf.WriteString(fmt.Sprintf("%q: %s\n}\n", "river", data))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,34 @@
+package river
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+)
+
+func (s *unitTestSuite) TestMetrics(c *C) {
+	r := &River{c: &Config{}, syncCh: make(chan interface{}, 4)}
+	st := &stat{r: r}
+	r.syncCh <- struct{}{}
+	st.InsertNum.Add(3)
+
+	w := httptest.NewRecorder()
+	st.serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	c.Assert(strings.Contains(body, "# TYPE river_insert_total counter\nriver_insert_total 3\n"), Equals, true)
+	c.Assert(strings.Contains(body, "river_sync_chan_length 1\n"), Equals, true)
+	c.Assert(strings.Contains(body, "river_sync_chan_capacity 4\n"), Equals, true)
+	c.Assert(strings.Contains(body, "go_goroutines "), Equals, true)
+	c.Assert(strings.Contains(body, "river_queue_size"), Equals, false)
+
+	w = httptest.NewRecorder()
+	st.serveVars(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars map[string]json.RawMessage
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &vars), IsNil)
+	c.Assert(vars["memstats"], NotNil)
+	var river map[string]float64
+	c.Assert(json.Unmarshal(vars["river"], &river), IsNil)
+	c.Assert(river["river_insert_total"], Equals, float64(3))
+}
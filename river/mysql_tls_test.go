@@ -0,0 +1,355 @@
+package river
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// fakeMySQL accepts the connections and authenticates them like MySQL 8 with
+// caching_sha2_password, the connection is closed after the auth.
+type fakeMySQL struct {
+	net.Listener
+	password string
+	// the plugin in the initial handshake, the client is asked to switch if it
+	// is not caching_sha2_password
+	plugin string
+	// ask for the full auth, the cache of the password is missed
+	fullAuth bool
+	tls      *tls.Config
+	key      *rsa.PrivateKey
+
+	// the results of the connections
+	results chan fakeMySQLResult
+}
+
+type fakeMySQLResult struct {
+	tls bool
+	err error
+}
+
+func newFakeMySQL(c *C, password string) *fakeMySQL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+
+	s := &fakeMySQL{Listener: l, password: password, plugin: mysql.AUTH_CACHING_SHA2_PASSWORD, key: key,
+		results: make(chan fakeMySQLResult, 1)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			secure, err := s.serve(&fakeMySQLConn{Conn: conn})
+			conn.Close()
+			s.results <- fakeMySQLResult{tls: secure, err: err}
+		}
+	}()
+	return s
+}
+
+// fakeMySQLConn reads the packets without a buffer, the TLS handshake follows the SSL request.
+type fakeMySQLConn struct {
+	net.Conn
+	seq uint8
+}
+
+func (c *fakeMySQLConn) readPacket() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.seq = header[3] + 1
+	data := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	_, err := io.ReadFull(c.Conn, data)
+	return data, errors.Trace(err)
+}
+
+func (c *fakeMySQLConn) writePacket(data []byte) error {
+	header := []byte{byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16), c.seq}
+	c.seq++
+	_, err := c.Write(append(header, data...))
+	return errors.Trace(err)
+}
+
+func (c *fakeMySQLConn) writeError(msg string) error {
+	data := []byte{mysql.ERR_HEADER, 0, 0, '#', '2', '8', '0', '0', '0'}
+	binary.LittleEndian.PutUint16(data[1:], mysql.ER_ACCESS_DENIED_ERROR)
+	if err := c.writePacket(append(data, msg...)); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.New(msg)
+}
+
+func newSalt() []byte {
+	salt := make([]byte, 20)
+	rand.Read(salt)
+	for i := range salt {
+		// no 0x00 in the salt
+		salt[i] = salt[i]%94 + 33
+	}
+	return salt
+}
+
+// serve authenticates the connection, and returns whether it is over TLS.
+func (s *fakeMySQL) serve(c *fakeMySQLConn) (bool, error) {
+	salt := newSalt()
+	capability := mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_SECURE_CONNECTION | mysql.CLIENT_PLUGIN_AUTH |
+		mysql.CLIENT_LONG_PASSWORD | mysql.CLIENT_TRANSACTIONS | mysql.CLIENT_LONG_FLAG
+	if s.tls != nil {
+		capability |= mysql.CLIENT_SSL
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(10)
+	buf.WriteString("8.0.30-fake\x00")
+	buf.Write([]byte{1, 0, 0, 0})
+	buf.Write(salt[:8])
+	buf.WriteByte(0)
+	buf.Write([]byte{byte(capability), byte(capability >> 8), mysql.DEFAULT_COLLATION_ID, 2, 0,
+		byte(capability >> 16), byte(capability >> 24), byte(len(salt) + 1)})
+	buf.Write(make([]byte, 10))
+	buf.Write(salt[8:])
+	buf.WriteByte(0)
+	buf.WriteString(s.plugin + "\x00")
+	if err := c.writePacket(buf.Bytes()); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	data, err := c.readPacket()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	secure := false
+	if binary.LittleEndian.Uint32(data)&mysql.CLIENT_SSL != 0 {
+		if s.tls == nil {
+			return false, errors.New("SSL is not supported")
+		}
+		conn := tls.Server(c.Conn, s.tls)
+		if err = conn.Handshake(); err != nil {
+			return false, errors.Trace(err)
+		}
+		c.Conn = conn
+		secure = true
+		if data, err = c.readPacket(); err != nil {
+			return secure, errors.Trace(err)
+		}
+	}
+
+	// capability, max packet size, charset and filler, then the user, auth data and plugin
+	fields := bytes.SplitN(data[4+4+1+23:], []byte{0}, 2)
+	if string(fields[0]) != "root" {
+		return secure, c.writeError("invalid user " + string(fields[0]))
+	}
+	auth := fields[1][1 : 1+int(fields[1][0])]
+	plugin := string(bytes.TrimSuffix(fields[1][1+len(auth):], []byte{0}))
+
+	if s.plugin != mysql.AUTH_CACHING_SHA2_PASSWORD {
+		if plugin != s.plugin {
+			return secure, c.writeError("invalid plugin " + plugin)
+		}
+		salt = newSalt()
+		if err = c.writePacket([]byte("\xfe" + mysql.AUTH_CACHING_SHA2_PASSWORD + "\x00" + string(salt) + "\x00")); err != nil {
+			return secure, errors.Trace(err)
+		}
+		if auth, err = c.readPacket(); err != nil {
+			return secure, errors.Trace(err)
+		}
+	} else if plugin != mysql.AUTH_CACHING_SHA2_PASSWORD {
+		return secure, c.writeError("invalid plugin " + plugin)
+	}
+
+	if !bytes.Equal(auth, mysql.CalcCachingSha2Password(salt, []byte(s.password))) {
+		return secure, c.writeError("Access denied")
+	}
+
+	if !s.fullAuth {
+		if err = c.writePacket([]byte{mysql.MORE_DATE_HEADER, mysql.CACHE_SHA2_FAST_AUTH}); err != nil {
+			return secure, errors.Trace(err)
+		}
+		return secure, errors.Trace(c.writePacket([]byte{mysql.OK_HEADER, 0, 0, 2, 0, 0, 0}))
+	}
+
+	if err = c.writePacket([]byte{mysql.MORE_DATE_HEADER, mysql.CACHE_SHA2_FULL_AUTH}); err != nil {
+		return secure, errors.Trace(err)
+	}
+	if data, err = c.readPacket(); err != nil {
+		return secure, errors.Trace(err)
+	}
+	var password []byte
+	if secure {
+		// in clear text over TLS
+		password = data
+	} else {
+		if !bytes.Equal(data, []byte{mysql.CACHE_SHA2_REQUEST_PUBLIC_KEY}) {
+			return secure, c.writeError("the public key is not requested")
+		}
+		der, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+		if err != nil {
+			return secure, errors.Trace(err)
+		}
+		key := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		if err = c.writePacket(append([]byte{mysql.MORE_DATE_HEADER}, key...)); err != nil {
+			return secure, errors.Trace(err)
+		}
+		if data, err = c.readPacket(); err != nil {
+			return secure, errors.Trace(err)
+		}
+		if password, err = rsa.DecryptOAEP(sha1.New(), rand.Reader, s.key, data, nil); err != nil {
+			return secure, c.writeError(err.Error())
+		}
+		for i := range password {
+			password[i] ^= salt[i%len(salt)]
+		}
+	}
+	if string(password) != s.password+"\x00" {
+		return secure, c.writeError("Access denied")
+	}
+	return secure, errors.Trace(c.writePacket([]byte{mysql.OK_HEADER, 0, 0, 2, 0, 0, 0}))
+}
+
+func (s *fakeMySQL) connect(c *C, password string, tlsConfig *tls.Config) (fakeMySQLResult, error) {
+	conn, err := client.Connect(s.Addr().String(), "root", password, "", func(conn *client.Conn) {
+		conn.TLSConfig = tlsConfig
+	})
+	if err == nil {
+		conn.Close()
+	}
+	select {
+	case res := <-s.results:
+		return res, err
+	case <-time.After(5 * time.Second):
+		c.Fatal("the fake MySQL is not connected")
+		return fakeMySQLResult{}, err
+	}
+}
+
+// writeTestCert writes a self-signed certificate of 127.0.0.1, and returns the TLS config of it.
+func writeTestCert(c *C, dir string, name string) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), IsNil)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func (s *unitTestSuite) TestCachingSha2Password(c *C) {
+	my := newFakeMySQL(c, "secret")
+	defer my.Close()
+
+	// the password is cached by the server
+	res, err := my.connect(c, "secret", nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.err, IsNil)
+	c.Assert(res.tls, IsFalse)
+
+	res, err = my.connect(c, "wrong", nil)
+	c.Assert(err, ErrorMatches, ".*Access denied.*")
+	c.Assert(res.err, NotNil)
+
+	// the password is encrypted by the public key of the server without TLS
+	my.fullAuth = true
+	res, err = my.connect(c, "secret", nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.err, IsNil)
+
+	// the server asks to switch from mysql_native_password, like the users of caching_sha2_password
+	// on a server with the default plugin mysql_native_password
+	my.plugin = mysql.AUTH_NATIVE_PASSWORD
+	my.fullAuth = false
+	res, err = my.connect(c, "secret", nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.err, IsNil)
+}
+
+func (s *unitTestSuite) TestMySQLTLS(c *C) {
+	dir, err := ioutil.TempDir("", "river_tls")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	my := newFakeMySQL(c, "secret")
+	defer my.Close()
+	my.tls = writeTestCert(c, dir, "server")
+	writeTestCert(c, dir, "other")
+
+	r := &River{c: &Config{MyAddr: my.Addr().String()}}
+	tlsConfig, err := r.newMyTLSConfig()
+	c.Assert(err, IsNil)
+	c.Assert(tlsConfig, IsNil)
+
+	// the server is verified by the CA
+	r.c.MySSLCA = filepath.Join(dir, "server.pem")
+	tlsConfig, err = r.newMyTLSConfig()
+	c.Assert(err, IsNil)
+	c.Assert(tlsConfig.ServerName, Equals, "127.0.0.1")
+	c.Assert(r.myDumpSSLOptions(), DeepEquals, []string{"--ssl-mode=VERIFY_IDENTITY", "--ssl-ca=" + r.c.MySSLCA})
+
+	res, err := my.connect(c, "secret", tlsConfig)
+	c.Assert(err, IsNil)
+	c.Assert(res.err, IsNil)
+	c.Assert(res.tls, IsTrue)
+
+	// the password is sent in clear text over TLS for the full auth
+	my.fullAuth = true
+	res, err = my.connect(c, "secret", tlsConfig)
+	c.Assert(err, IsNil)
+	c.Assert(res.err, IsNil)
+	c.Assert(res.tls, IsTrue)
+
+	// the server of another CA is rejected, unless the verify is skipped
+	r.c.MySSLCA = filepath.Join(dir, "other.pem")
+	tlsConfig, err = r.newMyTLSConfig()
+	c.Assert(err, IsNil)
+	res, err = my.connect(c, "secret", tlsConfig)
+	c.Assert(err, NotNil)
+	c.Assert(res.err, NotNil)
+
+	r.c.MySSLCA = ""
+	r.c.MySSLSkipVerify = true
+	tlsConfig, err = r.newMyTLSConfig()
+	c.Assert(err, IsNil)
+	c.Assert(r.myDumpSSLOptions(), DeepEquals, []string{"--ssl-mode=REQUIRED"})
+	res, err = my.connect(c, "secret", tlsConfig)
+	c.Assert(err, IsNil)
+	c.Assert(res.err, IsNil)
+	c.Assert(res.tls, IsTrue)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "invalid.pem"), []byte("invalid"), 0644), IsNil)
+	r.c.MySSLCA = filepath.Join(dir, "invalid.pem")
+	_, err = r.newMyTLSConfig()
+	c.Assert(err, ErrorMatches, "invalid MySQL ssl ca .*")
+}
@@ -0,0 +1,55 @@
+package river
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+
+	"github.com/siddontang/go-log/log"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// How to handle the updates which don't change the doc for the rule.
+const (
+	// send them as the other updates
+	NoopUpdateSend = "send"
+	// skip them by the content hashes of the docs before and after the update
+	NoopUpdateSkip = "skip"
+)
+
+// docHash returns the content hash of the doc, the keys are sorted by json.Marshal.
+func docHash(data map[string]interface{}) ([]byte, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(b)
+	return sum[:], nil
+}
+
+// isNoopUpdate returns whether the docs made from the rows before and after the update
+// are the same, like the update only changes the columns not synced.
+func (r *River) isNoopUpdate(rule *Rule, before []interface{}, after []interface{}) bool {
+	beforeData := r.makeFieldData(rule, before)
+	if beforeData == nil {
+		return false
+	}
+	defer elastic.ReleaseBulkData(beforeData)
+	afterData := r.makeFieldData(rule, after)
+	if afterData == nil {
+		return false
+	}
+	defer elastic.ReleaseBulkData(afterData)
+
+	beforeHash, err := docHash(beforeData)
+	if err != nil {
+		log.Warnf("hash the doc of %s.%s err %v, send the update", rule.Schema, rule.Table, err)
+		return false
+	}
+	afterHash, err := docHash(afterData)
+	if err != nil {
+		log.Warnf("hash the doc of %s.%s err %v, send the update", rule.Schema, rule.Table, err)
+		return false
+	}
+	return bytes.Equal(beforeHash, afterHash)
+}
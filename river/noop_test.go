@@ -0,0 +1,41 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestNoopUpdate(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("updated_at", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta, Filter: []string{"id", "name"},
+		UpdateMode: UpdateModeReindex, NoopUpdate: NoopUpdateSkip}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+
+	touch := [][]interface{}{{int32(1), "a", int32(10)}, {int32(1), "a", int32(20)}}
+	reqs, err := r.makeUpdateRequest(rule, touch)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 0)
+	c.Assert(r.st.NoopUpdateNum.Get(), Equals, int64(1))
+
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), "a", int32(10)}, {int32(1), "b", int32(20)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionIndex)
+
+	// the whole doc is indexed again for send
+	rule.NoopUpdate = NoopUpdateSend
+	reqs, err = r.makeUpdateRequest(rule, touch)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+
+	rule = &Rule{Schema: "test", Table: "t", Index: "t", NoopUpdate: "drop"}
+	c.Assert(rule.prepare(), NotNil)
+}
@@ -0,0 +1,67 @@
+package river
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash"
+	"github.com/juju/errors"
+)
+
+const defaultEtcdPrefix = "/go-mysql-elasticsearch/"
+
+// checkPartition checks partition_count and partition_index, and the etcd coordination.
+func (c *Config) checkPartition() error {
+	if len(c.EtcdEndpoints) > 0 {
+		if c.PartitionCount > 1 {
+			return errors.New("partition_count can't be used with etcd_endpoints")
+		}
+		if c.EtcdTTL.Duration != 0 && c.EtcdTTL.Duration < 3*time.Second {
+			return errors.Errorf("invalid etcd_ttl %s, must be at least 3s", c.EtcdTTL.Duration)
+		}
+		if len(c.EtcdPrefix) == 0 {
+			c.EtcdPrefix = defaultEtcdPrefix
+		}
+		if !strings.HasSuffix(c.EtcdPrefix, "/") {
+			c.EtcdPrefix += "/"
+		}
+	}
+	if c.PartitionCount < 0 {
+		return errors.Errorf("invalid partition_count %d", c.PartitionCount)
+	}
+	if c.PartitionIndex < 0 || c.PartitionCount > 0 && c.PartitionIndex >= c.PartitionCount {
+		return errors.Errorf("invalid partition_index %d, must be from 0 to partition_count - 1", c.PartitionIndex)
+	}
+	return nil
+}
+
+// ownsTable checks whether the table is synced by this instance, the tables are
+// split among the instances by the hash of the schema and table names.
+func (r *River) ownsTable(schema, table string) bool {
+	if r.c.PartitionCount <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ruleKey(schema, table)))
+	return int(h.Sum32()%uint32(r.c.PartitionCount)) == r.c.PartitionIndex
+}
+
+// rendezvousOwner returns the member owning the key by the highest hash of the member
+// and the key, so only the keys of a member which joins or leaves are moved.
+func rendezvousOwner(members []string, key string) string {
+	var owner string
+	var max uint64
+	for _, member := range members {
+		if sum := xxhash.Sum64String(member + "\x00" + key); len(owner) == 0 || sum > max || sum == max && member < owner {
+			owner, max = member, sum
+		}
+	}
+	return owner
+}
+
+// assignsTable checks whether the table is assigned to this instance by the etcd coordination.
+func (r *River) assignsTable(schema, table string) bool {
+	coord := r.root().coord
+	return coord == nil || coord.owns(schema, table)
+}
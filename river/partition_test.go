@@ -0,0 +1,88 @@
+package river
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+)
+
+func (s *unitTestSuite) TestPartition(c *C) {
+	c.Assert((&Config{PartitionCount: 2, PartitionIndex: 2}).checkPartition(), NotNil)
+	c.Assert((&Config{PartitionCount: -1}).checkPartition(), NotNil)
+	c.Assert((&Config{PartitionCount: 2, PartitionIndex: 1}).checkPartition(), IsNil)
+	c.Assert((&Config{}).checkPartition(), IsNil)
+
+	rivers := make([]*River, 3)
+	for i := range rivers {
+		rivers[i] = &River{c: &Config{PartitionCount: len(rivers), PartitionIndex: i}}
+	}
+	owned := make([]int, len(rivers))
+	for i := 0; i < 100; i++ {
+		table := fmt.Sprintf("t_%d", i)
+		owners := 0
+		for j, r := range rivers {
+			if r.ownsTable("test", table) {
+				owners++
+				owned[j]++
+				c.Assert(r.isIgnoredTable("test", table), IsFalse)
+			} else {
+				c.Assert(r.isIgnoredTable("test", table), IsTrue)
+			}
+		}
+		c.Assert(owners, Equals, 1)
+		// the names are case insensitive like the rules
+		c.Assert(rivers[0].ownsTable("TEST", strings.ToUpper(table)), Equals, rivers[0].ownsTable("test", table))
+	}
+	for _, n := range owned {
+		c.Assert(n > 0, IsTrue)
+	}
+
+	c.Assert((&River{c: &Config{}}).ownsTable("test", "t"), IsTrue)
+}
+
+func (s *unitTestSuite) TestRendezvousOwner(c *C) {
+	c.Assert(rendezvousOwner(nil, "test:t"), Equals, "")
+
+	owners := func(members []string) map[string]string {
+		m := make(map[string]string)
+		for i := 0; i < 300; i++ {
+			key := ruleKey("test", fmt.Sprintf("t_%d", i))
+			m[key] = rendezvousOwner(members, key)
+		}
+		return m
+	}
+	abc := owners([]string{"a", "b", "c"})
+	counts := make(map[string]int)
+	for _, owner := range abc {
+		counts[owner]++
+	}
+	for _, member := range []string{"a", "b", "c"} {
+		c.Assert(counts[member] > 50, IsTrue, Commentf("%v", counts))
+	}
+
+	// only the tables of the member which leaves are moved
+	for key, owner := range owners([]string{"a", "b"}) {
+		if abc[key] != "c" {
+			c.Assert(owner, Equals, abc[key])
+		}
+	}
+	// only the tables moved to the member which joins are moved
+	for key, owner := range owners([]string{"a", "b", "c", "d"}) {
+		if owner != "d" {
+			c.Assert(owner, Equals, abc[key])
+		}
+	}
+}
+
+func (s *unitTestSuite) TestCheckEtcd(c *C) {
+	cfg := &Config{EtcdEndpoints: []string{"127.0.0.1:2379"}}
+	c.Assert(cfg.checkPartition(), IsNil)
+	c.Assert(cfg.EtcdPrefix, Equals, defaultEtcdPrefix)
+
+	cfg = &Config{EtcdEndpoints: []string{"127.0.0.1:2379"}, PartitionCount: 2}
+	c.Assert(cfg.checkPartition(), ErrorMatches, "partition_count can't be used with etcd_endpoints")
+	cfg = &Config{EtcdEndpoints: []string{"127.0.0.1:2379"}, EtcdTTL: TomlDuration{time.Second}}
+	c.Assert(cfg.checkPartition(), ErrorMatches, "invalid etcd_ttl .*")
+}
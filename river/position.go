@@ -0,0 +1,93 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+type binlogPosition struct {
+	File string `json:"file"`
+	Pos  uint32 `json:"pos"`
+}
+
+func newBinlogPosition(pos mysql.Position) binlogPosition {
+	return binlogPosition{File: pos.Name, Pos: pos.Pos}
+}
+
+// positionData is the sync progress for the monitoring scripts.
+type positionData struct {
+	// the position saved in master.info, the sync restarts from it
+	SavedPosition binlogPosition `json:"saved_position"`
+	// the position of the events read by canal
+	ReadPosition binlogPosition `json:"read_position"`
+	// empty if GTID is not used
+	GTIDSet string `json:"gtid_set,omitempty"`
+	// requests in the sync loop not sent yet
+	PendingRequests int64 `json:"pending_requests"`
+	SyncChanLength  int   `json:"sync_chan_length"`
+	InflightBulks   int64 `json:"inflight_bulks"`
+	// entries in the disk queue, -1 if disk_queue is not enabled
+	QueueSize int64 `json:"queue_size"`
+	// nil if no bulk is done yet
+	LastBulkTime *time.Time `json:"last_bulk_time"`
+	// the positions of the other MySQL servers
+	Upstreams []*upstreamPosition `json:"upstreams,omitempty"`
+}
+
+type upstreamPosition struct {
+	Name          string         `json:"name"`
+	SavedPosition binlogPosition `json:"saved_position"`
+	ReadPosition  binlogPosition `json:"read_position"`
+	GTIDSet       string         `json:"gtid_set,omitempty"`
+}
+
+func (s *stat) positionData() *positionData {
+	d := &positionData{
+		SavedPosition:   newBinlogPosition(s.r.master.Position()),
+		ReadPosition:    newBinlogPosition(s.r.syncedPosition()),
+		PendingRequests: s.PendingReqNum.Get(),
+		SyncChanLength:  len(s.r.syncCh),
+		InflightBulks:   s.InflightBulkNum.Get(),
+		QueueSize:       -1,
+	}
+	if s.r.canal != nil {
+		if gset := s.r.canal.SyncedGTIDSet(); gset != nil {
+			d.GTIDSet = gset.String()
+		}
+	}
+	if s.r.queue != nil {
+		d.QueueSize = s.r.queue.Size()
+	}
+	if t := s.LastBulkTime.Get(); t > 0 {
+		last := time.Unix(0, t)
+		d.LastBulkTime = &last
+	}
+	for _, u := range s.r.upstreams {
+		p := &upstreamPosition{
+			Name:          u.name,
+			SavedPosition: newBinlogPosition(u.master.Position()),
+			ReadPosition:  newBinlogPosition(u.syncedPosition()),
+		}
+		if gset := u.canal.SyncedGTIDSet(); gset != nil {
+			p.GTIDSet = gset.String()
+		}
+		d.Upstreams = append(d.Upstreams, p)
+	}
+	return d
+}
+
+// servePosition serves the positions and the pending requests in JSON.
+func (s *stat) servePosition(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(s.positionData())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("marshal position error %v", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,27 @@
+package river
+
+import (
+	"net/http/httptest"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func (s *unitTestSuite) TestPosition(c *C) {
+	r := &River{c: &Config{}, master: &masterInfo{Name: "mysql-bin.000001", Pos: 100}, syncCh: make(chan interface{}, 4),
+		replayPos: mysql.Position{Name: "mysql-bin.000002", Pos: 200}}
+	st := &stat{r: r}
+	r.syncCh <- struct{}{}
+	st.PendingReqNum.Set(3)
+
+	w := httptest.NewRecorder()
+	st.servePosition(w, httptest.NewRequest("GET", "/position", nil))
+	c.Assert(w.Body.String(), Equals, `{"saved_position":{"file":"mysql-bin.000001","pos":100},`+
+		`"read_position":{"file":"mysql-bin.000002","pos":200},"pending_requests":3,"sync_chan_length":1,`+
+		`"inflight_bulks":0,"queue_size":-1,"last_bulk_time":null}`)
+
+	now := time.Now()
+	st.LastBulkTime.Set(now.UnixNano())
+	c.Assert(st.positionData().LastBulkTime.Equal(now), IsTrue)
+}
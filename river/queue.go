@@ -0,0 +1,454 @@
+package river
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go/ioutil2"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+const (
+	defaultQueueMaxSize     = 1 << 30
+	defaultQueueSegmentSize = 64 << 20
+)
+
+// queueEntry is a flushed bulk or a truncate in the disk queue.
+type queueEntry struct {
+	Reqs     []*elastic.BulkRequest `json:"reqs,omitempty"`
+	Truncate *queueTruncate         `json:"truncate,omitempty"`
+
+	DumpCleanup []*dumpCleanupIndex `json:"dump_cleanup,omitempty"`
+	DeleteQuery []*deleteQuery      `json:"delete_query,omitempty"`
+}
+
+// queueTruncate keeps what the truncate needs, the rule may be changed by DDL
+// before the truncate is drained.
+type queueTruncate struct {
+	Schema   string   `json:"schema"`
+	Table    string   `json:"table"`
+	Index    string   `json:"index"`
+	Type     string   `json:"type"`
+	Truncate string   `json:"truncate"`
+	Aliases  []string `json:"aliases,omitempty"`
+	// to tell the docs of the table apart in the shared index
+	Cluster   string `json:"cluster,omitempty"`
+	MetaField string `json:"meta_field,omitempty"`
+}
+
+func newQueueTruncate(rule *Rule) *queueTruncate {
+	return &queueTruncate{
+		Schema:   rule.Schema,
+		Table:    rule.Table,
+		Index:    rule.indexPattern(),
+		Type:     rule.Type,
+		Truncate: rule.Truncate,
+		Aliases:  rule.Aliases,
+
+		Cluster:   rule.Cluster,
+		MetaField: rule.MetaField,
+	}
+}
+
+func (t *queueTruncate) rule() *Rule {
+	return &Rule{Schema: t.Schema, Table: t.Table, Index: t.Index, Type: t.Type, Truncate: t.Truncate, Aliases: t.Aliases,
+		Cluster: t.Cluster, MetaField: t.MetaField}
+}
+
+type queueCheckpoint struct {
+	Seq    int64 `json:"seq"`
+	Offset int64 `json:"offset"`
+}
+
+// diskQueue keeps the flushed bulks in the segment files between the binlog reader
+// and ES, one JSON entry per line. The binlog position is saved after the bulk is
+// synced to the queue, and the entries are drained to ES in order, the drained
+// position is saved in the checkpoint file after every entry.
+type diskQueue struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	alertSize   int64
+
+	mu sync.Mutex
+	// the segment being written
+	w     *os.File
+	wSeq  int64
+	wSize int64
+	// the next entry to drain
+	rf      *os.File
+	r       *bufio.Reader
+	rSeq    int64
+	rOffset int64
+	// bytes not drained
+	size    int64
+	alerted bool
+
+	// signaled after an entry is put or drained
+	put     chan struct{}
+	drained chan struct{}
+}
+
+func segmentName(seq int64) string {
+	return fmt.Sprintf("%016d.queue", seq)
+}
+
+func newDiskQueue(c *Config) (*diskQueue, error) {
+	q := &diskQueue{
+		dir:         c.QueueDir,
+		segmentSize: c.QueueSegmentSize,
+		maxSize:     c.QueueMaxSize,
+		alertSize:   c.QueueAlertSize,
+		put:         make(chan struct{}, 1),
+		drained:     make(chan struct{}, 1),
+	}
+	if len(q.dir) == 0 {
+		q.dir = path.Join(c.DataDir, "queue")
+	}
+	if q.segmentSize <= 0 {
+		q.segmentSize = defaultQueueSegmentSize
+	}
+	if q.maxSize <= 0 {
+		q.maxSize = defaultQueueMaxSize
+	}
+	if q.alertSize <= 0 {
+		q.alertSize = q.maxSize / 10 * 8
+	}
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	names, err := filepath.Glob(path.Join(q.dir, "*.queue"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(names)
+	seqs := make([]int64, 0, len(names))
+	for _, name := range names {
+		var seq int64
+		if _, err = fmt.Sscanf(path.Base(name), "%d.queue", &seq); err != nil {
+			return nil, errors.Errorf("invalid queue segment %s", name)
+		}
+		seqs = append(seqs, seq)
+	}
+
+	var cp queueCheckpoint
+	data, err := ioutil.ReadFile(q.checkpointPath())
+	if err == nil {
+		if err = json.Unmarshal(data, &cp); err != nil {
+			return nil, errors.Annotatef(err, "invalid queue checkpoint")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Trace(err)
+	}
+
+	if len(seqs) == 0 {
+		q.wSeq = cp.Seq + 1
+		q.rSeq = q.wSeq
+		if err = q.openSegment(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return q, nil
+	}
+
+	if cp.Seq < seqs[0] {
+		cp = queueCheckpoint{Seq: seqs[0]}
+	}
+	q.rSeq, q.rOffset = cp.Seq, cp.Offset
+	for _, seq := range seqs {
+		name := path.Join(q.dir, segmentName(seq))
+		if seq < q.rSeq {
+			// drained, but not removed before the crash
+			os.Remove(name)
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		q.size += fi.Size()
+	}
+	q.size -= q.rOffset
+
+	// append to the last segment after dropping the partly written entry,
+	// its binlog position is not saved, so it is read again.
+	q.wSeq = seqs[len(seqs)-1]
+	if err = q.repairSegment(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	log.Infof("disk queue %s has %d bytes to drain from segment %d offset %d", q.dir, q.size, q.rSeq, q.rOffset)
+	return q, nil
+}
+
+func (q *diskQueue) checkpointPath() string {
+	return path.Join(q.dir, "checkpoint")
+}
+
+func (q *diskQueue) openSegment() error {
+	f, err := os.OpenFile(path.Join(q.dir, segmentName(q.wSeq)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	q.w = f
+	q.wSize = fi.Size()
+	return nil
+}
+
+func (q *diskQueue) repairSegment() error {
+	name := path.Join(q.dir, segmentName(q.wSeq))
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if n := bytes.LastIndexByte(data, '\n') + 1; n < len(data) {
+		log.Warnf("drop %d bytes of the partly written entry in queue segment %s", len(data)-n, name)
+		if err = os.Truncate(name, int64(n)); err != nil {
+			return errors.Trace(err)
+		}
+		q.size -= int64(len(data) - n)
+	}
+	return errors.Trace(q.openSegment())
+}
+
+// putEntry appends the entry and syncs it to disk, it blocks while the queue
+// is full, so the binlog is not read until ES drains the queue.
+func (q *diskQueue) putEntry(ctx context.Context, entry *queueEntry) error {
+	if entry.Truncate == nil && len(entry.DumpCleanup) == 0 && len(entry.DeleteQuery) == 0 && len(entry.Reqs) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data = append(data, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.size > 0 && q.size+int64(len(data)) > q.maxSize {
+		log.Warnf("disk queue is full with %d bytes, wait for ES to drain it", q.size)
+		q.mu.Unlock()
+		select {
+		case <-q.drained:
+		case <-time.After(10 * time.Second):
+		case <-ctx.Done():
+			q.mu.Lock()
+			return errors.Trace(ctx.Err())
+		}
+		q.mu.Lock()
+	}
+
+	if q.wSize > 0 && q.wSize+int64(len(data)) > q.segmentSize {
+		if err = q.w.Close(); err != nil {
+			return errors.Trace(err)
+		}
+		q.wSeq++
+		if err = q.openSegment(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	n, err := q.w.Write(data)
+	q.wSize += int64(n)
+	q.size += int64(n)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = q.w.Sync(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if q.size >= q.alertSize && !q.alerted {
+		q.alerted = true
+		log.Warnf("!!! disk queue has %d bytes, more than queue_alert_size %d, is ES down? !!!", q.size, q.alertSize)
+	}
+
+	select {
+	case q.put <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next returns the next entry to drain, it blocks until an entry is put.
+// The entry must be acked before next is called again.
+func (q *diskQueue) next(ctx context.Context) ([]byte, error) {
+	for {
+		data, err := q.read()
+		if err != nil || data != nil {
+			return data, errors.Trace(err)
+		}
+		select {
+		case <-q.put:
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		}
+	}
+}
+
+// read returns nil if no entry to drain.
+func (q *diskQueue) read() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.rSeq == q.wSeq && q.rOffset >= q.wSize {
+			return nil, nil
+		}
+
+		if q.rf == nil {
+			f, err := os.Open(path.Join(q.dir, segmentName(q.rSeq)))
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if _, err = f.Seek(q.rOffset, io.SeekStart); err != nil {
+				f.Close()
+				return nil, errors.Trace(err)
+			}
+			q.rf = f
+			q.r = bufio.NewReader(f)
+		}
+
+		data, err := q.r.ReadBytes('\n')
+		if err == nil {
+			return data, nil
+		} else if err != io.EOF || len(data) > 0 || q.rSeq == q.wSeq {
+			return nil, errors.Annotatef(err, "read queue segment %d offset %d", q.rSeq, q.rOffset)
+		}
+
+		// the segment is drained, move to the next one
+		q.rf.Close()
+		q.rf = nil
+		os.Remove(path.Join(q.dir, segmentName(q.rSeq)))
+		q.rSeq++
+		q.rOffset = 0
+	}
+}
+
+// ack marks the entry returned by next drained, and saves the checkpoint.
+func (q *diskQueue) ack(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rOffset += int64(len(data))
+	q.size -= int64(len(data))
+	if q.size < q.alertSize/2 {
+		q.alerted = false
+	}
+
+	select {
+	case q.drained <- struct{}{}:
+	default:
+	}
+
+	cp, err := json.Marshal(queueCheckpoint{Seq: q.rSeq, Offset: q.rOffset})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil2.WriteFileAtomic(q.checkpointPath(), cp, 0644))
+}
+
+// Size returns the bytes not drained.
+func (q *diskQueue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+func (q *diskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.rf != nil {
+		q.rf.Close()
+		q.rf = nil
+	}
+	return errors.Trace(q.w.Close())
+}
+
+func decodeQueueEntry(data []byte) (*queueEntry, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	// keep the numbers as they are, int64 can't be kept by float64
+	d.UseNumber()
+	entry := new(queueEntry)
+	return entry, errors.Trace(d.Decode(entry))
+}
+
+// drainQueue sends the entries in the disk queue to ES in order, the failed
+// entry is retried until ES is back.
+func (r *River) drainQueue() {
+	defer r.wg.Done()
+
+	for {
+		data, err := r.queue.next(r.ctx)
+		if err != nil {
+			if r.ctx.Err() == nil {
+				log.Errorf("read disk queue err %v, close sync", err)
+				r.st.addError("read disk queue err %v, close sync", err)
+				r.cancel()
+			}
+			return
+		}
+		entry, err := decodeQueueEntry(data)
+		if err != nil {
+			log.Errorf("decode disk queue entry err %v, close sync", err)
+			r.st.addError("decode disk queue entry err %v, close sync", err)
+			r.cancel()
+			return
+		}
+
+		backoff := time.Second
+		for {
+			if entry.Truncate != nil {
+				err = r.doTruncate(entry.Truncate.rule())
+			} else if len(entry.DumpCleanup) > 0 {
+				err = r.doDumpCleanup(entry.DumpCleanup)
+			} else if len(entry.DeleteQuery) > 0 {
+				err = r.doDeleteQueries(entry.DeleteQuery)
+			} else {
+				err = r.doBulk(entry.Reqs)
+			}
+			if err == nil || r.ctx.Err() != nil {
+				break
+			}
+
+			log.Errorf("drain disk queue err %v, retry after %s", err, backoff)
+			r.st.addError("drain disk queue err %v", err)
+			select {
+			case <-time.After(backoff):
+			case <-r.ctx.Done():
+			}
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		if err = r.queue.ack(data); err != nil {
+			log.Errorf("save disk queue checkpoint err %v, close sync", err)
+			r.st.addError("save disk queue checkpoint err %v, close sync", err)
+			r.cancel()
+			return
+		}
+	}
+}
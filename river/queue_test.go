@@ -0,0 +1,96 @@
+package river
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestDiskQueue(c *C) {
+	dir, err := ioutil.TempDir("", "river_queue")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{QueueDir: dir, QueueSegmentSize: 100, QueueMaxSize: 1000}
+	q, err := newDiskQueue(cfg)
+	c.Assert(err, IsNil)
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		req := &elastic.BulkRequest{Action: elastic.ActionIndex, Index: "t", ID: fmt.Sprint(i),
+			Data: map[string]interface{}{"n": int64(9007199254740993)}}
+		c.Assert(q.putEntry(ctx, &queueEntry{Reqs: []*elastic.BulkRequest{req}}), IsNil)
+	}
+	c.Assert(q.putEntry(ctx, &queueEntry{Truncate: newQueueTruncate(&Rule{Schema: "test", Table: "t", Index: "t", Truncate: TruncateRecreate})}), IsNil)
+	// nothing to queue
+	c.Assert(q.putEntry(ctx, &queueEntry{}), IsNil)
+
+	segments, _ := filepath.Glob(dir + "/*.queue")
+	c.Assert(len(segments) > 1, IsTrue)
+
+	// drain two entries
+	for i := 0; i < 2; i++ {
+		data, err := q.next(ctx)
+		c.Assert(err, IsNil)
+		entry, err := decodeQueueEntry(data)
+		c.Assert(err, IsNil)
+		c.Assert(entry.Reqs[0].ID, Equals, fmt.Sprint(i))
+		body, err := json.Marshal(entry.Reqs[0].Data)
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, `{"n":9007199254740993}`)
+		c.Assert(q.ack(data), IsNil)
+	}
+	size := q.Size()
+	c.Assert(q.Close(), IsNil)
+
+	// a partly written entry is dropped after restart
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	f.Write([]byte(`{"reqs":[{"Act`))
+	f.Close()
+
+	q, err = newDiskQueue(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(q.Size(), Equals, size)
+	for i := 2; i < 6; i++ {
+		data, err := q.next(ctx)
+		c.Assert(err, IsNil)
+		entry, err := decodeQueueEntry(data)
+		c.Assert(err, IsNil)
+		if i < 5 {
+			c.Assert(entry.Reqs[0].ID, Equals, fmt.Sprint(i))
+		} else {
+			c.Assert(entry.Truncate.rule().Truncate, Equals, TruncateRecreate)
+		}
+		c.Assert(q.ack(data), IsNil)
+	}
+	c.Assert(q.Size(), Equals, int64(0))
+
+	// the drained segments are removed
+	segments, _ = filepath.Glob(dir + "/*.queue")
+	c.Assert(segments, HasLen, 1)
+
+	// blocks while full
+	big := &elastic.BulkRequest{Action: elastic.ActionIndex, Index: "t", ID: "big", Data: map[string]interface{}{"s": strings.Repeat("a", 600)}}
+	c.Assert(q.putEntry(ctx, &queueEntry{Reqs: []*elastic.BulkRequest{big}}), IsNil)
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	c.Assert(q.putEntry(timeout, &queueEntry{Reqs: []*elastic.BulkRequest{big}}), NotNil)
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer waitCancel()
+	data, err := q.next(waitCtx)
+	c.Assert(err, IsNil)
+	c.Assert(q.ack(data), IsNil)
+	_, err = q.next(waitCtx)
+	c.Assert(err, NotNil)
+	c.Assert(q.Close(), IsNil)
+}
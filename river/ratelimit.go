@@ -0,0 +1,140 @@
+package river
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of docs or bytes per second, the burst is one second of the rate.
+// A request larger than the bucket is allowed, and the following ones wait for the debt.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// Rate returns the rate per second, 0 means no limit.
+func (b *tokenBucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// SetRate changes the rate per second, 0 means no limit.
+func (b *tokenBucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	b.tokens = float64(rate)
+	b.last = time.Now()
+}
+
+// reserve takes n tokens, and returns how long to wait for them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// Wait waits until n tokens are available or the context is done.
+func (b *tokenBucket) Wait(ctx context.Context, n int) error {
+	wait := b.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimits has the global limits of docs and bytes sent to ES per second,
+// and the limits of docs per second of the tables, they can be changed at runtime.
+type rateLimits struct {
+	docs  *tokenBucket
+	bytes *tokenBucket
+
+	mu     sync.Mutex
+	tables map[string]*tokenBucket
+}
+
+func newRateLimits(docs int64, bytes int64) *rateLimits {
+	return &rateLimits{
+		docs:   newTokenBucket(docs),
+		bytes:  newTokenBucket(bytes),
+		tables: make(map[string]*tokenBucket),
+	}
+}
+
+// table returns the limit of the rule's table, it is created with the rule's rate_limit_docs.
+func (l *rateLimits) table(rule *Rule) *tokenBucket {
+	key := ruleKey(rule.Schema, rule.Table)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.tables[key]
+	if !ok {
+		b = newTokenBucket(rule.RateLimitDocs)
+		l.tables[key] = b
+	}
+	return b
+}
+
+// setTable changes the limit of the table at runtime.
+func (l *rateLimits) setTable(schema, table string, rate int64) {
+	key := ruleKey(schema, table)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.tables[key]; ok {
+		b.SetRate(rate)
+		return
+	}
+	l.tables[key] = newTokenBucket(rate)
+}
+
+// tableRates returns the limits of the tables by "schema:table".
+func (l *rateLimits) tableRates() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rates := make(map[string]int64, len(l.tables))
+	for key, b := range l.tables {
+		rates[key] = b.Rate()
+	}
+	return rates
+}
+
+// throttleBulk waits for the global limits before a bulk is sent.
+func (r *River) throttleBulk(docs int, size int) error {
+	if err := r.limits.docs.Wait(r.ctx, docs); err != nil {
+		return err
+	}
+	return r.limits.bytes.Wait(r.ctx, size)
+}
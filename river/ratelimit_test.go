@@ -0,0 +1,84 @@
+package river
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestTokenBucket(c *C) {
+	b := newTokenBucket(0)
+	c.Assert(b.reserve(1000000), Equals, time.Duration(0))
+
+	b.SetRate(100)
+	c.Assert(b.reserve(100), Equals, time.Duration(0))
+	// in debt for 50 docs
+	wait := b.reserve(50)
+	c.Assert(wait > 400*time.Millisecond && wait <= 500*time.Millisecond, IsTrue, Commentf("%s", wait))
+
+	b.SetRate(0)
+	c.Assert(b.reserve(50), Equals, time.Duration(0))
+}
+
+func (s *unitTestSuite) TestTableRateLimit(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+	other := &schema.Table{Schema: "test", Name: "other"}
+	other.AddColumn("id", "int(11)", "", "")
+	other.PKColumns = []int{0}
+
+	limited := &Rule{Schema: "test", Table: "t", Index: "t", Type: "t", TableInfo: ta, RateLimitDocs: 10}
+	unlimited := &Rule{Schema: "test", Table: "other", Index: "other", Type: "other", TableInfo: other}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &River{c: &Config{}, ctx: ctx, st: &stat{}, syncCh: make(chan interface{}, 16), limits: newRateLimits(0, 0),
+		rules: map[string]*Rule{ruleKey("test", "t"): limited, ruleKey("test", "other"): unlimited}}
+	for _, rule := range r.rules {
+		c.Assert(rule.prepare(), IsNil)
+		r.setFieldMapping(rule)
+	}
+	h := &eventHandler{r: r}
+	rows := func(table *schema.Table, n int) *canal.RowsEvent {
+		e := &canal.RowsEvent{Action: canal.InsertAction, Table: table, Header: &replication.EventHeader{LogPos: 120}}
+		for i := 0; i < n; i++ {
+			e.Rows = append(e.Rows, []interface{}{int32(i)})
+		}
+		return e
+	}
+	syncRows := func(e *canal.RowsEvent) time.Duration {
+		start := time.Now()
+		c.Assert(h.OnRow(e), IsNil)
+		c.Assert((<-r.syncCh).([]*elastic.BulkRequest), HasLen, len(e.Rows))
+		return time.Since(start)
+	}
+
+	// one second of the rate is the burst
+	c.Assert(syncRows(rows(ta, 10)) < 100*time.Millisecond, IsTrue)
+	// the other tables don't wait for the limit of the table
+	c.Assert(syncRows(rows(other, 100)) < 100*time.Millisecond, IsTrue)
+	wait := syncRows(rows(ta, 5))
+	c.Assert(wait >= 400*time.Millisecond && wait < time.Second, IsTrue, Commentf("%s", wait))
+	c.Assert(r.limits.tableRates(), DeepEquals, map[string]int64{ruleKey("test", "t"): 10, ruleKey("test", "other"): 0})
+
+	// the limit changed at runtime applies to the next rows
+	r.limits.setTable("test", "t", 0)
+	c.Assert(syncRows(rows(ta, 1000)) < 100*time.Millisecond, IsTrue)
+
+	// the rows in debt stop waiting when the river is closed
+	r.limits.setTable("test", "t", 1)
+	c.Assert(syncRows(rows(ta, 1)) < 100*time.Millisecond, IsTrue)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	c.Assert(h.OnRow(rows(ta, 10)), ErrorMatches, "context canceled")
+	c.Assert(time.Since(start) < time.Second, IsTrue)
+	c.Assert(r.syncCh, HasLen, 0)
+}
@@ -0,0 +1,219 @@
+package river
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// eventRecord is a line of the record file, a table with its metadata,
+// or a rows event of the last recorded table of the same name.
+type eventRecord struct {
+	Table *schema.Table `json:"table,omitempty"`
+
+	Schema     string           `json:"schema,omitempty"`
+	Name       string           `json:"name,omitempty"`
+	Action     string           `json:"action,omitempty"`
+	Rows       [][]*recordValue `json:"rows,omitempty"`
+	BinlogFile string           `json:"binlog_file,omitempty"`
+	BinlogPos  uint32           `json:"binlog_pos,omitempty"`
+	Timestamp  uint32           `json:"timestamp,omitempty"`
+	GTID       string           `json:"gtid,omitempty"`
+	// the dumped rows have no binlog position
+	Dump bool `json:"dump,omitempty"`
+}
+
+// recordValue keeps the Go type of the column value, nil is null in JSON.
+type recordValue struct {
+	T string `json:"t"`
+	V string `json:"v"`
+}
+
+func encodeRecordValue(value interface{}) (*recordValue, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case int8:
+		return &recordValue{"int8", strconv.FormatInt(int64(v), 10)}, nil
+	case int16:
+		return &recordValue{"int16", strconv.FormatInt(int64(v), 10)}, nil
+	case int32:
+		return &recordValue{"int32", strconv.FormatInt(int64(v), 10)}, nil
+	case int64:
+		return &recordValue{"int64", strconv.FormatInt(v, 10)}, nil
+	case int:
+		return &recordValue{"int", strconv.FormatInt(int64(v), 10)}, nil
+	case uint8:
+		return &recordValue{"uint8", strconv.FormatUint(uint64(v), 10)}, nil
+	case uint16:
+		return &recordValue{"uint16", strconv.FormatUint(uint64(v), 10)}, nil
+	case uint32:
+		return &recordValue{"uint32", strconv.FormatUint(uint64(v), 10)}, nil
+	case uint64:
+		return &recordValue{"uint64", strconv.FormatUint(v, 10)}, nil
+	case float32:
+		return &recordValue{"float32", strconv.FormatFloat(float64(v), 'g', -1, 32)}, nil
+	case float64:
+		return &recordValue{"float64", strconv.FormatFloat(v, 'g', -1, 64)}, nil
+	case string:
+		return &recordValue{"string", v}, nil
+	case []byte:
+		return &recordValue{"bytes", base64.StdEncoding.EncodeToString(v)}, nil
+	case decimal.Decimal:
+		return &recordValue{"decimal", v.String()}, nil
+	case []*replication.JsonDiff:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &recordValue{"json_diff", string(data)}, nil
+	default:
+		return nil, errors.Errorf("unsupported value %v of type %T", value, value)
+	}
+}
+
+func decodeRecordValue(rv *recordValue) (interface{}, error) {
+	if rv == nil {
+		return nil, nil
+	}
+
+	var (
+		value interface{}
+		err   error
+	)
+	switch rv.T {
+	case "int8", "int16", "int32", "int64", "int":
+		var n int64
+		if n, err = strconv.ParseInt(rv.V, 10, 64); err == nil {
+			switch rv.T {
+			case "int8":
+				value = int8(n)
+			case "int16":
+				value = int16(n)
+			case "int32":
+				value = int32(n)
+			case "int64":
+				value = n
+			default:
+				value = int(n)
+			}
+		}
+	case "uint8", "uint16", "uint32", "uint64":
+		var n uint64
+		if n, err = strconv.ParseUint(rv.V, 10, 64); err == nil {
+			switch rv.T {
+			case "uint8":
+				value = uint8(n)
+			case "uint16":
+				value = uint16(n)
+			case "uint32":
+				value = uint32(n)
+			default:
+				value = n
+			}
+		}
+	case "float32":
+		var f float64
+		if f, err = strconv.ParseFloat(rv.V, 32); err == nil {
+			value = float32(f)
+		}
+	case "float64":
+		value, err = strconv.ParseFloat(rv.V, 64)
+	case "string":
+		value = rv.V
+	case "bytes":
+		value, err = base64.StdEncoding.DecodeString(rv.V)
+	case "decimal":
+		value, err = decimal.NewFromString(rv.V)
+	case "json_diff":
+		var diffs []*replication.JsonDiff
+		err = json.Unmarshal([]byte(rv.V), &diffs)
+		value = diffs
+	default:
+		return nil, errors.Errorf("unsupported value type %s", rv.T)
+	}
+	return value, errors.Annotatef(err, "invalid %s value %s", rv.T, rv.V)
+}
+
+// eventRecorder records the row events of the synced tables, the table metadata
+// is recorded when it is first seen or changed.
+type eventRecorder struct {
+	f *os.File
+	w *bufio.Writer
+
+	tables map[string]*schema.Table
+}
+
+func newEventRecorder(name string) (*eventRecorder, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &eventRecorder{f: f, w: bufio.NewWriter(f), tables: make(map[string]*schema.Table)}, nil
+}
+
+func (rec *eventRecorder) writeRecord(record *eventRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rec.w.Write(data)
+	return errors.Trace(rec.w.WriteByte('\n'))
+}
+
+func (rec *eventRecorder) record(h *eventHandler, e *canal.RowsEvent) error {
+	key := ruleKey(e.Table.Schema, e.Table.Name)
+	// the table is replaced in the cache after DDL
+	if rec.tables[key] != e.Table {
+		if err := rec.writeRecord(&eventRecord{Table: e.Table}); err != nil {
+			return errors.Trace(err)
+		}
+		rec.tables[key] = e.Table
+	}
+
+	record := &eventRecord{
+		Schema: e.Table.Schema,
+		Name:   e.Table.Name,
+		Action: e.Action,
+		Rows:   make([][]*recordValue, 0, len(e.Rows)),
+		GTID:   h.gtid,
+		Dump:   e.Header == nil,
+	}
+	if e.Header != nil {
+		record.BinlogFile = h.r.syncedPosition().Name
+		record.BinlogPos = e.Header.LogPos
+		record.Timestamp = e.Header.Timestamp
+	}
+	for _, row := range e.Rows {
+		values := make([]*recordValue, 0, len(row))
+		for _, value := range row {
+			rv, err := encodeRecordValue(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			values = append(values, rv)
+		}
+		record.Rows = append(record.Rows, values)
+	}
+
+	if err := rec.writeRecord(record); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(rec.w.Flush())
+}
+
+func (rec *eventRecorder) Close() error {
+	if err := rec.w.Flush(); err != nil {
+		rec.f.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(rec.f.Close())
+}
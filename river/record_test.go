@@ -0,0 +1,33 @@
+package river
+
+import (
+	"encoding/json"
+
+	. "github.com/pingcap/check"
+	"github.com/shopspring/decimal"
+)
+
+func (s *unitTestSuite) TestRecordValue(c *C) {
+	values := []interface{}{nil, int8(-1), int16(2), int32(-3), int64(4), 5, uint8(6), uint16(7), uint32(8),
+		uint64(18446744073709551615), float32(1.5), 2.25, "a", []byte{0, 0xff}, decimal.RequireFromString("12.340")}
+	for _, value := range values {
+		rv, err := encodeRecordValue(value)
+		c.Assert(err, IsNil)
+		data, err := json.Marshal(rv)
+		c.Assert(err, IsNil)
+		rv = nil
+		c.Assert(json.Unmarshal(data, &rv), IsNil)
+		v, err := decodeRecordValue(rv)
+		c.Assert(err, IsNil)
+		if d, ok := value.(decimal.Decimal); ok {
+			c.Assert(v.(decimal.Decimal).Equal(d), IsTrue)
+			continue
+		}
+		c.Assert(v, DeepEquals, value)
+	}
+
+	_, err := encodeRecordValue(struct{}{})
+	c.Assert(err, NotNil)
+	_, err = decodeRecordValue(&recordValue{T: "int8", V: "x"})
+	c.Assert(err, NotNil)
+}
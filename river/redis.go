@@ -0,0 +1,239 @@
+package river
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+const defaultRedisTimeout = 3 * time.Second
+
+// redisClient deletes the cache keys of the changed rows in Redis, it speaks the
+// few commands of RESP it needs over one connection.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	// DEL or UNLINK
+	command string
+
+	// the upstreams share the client
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// newRedisClient returns nil if redis_addr is not set.
+func newRedisClient(c *Config) (*redisClient, error) {
+	if len(c.RedisAddr) == 0 {
+		for _, rule := range c.Rules {
+			if len(rule.RedisKeys) > 0 {
+				return nil, errors.Errorf("redis_addr must be set for redis_keys of rule %s.%s", rule.Schema, rule.Table)
+			}
+		}
+		return nil, nil
+	}
+
+	timeout := c.RedisTimeout.Duration
+	if timeout == 0 {
+		timeout = defaultRedisTimeout
+	}
+	command := "DEL"
+	if c.RedisUnlink {
+		command = "UNLINK"
+	}
+	return &redisClient{
+		addr:     c.RedisAddr,
+		password: c.RedisPassword,
+		db:       c.RedisDB,
+		timeout:  timeout,
+		command:  command,
+	}, nil
+}
+
+// parseRedisKeys parses the key templates of the rule like "user:{id}".
+func parseRedisKeys(keys []string) ([][]idTemplatePart, error) {
+	templates := make([][]idTemplatePart, 0, len(keys))
+	for _, key := range keys {
+		parts, err := parseIDTemplate(key)
+		if err != nil {
+			return nil, errors.Errorf("invalid redis key %s: %v", key, err)
+		}
+		templates = append(templates, parts)
+	}
+	return templates, nil
+}
+
+// redisKeys returns the cache keys of the rows, the keys with a NULL column are skipped.
+// Both the before and after images of the updated rows are used, so the keys of the
+// changed columns are deleted too.
+func (r *River) redisKeys(rule *Rule, rows [][]interface{}, keys []string, seen map[string]bool) ([]string, error) {
+	var buf bytes.Buffer
+	for _, row := range rows {
+	templates:
+		for _, parts := range rule.redisKeys {
+			buf.Reset()
+			for _, part := range parts {
+				if len(part.column) == 0 {
+					buf.WriteString(part.literal)
+					continue
+				}
+				value, err := rule.TableInfo.GetColumnValue(part.column, row)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				switch v := value.(type) {
+				case nil:
+					continue templates
+				case []byte:
+					buf.Write(v)
+				default:
+					writePlainIDValue(&buf, v)
+				}
+			}
+			if key := buf.String(); !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// invalidateRows deletes the cache keys of the changed rows of the rule and its fan-out rules.
+func (r *River) invalidateRows(rule *Rule, rows [][]interface{}) error {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, target := range rule.targets() {
+		if len(target.redisKeys) == 0 {
+			continue
+		}
+		var err error
+		if keys, err = r.redisKeys(target, rows, keys, seen); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if err := r.redis.delete(keys); err != nil {
+		return errors.Annotatef(err, "delete %d redis keys", len(keys))
+	}
+	r.st.RedisKeyNum.Add(int64(len(keys)))
+	return nil
+}
+
+// delete deletes the keys, the command is tried again once on a new connection,
+// as the idle one may be closed by Redis.
+func (c *redisClient) delete(keys []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	args := make([]string, 0, len(keys)+1)
+	args = append(args, c.command)
+	args = append(args, keys...)
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if c.conn == nil {
+			if err = c.connect(); err != nil {
+				continue
+			}
+		}
+		if _, err = c.do(args...); err == nil {
+			return nil
+		}
+		if _, ok := err.(redisError); ok {
+			return errors.Trace(err)
+		}
+		log.Warnf("redis %s err %v, reconnect", c.addr, err)
+		c.close()
+	}
+	return errors.Trace(err)
+}
+
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+
+	if len(c.password) > 0 {
+		if _, err = c.do("AUTH", c.password); err != nil {
+			c.close()
+			return errors.Annotatef(err, "redis auth")
+		}
+	}
+	if c.db > 0 {
+		if _, err = c.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			c.close()
+			return errors.Annotatef(err, "redis select %d", c.db)
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.rd = nil
+	}
+}
+
+// Close closes the connection.
+func (c *redisClient) Close() {
+	c.mu.Lock()
+	c.close()
+	c.mu.Unlock()
+}
+
+// redisError is the error reply of Redis, the command is not tried again.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do sends the command and reads the reply, only the simple string and the
+// integer replies are expected.
+func (c *redisClient) do(args ...string) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		buf.WriteString(arg)
+		buf.WriteString("\r\n")
+	}
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return "", errors.Trace(err)
+	}
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errors.Errorf("invalid redis reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	default:
+		return "", errors.Errorf("unexpected redis reply %q", line)
+	}
+}
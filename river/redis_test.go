@@ -0,0 +1,100 @@
+package river
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestRedisKeys(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	// a fake Redis replies the commands, and closes the connection after QUIT
+	commands := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			rd := bufio.NewReader(conn)
+			for {
+				line, err := rd.ReadString('\n')
+				if err != nil {
+					break
+				}
+				n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				args := make([]string, 0, n)
+				for i := 0; i < n; i++ {
+					rd.ReadString('\n')
+					arg, _ := rd.ReadString('\n')
+					args = append(args, strings.TrimSpace(arg))
+				}
+				cmd := strings.Join(args, " ")
+				commands <- cmd
+				switch {
+				case args[0] == "QUIT":
+					conn.Write([]byte("+OK\r\n"))
+					conn.Close()
+				case args[0] == "UNLINK" && args[1] == "bad":
+					conn.Write([]byte("-ERR bad key\r\n"))
+				case args[0] == "UNLINK":
+					conn.Write([]byte(":" + strconv.Itoa(n-1) + "\r\n"))
+				default:
+					conn.Write([]byte("+OK\r\n"))
+				}
+			}
+		}
+	}()
+
+	ta := &schema.Table{Schema: "test", Name: "users"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("email", "varchar(32)", "", "")
+	ta.PKColumns = []int{0}
+
+	c.Assert((&Rule{Schema: "test", Table: "users", RedisKeys: []string{"user:{id"}}).prepare(), NotNil)
+	rule := &Rule{Schema: "test", Table: "users", TableInfo: ta, RedisKeys: []string{"user:{id}", "user_email:{email}"}}
+	c.Assert(rule.prepare(), IsNil)
+
+	cfg := &Config{Rules: []*Rule{rule}}
+	_, err = newRedisClient(cfg)
+	c.Assert(err, NotNil)
+	cfg.RedisAddr = ln.Addr().String()
+	cfg.RedisPassword = "secret"
+	cfg.RedisDB = 2
+	cfg.RedisUnlink = true
+	r := &River{c: cfg, st: &stat{}}
+	r.redis, err = newRedisClient(cfg)
+	c.Assert(err, IsNil)
+	defer r.redis.Close()
+
+	// the keys of the old and new rows, without the NULL email
+	rows := [][]interface{}{{int64(1), "a@example.com"}, {int64(1), "b@example.com"}, {int64(2), nil}, {int64(2), []byte("c@example.com")}}
+	c.Assert(r.invalidateRows(rule, rows), IsNil)
+	c.Assert(<-commands, Equals, "AUTH secret")
+	c.Assert(<-commands, Equals, "SELECT 2")
+	c.Assert(<-commands, Equals, "UNLINK user:1 user_email:a@example.com user_email:b@example.com user:2 user_email:c@example.com")
+	c.Assert(r.st.RedisKeyNum.Get(), Equals, int64(5))
+
+	// tried again on a new connection after it is closed
+	r.redis.mu.Lock()
+	_, err = r.redis.do("QUIT")
+	r.redis.mu.Unlock()
+	c.Assert(err, IsNil)
+	c.Assert(<-commands, Equals, "QUIT")
+	c.Assert(r.invalidateRows(rule, [][]interface{}{{int64(3), nil}}), IsNil)
+	c.Assert(<-commands, Equals, "AUTH secret")
+	c.Assert(<-commands, Equals, "SELECT 2")
+	c.Assert(<-commands, Equals, "UNLINK user:3")
+
+	// the error replies are not tried again
+	c.Assert(r.redis.delete([]string{"bad"}), NotNil)
+	c.Assert(<-commands, Equals, "UNLINK bad")
+	c.Assert(r.st.RedisKeyNum.Get(), Equals, int64(6))
+}
@@ -0,0 +1,177 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// the rows selected by a query of the re-dump
+const redumpBatchSize = 1000
+
+// redumpQuery returns the query of the next rows of the table after the primary key
+// of the last row, the first rows if after is nil.
+func redumpQuery(table *schema.Table, after bool) string {
+	var buf bytes.Buffer
+	buf.WriteString("SELECT ")
+	for i, col := range table.Columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(fmt.Sprintf("`%s`", col.Name))
+	}
+	buf.WriteString(fmt.Sprintf(" FROM `%s`.`%s`", table.Schema, table.Name))
+
+	pks := make([]string, len(table.PKColumns))
+	for i, index := range table.PKColumns {
+		pks[i] = fmt.Sprintf("`%s`", table.Columns[index].Name)
+	}
+	if after {
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(pks)), ", ")
+		buf.WriteString(fmt.Sprintf(" WHERE (%s) > (%s)", strings.Join(pks, ", "), marks))
+	}
+	buf.WriteString(fmt.Sprintf(" ORDER BY %s LIMIT %d", strings.Join(pks, ", "), redumpBatchSize))
+	return buf.String()
+}
+
+// startRedump re-dumps the table of the rule in the background, only one table is
+// re-dumped at a time.
+func (r *River) startRedump(schemaName, table string) error {
+	rule, ok := r.getRule(ruleKey(schemaName, table))
+	if !ok {
+		return errors.NotFoundf("rule of %s.%s", schemaName, table)
+	}
+	if rule.TableInfo == nil || len(rule.TableInfo.PKColumns) == 0 {
+		return errors.NotSupportedf("re-dump of %s.%s without primary key", schemaName, table)
+	}
+
+	root := r.root()
+	name := rule.Schema + "." + rule.Table
+	if !root.redumping.CompareAndSwap("", name) {
+		return errors.AlreadyExistsf("re-dump of %s", root.redumping.Get())
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer root.redumping.Set("")
+
+		if err := r.redump(rule); err != nil {
+			log.Errorf("re-dump %s err %v", name, err)
+			r.st.addError("re-dump %s err %v", name, err)
+		}
+	}()
+	return nil
+}
+
+// redumpTable re-dumps the table of the rule after the re-dump of the other table.
+func (r *River) redumpTable(rule *Rule) error {
+	if rule.TableInfo == nil || len(rule.TableInfo.PKColumns) == 0 {
+		return errors.NotSupportedf("re-dump of %s.%s without primary key", rule.Schema, rule.Table)
+	}
+
+	root := r.root()
+	name := rule.Schema + "." + rule.Table
+	for !root.redumping.CompareAndSwap("", name) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.ctx.Done():
+			return errors.Trace(r.ctx.Err())
+		}
+	}
+	defer root.redumping.Set("")
+	return errors.Trace(r.redump(rule))
+}
+
+// redump reads the rows of the table by the primary key, and syncs them like the
+// dumped ones. The binlog events wait until it is done, so the changes during
+// the re-dump are applied after it, like the ones after the dump.
+func (r *River) redump(rule *Rule) error {
+	select {
+	case <-r.canal.WaitDumpDone():
+	case <-r.ctx.Done():
+		return errors.Trace(r.ctx.Err())
+	}
+
+	root := r.root()
+	root.redumpMu.Lock()
+	defer root.redumpMu.Unlock()
+
+	log.Infof("re-dump %s.%s", rule.Schema, rule.Table)
+	h := &eventHandler{r: r}
+	var after []interface{}
+	rows := 0
+	for {
+		res, err := r.canal.Execute(redumpQuery(rule.TableInfo, after != nil), after...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if res.Resultset == nil || res.RowNumber() == 0 {
+			break
+		}
+
+		values := make([][]interface{}, len(res.Values))
+		for i, row := range res.Values {
+			values[i] = make([]interface{}, len(row))
+			for j, v := range row {
+				// same as the values in dump
+				if b, ok := v.([]byte); ok {
+					values[i][j] = string(b)
+				} else {
+					values[i][j] = v
+				}
+			}
+		}
+		// no header like the dumped rows
+		if err = h.OnRow(&canal.RowsEvent{Table: rule.TableInfo, Action: canal.InsertAction, Rows: values}); err != nil {
+			return errors.Trace(err)
+		}
+		rows += len(values)
+
+		if len(values) < redumpBatchSize {
+			break
+		}
+		if after, err = rule.TableInfo.GetPKValues(values[len(values)-1]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	log.Infof("re-dump %s.%s done with %d rows", rule.Schema, rule.Table, rows)
+	return nil
+}
+
+// serveRedump re-dumps the table of schema.table with POST.
+func (s *stat) serveRedump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	table := r.FormValue("table")
+	dot := strings.IndexByte(table, '.')
+	if dot <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("invalid table %s, must be schema.table\n", table)))
+		return
+	}
+	if err := s.r.startRedump(table[:dot], table[dot+1:]); err != nil {
+		switch {
+		case errors.IsNotFound(err):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.IsAlreadyExists(err):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	log.Infof("re-dump %s by %s", table, r.RemoteAddr)
+	w.Write([]byte(fmt.Sprintf("re-dump %s\n", table)))
+}
@@ -0,0 +1,47 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestRedump(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("seq", "int(11)", "", "")
+	ta.PKColumns = []int{0, 2}
+
+	c.Assert(redumpQuery(ta, false), Equals, "SELECT `id`, `name`, `seq` FROM `test`.`t` ORDER BY `id`, `seq` LIMIT 1000")
+	c.Assert(redumpQuery(ta, true), Equals, "SELECT `id`, `name`, `seq` FROM `test`.`t` WHERE (`id`, `seq`) > (?, ?) ORDER BY `id`, `seq` LIMIT 1000")
+
+	noPK := &schema.Table{Schema: "test", Name: "log"}
+	noPK.AddColumn("msg", "text", "", "")
+	r := &River{rules: map[string]*Rule{
+		ruleKey("test", "t"):   {Schema: "test", Table: "t", TableInfo: ta},
+		ruleKey("test", "log"): {Schema: "test", Table: "log", TableInfo: noPK},
+	}}
+	st := &stat{r: r}
+
+	for _, t := range []struct {
+		method string
+		table  string
+		code   int
+	}{
+		{"GET", "test.t", http.StatusMethodNotAllowed},
+		{"POST", "t", http.StatusBadRequest},
+		{"POST", "test.a", http.StatusNotFound},
+		{"POST", "test.log", http.StatusBadRequest},
+		// only one table is re-dumped at a time
+		{"POST", "test.t", http.StatusConflict},
+	} {
+		r.redumping.Set("test.other")
+		w := httptest.NewRecorder()
+		st.serveRedump(w, httptest.NewRequest(t.method, "/redump?table="+t.table, nil))
+		c.Assert(w.Code, Equals, t.code, Commentf("%s %s", t.method, t.table))
+	}
+	c.Assert(r.redumping.Get(), Equals, "test.other")
+}
@@ -0,0 +1,239 @@
+package river
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// syncDone asks the sync loop to flush all the requests and close done.
+type syncDone struct {
+	done chan struct{}
+}
+
+// NewReplayRiver creates the River to replay the row events recorded by record_file,
+// MySQL is not connected, and the rules are made with the recorded tables.
+func NewReplayRiver(c *Config) (*River, error) {
+	if err := c.resolveSecrets(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := c.checkPartition(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.applyRuleDefaults()
+
+	r := new(River)
+
+	r.c = c
+	r.rules = make(map[string]*Rule)
+	r.wildRules = make(map[string]*Rule)
+	r.syncCh = make(chan interface{}, 4096)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	// the position is never saved
+	r.master = new(masterInfo)
+
+	var err error
+	if r.skipDDLRegex, err = compileRegexps(c.SkipDDLRegex); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if r.ignoreTableRegex, err = compileRegexps(c.IgnoreTables); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if r.excludeTableRegex, err = compileExcludes(c); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = r.setTimeWindow(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	switch c.PartialRowImage {
+	case "", PartialRowUpdate:
+	case PartialRowFetch:
+		return nil, errors.Errorf("partial_row_image %s needs MySQL, it can't be replayed", c.PartialRowImage)
+	default:
+		return nil, errors.Errorf("invalid partial_row_image %s", c.PartialRowImage)
+	}
+
+	for _, rule := range c.Rules {
+		if len(rule.Schema) == 0 {
+			return nil, errors.Errorf("empty schema not allowed for rule")
+		}
+		if err = rule.prepare(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if regexp.QuoteMeta(rule.Table) != rule.Table || rule.schemaRegex != nil {
+			r.wildRules[ruleKey(rule.Schema, rule.Table)] = rule
+		}
+	}
+
+	if err = r.prepareOutput(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r.st = &stat{r: r}
+
+	return r, nil
+}
+
+// makeReplayRule makes the rule of the recorded table, nil if the table is not synced.
+func (r *River) makeReplayRule(schemaName, table string) (*Rule, error) {
+	if r.isIgnoredTable(schemaName, table) {
+		return nil, nil
+	}
+
+	var rule *Rule
+	for _, cr := range r.c.Rules {
+		if !strings.EqualFold(cr.Schema, schemaName) || !strings.EqualFold(cr.Table, table) {
+			continue
+		}
+		if rule == nil {
+			rule = cr
+		} else {
+			// fan out the table to more indices
+			rule.fanout = append(rule.fanout, cr)
+		}
+	}
+	if rule != nil {
+		return rule, nil
+	}
+
+	rule, err := r.matchWildcardRule(schemaName, table)
+	if err != nil || rule != nil {
+		return rule, errors.Trace(err)
+	}
+
+	for _, s := range r.c.Sources {
+		if !strings.EqualFold(s.Schema, schemaName) {
+			continue
+		}
+		for _, t := range s.Tables {
+			matched, err := regexp.MatchString("(?i)^"+buildTable(t)+"$", table)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if matched {
+				rule = r.c.RuleDefaults.apply(newDefaultRule(schemaName, table))
+				return rule, errors.Trace(rule.prepare())
+			}
+		}
+	}
+	return nil, nil
+}
+
+// replayTable sets the recorded table of the rule.
+func (r *River) replayTable(table *schema.Table) error {
+	key := ruleKey(table.Schema, table.Name)
+	rule, ok := r.rules[key]
+	if !ok {
+		var err error
+		if rule, err = r.makeReplayRule(table.Schema, table.Name); err != nil {
+			return errors.Trace(err)
+		}
+		if rule == nil {
+			log.Infof("table %s.%s is not synced, skip its events", table.Schema, table.Name)
+			return nil
+		}
+		r.rules[key] = rule
+	}
+
+	for _, target := range rule.targets() {
+		target.TableInfo = table
+		r.setFieldMapping(target)
+	}
+	return nil
+}
+
+// Replay runs the row events recorded in the file through the rules,
+// and returns after all the requests are sent.
+func (r *River) Replay(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	if r.sink == nil {
+		if err = r.prepareES(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	h := &eventHandler{r: r}
+	tables := make(map[string]*schema.Table)
+	reader := bufio.NewReader(f)
+	events := 0
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return errors.Trace(err)
+		}
+
+		var record eventRecord
+		if err = json.Unmarshal(data, &record); err != nil {
+			return errors.Annotatef(err, "invalid record at line %d", line)
+		}
+
+		if record.Table != nil {
+			tables[ruleKey(record.Table.Schema, record.Table.Name)] = record.Table
+			if err = r.replayTable(record.Table); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+
+		table, ok := tables[ruleKey(record.Schema, record.Name)]
+		if !ok {
+			return errors.Errorf("no table %s.%s recorded before line %d", record.Schema, record.Name, line)
+		}
+
+		e := &canal.RowsEvent{Table: table, Action: record.Action, Rows: make([][]interface{}, 0, len(record.Rows))}
+		for _, values := range record.Rows {
+			row := make([]interface{}, 0, len(values))
+			for _, rv := range values {
+				value, err := decodeRecordValue(rv)
+				if err != nil {
+					return errors.Annotatef(err, "invalid record at line %d", line)
+				}
+				row = append(row, value)
+			}
+			e.Rows = append(e.Rows, row)
+		}
+		if !record.Dump {
+			e.Header = &replication.EventHeader{Timestamp: record.Timestamp, LogPos: record.BinlogPos}
+			r.replayPos = mysql.Position{Name: record.BinlogFile, Pos: record.BinlogPos}
+		}
+		h.gtid = record.GTID
+
+		if err = h.OnRow(e); err != nil {
+			return errors.Trace(err)
+		}
+		events++
+	}
+
+	done := make(chan struct{})
+	r.syncCh <- syncDone{done}
+	select {
+	case <-done:
+	case <-r.ctx.Done():
+		return errors.Errorf("replay is closed before all the requests are sent")
+	}
+
+	log.Infof("replay %d events in %s", events, name)
+	return nil
+}
@@ -2,14 +2,24 @@ package river
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-log/log"
 	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/siddontang/go/sync2"
 	"github.com/zeayes/go-mysql-elasticsearch/elastic"
 )
 
@@ -24,7 +34,18 @@ type River struct {
 
 	canal *canal.Canal
 
-	rules map[string]*Rule
+	// rules are changed at runtime by DDL and the control API, the other
+	// goroutines take them with getRule and allRules
+	rulesMu sync.RWMutex
+	rules   map[string]*Rule
+
+	// wildcard rules to match the tables renamed at runtime
+	wildRules map[string]*Rule
+
+	skipDDLRegex     []*regexp.Regexp
+	ignoreTableRegex []*regexp.Regexp
+	// schema in lower case -> the excluded tables of the sources
+	excludeTableRegex map[string][]*regexp.Regexp
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -33,27 +54,139 @@ type River struct {
 
 	es *elastic.Client
 
+	// the secondary cluster for dual-write, nil if not set
+	secondaryES *elastic.Client
+
+	// the clients of the other clusters by name, see esClient
+	clusters map[string]*elastic.Client
+
+	// ES asks to slow down until the time in unix nano
+	slowDownUntil sync2.AtomicInt64
+
+	limits *rateLimits
+
+	// the dump is paused by the throttle schedule
+	dumpPaused sync2.AtomicBool
+	// the sync is paused by the control API and the /pause API of stat_addr
+	paused sync2.AtomicBool
+	// schema.table re-dumped by the /redump API or the control API, the binlog events
+	// hold the read lock, and the re-dump holds the write lock
+	redumping sync2.AtomicString
+	redumpMu  sync.RWMutex
+	// the tables are split among the instances in etcd, nil if etcd_endpoints is not set
+	coord *coordinator
+	// the gRPC control API, nil if grpc_addr is not set
+	control *controlServer
+	// the row events to skip by the /skip API or -skip_events
+	skipEvents sync2.AtomicInt64
+	// the binlog events before and after the unix seconds are ignored, 0 means no limit,
+	// from ignore_before_ts and ignore_after_ts or the /timewindow API
+	ignoreBeforeTS sync2.AtomicInt64
+	ignoreAfterTS  sync2.AtomicInt64
+
+	// the columns in the charsets which can't be converted to UTF-8 are warned once
+	charsetWarned sync.Map
+
 	st *stat
 
 	master *masterInfo
 
+	hb *heartbeat
+
+	// nil if no audit_file or audit_index
+	audit *auditLog
+
+	// nil if no ddl_log_file or ddl_log_index
+	ddlLog *ddlLog
+
+	// the bulk requests are written to the files or diffed with ES instead of written to ES if not nil
+	sink bulkSink
+
+	// the row events are recorded if not nil
+	recorder *eventRecorder
+
+	// the flushed bulks are queued on disk before they are sent if not nil
+	queue *diskQueue
+
+	// the doc operations are published to Kafka after they are written to ES if not nil
+	kafka *kafkaMirror
+
+	// posts the doc operations of the rules with webhook
+	webhook *webhookClient
+	// deletes the cache keys of the rules with redis_keys
+	redis *redisClient
+	// writes the docs over the field limits of the dlq policy and the ones rejected by the mapping
+	dlq *deadLetters
+
+	// the generation of the dumped docs in unix milliseconds, 0 if no dump
+	dumpGeneration int64
+
+	// the position of the replayed event, canal is nil for replay
+	replayPos mysql.Position
+
 	syncCh chan interface{}
+
+	// the rivers of the other MySQL servers, they share the output and the sync loop
+	upstreams []*River
+	// the name and the primary river of an upstream, empty and nil for the primary
+	name    string
+	primary *River
 }
 
 // NewRiver creates the River from config
 func NewRiver(c *Config) (*River, error) {
+	if err := c.resolveSecrets(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := c.checkStatAuth(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := c.checkPartition(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.applyRuleDefaults()
+	if err := c.checkUpstreams(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the config rules are copied before they are prepared
+	upstreams := make([]*Config, 0, len(c.Upstreams))
+	for _, u := range c.Upstreams {
+		upstreams = append(upstreams, c.upstreamConfig(u))
+	}
+
 	r := new(River)
 
 	r.c = c
 	r.rules = make(map[string]*Rule)
+	r.wildRules = make(map[string]*Rule)
 	r.syncCh = make(chan interface{}, 4096)
 	r.ctx, r.cancel = context.WithCancel(context.Background())
 
 	var err error
+	if r.skipDDLRegex, err = compileRegexps(c.SkipDDLRegex); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if r.ignoreTableRegex, err = compileRegexps(c.IgnoreTables); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if r.excludeTableRegex, err = compileExcludes(c); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err = r.setTimeWindow(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	if r.master, err = loadMasterInfo(c.DataDir); err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	if len(c.HeartbeatTable) > 0 {
+		if r.hb, err = newHeartbeat(r); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	if err = r.newCanal(); err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -66,22 +199,249 @@ func NewRiver(c *Config) (*River, error) {
 		return nil, errors.Trace(err)
 	}
 
-	// We must use binlog full row image
-	if err = r.canal.CheckBinlogRowImage("FULL"); err != nil {
+	if r.hb != nil {
+		if err = r.hb.prepare(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	switch c.PartialRowImage {
+	case "":
+		// We must use binlog full row image
+		if err = r.canal.CheckBinlogRowImage("FULL"); err != nil {
+			return nil, errors.Trace(err)
+		}
+	case PartialRowUpdate, PartialRowFetch:
+	default:
+		return nil, errors.Errorf("invalid partial_row_image %s", c.PartialRowImage)
+	}
+
+	switch c.BinlogCompression {
+	case "":
+		c.BinlogCompression = BinlogCompressionDecompress
+	case BinlogCompressionDecompress:
+	case BinlogCompressionReject:
+		if err = r.checkBinlogCompression(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	default:
+		return nil, errors.Errorf("invalid binlog_compression %s", c.BinlogCompression)
+	}
+
+	if err = r.prepareOutput(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// not for replay, the replayed events would be recorded again
+	if len(r.c.RecordFile) > 0 {
+		if r.recorder, err = newEventRecorder(r.c.RecordFile); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if r.c.DiskQueue {
+		if r.queue, err = newDiskQueue(r.c); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	r.st = &stat{r: r}
+
+	if err = r.prepareUpstreams(upstreams); err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	if len(c.EtcdEndpoints) > 0 {
+		r.coord = newCoordinator(r)
+	}
+
+	if len(c.GRPCAddr) > 0 {
+		if r.control, err = newControlServer(r); err != nil {
+			return nil, errors.Trace(err)
+		}
+		go r.control.Run(c.GRPCAddr)
+	}
+
+	go r.st.Run(r.c.StatAddr)
+
+	return r, nil
+}
+
+// prepareOutput prepares the ES clients, the rate limits, the audit and DDL logs and the sink.
+func (r *River) prepareOutput() error {
+	var err error
+	for _, w := range r.c.ThrottleSchedule {
+		if err = w.prepare(); err != nil {
+			return errors.Annotatef(err, "invalid throttle_schedule")
+		}
+	}
+
+	switch r.c.VersionType {
+	case "", VersionExternal, VersionExternalGTE:
+	default:
+		return errors.Errorf("invalid version_type %s", r.c.VersionType)
+	}
+
 	cfg := new(elastic.ClientConfig)
 	cfg.Addr = r.c.ESAddr
 	cfg.User = r.c.ESUser
 	cfg.Password = r.c.ESPassword
 	cfg.HTTPS = r.c.ESHttps
+	if len(r.c.ESCloudID) > 0 {
+		if cfg.Addr, err = elastic.ParseCloudID(r.c.ESCloudID); err != nil {
+			return errors.Trace(err)
+		}
+		cfg.HTTPS = true
+	}
+	if len(r.c.ESAPIKey) > 0 {
+		cfg.APIKey = elastic.EncodeAPIKey(r.c.ESAPIKey)
+	}
+	if err = r.setESTransport(cfg); err != nil {
+		return errors.Trace(err)
+	}
 	r.es = elastic.NewClient(cfg)
+	if r.es.Fault, err = r.newFaultInjector(); err != nil {
+		return errors.Trace(err)
+	}
+	r.limits = newRateLimits(r.c.RateLimitDocs, r.c.RateLimitBytes)
+	r.es.BulkThrottle = r.throttleBulk
+
+	if len(r.c.ESSecondaryAddr) > 0 {
+		cfg = new(elastic.ClientConfig)
+		cfg.Addr = r.c.ESSecondaryAddr
+		cfg.User = r.c.ESSecondaryUser
+		cfg.Password = r.c.ESSecondaryPassword
+		cfg.HTTPS = r.c.ESSecondaryHttps
+		if err = r.setESTransport(cfg); err != nil {
+			return errors.Trace(err)
+		}
+		r.secondaryES = elastic.NewClient(cfg)
+	}
 
-	r.st = &stat{r: r}
-	go r.st.Run(r.c.StatAddr)
+	if err = r.prepareClusters(); err != nil {
+		return errors.Trace(err)
+	}
 
-	return r, nil
+	if r.audit, err = newAuditLog(r.c); err != nil {
+		return errors.Trace(err)
+	}
+	if r.ddlLog, err = newDDLLog(r.c); err != nil {
+		return errors.Trace(err)
+	}
+
+	switch r.c.Sink {
+	case "", SinkES:
+	case SinkFile:
+		if r.sink, err = newFileSink(r.c); err != nil {
+			return errors.Trace(err)
+		}
+	case SinkShadow:
+		r.sink = newShadowSink(r)
+	default:
+		return errors.Errorf("invalid sink %s", r.c.Sink)
+	}
+
+	if r.kafka, err = newKafkaMirror(r.c); err != nil {
+		return errors.Trace(err)
+	}
+	r.webhook = newWebhookClient(r.c)
+	if r.redis, err = newRedisClient(r.c); err != nil {
+		return errors.Trace(err)
+	}
+	switch r.c.MappingCheck {
+	case "":
+		r.c.MappingCheck = MappingCheckWarn
+	case MappingCheckWarn, MappingCheckError, MappingCheckOff:
+	default:
+		return errors.Errorf("invalid mapping_check %s", r.c.MappingCheck)
+	}
+	switch r.c.MappingConflict {
+	case "":
+		r.c.MappingConflict = MappingConflictSkip
+	case MappingConflictSkip, MappingConflictDropField:
+	default:
+		return errors.Errorf("invalid mapping_conflict %s", r.c.MappingConflict)
+	}
+	switch r.c.BulkClientError {
+	case "":
+		r.c.BulkClientError = BulkClientErrorSkip
+		if len(r.c.DLQDir) > 0 || len(r.c.DataDir) > 0 {
+			r.c.BulkClientError = BulkClientErrorDLQ
+		}
+	case BulkClientErrorDLQ, BulkClientErrorSkip:
+	default:
+		return errors.Errorf("invalid bulk_client_error %s", r.c.BulkClientError)
+	}
+	if r.dlq, err = newDeadLetters(r.c); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// BulkFilterPathNone parses the whole bulk responses.
+const BulkFilterPathNone = "none"
+
+func (r *River) setESTransport(cfg *elastic.ClientConfig) error {
+	if len(r.c.ESProxy) > 0 {
+		proxy, err := url.Parse(r.c.ESProxy)
+		if err != nil {
+			return errors.Annotatef(err, "invalid es_proxy %s", r.c.ESProxy)
+		}
+		cfg.Proxy = proxy
+	}
+	cfg.MaxIdleConns = r.c.ESMaxIdleConns
+	cfg.MaxIdleConnsPerHost = r.c.ESMaxIdleConnsPerHost
+	cfg.MaxConnsPerHost = r.c.ESMaxConnsPerHost
+	cfg.TLSHandshakeTimeout = r.c.ESTLSHandshakeTimeout.Duration
+	cfg.ResponseHeaderTimeout = r.c.ESResponseHeaderTimeout.Duration
+	cfg.BulkTimeout = r.c.BulkTimeout.Duration
+	switch r.c.BulkFilterPath {
+	case "":
+		cfg.BulkFilterPath = elastic.DefaultBulkFilterPath
+	case BulkFilterPathNone:
+	default:
+		cfg.BulkFilterPath = r.c.BulkFilterPath
+	}
+	return nil
+}
+
+// newFaultInjector returns the fault injector of the fault_* config, nil if no fault.
+func (r *River) newFaultInjector() (*elastic.FaultInjector, error) {
+	rates := map[string]float64{
+		"fault_error_rate":  r.c.FaultErrorRate,
+		"fault_fail_rate":   r.c.FaultFailRate,
+		"fault_delay_rate":  r.c.FaultDelayRate,
+		"fault_reject_rate": r.c.FaultRejectRate,
+	}
+	enabled := false
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return nil, errors.Errorf("invalid %s %v, must be from 0 to 1", name, rate)
+		}
+		enabled = enabled || rate > 0
+	}
+	if !enabled {
+		return nil, nil
+	}
+	if r.c.FaultDelayRate > 0 && r.c.FaultDelay.Duration <= 0 {
+		return nil, errors.Errorf("fault_delay must be set with fault_delay_rate")
+	}
+
+	seed := r.c.FaultSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	f := elastic.NewFaultInjector(seed)
+	f.ErrorRate = r.c.FaultErrorRate
+	f.FailRate = r.c.FaultFailRate
+	f.DelayRate = r.c.FaultDelayRate
+	f.Delay = r.c.FaultDelay.Duration
+	f.RejectRate = r.c.FaultRejectRate
+
+	log.Warnf("!!! fault injection is enabled with seed %d, error rate %v, fail rate %v, delay rate %v, delay %s, reject rate %v !!!",
+		seed, f.ErrorRate, f.FailRate, f.DelayRate, f.Delay, f.RejectRate)
+	return f, nil
 }
 
 func (r *River) newCanal() error {
@@ -93,21 +453,93 @@ func (r *River) newCanal() error {
 	cfg.Flavor = r.c.Flavor
 
 	cfg.ServerID = r.c.ServerID
+	if period := r.c.HeartbeatPeriod.Duration; period > 0 {
+		cfg.HeartbeatPeriod = period
+		cfg.ReadTimeout = 3 * period
+	}
 	cfg.Dump.ExecutionPath = r.c.DumpExec
 	cfg.Dump.DiscardErr = false
 	cfg.Dump.SkipMasterData = r.c.SkipMasterData
+	cfg.RejectTransactionPayload = r.c.BinlogCompression == BinlogCompressionReject
+
+	tlsConfig, err := r.newMyTLSConfig()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if tlsConfig != nil {
+		cfg.TLSConfig = tlsConfig
+		cfg.Dump.ExtraOptions = r.myDumpSSLOptions()
+	}
 
 	for _, s := range r.c.Sources {
+		schema := s.Schema
+		if isSchemaRegex(schema) {
+			schema = "(?:" + schema + ")"
+		}
 		for _, t := range s.Tables {
-			cfg.IncludeTableRegex = append(cfg.IncludeTableRegex, s.Schema+"\\."+t)
+			cfg.IncludeTableRegex = append(cfg.IncludeTableRegex, schema+"\\."+buildTable(t))
 		}
 	}
+	if r.hb != nil && len(cfg.IncludeTableRegex) > 0 {
+		cfg.IncludeTableRegex = append(cfg.IncludeTableRegex, regexp.QuoteMeta(r.hb.schema+"."+r.hb.table))
+	}
 
-	var err error
 	r.canal, err = canal.NewCanal(cfg)
 	return errors.Trace(err)
 }
 
+func (r *River) myTLSEnabled() bool {
+	return len(r.c.MySSLCA) > 0 || len(r.c.MySSLCert) > 0 || r.c.MySSLSkipVerify
+}
+
+// newMyTLSConfig returns nil if TLS is not enabled for MySQL.
+func (r *River) newMyTLSConfig() (*tls.Config, error) {
+	if !r.myTLSEnabled() {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: r.c.MySSLSkipVerify}
+	if host, _, err := net.SplitHostPort(r.c.MyAddr); err == nil {
+		cfg.ServerName = host
+	}
+
+	if len(r.c.MySSLCA) > 0 {
+		pem, err := ioutil.ReadFile(r.c.MySSLCA)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("invalid MySQL ssl ca %s", r.c.MySSLCA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(r.c.MySSLCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(r.c.MySSLCert, r.c.MySSLKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// myDumpSSLOptions makes mysqldump use the same TLS settings as canal.
+func (r *River) myDumpSSLOptions() []string {
+	opts := make([]string, 0, 4)
+	if len(r.c.MySSLCA) > 0 && !r.c.MySSLSkipVerify {
+		opts = append(opts, "--ssl-mode=VERIFY_IDENTITY", "--ssl-ca="+r.c.MySSLCA)
+	} else {
+		opts = append(opts, "--ssl-mode=REQUIRED")
+	}
+	if len(r.c.MySSLCert) > 0 {
+		opts = append(opts, "--ssl-cert="+r.c.MySSLCert, "--ssl-key="+r.c.MySSLKey)
+	}
+	return opts
+}
+
 func (r *River) prepareCanal() error {
 	var db string
 	dbs := map[string]struct{}{}
@@ -131,7 +563,7 @@ func (r *River) prepareCanal() error {
 		r.canal.AddDumpDatabases(keys...)
 	}
 
-	r.canal.SetEventHandler(&eventHandler{r})
+	r.canal.SetEventHandler(&eventHandler{r: r})
 
 	return nil
 }
@@ -143,12 +575,12 @@ func (r *River) newRule(schema, table string) error {
 		return errors.Errorf("duplicate source %s, %s defined in config", schema, table)
 	}
 
-	r.rules[key] = newDefaultRule(schema, table)
+	r.rules[key] = r.c.RuleDefaults.apply(newDefaultRule(schema, table))
 	return nil
 }
 
 func (r *River) updateRule(schema, table string) error {
-	rule, ok := r.rules[ruleKey(schema, table)]
+	rule, ok := r.getRule(ruleKey(schema, table))
 	if !ok {
 		return ErrRuleNotExist
 	}
@@ -158,79 +590,260 @@ func (r *River) updateRule(schema, table string) error {
 		return errors.Trace(err)
 	}
 
-	rule.TableInfo = tableInfo
-	r.setFieldMapping(rule)
+	for _, rule := range rule.targets() {
+		oldInfo := rule.TableInfo
+		rule.TableInfo = tableInfo
+		if err = r.loadGeneratedColumns(rule); err != nil {
+			return errors.Trace(err)
+		}
+		r.setFieldMapping(rule)
+
+		if rule.UpdateMapping && oldInfo != nil {
+			if err = r.updateMapping(rule, oldInfo); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
 
 	return nil
 }
 
+// updateMapping pushes the mapping of the columns added since oldInfo.
+func (r *River) updateMapping(rule *Rule, oldInfo *schema.Table) error {
+	added := make([]schema.TableColumn, 0)
+	for _, col := range rule.TableInfo.Columns {
+		if oldInfo.FindColumn(col.Name) < 0 {
+			added = append(added, col)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	properties := r.makeMappingProperties(rule, added)
+	for field := range properties {
+		if m, ok := rule.Mapping[field]; ok {
+			properties[field] = m
+		}
+	}
+	if len(properties) == 0 {
+		return nil
+	}
+
+	if r.sink != nil {
+		log.Warnf("table %s.%s has new columns, but the mapping of index %s is not updated with sink %s",
+			rule.Schema, rule.Table, rule.Index, r.c.Sink)
+		return nil
+	}
+
+	log.Infof("table %s.%s has new columns, update mapping of index %s, type %s", rule.Schema, rule.Table, rule.indexPattern(), rule.Type)
+	return errors.Trace(r.esClient(rule.Cluster).PutMapping(rule.indexPattern(), rule.Type, properties))
+}
+
 func (r *River) setFieldMapping(rule *Rule) {
-	defaultFields := make([]string, len(rule.TableInfo.Columns))
+	rule.TableFields = make(map[string]int, len(rule.TableInfo.Columns))
+	defaultFields := make([]string, 0, len(rule.TableInfo.Columns))
 	for index, column := range rule.TableInfo.Columns {
 		rule.TableFields[column.Name] = index
 		defaultFields = append(defaultFields, column.Name)
 	}
 
 	// 没有设置，默认导出所有字段到 doc 中
-	if rule.Filter == nil {
-		rule.Filter = defaultFields
+	fields := rule.Filter
+	if fields == nil {
+		fields = defaultFields
 	}
 	if rule.FieldMapping == nil {
-		rule.FieldMapping = make(map[string]string, len(rule.Filter))
+		rule.FieldMapping = make(map[string]string, len(fields))
 	}
-	for _, field := range rule.Filter {
+	for _, field := range fields {
 		if _, ok := rule.FieldMapping[field]; !ok {
 			rule.FieldMapping[field] = field
 		}
 	}
+
+	rule.fields = make([]ruleField, 0, len(rule.FieldMapping)+len(rule.CopyField)+len(rule.funcFields))
+	for key, value := range rule.FieldMapping {
+		mysqlField, esField, fieldType := r.getFieldParts(key, value)
+		if f, ok := r.makeRuleField(rule, mysqlField, esField, fieldType); ok {
+			f.labels = rule.ValueMap[mysqlField]
+			rule.fields = append(rule.fields, f)
+		}
+	}
+	for esField, value := range rule.CopyField {
+		// "column,type" is parsed like the field mapping value "field,type"
+		_, mysqlField, fieldType := r.getFieldParts("", value)
+		if f, ok := r.makeRuleField(rule, mysqlField, esField, fieldType); ok {
+			f.derived = true
+			rule.fields = append(rule.fields, f)
+		}
+	}
+	for esField, fn := range rule.funcFields {
+		if f, ok := r.makeFuncField(rule, esField, fn); ok {
+			rule.fields = append(rule.fields, f)
+		}
+	}
+
+	// the docs are written in the column order, the copies and the helpers are after
+	// the field of their first column
+	sort.Slice(rule.fields, func(i, j int) bool {
+		a, b := &rule.fields[i], &rule.fields[j]
+		if a.column != b.column {
+			return a.column < b.column
+		} else if a.derived != b.derived {
+			return b.derived
+		}
+		return a.esField < b.esField
+	})
+	esFields := make([]string, 0, len(rule.fields))
+	for _, f := range rule.fields {
+		esFields = append(esFields, f.esField)
+	}
+	rule.encoder = elastic.NewFieldEncoder(esFields)
+}
+
+// makeRuleField compiles the field of the column converted by fieldType, false if the
+// column is dropped or skipped.
+func (r *River) makeRuleField(rule *Rule, mysqlField, esField, fieldType string) (ruleField, bool) {
+	index, ok := rule.TableFields[mysqlField]
+	if !ok {
+		// the column is dropped
+		return ruleField{}, false
+	}
+	if rule.GeneratedColumns == GeneratedSkip && rule.generated[mysqlField] {
+		return ruleField{}, false
+	}
+	f := ruleField{column: index, esField: esField, convert: r.makeReqColumnData}
+	if fieldType != "" {
+		f.convert = func(col *schema.TableColumn, value interface{}) interface{} {
+			return r.getFieldValue(col, fieldType, value)
+		}
+	}
+	switch rule.TableInfo.Columns[index].Type {
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		convert := f.convert
+		f.convert = func(col *schema.TableColumn, value interface{}) interface{} {
+			return r.makeDateColumnData(rule, col, value, convert)
+		}
+	case schema.TYPE_TIME:
+		if rule.TimeFormat != TimeFormatRaw && fieldType == "" {
+			f.convert = func(col *schema.TableColumn, value interface{}) interface{} {
+				return makeTimeColumnData(rule, col, value)
+			}
+		}
+	case schema.TYPE_BIT:
+		if rule.BitFormat == BitFormatString && fieldType == "" {
+			f.convert = makeBitColumnData
+		}
+	case schema.TYPE_NUMBER:
+		if rule.TinyintFormat == TinyintFormatBool && fieldType == "" && isTinyint1(&rule.TableInfo.Columns[index]) {
+			f.convert = makeBoolColumnData
+		}
+	}
+	return f, true
 }
 
-func (r *River) parseSource() (map[string][]string, error) {
-	wildTables := make(map[string][]string, len(r.c.Sources))
+// makeDateColumnData converts the date column with convert, which returns nil
+// for the zero and invalid dates, they are handled by the rule then.
+func (r *River) makeDateColumnData(rule *Rule, col *schema.TableColumn, value interface{},
+	convert func(col *schema.TableColumn, value interface{}) interface{}) interface{} {
+	v := convert(col, value)
+	if v != nil || value == nil {
+		return v
+	}
+
+	r.st.InvalidDateNum.Add(1)
+	switch rule.InvalidDate {
+	case InvalidDateSentinel:
+		return rule.InvalidDateSentinel
+	case InvalidDateRaw:
+		if b, ok := value.([]byte); ok {
+			return string(b)
+		}
+		return value
+	case InvalidDateSkip:
+		return skipField{}
+	default:
+		return nil
+	}
+}
+
+func (r *River) parseSource() (map[string][]ruleTable, error) {
+	// the tables of the wildcard tables and the schema regexes of the sources
+	wildTables := make(map[string][]ruleTable, len(r.c.Sources))
 
 	// first, check sources
 	for _, s := range r.c.Sources {
 		if !isValidTables(s.Tables) {
 			return nil, errors.Errorf("wildcard * is not allowed for multiple tables")
 		}
+		if len(s.Schema) == 0 {
+			return nil, errors.Errorf("empty schema not allowed for source")
+		}
 
-		for _, table := range s.Tables {
-			if len(s.Schema) == 0 {
-				return nil, errors.Errorf("empty schema not allowed for source")
+		schemas := []string{s.Schema}
+		var schemaRegex *regexp.Regexp
+		if isSchemaRegex(s.Schema) {
+			var err error
+			if schemaRegex, err = compileSchemaRegex(s.Schema); err != nil {
+				return nil, errors.Trace(err)
 			}
+			if schemas, err = r.matchSchemas(schemaRegex); err != nil {
+				return nil, errors.Trace(err)
+			}
+			log.Infof("schema regex %s matches %d schemas", s.Schema, len(schemas))
+		}
 
-			if regexp.QuoteMeta(table) != table {
-				if _, ok := wildTables[ruleKey(s.Schema, table)]; ok {
-					return nil, errors.Errorf("duplicate wildcard table defined for %s.%s", s.Schema, table)
+		for _, table := range s.Tables {
+			wildTable := regexp.QuoteMeta(table) != table
+			if !wildTable && schemaRegex == nil {
+				err := r.newRule(s.Schema, table)
+				if err != nil {
+					return nil, errors.Trace(err)
 				}
+				continue
+			}
 
-				tables := []string{}
+			if _, ok := wildTables[ruleKey(s.Schema, table)]; ok {
+				return nil, errors.Errorf("duplicate wildcard table defined for %s.%s", s.Schema, table)
+			}
 
-				sql := fmt.Sprintf(`SELECT table_name FROM information_schema.tables WHERE
-					table_name RLIKE "%s" AND table_schema = "%s";`, buildTable(table), s.Schema)
+			// set before matching the tables, so the excluded ones of the schema regex are known
+			r.wildRules[ruleKey(s.Schema, table)] = &Rule{Schema: s.Schema, Table: table, schemaRegex: schemaRegex}
 
-				res, err := r.canal.Execute(sql)
-				if err != nil {
-					return nil, errors.Trace(err)
-				}
+			tables := []ruleTable{}
+			for _, schema := range schemas {
+				names := []string{table}
+				if wildTable {
+					sql := fmt.Sprintf(`SELECT table_name FROM information_schema.tables WHERE
+						table_name RLIKE "%s" AND table_schema = "%s";`, buildTable(table), schema)
 
-				for i := 0; i < res.Resultset.RowNumber(); i++ {
-					f, _ := res.GetString(i, 0)
-					err := r.newRule(s.Schema, f)
+					res, err := r.canal.Execute(sql)
 					if err != nil {
 						return nil, errors.Trace(err)
 					}
 
-					tables = append(tables, f)
+					names = names[:0]
+					for i := 0; i < res.Resultset.RowNumber(); i++ {
+						f, _ := res.GetString(i, 0)
+						names = append(names, f)
+					}
 				}
 
-				wildTables[ruleKey(s.Schema, table)] = tables
-			} else {
-				err := r.newRule(s.Schema, table)
-				if err != nil {
-					return nil, errors.Trace(err)
+				for _, name := range names {
+					if r.isIgnoredTable(schema, name) {
+						continue
+					}
+					err := r.newRule(schema, name)
+					if err != nil {
+						return nil, errors.Trace(err)
+					}
+
+					tables = append(tables, ruleTable{schema, name})
 				}
 			}
+
+			wildTables[ruleKey(s.Schema, table)] = tables
 		}
 	}
 
@@ -248,14 +861,15 @@ func (r *River) prepareRule() error {
 	}
 
 	if r.c.Rules != nil {
+		customRules := make(map[string]*Rule)
 		// then, set custom mapping rule
 		for _, rule := range r.c.Rules {
 			if len(rule.Schema) == 0 {
 				return errors.Errorf("empty schema not allowed for rule")
 			}
 
-			if regexp.QuoteMeta(rule.Table) != rule.Table {
-				//wildcard table
+			if regexp.QuoteMeta(rule.Table) != rule.Table || isSchemaRegex(rule.Schema) {
+				//wildcard table or schema regex
 				tables, ok := wildtables[ruleKey(rule.Schema, rule.Table)]
 				if !ok {
 					return errors.Errorf("wildcard table for %s.%s is not defined in source", rule.Schema, rule.Table)
@@ -265,22 +879,28 @@ func (r *River) prepareRule() error {
 					return errors.Errorf("wildcard table rule %s.%s must have a index, can not empty", rule.Schema, rule.Table)
 				}
 
-				rule.prepare()
+				if err := rule.prepare(); err != nil {
+					return errors.Trace(err)
+				}
 
 				for _, table := range tables {
-					rr := r.rules[ruleKey(rule.Schema, table)]
-					rr.Index = rule.Index
-					rr.Type = rule.Type
-					rr.Parent = rule.Parent
-					rr.ID = rule.ID
-					rr.FieldMapping = rule.FieldMapping
+					applyWildcardRule(r.rules[ruleKey(table.schema, table.table)], rule)
 				}
+				r.wildRules[ruleKey(rule.Schema, rule.Table)] = rule
 			} else {
 				key := ruleKey(rule.Schema, rule.Table)
 				if _, ok := r.rules[key]; !ok {
 					return errors.Errorf("rule %s, %s not defined in source", rule.Schema, rule.Table)
 				}
-				rule.prepare()
+				if err := rule.prepare(); err != nil {
+					return errors.Trace(err)
+				}
+				if first, ok := customRules[key]; ok {
+					// fan out the table to more indices
+					first.fanout = append(first.fanout, rule)
+					continue
+				}
+				customRules[key] = rule
 				r.rules[key] = rule
 			}
 		}
@@ -288,36 +908,523 @@ func (r *River) prepareRule() error {
 
 	rules := make(map[string]*Rule)
 	for key, rule := range r.rules {
-		if rule.TableInfo, err = r.canal.GetTable(rule.Schema, rule.Table); err != nil {
+		if !r.ownsTable(rule.Schema, rule.Table) {
+			continue
+		}
+		tableInfo, err := r.canal.GetTable(rule.Schema, rule.Table)
+		if err != nil {
 			return errors.Trace(err)
 		}
-		r.setFieldMapping(rule)
+		for _, target := range rule.targets() {
+			if err = target.prepare(); err != nil {
+				return errors.Trace(err)
+			}
+			target.TableInfo = tableInfo
+			if err = r.loadGeneratedColumns(target); err != nil {
+				return errors.Trace(err)
+			}
+			r.setFieldMapping(target)
+		}
 
 		rules[key] = rule
 	}
 	r.rules = rules
+	if r.c.PartitionCount > 1 {
+		if len(rules) == 0 {
+			return errors.Errorf("no table in partition %d/%d, use less partitions", r.c.PartitionIndex, r.c.PartitionCount)
+		}
+		log.Infof("sync %d tables of partition %d/%d", len(rules), r.c.PartitionIndex, r.c.PartitionCount)
+	}
+
+	return nil
+}
+
+func applyWildcardRule(rr *Rule, rule *Rule) {
+	rr.Index = rule.schemaIndex(rr.Schema)
+	rr.Type = rule.Type
+	rr.Parent = rule.Parent
+	rr.Routing = rule.Routing
+	rr.ID = rule.ID
+	rr.IDTemplate = rule.IDTemplate
+	rr.IDSeparator = rule.IDSeparator
+	rr.IDHash = rule.IDHash
+	rr.IDEncoding = rule.IDEncoding
+	rr.IDFormat = rule.IDFormat
+	rr.idTemplate = rule.idTemplate
+	rr.FieldMapping = rule.FieldMapping
+	rr.CopyField = rule.CopyField
+	rr.FuncField = rule.FuncField
+	rr.ValueMap = rule.ValueMap
+	rr.FieldLimit = rule.FieldLimit
+	rr.funcFields = rule.funcFields
+	rr.Pipeline = rule.Pipeline
+	rr.ActionMapping = rule.ActionMapping
+	rr.ActionScript = rule.ActionScript
+	rr.DeleteQuery = rule.DeleteQuery
+	rr.Rollup = rule.Rollup
+	rr.ActionPipeline = rule.ActionPipeline
+	rr.Upsert = rule.Upsert
+	rr.Script = rule.Script
+	rr.ScriptParams = rule.ScriptParams
+	rr.NullHandling = rule.NullHandling
+	rr.InvalidDate = rule.InvalidDate
+	rr.InvalidDateSentinel = rule.InvalidDateSentinel
+	rr.TimeFormat = rule.TimeFormat
+	rr.BitFormat = rule.BitFormat
+	rr.TinyintFormat = rule.TinyintFormat
+	rr.GeneratedColumns = rule.GeneratedColumns
+	rr.UpdateMode = rule.UpdateMode
+	rr.NoopUpdate = rule.NoopUpdate
+	rr.DeleteMode = rule.DeleteMode
+	rr.TombstoneField = rule.TombstoneField
+	rr.TombstoneTimeField = rule.TombstoneTimeField
+	rr.PKChange = rule.PKChange
+	rr.AppendOnly = rule.AppendOnly
+	rr.AppendID = rule.AppendID
+	rr.DumpCleanup = rule.DumpCleanup
+	rr.DumpGenerationField = rule.DumpGenerationField
+	rr.TTL = rule.TTL
+	rr.TTLField = rule.TTLField
+	rr.MetaField = rule.MetaField
+	rr.FieldPreset = rule.FieldPreset
+	rr.MissingIndex = rule.MissingIndex
+	rr.RateLimitDocs = rule.RateLimitDocs
+	rr.Cluster = rule.Cluster
+	rr.Priority = rule.Priority
+	rr.BulkSize = rule.BulkSize
+	rr.FlushBulkTime = rule.FlushBulkTime
+	rr.Isolate = rule.Isolate
+	rr.IsolateMaxPending = rule.IsolateMaxPending
+	rr.Webhook = rule.Webhook
+	rr.WebhookOnly = rule.WebhookOnly
+	rr.RedisKeys = rule.RedisKeys
+	rr.redisKeys = rule.redisKeys
+	rr.Truncate = rule.Truncate
+	rr.UpdateMapping = rule.UpdateMapping
+	rr.Mapping = rule.Mapping
+	rr.Aliases = rule.Aliases
+	rr.IndexSuffixColumn = rule.IndexSuffixColumn
+	rr.Template = rule.Template
+	rr.TemplatePatterns = rule.TemplatePatterns
+	rr.Settings = rule.Settings
+	rr.ILMPolicy = rule.ILMPolicy
+	rr.ILMPolicyFile = rule.ILMPolicyFile
+	rr.ILMRolloverAlias = rule.ILMRolloverAlias
+}
+
+// matchWildcardRule creates a rule for the table if it matches any wildcard source.
+func (r *River) matchWildcardRule(schema, table string) (*Rule, error) {
+	if r.isIgnoredTable(schema, table) {
+		return nil, nil
+	}
+
+	for _, w := range r.wildRules {
+		if !w.matchesSchema(schema) {
+			continue
+		}
+		matched := strings.EqualFold(w.Table, table)
+		if regexp.QuoteMeta(w.Table) != w.Table {
+			var err error
+			if matched, err = regexp.MatchString("(?i)"+buildTable(w.Table), table); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		rule := r.c.RuleDefaults.apply(newDefaultRule(schema, table))
+		if len(w.Index) > 0 {
+			applyWildcardRule(rule, w)
+		}
+		if err := rule.prepare(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return rule, nil
+	}
+	return nil, nil
+}
+
+// renameRule moves the rule of the old table to the new one, so the renamed
+// table is still synced into the same index.
+func (r *River) renameRule(oldSchema, oldTable, newSchema, newTable string) error {
+	oldKey := ruleKey(oldSchema, oldTable)
+	newKey := ruleKey(newSchema, newTable)
+
+	if r.isIgnoredTable(newSchema, newTable) {
+		// like pt-online-schema-change renames the table to _table_old,
+		// the rule is kept for the new table which will be renamed back.
+		return nil
+	}
+	if _, ok := r.getRule(newKey); ok && r.isIgnoredTable(oldSchema, oldTable) {
+		// the ghost table is renamed to the synced table
+		log.Infof("table %s.%s is renamed to %s.%s, refresh the rule", oldSchema, oldTable, newSchema, newTable)
+		r.canal.ClearTableCache([]byte(newSchema), []byte(newTable))
+		return errors.Trace(r.updateRule(newSchema, newTable))
+	}
+
+	rule, ok := r.getRule(oldKey)
+	if ok {
+		r.deleteRule(oldKey)
+		for _, target := range rule.targets() {
+			target.Schema = newSchema
+			target.Table = newTable
+		}
+		log.Infof("table %s.%s is renamed to %s.%s, move the rule", oldSchema, oldTable, newSchema, newTable)
+	} else {
+		var err error
+		if rule, err = r.matchWildcardRule(newSchema, newTable); err != nil {
+			return errors.Trace(err)
+		} else if rule == nil {
+			return nil
+		}
+		log.Infof("table %s.%s is renamed to %s.%s, which matches a wildcard rule", oldSchema, oldTable, newSchema, newTable)
+	}
+
+	return errors.Trace(r.addRule(newSchema, newTable, rule))
+}
+
+// addCreatedTable adds the rule of the table created at runtime if it matches a wildcard rule,
+// like tables = ["*"] of the source.
+func (r *River) addCreatedTable(schema, table string) error {
+	rule, err := r.matchWildcardRule(schema, table)
+	if err != nil || rule == nil {
+		return errors.Trace(err)
+	}
+	log.Infof("table %s.%s is created, which matches a wildcard rule, sync it to index %s", schema, table, rule.Index)
+	return errors.Trace(r.addRule(schema, table, rule))
+}
+
+// addRule adds the rule of the table at runtime, and handles its missing index by missing_index.
+func (r *River) addRule(schema, table string, rule *Rule) error {
+	if err := r.canal.AddIncludeTableRegex(regexp.QuoteMeta(schema + "." + table)); err != nil {
+		return errors.Trace(err)
+	}
+	r.canal.ClearTableCache([]byte(schema), []byte(table))
 
+	tableInfo, err := r.canal.GetTable(schema, table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(r.addRuleTable(schema, table, rule, tableInfo))
+}
+
+// addRuleTable sets the table info of the rule added at runtime, and ensures its index.
+func (r *River) addRuleTable(schema, table string, rule *Rule, tableInfo *schema.Table) error {
+	for _, target := range rule.targets() {
+		target.TableInfo = tableInfo
+		if err := r.loadGeneratedColumns(target); err != nil {
+			return errors.Trace(err)
+		}
+		r.setFieldMapping(target)
+	}
+
+	r.setRule(ruleKey(schema, table), rule)
+
+	if r.sink == nil {
+		return errors.Trace(r.ensureIndices(rule.Cluster))
+	}
 	return nil
 }
 
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	regs := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		reg, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		regs = append(regs, reg)
+	}
+	return regs, nil
+}
+
+// compileExcludes compiles exclude_tables and the excluded tables of the sources by schema.
+func compileExcludes(c *Config) (map[string][]*regexp.Regexp, error) {
+	excludes := make(map[string][]*regexp.Regexp)
+	add := func(schema, table string) error {
+		reg, err := regexp.Compile("(?i)^" + buildTable(table) + "$")
+		if err != nil {
+			return errors.Annotatef(err, "invalid excluded table %s.%s", schema, table)
+		}
+		schema = strings.ToLower(schema)
+		excludes[schema] = append(excludes[schema], reg)
+		return nil
+	}
+
+	for _, name := range c.ExcludeTables {
+		i := strings.Index(name, ".")
+		if i <= 0 || i == len(name)-1 {
+			return nil, errors.Errorf("invalid exclude_tables %s, must be schema.table", name)
+		}
+		if err := add(name[:i], name[i+1:]); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	for _, s := range c.Sources {
+		for _, table := range s.Exclude {
+			if err := add(s.Schema, table); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+	return excludes, nil
+}
+
+// isIgnoredTable checks whether the table is in ignore_schemas or ignore_tables,
+// or excluded by exclude_tables or the source, or in the other partitions.
+func (r *River) isIgnoredTable(schema, table string) bool {
+	for _, s := range r.c.IgnoreSchemas {
+		if strings.EqualFold(s, schema) {
+			return true
+		}
+	}
+	for _, reg := range r.ignoreTableRegex {
+		if reg.MatchString(table) {
+			return true
+		}
+	}
+	for _, reg := range r.excludeTableRegex[strings.ToLower(schema)] {
+		if reg.MatchString(table) {
+			return true
+		}
+	}
+	// the excluded tables of the sources with the schema regexes
+	for _, w := range r.wildRules {
+		if w.schemaRegex == nil || !w.schemaRegex.MatchString(schema) {
+			continue
+		}
+		for _, reg := range r.excludeTableRegex[strings.ToLower(w.Schema)] {
+			if reg.MatchString(table) {
+				return true
+			}
+		}
+	}
+	return !r.ownsTable(schema, table)
+}
+
+// isSkippedDDL checks whether the DDL matches skip_ddl_regex.
+func (r *River) isSkippedDDL(query string) bool {
+	for _, reg := range r.skipDDLRegex {
+		if reg.MatchString(query) {
+			return true
+		}
+	}
+	return false
+}
+
+// getRule returns the rule of the key.
+func (r *River) getRule(key string) (*Rule, bool) {
+	r.rulesMu.RLock()
+	defer r.rulesMu.RUnlock()
+	rule, ok := r.rules[key]
+	return rule, ok
+}
+
+func (r *River) setRule(key string, rule *Rule) {
+	r.rulesMu.Lock()
+	defer r.rulesMu.Unlock()
+	r.rules[key] = rule
+}
+
+func (r *River) deleteRule(key string) {
+	r.rulesMu.Lock()
+	defer r.rulesMu.Unlock()
+	delete(r.rules, key)
+}
+
+// ruleKeys returns the keys of the rules.
+func (r *River) ruleKeys() []string {
+	r.rulesMu.RLock()
+	defer r.rulesMu.RUnlock()
+	keys := make([]string, 0, len(r.rules))
+	for key := range r.rules {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// allRules returns all the rules including the fan-out ones.
+func (r *River) allRules() []*Rule {
+	r.rulesMu.RLock()
+	defer r.rulesMu.RUnlock()
+	rules := make([]*Rule, 0, len(r.rules))
+	for _, rule := range r.rules {
+		rules = append(rules, rule.targets()...)
+	}
+	return rules
+}
+
+// syncedPosition returns the binlog position being synced or replayed.
+func (r *River) syncedPosition() mysql.Position {
+	if r.canal == nil {
+		return r.replayPos
+	}
+	return r.canal.SyncedPosition()
+}
+
 func ruleKey(schema string, table string) string {
 	return strings.ToLower(fmt.Sprintf("%s:%s", schema, table))
 }
 
 // Run syncs the data from MySQL and inserts to ES.
 func (r *River) Run() error {
+	if r.willDump() {
+		r.dumpGeneration = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	// nothing to prepare in ES if the requests are written to the files
+	if r.sink == nil {
+		if err := r.prepareES(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if len(r.c.ThrottleSchedule) > 0 {
+		r.wg.Add(1)
+		go r.runThrottleSchedule()
+	}
+
+	// join the cluster before the dump and the binlog, they only sync the tables of this instance
+	if r.coord != nil {
+		if err := r.coord.join(); err != nil {
+			return errors.Trace(err)
+		}
+		r.wg.Add(1)
+		go r.coord.run()
+	}
+
 	r.wg.Add(1)
 	go r.syncLoop()
 
+	r.wg.Add(1)
+	go r.runBinlogRates()
+
+	if r.queue != nil {
+		r.wg.Add(1)
+		go r.drainQueue()
+	}
+
+	if r.hb != nil {
+		r.wg.Add(1)
+		go r.hb.run()
+	}
+
+	// no ES to expire the docs in if the requests are written to the files
+	if indices := r.ttlIndices(); len(indices) > 0 && r.sink == nil {
+		r.wg.Add(1)
+		go r.runTTL(indices)
+	}
+
+	// nothing to verify against if the requests are not written to ES
+	if r.c.VerifyInterval.Duration > 0 && r.sink == nil {
+		if rules := r.verifyRules(); len(rules) > 0 {
+			r.wg.Add(1)
+			go r.runVerify(rules)
+		} else {
+			log.Warnf("no rule can be verified with verify_interval, they need a single integer PK")
+		}
+	}
+
+	for _, u := range r.upstreams {
+		r.wg.Add(1)
+		go r.runUpstream(u)
+	}
+
 	pos := r.master.Position()
 	if err := r.canal.RunFrom(pos); err != nil {
 		log.Errorf("start canal err %v", err)
+		r.st.addError("start canal err %v", err)
 		return errors.Trace(err)
 	}
 
 	return nil
 }
 
+// prepareES prepares every cluster with its rules.
+func (r *River) prepareES() error {
+	for _, cluster := range r.clusterNames() {
+		if err := r.prepareCluster(cluster); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// prepareCluster checks the pipelines, and prepares the templates, indices and aliases of the cluster.
+func (r *River) prepareCluster(cluster string) error {
+	if err := r.checkPipelines(cluster); err != nil {
+		log.Errorf("check pipelines err %v", err)
+		return errors.Trace(err)
+	}
+
+	// templates must be ready before any index is created
+	if err := r.putTemplates(cluster); err != nil {
+		log.Errorf("put index templates err %v", err)
+		return errors.Trace(err)
+	}
+
+	if err := r.ensureIndices(cluster); err != nil {
+		log.Errorf("ensure indices err %v", err)
+		return errors.Trace(err)
+	}
+
+	if err := r.checkMappings(cluster); err != nil {
+		log.Errorf("check mappings err %v", err)
+		return errors.Trace(err)
+	}
+
+	if err := r.ensureAliases(cluster); err != nil {
+		log.Errorf("ensure aliases err %v", err)
+		return errors.Trace(err)
+	}
+
+	// no dump for replay
+	if r.c.DumpTuneIndex && r.canal != nil {
+		t, err := newDumpTuner(r, cluster)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if r.willDump() {
+			if err = t.tune(); err != nil {
+				log.Errorf("tune indices for dump err %v", err)
+				return errors.Trace(err)
+			}
+		}
+		// restore the tuned indices even if no dump, they may be left by the last run
+		r.wg.Add(1)
+		go t.run()
+	}
+
+	return nil
+}
+
+// checkPipelines checks all the pipelines of rules exist in the cluster.
+func (r *River) checkPipelines(cluster string) error {
+	checked := make(map[string]bool)
+	for _, rule := range r.clusterRules(cluster) {
+		pipelines := []string{rule.Pipeline}
+		for _, pipeline := range rule.ActionPipeline {
+			pipelines = append(pipelines, pipeline)
+		}
+
+		for _, pipeline := range pipelines {
+			if len(pipeline) == 0 || checked[pipeline] {
+				continue
+			}
+			checked[pipeline] = true
+
+			exists, err := r.esClient(cluster).ExistsPipeline(pipeline)
+			if err != nil {
+				return errors.Trace(err)
+			} else if !exists {
+				return errors.Errorf("pipeline %s of rule %s.%s doesn't exist", pipeline, rule.Schema, rule.Table)
+			}
+		}
+	}
+	return nil
+}
+
 // Ctx returns the internal context for outside use.
 func (r *River) Ctx() context.Context {
 	return r.ctx
@@ -329,11 +1436,55 @@ func (r *River) Close() {
 
 	r.cancel()
 
-	r.canal.Close()
+	if r.control != nil {
+		r.control.Close()
+	}
+	if r.canal != nil {
+		r.canal.Close()
+	}
+	r.closeUpstreams()
 
 	r.master.Close()
 
 	r.wg.Wait()
+
+	if r.coord != nil {
+		r.coord.leave()
+	}
+
+	if r.audit != nil {
+		if err := r.audit.Close(); err != nil {
+			log.Errorf("close audit log err %v", err)
+		}
+	}
+	if r.ddlLog != nil {
+		if err := r.ddlLog.Close(); err != nil {
+			log.Errorf("close DDL log err %v", err)
+		}
+	}
+	if r.sink != nil {
+		if err := r.sink.Close(); err != nil {
+			log.Errorf("close sink file err %v", err)
+		}
+	}
+	if r.recorder != nil {
+		if err := r.recorder.Close(); err != nil {
+			log.Errorf("close record file err %v", err)
+		}
+	}
+	if r.queue != nil {
+		if err := r.queue.Close(); err != nil {
+			log.Errorf("close disk queue err %v", err)
+		}
+	}
+	if r.redis != nil {
+		r.redis.Close()
+	}
+	if r.dlq != nil {
+		if err := r.dlq.Close(); err != nil {
+			log.Errorf("close dlq file err %v", err)
+		}
+	}
 }
 
 func isValidTables(tables []string) bool {
@@ -1,9 +1,16 @@
 package river
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,6 +18,7 @@ import (
 	"github.com/zeayes/go-mysql-elasticsearch/elastic"
 	"github.com/siddontang/go-mysql/client"
 	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
 )
 
 var myAddr = flag.String("my_addr", "127.0.0.1:3306", "MySQL addr")
@@ -29,6 +37,11 @@ type riverTestSuite struct {
 
 var _ = Suite(&riverTestSuite{})
 
+// unitTestSuite is for the tests without MySQL and ES.
+type unitTestSuite struct{}
+
+var _ = Suite(&unitTestSuite{})
+
 func (s *riverTestSuite) SetUpSuite(c *C) {
 	var err error
 	s.c, err = client.Connect(*myAddr, "root", "", "test")
@@ -431,3 +444,172 @@ func TestBuildTable(t *testing.T) {
 		}
 	}
 }
+
+// fakeES records the requests as "METHOD /path?query body", they are answered by
+// the handler, or with 200 and {} if it is nil.
+type fakeES struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newFakeES(handler http.HandlerFunc) *fakeES {
+	es := &fakeES{}
+	es.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		line := req.Method + " " + req.URL.RequestURI()
+		if body = bytes.TrimSpace(body); len(body) > 0 {
+			line += " " + string(body)
+		}
+		es.mu.Lock()
+		es.requests = append(es.requests, line)
+		es.mu.Unlock()
+
+		if handler == nil {
+			w.Write([]byte("{}"))
+			return
+		}
+		handler(w, req)
+	}))
+	return es
+}
+
+func (es *fakeES) client() *elastic.Client {
+	return elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+}
+
+// takeRequests returns the requests recorded and clears them.
+func (es *fakeES) takeRequests() []string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	requests := es.requests
+	es.requests = nil
+	return requests
+}
+
+func (s *unitTestSuite) TestUpdateMapping(c *C) {
+	es := newFakeES(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/locked/") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte("{}"))
+	})
+	defer es.Close()
+
+	old := &schema.Table{Schema: "test", Name: "t"}
+	old.AddColumn("id", "int(11)", "", "")
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("age", "int(11)", "", "")
+	ta.AddColumn("tags", "varchar(256)", "", "")
+	ta.AddColumn("secret", "varchar(256)", "", "")
+
+	r := &River{c: &Config{}, es: es.client()}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", Type: "_doc", TableInfo: ta,
+		Filter:       []string{"id", "age", "tags"},
+		FieldMapping: map[string]string{"tags": ",list"},
+		Mapping:      map[string]interface{}{"age": map[string]interface{}{"type": "integer"}}}
+	r.setFieldMapping(rule)
+
+	// only the new columns synced by the rule are added, with the rule mapping
+	c.Assert(r.updateMapping(rule, old), IsNil)
+	c.Assert(es.takeRequests(), DeepEquals, []string{
+		`PUT /t/_doc/_mapping {"properties":{"age":{"type":"integer"},"tags":{"type":"keyword"}}}`})
+
+	// no new columns
+	c.Assert(r.updateMapping(rule, ta), IsNil)
+	c.Assert(es.takeRequests(), HasLen, 0)
+
+	rule.Index = "locked"
+	c.Assert(r.updateMapping(rule, old), ErrorMatches, ".*code: 400")
+
+	// the mapping is not updated with the sink
+	r.sink = &fileSink{}
+	c.Assert(r.updateMapping(rule, old), IsNil)
+	c.Assert(es.takeRequests(), HasLen, 1)
+}
+
+func (s *unitTestSuite) TestAddCreatedTable(c *C) {
+	es := newFakeES(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("{}"))
+	})
+	defer es.Close()
+
+	r := &River{c: &Config{AutoCreateIndex: true}, es: es.client(), rules: make(map[string]*Rule),
+		wildRules: map[string]*Rule{
+			ruleKey("test", "log_[0-9]{4}"): {Schema: "test", Table: "log_[0-9]{4}", Index: "log", Type: "_doc"},
+		}}
+	var err error
+	r.ignoreTableRegex, err = compileRegexps([]string{"^_.*_gho$"})
+	c.Assert(err, IsNil)
+
+	// the tables not matching the wildcard rule are skipped without MySQL
+	for _, t := range [][2]string{{"test", "user"}, {"other", "log_2020"}, {"test", "_log_2020_gho"}} {
+		c.Assert(r.addCreatedTable(t[0], t[1]), IsNil)
+	}
+	c.Assert(r.rules, HasLen, 0)
+	c.Assert(es.takeRequests(), HasLen, 0)
+
+	rule, err := r.matchWildcardRule("test", "LOG_2020")
+	c.Assert(err, IsNil)
+	c.Assert(rule.Schema, Equals, "test")
+	c.Assert(rule.Table, Equals, "LOG_2020")
+	c.Assert(rule.Index, Equals, "log")
+	c.Assert(rule.Type, Equals, "_doc")
+
+	ta := &schema.Table{Schema: "test", Name: "LOG_2020"}
+	ta.AddColumn("id", "int(11)", "", "")
+	c.Assert(r.addRuleTable("test", "LOG_2020", rule, ta), IsNil)
+	c.Assert(r.rules[ruleKey("test", "LOG_2020")], Equals, rule)
+	c.Assert(rule.TableInfo, Equals, ta)
+	requests := es.takeRequests()
+	c.Assert(requests, HasLen, 2)
+	c.Assert(requests[0], Equals, "HEAD /log")
+	c.Assert(requests[1], Matches, "PUT /log .*")
+
+	// the index is not created with the sink
+	r.sink = &fileSink{}
+	rule, err = r.matchWildcardRule("test", "log_2021")
+	c.Assert(err, IsNil)
+	c.Assert(r.addRuleTable("test", "log_2021", rule, ta), IsNil)
+	c.Assert(r.rules, HasLen, 2)
+	c.Assert(es.takeRequests(), HasLen, 0)
+}
+
+func (s *unitTestSuite) TestCheckPipelines(c *C) {
+	es := newFakeES(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/_ingest/pipeline/p1", "/_ingest/pipeline/p2":
+			w.Write([]byte(`{}`))
+		case "/_ingest/pipeline/denied":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer es.Close()
+
+	r := &River{c: &Config{}, es: es.client(), rules: map[string]*Rule{
+		"a": {Schema: "test", Table: "a", Pipeline: "p1", ActionPipeline: map[string]string{"delete": "p2"}},
+		// every pipeline is checked once
+		"b": {Schema: "test", Table: "b", Pipeline: "p1"},
+		"c": {Schema: "test", Table: "c"},
+		// the rules of the other clusters are checked in them
+		"d": {Schema: "test", Table: "d", Pipeline: "other", Cluster: "logs"},
+	}}
+	c.Assert(r.checkPipelines(""), IsNil)
+	requests := es.takeRequests()
+	sort.Strings(requests)
+	c.Assert(requests, DeepEquals, []string{"GET /_ingest/pipeline/p1", "GET /_ingest/pipeline/p2"})
+
+	r.rules["e"] = &Rule{Schema: "test", Table: "e", Pipeline: "missing"}
+	c.Assert(r.checkPipelines(""), ErrorMatches, "pipeline missing of rule test.e doesn't exist")
+	r.rules["e"].Pipeline = "denied"
+	c.Assert(r.checkPipelines(""), ErrorMatches, ".*code: 403")
+}
@@ -0,0 +1,307 @@
+package river
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// The aggregations of a rollup field.
+const (
+	// the rows of the group
+	RollupCount = "count"
+	// sum(column) of the rows of the group
+	RollupSum = "sum"
+)
+
+// rollupScript adds the deltas to the fields of the group doc, and deletes the doc when
+// the count field is 0, so the doc of a group without rows is gone.
+const rollupScript = `for (e in params.deltas.entrySet()) { def v = ctx._source[e.getKey()]; ctx._source[e.getKey()] = (v == null ? 0 : v) + e.getValue() } ` +
+	`if (params.count != null && ctx._source[params.count] <= 0) { ctx.op = 'delete' }`
+
+// Rollup maintains one doc per group of the rows in its index, like the orders and the amount
+// of every user, by the scripted updates of the inserts, updates and deletes.
+type Rollup struct {
+	Index string `toml:"index"`
+	Type  string `toml:"type"`
+	// The columns of the group key, the doc id is their values joined by id_separator
+	GroupBy []string `toml:"group_by"`
+	// ES field -> count or sum(column)
+	Aggs map[string]string `toml:"aggs"`
+
+	// parsed from Aggs, in the order of the fields
+	aggs []rollupAgg
+	// the first count field, the doc is deleted when it is 0
+	countField string
+}
+
+type rollupAgg struct {
+	field  string
+	fn     string
+	column string
+}
+
+func (ru *Rollup) prepare(rule *Rule) error {
+	if len(ru.Index) == 0 || len(ru.GroupBy) == 0 || len(ru.Aggs) == 0 {
+		return errors.Errorf("index, group_by and aggs must be set for the rollup of rule %s.%s", rule.Schema, rule.Table)
+	}
+	ru.Index = strings.ToLower(ru.Index)
+	if len(ru.Type) == 0 {
+		ru.Type = ru.Index
+	}
+	ru.Type = strings.ToLower(ru.Type)
+
+	ru.aggs = make([]rollupAgg, 0, len(ru.Aggs))
+	for field, value := range ru.Aggs {
+		agg, err := parseRollupAgg(field, value)
+		if err != nil {
+			return errors.Errorf("invalid aggs %s = %q of rollup %s for rule %s.%s", field, value, ru.Index, rule.Schema, rule.Table)
+		}
+		ru.aggs = append(ru.aggs, agg)
+	}
+	sort.Slice(ru.aggs, func(i, j int) bool { return ru.aggs[i].field < ru.aggs[j].field })
+
+	ru.countField = ""
+	for _, agg := range ru.aggs {
+		if agg.fn == RollupCount {
+			ru.countField = agg.field
+			break
+		}
+	}
+	return nil
+}
+
+// parseRollupAgg parses "count" or "sum(column)".
+func parseRollupAgg(field string, value string) (rollupAgg, error) {
+	value = strings.TrimSpace(value)
+	if value == RollupCount {
+		return rollupAgg{field: field, fn: RollupCount}, nil
+	}
+	if strings.HasPrefix(value, RollupSum+"(") && strings.HasSuffix(value, ")") {
+		column := strings.TrimSpace(value[len(RollupSum)+1 : len(value)-1])
+		if len(column) > 0 {
+			return rollupAgg{field: field, fn: RollupSum, column: column}, nil
+		}
+	}
+	return rollupAgg{}, errors.Errorf("invalid aggregation %s", value)
+}
+
+// rollupGroup is the group of a row and the values of the aggregations of the row.
+type rollupGroup struct {
+	id     string
+	key    map[string]interface{}
+	values map[string]interface{}
+}
+
+// makeRollupGroup returns the group of the row, nil if the row doesn't match the where of the rule,
+// or a group_by column is NULL.
+func (r *River) makeRollupGroup(rule *Rule, ru *Rollup, values []interface{}) (*rollupGroup, error) {
+	for field := range rule.Where {
+		i := rule.TableInfo.FindColumn(field)
+		if i < 0 {
+			continue
+		}
+		if _, pass := rule.CheckWhere(field, r.makeReqColumnData(&rule.TableInfo.Columns[i], values[i])); !pass {
+			return nil, nil
+		}
+	}
+
+	var buf bytes.Buffer
+	g := &rollupGroup{key: make(map[string]interface{}, len(ru.GroupBy)), values: make(map[string]interface{}, len(ru.aggs))}
+	for n, column := range ru.GroupBy {
+		i := rule.TableInfo.FindColumn(column)
+		if i < 0 {
+			return nil, errors.Errorf("group_by column %s of rollup %s is not in table %s", column, ru.Index, rule.TableInfo)
+		}
+		if n > 0 {
+			buf.WriteString(rule.IDSeparator)
+		}
+		value := values[i]
+		if value == nil {
+			return nil, nil
+		}
+		if err := writeIDValue(&buf, rule, column, value); err != nil {
+			return nil, errors.Trace(err)
+		}
+		g.key[column] = r.makeReqColumnData(&rule.TableInfo.Columns[i], value)
+	}
+	g.id = buf.String()
+
+	for _, agg := range ru.aggs {
+		if agg.fn == RollupCount {
+			g.values[agg.field] = int64(1)
+			continue
+		}
+		i := rule.TableInfo.FindColumn(agg.column)
+		if i < 0 {
+			return nil, errors.Errorf("sum column %s of rollup %s is not in table %s", agg.column, ru.Index, rule.TableInfo)
+		}
+		value, err := rollupNumber(&rule.TableInfo.Columns[i], values[i])
+		if err != nil {
+			return nil, errors.Annotatef(err, "sum column %s of rollup %s", agg.column, ru.Index)
+		}
+		g.values[agg.field] = value
+	}
+	return g, nil
+}
+
+// rollupNumber returns the number of the column value, int64 for the integers, so the sums
+// of them are exact, or float64. NULL is 0.
+func rollupNumber(col *schema.TableColumn, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return int64(0), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case []byte:
+		return strconv.ParseFloat(string(v), 64)
+	}
+	return nil, errors.Errorf("column %s of type %d has no number %v", col.Name, col.Type, value)
+}
+
+// rollupNegate returns -value of rollupNumber.
+func rollupNegate(value interface{}) interface{} {
+	if v, ok := value.(int64); ok {
+		return -v
+	}
+	return -value.(float64)
+}
+
+// rollupDelta returns after - before of rollupNumber, and false if they are the same.
+func rollupDelta(before, after interface{}) (interface{}, bool) {
+	b, bok := before.(int64)
+	a, aok := after.(int64)
+	if bok && aok {
+		return a - b, a != b
+	}
+	bf, af := rollupFloat(before), rollupFloat(after)
+	return af - bf, af != bf
+}
+
+func rollupFloat(value interface{}) float64 {
+	if v, ok := value.(int64); ok {
+		return float64(v)
+	}
+	return value.(float64)
+}
+
+// makeRollupRequest makes the scripted update adding the deltas to the doc of the group,
+// the doc is inserted with the deltas if it is missing and upsert is true.
+func makeRollupRequest(rule *Rule, ru *Rollup, g *rollupGroup, deltas map[string]interface{}, upsert bool) *elastic.BulkRequest {
+	params := map[string]interface{}{"deltas": deltas, "count": nil}
+	if len(ru.countField) > 0 {
+		params["count"] = ru.countField
+	}
+	req := &elastic.BulkRequest{
+		Cluster: rule.Cluster,
+		Action:  elastic.ActionUpdate,
+		Index:   ru.Index,
+		Type:    ru.Type,
+		ID:      g.id,
+		Script: map[string]interface{}{
+			"source": rollupScript,
+			"lang":   "painless",
+			"params": params,
+		},
+	}
+	if upsert {
+		data := make(map[string]interface{}, len(g.key)+len(deltas))
+		for k, v := range g.key {
+			data[k] = v
+		}
+		for k, v := range deltas {
+			data[k] = v
+		}
+		req.Data = data
+		req.Upsert = true
+	}
+	return req
+}
+
+// makeRollupRequests makes the requests of the rollups of the rule for the rows event.
+// The rows added to a group increase its doc, which is inserted if it is missing, and the
+// rows removed from a group decrease it.
+func (r *River) makeRollupRequests(rule *Rule, action string, rows [][]interface{}) ([]*elastic.BulkRequest, error) {
+	var reqs []*elastic.BulkRequest
+	for _, ru := range rule.Rollup {
+		step := 1
+		if action == canal.UpdateAction {
+			if len(rows)%2 != 0 {
+				return nil, errors.Errorf("invalid update rows event, must have 2x rows, but %d", len(rows))
+			}
+			step = 2
+		}
+		for i := 0; i < len(rows); i += step {
+			var before, after *rollupGroup
+			var err error
+			switch action {
+			case canal.InsertAction:
+				after, err = r.makeRollupGroup(rule, ru, rows[i])
+			case canal.DeleteAction:
+				before, err = r.makeRollupGroup(rule, ru, rows[i])
+			case canal.UpdateAction:
+				if before, err = r.makeRollupGroup(rule, ru, rows[i]); err == nil {
+					after, err = r.makeRollupGroup(rule, ru, rows[i+1])
+				}
+			default:
+				err = errors.Errorf("invalid rows action %s", action)
+			}
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			if before != nil && after != nil && before.id == after.id {
+				// the row stays in the group, only the sums change
+				deltas := make(map[string]interface{}, len(ru.aggs))
+				for _, agg := range ru.aggs {
+					if d, changed := rollupDelta(before.values[agg.field], after.values[agg.field]); changed {
+						deltas[agg.field] = d
+					}
+				}
+				if len(deltas) > 0 {
+					reqs = append(reqs, makeRollupRequest(rule, ru, after, deltas, false))
+				}
+				continue
+			}
+			if before != nil {
+				deltas := make(map[string]interface{}, len(before.values))
+				for field, value := range before.values {
+					deltas[field] = rollupNegate(value)
+				}
+				reqs = append(reqs, makeRollupRequest(rule, ru, before, deltas, false))
+			}
+			if after != nil {
+				reqs = append(reqs, makeRollupRequest(rule, ru, after, after.values, true))
+			}
+		}
+	}
+	return reqs, nil
+}
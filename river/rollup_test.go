@@ -0,0 +1,95 @@
+package river
+
+import (
+	"context"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestRollup(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "orders"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("user_id", "int(11)", "", "")
+	ta.AddColumn("amount", "decimal(10,2)", "", "")
+	ta.AddColumn("qty", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "orders", Index: "orders", TableInfo: ta, Rollup: []*Rollup{{
+		Index: "User_Orders", GroupBy: []string{"user_id"},
+		Aggs: map[string]string{"orders": "count", "amount": "sum(amount)", "qty": "sum( qty )"},
+	}}}
+	c.Assert(rule.prepare(), IsNil)
+	ru := rule.Rollup[0]
+	c.Assert(ru.Index, Equals, "user_orders")
+	c.Assert(ru.countField, Equals, "orders")
+
+	r := &River{c: &Config{}, ctx: context.Background(), st: &stat{}, syncCh: make(chan interface{}, 4),
+		rules: map[string]*Rule{ruleKey("test", "orders"): rule}, limits: newRateLimits(0, 0)}
+	r.setFieldMapping(rule)
+
+	params := func(req *elastic.BulkRequest) map[string]interface{} {
+		return req.Script["params"].(map[string]interface{})
+	}
+
+	// the inserted rows are added to their groups, which are inserted if missing
+	reqs, err := r.makeRollupRequests(rule, canal.InsertAction, [][]interface{}{{int32(1), int32(7), "10.50", int32(2)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Index, Equals, "user_orders")
+	c.Assert(reqs[0].ID, Equals, "7")
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].Upsert, IsTrue)
+	c.Assert(params(reqs[0])["deltas"], DeepEquals, map[string]interface{}{"orders": int64(1), "amount": 10.5, "qty": int64(2)})
+	c.Assert(params(reqs[0])["count"], Equals, "orders")
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"user_id": int32(7), "orders": int64(1), "amount": 10.5, "qty": int64(2)})
+
+	// an update in the same group only changes the sums
+	reqs, err = r.makeRollupRequests(rule, canal.UpdateAction, [][]interface{}{
+		{int32(1), int32(7), "10.50", int32(2)}, {int32(1), int32(7), "10.50", int32(5)},
+		{int32(2), int32(7), "1.00", int32(1)}, {int32(2), int32(7), "1.00", int32(1)},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Upsert, IsFalse)
+	c.Assert(params(reqs[0])["deltas"], DeepEquals, map[string]interface{}{"qty": int64(3)})
+
+	// an update moving the row to another group decreases the old one
+	reqs, err = r.makeRollupRequests(rule, canal.UpdateAction, [][]interface{}{
+		{int32(1), int32(7), "10.50", int32(5)}, {int32(1), int32(8), "10.50", int32(5)},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].ID, Equals, "7")
+	c.Assert(reqs[0].Upsert, IsFalse)
+	c.Assert(params(reqs[0])["deltas"], DeepEquals, map[string]interface{}{"orders": int64(-1), "amount": -10.5, "qty": int64(-5)})
+	c.Assert(reqs[1].ID, Equals, "8")
+	c.Assert(reqs[1].Upsert, IsTrue)
+
+	// the deleted rows are removed from their groups, the rows without a group are skipped
+	reqs, err = r.makeRollupRequests(rule, canal.DeleteAction, [][]interface{}{{int32(1), int32(8), nil, int32(5)}, {int32(3), nil, "1", int32(1)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(params(reqs[0])["deltas"], DeepEquals, map[string]interface{}{"orders": int64(-1), "amount": int64(0), "qty": int64(-5)})
+
+	// the rollup requests are sent with the docs of the rule
+	h := &eventHandler{r: r}
+	e := &canal.RowsEvent{Action: canal.InsertAction, Table: ta, Rows: [][]interface{}{{int32(4), int32(9), "3", int32(1)}},
+		Header: &replication.EventHeader{LogPos: 120}}
+	c.Assert(h.OnRow(e), IsNil)
+	reqs = (<-r.syncCh).([]*elastic.BulkRequest)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Index, Equals, "orders")
+	c.Assert(reqs[1].Index, Equals, "user_orders")
+
+	for _, bad := range []*Rollup{
+		{Index: "x", Aggs: map[string]string{"n": "count"}},
+		{Index: "x", GroupBy: []string{"user_id"}, Aggs: map[string]string{"n": "avg(qty)"}},
+		{Index: "x", GroupBy: []string{"user_id"}, Aggs: map[string]string{"n": "sum()"}},
+	} {
+		rule := &Rule{Schema: "test", Table: "orders", Rollup: []*Rollup{bad}}
+		c.Assert(rule.prepare(), NotNil)
+	}
+}
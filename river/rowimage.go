@@ -0,0 +1,333 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// How to handle the partial rows with binlog_row_image MINIMAL or NOBLOB.
+const (
+	// update ES with the columns in the row image only
+	PartialRowUpdate = "update"
+	// fetch the missing columns from MySQL by PK
+	PartialRowFetch = "fetch"
+)
+
+func isColumnPresent(bitmap []byte, i int) bool {
+	// no bitmap for dump, all columns are present
+	if bitmap == nil {
+		return true
+	}
+	if i>>3 >= len(bitmap) {
+		return false
+	}
+	return bitmap[i>>3]&(1<<(uint(i)&7)) > 0
+}
+
+// areColumnsPresent returns whether all the columns are in the rows event.
+func areColumnsPresent(bitmap []byte, columns []int) bool {
+	for _, i := range columns {
+		if !isColumnPresent(bitmap, i) {
+			return false
+		}
+	}
+	return true
+}
+
+func isPartialRow(bitmap []byte, columns int) bool {
+	for i := 0; i < columns; i++ {
+		if !isColumnPresent(bitmap, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPartialRowsEvent(e *canal.RowsEvent) bool {
+	n := len(e.Table.Columns)
+	if e.Action == canal.UpdateAction {
+		return isPartialRow(e.ColumnBitmap2, n)
+	}
+	return isPartialRow(e.ColumnBitmap1, n)
+}
+
+// mergeUpdateRow fills the columns missing in the after image with the before image,
+// they are not changed by the update.
+func mergeUpdateRow(e *canal.RowsEvent, before, after []interface{}) []interface{} {
+	row := make([]interface{}, len(after))
+	for i := range after {
+		if isColumnPresent(e.ColumnBitmap2, i) {
+			row[i] = after[i]
+		} else {
+			row[i] = before[i]
+		}
+	}
+	return row
+}
+
+// fetchPartialRows fills the missing columns of insert and update rows by
+// selecting the current row from MySQL by PK, the row may be changed after
+// the event, so the values are the latest but not the ones at the event.
+func (r *River) fetchPartialRows(rule *Rule, e *canal.RowsEvent) ([][]interface{}, error) {
+	return fillPartialRows(e, func(row []interface{}) ([]interface{}, error) {
+		current, err := r.selectRow(rule, row)
+		if err == nil && current == nil {
+			log.Warnf("row of %s.%s is not found when fetching the missing columns, it may be deleted", rule.Schema, rule.Table)
+		}
+		return current, err
+	})
+}
+
+// fillPartialRows fills the missing columns of the partial rows with the current rows
+// returned by selectRow, nil if the row is not found, then it is kept as it is.
+func fillPartialRows(e *canal.RowsEvent, selectRow func(row []interface{}) ([]interface{}, error)) ([][]interface{}, error) {
+	if e.Action == canal.DeleteAction || !isPartialRowsEvent(e) {
+		return e.Rows, nil
+	}
+
+	rows := make([][]interface{}, len(e.Rows))
+	copy(rows, e.Rows)
+
+	step := 1
+	if e.Action == canal.UpdateAction {
+		step = 2
+	}
+	for i := 0; i < len(rows); i += step {
+		row := rows[i]
+		bitmap := e.ColumnBitmap1
+		if e.Action == canal.UpdateAction {
+			row = mergeUpdateRow(e, rows[i], rows[i+1])
+			bitmap = e.ColumnBitmap2
+		}
+		if !isPartialRow(bitmap, len(row)) {
+			continue
+		}
+
+		current, err := selectRow(row)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if current == nil {
+			current = row
+		}
+
+		filled := make([]interface{}, len(row))
+		for j := range row {
+			if isColumnPresent(bitmap, j) {
+				filled[j] = row[j]
+			} else {
+				filled[j] = current[j]
+			}
+		}
+
+		if e.Action == canal.UpdateAction {
+			// the missing columns are not changed, so use the same values for before
+			before := make([]interface{}, len(filled))
+			for j := range before {
+				if isColumnPresent(e.ColumnBitmap1, j) && isColumnPresent(e.ColumnBitmap2, j) {
+					before[j] = rows[i][j]
+				} else {
+					before[j] = filled[j]
+				}
+			}
+			rows[i] = before
+			rows[i+1] = filled
+		} else {
+			rows[i] = filled
+		}
+	}
+
+	return rows, nil
+}
+
+// selectRow selects the row with the PK of row, returns nil if not found.
+func (r *River) selectRow(rule *Rule, row []interface{}) ([]interface{}, error) {
+	pks, err := rule.TableInfo.GetPKValues(row)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	res, err := r.canal.Execute(selectRowQuery(rule), pks...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if res.Resultset == nil || res.RowNumber() == 0 {
+		return nil, nil
+	}
+
+	values := make([]interface{}, len(res.Values[0]))
+	for i, v := range res.Values[0] {
+		// same as the values in dump
+		if b, ok := v.([]byte); ok {
+			values[i] = string(b)
+		} else {
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
+// selectRowQuery returns the query of the row of the table by PK.
+func selectRowQuery(rule *Rule) string {
+	var buf bytes.Buffer
+	buf.WriteString("SELECT ")
+	for i, col := range rule.TableInfo.Columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(fmt.Sprintf("`%s`", col.Name))
+	}
+	buf.WriteString(fmt.Sprintf(" FROM `%s`.`%s` WHERE ", rule.Schema, rule.Table))
+	for i, index := range rule.TableInfo.PKColumns {
+		if i > 0 {
+			buf.WriteString(" AND ")
+		}
+		buf.WriteString(fmt.Sprintf("`%s` = ?", rule.TableInfo.Columns[index].Name))
+	}
+	return buf.String()
+}
+
+// updatesPartially returns whether the update of the partial rows event is sent with the changed
+// columns only, the versioned docs and the ones of a new id are indexed as a whole from the fetched
+// rows, like the updates with the full row image.
+func (r *River) updatesPartially(rule *Rule, e *canal.RowsEvent) (bool, error) {
+	if len(r.c.VersionType) > 0 {
+		return false, nil
+	}
+	changed, err := r.changesDocID(rule, e)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return !changed, nil
+}
+
+// changesDocID returns whether an update of the partial rows event changes the doc id or the parent
+// of the rule or a fan-out one which updates the changed columns only, the id columns not in the
+// before image are not changed.
+func (r *River) changesDocID(rule *Rule, e *canal.RowsEvent) (bool, error) {
+	rows := e.Rows
+	for _, t := range rule.targets() {
+		if !t.updatesPartially() {
+			continue
+		}
+		for i := 0; i+1 < len(rows); i += 2 {
+			row := mergeUpdateRow(e, rows[i], rows[i+1])
+			id, err := r.getDocID(t, row)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			if beforeID, err := r.getDocID(t, rows[i]); err == nil && beforeID != id {
+				return true, nil
+			}
+			if len(t.Parent) == 0 {
+				continue
+			}
+			parentID, err := r.getParentID(t, row, t.Parent)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			if beforeParentID, err := r.getParentID(t, rows[i], t.Parent); err == nil && beforeParentID != parentID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// makePartialUpdateRequest makes the update requests with the changed columns only.
+func (r *River) makePartialUpdateRequest(rule *Rule, e *canal.RowsEvent) ([]*elastic.BulkRequest, error) {
+	rows := e.Rows
+	if len(rows)%2 != 0 {
+		return nil, errors.Errorf("invalid update rows event, must have 2x rows, but %d", len(rows))
+	}
+	if rule.ActionMapping[canal.UpdateAction] == "" {
+		return nil, nil
+	}
+	reqs := make([]*elastic.BulkRequest, 0, len(rows)/2)
+
+	for i := 0; i < len(rows); i += 2 {
+		row := mergeUpdateRow(e, rows[i], rows[i+1])
+
+		id, err := r.getDocID(rule, row)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		parentID := ""
+		if len(rule.Parent) > 0 {
+			if parentID, err = r.getParentID(rule, row, rule.Parent); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		req := &elastic.BulkRequest{
+			Index:  rule.Index,
+			Type:   rule.Type,
+			ID:     id,
+			Parent: parentID,
+			Action: elastic.ActionUpdate,
+			Data:   make(map[string]interface{}, len(rule.FieldMapping)),
+		}
+
+		deleted := false
+		for _, f := range rule.fields {
+			if !isColumnPresent(e.ColumnBitmap2, f.column) || !areColumnsPresent(e.ColumnBitmap2, f.columns) {
+				continue
+			}
+			c := rule.TableInfo.Columns[f.column]
+			v := f.value(rule, row)
+			if exist, pass := rule.CheckWhere(c.Name, v); exist && !pass && !f.derived {
+				deleted = true
+				break
+			}
+			if _, ok := v.(skipField); ok {
+				continue
+			}
+			// the NULL clears the field unless it was NULL in the before image too
+			if v == nil && rule.NullHandling == NullHandlingOmit && isColumnPresent(e.ColumnBitmap1, f.column) &&
+				areColumnsPresent(e.ColumnBitmap1, f.columns) && f.value(rule, rows[i]) == nil {
+				continue
+			}
+			req.Data[f.esField] = f.label(v)
+		}
+
+		// the partial JSON updates not applied to the before image
+		diffs, err := r.makeJSONDiffParams(rule, rows[i+1])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// the doc is deleted if the new row doesn't match the where, the updates changing
+		// the doc id are made from the whole rows by makeUpdateRequest instead
+		if deleted {
+			reqs = append(reqs, &elastic.BulkRequest{
+				Index:  rule.Index,
+				Type:   rule.Type,
+				ID:     id,
+				Parent: parentID,
+				Action: elastic.ActionDelete,
+			})
+			r.st.DeleteNum.Add(1)
+			continue
+		}
+
+		if len(diffs) > 0 {
+			req.Script = map[string]interface{}{
+				"source": jsonDiffScript,
+				"lang":   "painless",
+				"params": map[string]interface{}{"doc": req.Data, "diffs": diffs},
+			}
+		} else if len(req.Data) == 0 {
+			continue
+		}
+		r.st.UpdateNum.Add(1)
+		reqs = append(reqs, req)
+	}
+
+	return reqs, nil
+}
@@ -0,0 +1,197 @@
+package river
+
+import (
+	"errors"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestFetchPartialRows(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("body", "text", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "t", TableInfo: ta}
+	c.Assert(selectRowQuery(rule), Equals, "SELECT `id`, `name`, `body` FROM `test`.`t` WHERE `id` = ?")
+
+	current := map[interface{}][]interface{}{
+		int32(1): {int32(1), "a", "body 1"},
+		int32(2): {int32(2), "b", "body 2"},
+	}
+	var selected []interface{}
+	selectRow := func(row []interface{}) ([]interface{}, error) {
+		selected = append(selected, row[0])
+		return current[row[0]], nil
+	}
+
+	// the full rows and the deletes are not fetched
+	full := &canal.RowsEvent{Table: ta, Action: canal.InsertAction, ColumnBitmap1: []byte{0x07},
+		Rows: [][]interface{}{{int32(1), "a", "x"}}}
+	rows, err := fillPartialRows(full, selectRow)
+	c.Assert(err, IsNil)
+	c.Assert(rows, DeepEquals, full.Rows)
+	del := &canal.RowsEvent{Table: ta, Action: canal.DeleteAction, ColumnBitmap1: []byte{0x01},
+		Rows: [][]interface{}{{int32(1), nil, nil}}}
+	rows, err = fillPartialRows(del, selectRow)
+	c.Assert(err, IsNil)
+	c.Assert(rows, DeepEquals, del.Rows)
+	c.Assert(selected, HasLen, 0)
+
+	// the missing body of the insert is fetched, the row not found is kept
+	insert := &canal.RowsEvent{Table: ta, Action: canal.InsertAction, ColumnBitmap1: []byte{0x03},
+		Rows: [][]interface{}{{int32(1), "new", nil}, {int32(3), "c", nil}}}
+	rows, err = fillPartialRows(insert, selectRow)
+	c.Assert(err, IsNil)
+	c.Assert(rows, DeepEquals, [][]interface{}{{int32(1), "new", "body 1"}, {int32(3), "c", nil}})
+	// the event is not changed
+	c.Assert(insert.Rows[0][2], IsNil)
+	c.Assert(selected, DeepEquals, []interface{}{int32(1), int32(3)})
+
+	// the missing columns of the update are the same in both images
+	update := &canal.RowsEvent{Table: ta, Action: canal.UpdateAction, ColumnBitmap1: []byte{0x01}, ColumnBitmap2: []byte{0x03},
+		Rows: [][]interface{}{{int32(2), nil, nil}, {int32(2), "b2", nil}}}
+	rows, err = fillPartialRows(update, selectRow)
+	c.Assert(err, IsNil)
+	c.Assert(rows, DeepEquals, [][]interface{}{{int32(2), "b2", "body 2"}, {int32(2), "b2", "body 2"}})
+
+	_, err = fillPartialRows(insert, func(row []interface{}) ([]interface{}, error) {
+		return nil, errors.New("lost connection")
+	})
+	c.Assert(err, ErrorMatches, "lost connection")
+}
+
+func (s *unitTestSuite) TestPartialRowUpdate(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("body", "text", "", "")
+	ta.PKColumns = []int{0}
+
+	r := &River{c: &Config{PartialRowImage: PartialRowUpdate}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+	c.Assert(rule.updatesPartially(), IsTrue)
+
+	current := map[interface{}][]interface{}{
+		int32(1): {int32(1), "b", "body 1"},
+		int32(2): {int32(2), "a", "body 1"},
+	}
+	selectRow := func(row []interface{}) ([]interface{}, error) {
+		return current[row[0]], nil
+	}
+
+	// the changed columns only
+	e := &canal.RowsEvent{Table: ta, Action: canal.UpdateAction, ColumnBitmap1: []byte{0x03}, ColumnBitmap2: []byte{0x03},
+		Rows: [][]interface{}{{int32(1), "a", nil}, {int32(1), "b", nil}}}
+	changed, err := r.changesDocID(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(changed, IsFalse)
+	reqs, err := r.makePartialUpdateRequest(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "name": "b"})
+
+	// the upsert doc and the docs through a pipeline are whole, so the rows are fetched
+	for _, set := range []func(*Rule){
+		func(rule *Rule) { rule.Upsert = true },
+		func(rule *Rule) { rule.Pipeline = "p" },
+		func(rule *Rule) { rule.ActionPipeline = map[string]string{canal.UpdateAction: "p"} },
+	} {
+		rule := rule.clone()
+		set(rule)
+		c.Assert(rule.updatesPartially(), IsFalse)
+		c.Assert(rule.rewritesUpdate(), IsTrue)
+	}
+	rule.ActionPipeline = map[string]string{canal.InsertAction: "p"}
+	c.Assert(rule.updatesPartially(), IsTrue)
+	rule.ActionPipeline = nil
+
+	upsert := rule.clone()
+	upsert.Upsert = true
+	rows, err := fillPartialRows(e, selectRow)
+	c.Assert(err, IsNil)
+	reqs, err = r.makeUpdateRequest(upsert, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Upsert, IsTrue)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "name": "b", "body": "body 1"})
+
+	// the doc of the new id is indexed as a whole from the fetched row
+	e = &canal.RowsEvent{Table: ta, Action: canal.UpdateAction, ColumnBitmap1: []byte{0x01}, ColumnBitmap2: []byte{0x01},
+		Rows: [][]interface{}{{int32(1), nil, nil}, {int32(2), nil, nil}}}
+	changed, err = r.changesDocID(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(changed, IsTrue)
+	rows, err = fillPartialRows(e, selectRow)
+	c.Assert(err, IsNil)
+	reqs, err = r.makeUpdateRequest(rule, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionDelete)
+	c.Assert(reqs[0].ID, Equals, "1")
+	c.Assert(reqs[1].Action, Equals, elastic.ActionIndex)
+	c.Assert(reqs[1].ID, Equals, "2")
+	c.Assert(reqs[1].Data, DeepEquals, map[string]interface{}{"id": int32(2), "name": "a", "body": "body 1"})
+
+	// and still rejected by pk_change
+	rule.PKChange = PKChangeReject
+	_, err = r.makeUpdateRequest(rule, rows)
+	c.Assert(err, ErrorMatches, ".*pk_change is reject")
+}
+
+func (s *unitTestSuite) TestPartialRowVersion(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("body", "text", "", "")
+	ta.PKColumns = []int{0}
+
+	r := &River{c: &Config{PartialRowImage: PartialRowUpdate}, st: &stat{}, replayPos: mysql.Position{Name: "mysql-bin.000002"}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta, DeleteMode: DeleteModeTombstone,
+		Where: map[string]interface{}{"name": "a"}}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+
+	e := &canal.RowsEvent{Table: ta, Action: canal.UpdateAction, ColumnBitmap1: []byte{0x03}, ColumnBitmap2: []byte{0x03},
+		Rows: [][]interface{}{{int32(1), "a", nil}, {int32(1), "b", nil}}}
+	partial, err := r.updatesPartially(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(partial, IsTrue)
+
+	// the doc of the row not matching the where any more is a tombstone
+	reqs, err := r.makePartialUpdateRequest(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionDelete)
+	tombstoneDeletes(rule, reqs, e)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].Data[rule.TombstoneField], Equals, true)
+
+	// the versioned doc is indexed as a whole from the fetched row
+	r.c.VersionType = VersionExternal
+	rule.Where = nil
+	partial, err = r.updatesPartially(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(partial, IsFalse)
+	rows, err := fillPartialRows(e, func(row []interface{}) ([]interface{}, error) {
+		return []interface{}{int32(1), "b", "body 1"}, nil
+	})
+	c.Assert(err, IsNil)
+	reqs, err = r.makeUpdateRequest(rule, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(r.setVersion(reqs, 120), IsNil)
+	version, err := binlogVersion("mysql-bin.000002", 120)
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionIndex)
+	c.Assert(reqs[0].Version, Equals, version)
+	c.Assert(reqs[0].VersionType, Equals, VersionExternal)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "name": "b", "body": "body 1"})
+}
@@ -1,14 +1,176 @@
 package river
 
 import (
+	"bytes"
+	"net/url"
 	"reflect"
+	"regexp"
 	"strings"
 
+	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/schema"
 	"github.com/zeayes/go-mysql-elasticsearch/elastic"
 )
 
+// ruleField is a compiled field mapping of a synced column.
+type ruleField struct {
+	// index in TableInfo.Columns
+	column  int
+	esField string
+	convert func(col *schema.TableColumn, value interface{}) interface{}
+	// from CopyField or FuncField, the where is not checked with its value
+	derived bool
+	// the columns and the value of the helper of FuncField
+	columns []int
+	compute func(values []interface{}) interface{}
+	// value -> label from ValueMap of the column
+	labels map[string]string
+}
+
+// value returns the field value of the row.
+func (f *ruleField) value(rule *Rule, values []interface{}) interface{} {
+	if f.compute != nil {
+		return f.compute(values)
+	}
+	// the converters may change the column copy
+	c := rule.TableInfo.Columns[f.column]
+	return f.convert(&c, values[f.column])
+}
+
+// label returns the label of the value in value_map, or the value itself if it has none,
+// the where is checked with the value before.
+func (f *ruleField) label(value interface{}) interface{} {
+	if len(f.labels) == 0 || value == nil {
+		return value
+	}
+	var key string
+	switch v := value.(type) {
+	case string:
+		key = v
+	case []byte:
+		key = string(v)
+	default:
+		var buf bytes.Buffer
+		writePlainIDValue(&buf, v)
+		key = buf.String()
+	}
+	if label, ok := f.labels[key]; ok {
+		return label
+	}
+	return value
+}
+
+// skipField is the value of the field which is omitted in the doc.
+type skipField struct{}
+
+// How to handle TRUNCATE TABLE for the rule.
+const (
+	// only log a warning, documents in ES are kept
+	TruncateWarn = "warn"
+	// delete the documents of the table in the rule's index and type
+	TruncateDeleteByQuery = "delete_by_query"
+	// delete and create the rule's index again
+	TruncateRecreate = "recreate"
+)
+
+// Priority of the rule.
+const (
+	PriorityNormal = "normal"
+	// the requests are sent ahead of the normal ones in every flush
+	PriorityHigh = "high"
+)
+
+// How to handle the NULL columns for the rule.
+const (
+	// the field is null in the doc
+	NullHandlingNull = "null"
+	// the field is omitted in the doc, so update doesn't change it
+	NullHandlingOmit = "omit"
+)
+
+// How to handle the zero and invalid dates like 0000-00-00 for the rule.
+const (
+	// the field is null
+	InvalidDateNull = "null"
+	// the field is the sentinel date in invalid_date_sentinel
+	InvalidDateSentinel = "sentinel"
+	// the field is the raw string from MySQL
+	InvalidDateRaw = "raw"
+	// the field is omitted in the doc
+	InvalidDateSkip = "skip"
+)
+
+// How to convert the TIME columns for the rule.
+const (
+	// the raw string from MySQL like -838:59:59
+	TimeFormatRaw = "raw"
+	// the seconds, with the fraction if the TIME has
+	TimeFormatSeconds = "seconds"
+	// the ISO-8601 duration like -PT838H59M59S
+	TimeFormatDuration = "duration"
+)
+
+// How to convert the BIT columns for the rule.
+const (
+	// the integer of the bits
+	BitFormatInteger = "int"
+	// the bit string padded to the column width like "00000101"
+	BitFormatString = "bitstring"
+)
+
+// How to convert the TINYINT(1) columns for the rule.
+const (
+	// the integer 0 or 1
+	TinyintFormatInteger = "int"
+	// false for 0 and true for the others
+	TinyintFormatBool = "bool"
+)
+
+// How to handle the generated columns for the rule.
+const (
+	// use the values in the rows as they are
+	GeneratedKeep = "keep"
+	// never sync the generated columns
+	GeneratedSkip = "skip"
+	// select the generated columns from MySQL by PK for the binlog rows
+	GeneratedFetch = "fetch"
+)
+
+// How to handle the update which changes the doc id for the rule.
+const (
+	// delete the old doc and index the new one
+	PKChangeDeleteIndex = "delete_index"
+	// fail the sync
+	PKChangeReject = "reject"
+)
+
+// What to do on start when the index of the rule doesn't exist.
+const (
+	// create the index with the inferred mapping like auto_create_index
+	MissingIndexCreate = "create"
+	// fail the start
+	MissingIndexRequire = "require"
+	// skip the rule with a warning, its rows are not synced
+	MissingIndexIgnore = "ignore"
+)
+
+// The field naming preset of the source metadata for the rule.
+const (
+	// Elastic Common Schema, @timestamp and the event, host, log and labels fields
+	FieldPresetECS = "ecs"
+)
+
+// How to sync the updates for the rule.
+const (
+	// update the changed fields of the doc
+	UpdateModeUpdate = "update"
+	// index the whole doc
+	UpdateModeReindex = "reindex"
+	// delete the doc and index the whole one
+	UpdateModeDeleteIndex = "delete_index"
+)
+
 var ElasticActions = map[string]string{
 	elastic.ActionIndex:  canal.InsertAction,
 	elastic.ActionUpdate: canal.UpdateAction,
@@ -20,6 +182,19 @@ var DefaultActionMapping = map[string]string{
 	canal.DeleteAction: elastic.ActionDelete,
 }
 
+// ScriptAction in [rule.action] maps the MySQL action to an update with its action_script.
+const ScriptAction = "script"
+
+// ActionScript is the Painless script of a MySQL action mapped to script, the params
+// are the columns in params, param name -> MySQL column, the deleted row for delete,
+// and params.before has the values before update. With upsert, the row is inserted as
+// the doc if it is missing.
+type ActionScript struct {
+	Source string            `toml:"source"`
+	Params map[string]string `toml:"params"`
+	Upsert bool              `toml:"upsert"`
+}
+
 // Rule is the rule for how to sync data from MySQL to ES.
 // If you want to sync MySQL data into elasticsearch, you must set a rule to let use know how to do it.
 // The mapping rule may thi: schema + table <-> index + document type.
@@ -32,6 +207,23 @@ type Rule struct {
 	Parent string   `toml:"parent"`
 	ID     []string `toml:"id"`
 
+	// The column routing the doc to the shard of its value, like the user_id of the orders,
+	// the doc is routed by its id if the value is NULL.
+	Routing string `toml:"routing"`
+
+	// The doc id is made from the columns in id_template like "{tenant_id}-{order_id}" if set,
+	// otherwise the id columns or PK joined by id_separator, default is ":".
+	// The id is hashed by id_hash, sha1 or xxhash, and encoded by id_encoding, hex or base64url,
+	// the hashed id is hex encoded by default.
+	IDTemplate  string `toml:"id_template"`
+	IDSeparator string `toml:"id_separator"`
+	IDHash      string `toml:"id_hash"`
+	IDEncoding  string `toml:"id_encoding"`
+
+	// Format of the binary id and parent columns, hex, uuid or base64url,
+	// like id_format = {uuid = "uuid"} for the BINARY(16) UUID column uuid.
+	IDFormat map[string]string `toml:"id_format"`
+
 	Where map[string]interface{} `toml:"where"`
 
 	// Default, a MySQL table field name is mapped to Elasticsearch field name.
@@ -39,12 +231,67 @@ type Rule struct {
 	// but in Elasticsearch, you want to name it my_title.
 	FieldMapping map[string]string `toml:"field"`
 
+	// Copy a column to more ES fields with other conversions, ES field -> "column,type",
+	// like created_ts = "created_at,timestamp" besides the created_at field.
+	CopyField map[string]string `toml:"copy_field"`
+
+	// Make the ES field with a helper of the columns, ES field -> helper, like
+	// full_name = "concat(first_name, last_name, ' ')" or tags = "split(tags_csv, ',')".
+	FuncField map[string]string `toml:"func_field"`
+
+	// Map the values of the columns to the labels, column -> value -> label, like
+	// [rule.value_map.status] 1 = "active", the values not in the map are kept.
+	ValueMap map[string]map[string]string `toml:"value_map"`
+
+	// Limit the size of the string fields, ES field -> limit, "*" is for the fields without
+	// their own limit, like [rule.field_limit.body] max_bytes = 32766, policy = "dlq".
+	FieldLimit map[string]*FieldLimit `toml:"field_limit"`
+
 	ActionMapping map[string]string `toml:"action"`
 
+	// The scripts of the actions mapped to script in ActionMapping, action -> script,
+	// like a delete appending the row to a history array instead of deleting the doc.
+	ActionScript map[string]*ActionScript `toml:"action_script"`
+
+	// The columns of the deleted rows matching the docs to delete by delete_by_query, with
+	// delete mapped to delete_by_query, like the aggregated docs of a user = ["user_id"].
+	DeleteQuery []string `toml:"delete_query"`
+
+	// Maintain the docs of the groups of the rows in the rollup indices, like
+	// [[rule.rollup]] index = "user_orders", group_by = ["user_id"], aggs = {orders = "count"}.
+	Rollup []*Rollup `toml:"rollup"`
+
 	// MySQL table information
-	TableInfo *schema.Table
+	TableInfo *schema.Table `json:"-" toml:"-"`
+
+	TableFields map[string]int `json:"-" toml:"-"`
+
+	// compiled from FieldMapping and TableInfo, see River.setFieldMapping
+	fields []ruleField
+	// writes the docs with the fields in the column order
+	encoder *elastic.FieldEncoder
+
+	// parsed from IDTemplate
+	idTemplate []idTemplatePart
+	// parsed from RedisKeys
+	redisKeys [][]idTemplatePart
+	// parsed from FuncField
+	funcFields map[string]*fieldFunc
 
-	TableFields map[string]int
+	// the other rules of the same table, the rows are written to all of them
+	fanout []*Rule
+
+	// the rule defaults are applied, see RuleDefaults.apply
+	defaulted bool
+
+	// the generated columns of the table, only loaded if generated_columns is not keep
+	generated map[string]bool
+
+	// the index doesn't exist with missing_index ignore, the rows are not synced
+	indexMissing bool
+
+	// compiled from Schema if it is a regex, see isSchemaRegex
+	schemaRegex *regexp.Regexp
 
 	//only MySQL fields in filter will be synced , default sync all fields
 	Filter []string `toml:"filter"`
@@ -52,6 +299,142 @@ type Rule struct {
 	// Elasticsearch pipeline
 	// To pre-process documents before indexing
 	Pipeline string `toml:"pipeline"`
+
+	// Pipelines per MySQL action insert or update, override the pipeline above,
+	// like action_pipeline = {insert = "enrich"}, use "" to skip pipeline for the action.
+	ActionPipeline map[string]string `toml:"action_pipeline"`
+
+	// Update with doc_as_upsert, so the doc is inserted if it doesn't exist,
+	// the whole row is sent for update then.
+	Upsert bool `toml:"upsert"`
+
+	// Painless script for update, like "ctx._source.count += params.count - params.before.count",
+	// the params are the columns in script_params, param name -> MySQL column,
+	// params.before has the values before update.
+	Script       string            `toml:"script"`
+	ScriptParams map[string]string `toml:"script_params"`
+
+	// How to handle the NULL columns, null or omit, default is null
+	NullHandling string `toml:"null_handling"`
+
+	// How to handle the zero and invalid dates, null, sentinel, raw or skip, default is null
+	InvalidDate         string `toml:"invalid_date"`
+	InvalidDateSentinel string `toml:"invalid_date_sentinel"`
+
+	// How to convert the TIME columns, raw, seconds or duration, default is raw
+	TimeFormat string `toml:"time_format"`
+
+	// How to convert the BIT columns, int or bitstring, default is int
+	BitFormat string `toml:"bit_format"`
+
+	// How to convert the TINYINT(1) columns, int or bool, default is int
+	TinyintFormat string `toml:"tinyint_format"`
+
+	// How to handle the generated columns, keep, skip or fetch, default is keep
+	GeneratedColumns string `toml:"generated_columns"`
+
+	// How to sync the updates, update, reindex or delete_index, default is update
+	UpdateMode string `toml:"update_mode"`
+
+	// How to sync the deletes, delete or tombstone, default is delete. tombstone updates the doc
+	// with tombstone_field = true and tombstone_time_field = the deletion time instead,
+	// default fields are deleted and deleted_at.
+	DeleteMode         string `toml:"delete_mode"`
+	TombstoneField     string `toml:"tombstone_field"`
+	TombstoneTimeField string `toml:"tombstone_time_field"`
+
+	// Tag the dumped docs with the dump generation in dump_generation_field, default is
+	// dump_generation, and delete the docs of the older dumps after the dump.
+	DumpCleanup         bool   `toml:"dump_cleanup"`
+	DumpGenerationField string `toml:"dump_generation_field"`
+
+	// Delete the docs whose ttl_field is older than ttl periodically, like ttl = "30d",
+	// ttl_field is the date field of the docs, like created_at, no expiry if not set.
+	TTL      TomlDuration `toml:"ttl"`
+	TTLField string       `toml:"ttl_field"`
+
+	// How to handle the updates which don't change the doc, send or skip, default is send
+	NoopUpdate string `toml:"noop_update"`
+
+	// What to do when an update changes the doc id, delete_index or reject, default is delete_index
+	PKChange string `toml:"pk_change"`
+
+	// Index every insert as a new doc and ignore the updates and deletes, for the immutable
+	// event tables, the PK is not needed then. The doc id is position or auto, default is position.
+	AppendOnly bool   `toml:"append_only"`
+	AppendID   string `toml:"append_id"`
+
+	// Add the source metadata to the docs in this field, like _meta, it has the schema, table,
+	// action, binlog_file, binlog_pos, gtid and timestamp of the row, not added if empty.
+	MetaField string `toml:"meta_field"`
+
+	// Add the source metadata to the docs as the fields of the preset too, only ecs now,
+	// so the docs can be searched with the logs and metrics in the same tools.
+	FieldPreset string `toml:"field_preset"`
+
+	// What to do when the index doesn't exist, create, require or ignore, default is create
+	// with auto_create_index, or leaving it to ES.
+	MissingIndex string `toml:"missing_index"`
+
+	// Name of the cluster in [[cluster]] the docs are synced to, default is es_addr
+	Cluster string `toml:"cluster"`
+
+	// Priority of the requests, normal or high, default is normal
+	Priority string `toml:"priority"`
+
+	// The requests of the rule are batched apart with its own bulk_size and flush_bulk_time
+	// if any is set, the unset one is the global one. The priority is ignored then.
+	BulkSize      int          `toml:"bulk_size"`
+	FlushBulkTime TomlDuration `toml:"flush_bulk_time"`
+
+	// Send the requests of the rule in its own worker, so a slow or failing index doesn't
+	// block the flushes of the other rules. The sync loop waits for it after isolate_max_pending
+	// requests are buffered, default is 16 times of the bulk size.
+	Isolate           bool `toml:"isolate"`
+	IsolateMaxPending int  `toml:"isolate_max_pending"`
+
+	// POST the doc operations of the rule to the webhook URL after they are written to ES,
+	// or instead of ES with webhook_only, like to purge the caches when the table changes.
+	Webhook     string `toml:"webhook"`
+	WebhookOnly bool   `toml:"webhook_only"`
+
+	// Delete the Redis keys made from the columns like "user:{id}" when the rows change,
+	// with redis_addr. The keys of both the old and new rows of the updates are deleted.
+	RedisKeys []string `toml:"redis_keys"`
+
+	// Max docs of the table synced per second, 0 means no limit,
+	// the docs of all the rules of the table are counted.
+	RateLimitDocs int64 `toml:"rate_limit_docs"`
+
+	// What to do when the table is truncated, warn, delete_by_query or recreate
+	Truncate string `toml:"truncate"`
+
+	// Put the mapping of the new columns to ES when the table is altered
+	UpdateMapping bool `toml:"update_mapping"`
+
+	// ES field mappings override the ones inferred from MySQL column types,
+	// like title = {type = "text", analyzer = "standard"}
+	Mapping map[string]interface{} `toml:"mapping"`
+
+	// Aliases maintained on the index.
+	Aliases []string `toml:"aliases"`
+
+	// Write the docs to the index of the tenant of the row, like orders_acme with
+	// index_suffix_column = "tenant_id". The tenant indices are created by ES with the
+	// template of the rule, default is the index.
+	IndexSuffixColumn string `toml:"index_suffix_column"`
+
+	// Index template installed or refreshed at startup, it matches the indices in
+	// template_patterns, default is the index with a "*" suffix.
+	// The template has the index settings, the ILM policy and the rule mapping.
+	Template         string                 `toml:"template"`
+	TemplatePatterns []string               `toml:"template_patterns"`
+	Settings         map[string]interface{} `toml:"settings"`
+
+	// ILM policy attached to the indices, it is installed from ilm_policy_file if set.
+	ILMPolicy        string `toml:"ilm_policy"`
+	ILMPolicyFile    string `toml:"ilm_policy_file"`
+	ILMRolloverAlias string `toml:"ilm_rollover_alias"`
 }
 
 func newDefaultRule(schema string, table string) *Rule {
@@ -73,6 +456,15 @@ func newDefaultRule(schema string, table string) *Rule {
 }
 
 func (r *Rule) prepare() error {
+	r.schemaRegex = nil
+	if isSchemaRegex(r.Schema) {
+		reg, err := compileSchemaRegex(r.Schema)
+		if err != nil {
+			return errors.Annotatef(err, "rule %s.%s", r.Schema, r.Table)
+		}
+		r.schemaRegex = reg
+	}
+
 	if r.TableFields == nil {
 		r.TableFields = make(map[string]int)
 	}
@@ -93,6 +485,56 @@ func (r *Rule) prepare() error {
 		}
 	}
 
+	for esField, value := range r.CopyField {
+		if len(esField) == 0 || len(strings.Split(value, ",")[0]) == 0 {
+			return errors.Errorf("invalid copy_field %s = %q for rule %s.%s", esField, value, r.Schema, r.Table)
+		}
+	}
+
+	r.funcFields = nil
+	if len(r.FuncField) > 0 {
+		r.funcFields = make(map[string]*fieldFunc, len(r.FuncField))
+		for esField, value := range r.FuncField {
+			fn, err := parseFieldFunc(value)
+			if err != nil {
+				return errors.Errorf("invalid func_field %s for rule %s.%s: %v", esField, r.Schema, r.Table, err)
+			}
+			r.funcFields[esField] = fn
+		}
+	}
+
+	for action, script := range r.ActionScript {
+		if _, ok := DefaultActionMapping[action]; !ok {
+			return errors.Errorf("invalid action %s in action_script for rule %s.%s", action, r.Schema, r.Table)
+		} else if script == nil || len(script.Source) == 0 {
+			return errors.Errorf("source of action_script %s must be set for rule %s.%s", action, r.Schema, r.Table)
+		}
+	}
+	for action, esAction := range r.ActionMapping {
+		if esAction == DeleteByQueryAction {
+			if action != canal.DeleteAction {
+				return errors.Errorf("only delete can be mapped to delete_by_query for rule %s.%s", r.Schema, r.Table)
+			} else if len(r.DeleteQuery) == 0 {
+				return errors.Errorf("delete_query must be set for the delete_by_query action of rule %s.%s", r.Schema, r.Table)
+			}
+			continue
+		}
+		if esAction != ScriptAction {
+			continue
+		}
+		if r.ActionScript[action] == nil {
+			return errors.Errorf("action_script %s must be set for the script action of rule %s.%s", action, r.Schema, r.Table)
+		} else if action == canal.InsertAction && r.AppendOnly {
+			return errors.Errorf("insert can't be mapped to script with append_only for rule %s.%s", r.Schema, r.Table)
+		}
+	}
+
+	for action := range r.ActionPipeline {
+		if action != canal.InsertAction && action != canal.UpdateAction {
+			return errors.Errorf("invalid action %s in action_pipeline for rule %s.%s, must be insert or update", action, r.Schema, r.Table)
+		}
+	}
+
 	if len(r.Index) == 0 {
 		r.Index = r.Table
 	}
@@ -101,14 +543,305 @@ func (r *Rule) prepare() error {
 		r.Type = r.Index
 	}
 
+	r.idTemplate = nil
+	if len(r.IDTemplate) > 0 {
+		parts, err := parseIDTemplate(r.IDTemplate)
+		if err != nil {
+			return errors.Errorf("invalid id_template %s for rule %s.%s: %v", r.IDTemplate, r.Schema, r.Table, err)
+		}
+		r.idTemplate = parts
+	}
+
+	if len(r.IDSeparator) == 0 {
+		r.IDSeparator = ":"
+	}
+
+	switch r.IDHash {
+	case "":
+	case IDHashSHA1, IDHashXXHash:
+		if len(r.IDEncoding) == 0 {
+			r.IDEncoding = IDEncodingHex
+		}
+	default:
+		return errors.Errorf("invalid id_hash %s for rule %s.%s", r.IDHash, r.Schema, r.Table)
+	}
+
+	switch r.IDEncoding {
+	case "", IDEncodingHex, IDEncodingBase64URL:
+	default:
+		return errors.Errorf("invalid id_encoding %s for rule %s.%s", r.IDEncoding, r.Schema, r.Table)
+	}
+
+	for column, format := range r.IDFormat {
+		switch format {
+		case IDFormatHex, IDFormatUUID, IDFormatBase64URL:
+		default:
+			return errors.Errorf("invalid id_format %s of column %s for rule %s.%s", format, column, r.Schema, r.Table)
+		}
+	}
+
+	switch r.NullHandling {
+	case "":
+		r.NullHandling = NullHandlingNull
+	case NullHandlingNull, NullHandlingOmit:
+	default:
+		return errors.Errorf("invalid null_handling %s for rule %s.%s", r.NullHandling, r.Schema, r.Table)
+	}
+
+	switch r.InvalidDate {
+	case "":
+		r.InvalidDate = InvalidDateNull
+	case InvalidDateNull, InvalidDateRaw, InvalidDateSkip:
+	case InvalidDateSentinel:
+		if len(r.InvalidDateSentinel) == 0 {
+			return errors.Errorf("invalid_date_sentinel must be set for rule %s.%s", r.Schema, r.Table)
+		}
+	default:
+		return errors.Errorf("invalid invalid_date %s for rule %s.%s", r.InvalidDate, r.Schema, r.Table)
+	}
+
+	switch r.TimeFormat {
+	case "":
+		r.TimeFormat = TimeFormatRaw
+	case TimeFormatRaw, TimeFormatSeconds, TimeFormatDuration:
+	default:
+		return errors.Errorf("invalid time_format %s for rule %s.%s", r.TimeFormat, r.Schema, r.Table)
+	}
+
+	switch r.BitFormat {
+	case "":
+		r.BitFormat = BitFormatInteger
+	case BitFormatInteger, BitFormatString:
+	default:
+		return errors.Errorf("invalid bit_format %s for rule %s.%s", r.BitFormat, r.Schema, r.Table)
+	}
+
+	switch r.TinyintFormat {
+	case "":
+		r.TinyintFormat = TinyintFormatInteger
+	case TinyintFormatInteger, TinyintFormatBool:
+	default:
+		return errors.Errorf("invalid tinyint_format %s for rule %s.%s", r.TinyintFormat, r.Schema, r.Table)
+	}
+
+	switch r.GeneratedColumns {
+	case "":
+		r.GeneratedColumns = GeneratedKeep
+	case GeneratedKeep, GeneratedSkip, GeneratedFetch:
+	default:
+		return errors.Errorf("invalid generated_columns %s for rule %s.%s", r.GeneratedColumns, r.Schema, r.Table)
+	}
+
+	switch r.UpdateMode {
+	case "":
+		r.UpdateMode = UpdateModeUpdate
+	case UpdateModeUpdate, UpdateModeReindex, UpdateModeDeleteIndex:
+	default:
+		return errors.Errorf("invalid update_mode %s for rule %s.%s", r.UpdateMode, r.Schema, r.Table)
+	}
+
+	switch r.NoopUpdate {
+	case "":
+		r.NoopUpdate = NoopUpdateSend
+	case NoopUpdateSend, NoopUpdateSkip:
+	default:
+		return errors.Errorf("invalid noop_update %s for rule %s.%s", r.NoopUpdate, r.Schema, r.Table)
+	}
+
+	switch r.DeleteMode {
+	case "":
+		r.DeleteMode = DeleteModeDelete
+	case DeleteModeDelete, DeleteModeTombstone:
+	default:
+		return errors.Errorf("invalid delete_mode %s for rule %s.%s", r.DeleteMode, r.Schema, r.Table)
+	}
+	for _, ru := range r.Rollup {
+		if err := ru.prepare(r); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if r.deletesByQuery() && (r.DeleteMode == DeleteModeTombstone || r.AppendOnly) {
+		return errors.Errorf("delete_by_query can't be set with tombstone or append_only for rule %s.%s", r.Schema, r.Table)
+	}
+	if len(r.TombstoneField) == 0 {
+		r.TombstoneField = "deleted"
+	}
+	if len(r.TombstoneTimeField) == 0 {
+		r.TombstoneTimeField = "deleted_at"
+	}
+	if r.TTL.Duration < 0 {
+		return errors.Errorf("invalid ttl %s for rule %s.%s", r.TTL.Duration, r.Schema, r.Table)
+	} else if r.TTL.Duration > 0 && len(r.TTLField) == 0 {
+		return errors.Errorf("ttl_field must be set for the ttl of rule %s.%s", r.Schema, r.Table)
+	}
+
+	if len(r.DumpGenerationField) == 0 {
+		r.DumpGenerationField = "dump_generation"
+	}
+
+	switch r.PKChange {
+	case "":
+		r.PKChange = PKChangeDeleteIndex
+	case PKChangeDeleteIndex, PKChangeReject:
+	default:
+		return errors.Errorf("invalid pk_change %s for rule %s.%s", r.PKChange, r.Schema, r.Table)
+	}
+
+	for field, l := range r.FieldLimit {
+		if err := l.prepare(r, field); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	switch r.MissingIndex {
+	case "", MissingIndexCreate, MissingIndexRequire, MissingIndexIgnore:
+	default:
+		return errors.Errorf("invalid missing_index %s for rule %s.%s", r.MissingIndex, r.Schema, r.Table)
+	}
+
+	switch r.FieldPreset {
+	case "", FieldPresetECS:
+	default:
+		return errors.Errorf("invalid field_preset %s for rule %s.%s", r.FieldPreset, r.Schema, r.Table)
+	}
+
+	switch r.AppendID {
+	case "":
+		r.AppendID = AppendIDPosition
+	case AppendIDPosition, AppendIDAuto:
+	default:
+		return errors.Errorf("invalid append_id %s for rule %s.%s", r.AppendID, r.Schema, r.Table)
+	}
+
+	switch r.Priority {
+	case "":
+		r.Priority = PriorityNormal
+	case PriorityNormal, PriorityHigh:
+	default:
+		return errors.Errorf("invalid priority %s for rule %s.%s", r.Priority, r.Schema, r.Table)
+	}
+
+	if r.BulkSize < 0 || r.FlushBulkTime.Duration < 0 {
+		return errors.Errorf("invalid bulk_size %d or flush_bulk_time %s for rule %s.%s",
+			r.BulkSize, r.FlushBulkTime.Duration, r.Schema, r.Table)
+	}
+	if r.IsolateMaxPending < 0 {
+		return errors.Errorf("invalid isolate_max_pending %d for rule %s.%s", r.IsolateMaxPending, r.Schema, r.Table)
+	}
+	if r.Isolate && len(r.Webhook) > 0 {
+		return errors.Errorf("isolate can't be set with webhook for rule %s.%s", r.Schema, r.Table)
+	}
+
+	if len(r.Webhook) > 0 {
+		if u, err := url.Parse(r.Webhook); err != nil || u.Scheme != "http" && u.Scheme != "https" || len(u.Host) == 0 {
+			return errors.Errorf("invalid webhook %s for rule %s.%s", r.Webhook, r.Schema, r.Table)
+		}
+	} else if r.WebhookOnly {
+		return errors.Errorf("webhook must be set with webhook_only for rule %s.%s", r.Schema, r.Table)
+	}
+
+	r.redisKeys = nil
+	if len(r.RedisKeys) > 0 {
+		keys, err := parseRedisKeys(r.RedisKeys)
+		if err != nil {
+			return errors.Errorf("%v for rule %s.%s", err, r.Schema, r.Table)
+		}
+		r.redisKeys = keys
+	}
+
+	switch r.Truncate {
+	case "":
+		r.Truncate = TruncateWarn
+	case TruncateWarn, TruncateDeleteByQuery, TruncateRecreate:
+	default:
+		return errors.Errorf("invalid truncate %s for rule %s.%s", r.Truncate, r.Schema, r.Table)
+	}
+
 	// ES must use a lower-case Type
 	// Here we also use for Index
 	r.Index = strings.ToLower(r.Index)
 	r.Type = strings.ToLower(r.Type)
 
+	if len(r.IndexSuffixColumn) > 0 {
+		if r.Truncate == TruncateRecreate {
+			return errors.Errorf("index_suffix_column can't be set with truncate = recreate for rule %s.%s", r.Schema, r.Table)
+		} else if r.MissingIndex == MissingIndexRequire || r.MissingIndex == MissingIndexIgnore {
+			return errors.Errorf("index_suffix_column can't be set with missing_index = %s for rule %s.%s", r.MissingIndex, r.Schema, r.Table)
+		}
+		if len(r.Template) == 0 {
+			r.Template = r.Index
+		}
+	}
+
 	return nil
 }
 
+// hasOwnBatch returns true if the requests are batched apart with bulk_size or flush_bulk_time
+// of the rule, posted to its webhook, or isolated.
+func (r *Rule) hasOwnBatch() bool {
+	return r.BulkSize > 0 || r.FlushBulkTime.Duration > 0 || len(r.Webhook) > 0 || r.Isolate
+}
+
+// locatesByRow returns true if the index or the routing of the doc is from the columns
+// of the row, the updates need the whole rows to find the doc.
+func (r *Rule) locatesByRow() bool {
+	return len(r.IndexSuffixColumn) > 0 || len(r.Routing) > 0
+}
+
+// updatesPartially returns whether the update of the rule can be sent with the changed columns only,
+// the upsert doc and the docs through a pipeline must be whole.
+func (r *Rule) updatesPartially() bool {
+	return r.UpdateMode == UpdateModeUpdate && r.ActionMapping[canal.UpdateAction] != ScriptAction && !r.locatesByRow() &&
+		!r.Upsert && len(r.GetPipeline(canal.UpdateAction)) == 0
+}
+
+// rewritesUpdate returns whether the rule or a fan-out one indexes the whole doc for the update,
+// maps it to a script, whose params may be any columns, upserts it, sends it through a pipeline,
+// or locates the doc by the row.
+func (r *Rule) rewritesUpdate() bool {
+	for _, t := range r.targets() {
+		if !t.updatesPartially() {
+			return true
+		}
+	}
+	return false
+}
+
+// clone copies the rule of the config, the maps filled by prepare are copied too.
+func (r *Rule) clone() *Rule {
+	c := *r
+	if r.FieldMapping != nil {
+		c.FieldMapping = make(map[string]string, len(r.FieldMapping))
+		for k, v := range r.FieldMapping {
+			c.FieldMapping[k] = v
+		}
+	}
+	if r.ActionMapping != nil {
+		c.ActionMapping = make(map[string]string, len(r.ActionMapping))
+		for k, v := range r.ActionMapping {
+			c.ActionMapping[k] = v
+		}
+	}
+	return &c
+}
+
+// targets returns the rule and its fan-out rules.
+func (r *Rule) targets() []*Rule {
+	if len(r.fanout) == 0 {
+		return []*Rule{r}
+	}
+	return append([]*Rule{r}, r.fanout...)
+}
+
+// GetPipeline returns the pipeline for the MySQL action.
+func (r *Rule) GetPipeline(action string) string {
+	if pipeline, ok := r.ActionPipeline[action]; ok {
+		return pipeline
+	}
+	return r.Pipeline
+}
+
 // CheckFilter checkers whether the field needs to be filtered.
 func (r *Rule) CheckFilter(field string) bool {
 	if r.Filter == nil {
@@ -129,5 +862,24 @@ func (r *Rule) CheckWhere(field string, value interface{}) (bool, bool) {
 		return false, true
 	}
 	// 配置过该字段值，或者值相等，表示需要同步到ES
-	return true, !ok || reflect.DeepEqual(val, value)
+	return true, !ok || valueEqual(val, value)
+}
+
+// valueEqual is the same as reflect.DeepEqual, but it is much faster
+// for the scalar types produced by canal and TOML.
+func valueEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case nil, bool, string,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		// interface comparison checks both the type and the value,
+		// and it never panics with a comparable a
+		return a == b
+	case []byte:
+		y, ok := b.([]byte)
+		return ok && (x == nil) == (y == nil) && bytes.Equal(x, y)
+	default:
+		return reflect.DeepEqual(a, b)
+	}
 }
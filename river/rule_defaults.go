@@ -0,0 +1,123 @@
+package river
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RuleDefaults are the options inherited by all the rules which don't set them,
+// including the default rules of the source tables without a rule.
+type RuleDefaults struct {
+	// Prefix of the index of every rule, like "app-" for index app-users
+	IndexPrefix string `toml:"index_prefix"`
+
+	ActionMapping  map[string]string `toml:"action"`
+	Pipeline       string            `toml:"pipeline"`
+	ActionPipeline map[string]string `toml:"action_pipeline"`
+	IDSeparator    string            `toml:"id_separator"`
+
+	NullHandling        string `toml:"null_handling"`
+	InvalidDate         string `toml:"invalid_date"`
+	InvalidDateSentinel string `toml:"invalid_date_sentinel"`
+	TimeFormat          string `toml:"time_format"`
+	BitFormat           string `toml:"bit_format"`
+	TinyintFormat       string `toml:"tinyint_format"`
+	GeneratedColumns    string `toml:"generated_columns"`
+	UpdateMode          string `toml:"update_mode"`
+	NoopUpdate          string `toml:"noop_update"`
+	DeleteMode          string `toml:"delete_mode"`
+	PKChange            string `toml:"pk_change"`
+	MetaField           string `toml:"meta_field"`
+	FieldPreset         string `toml:"field_preset"`
+	MissingIndex        string `toml:"missing_index"`
+	Truncate            string `toml:"truncate"`
+
+	Cluster       string       `toml:"cluster"`
+	Priority      string       `toml:"priority"`
+	RateLimitDocs int64        `toml:"rate_limit_docs"`
+	BulkSize      int          `toml:"bulk_size"`
+	FlushBulkTime TomlDuration `toml:"flush_bulk_time"`
+}
+
+// applyRuleDefaults applies the rule defaults to the rules in config once.
+func (c *Config) applyRuleDefaults() {
+	for _, rule := range c.Rules {
+		c.RuleDefaults.apply(rule)
+	}
+}
+
+// apply sets the unset options of the rule, the action mappings are merged.
+func (d *RuleDefaults) apply(rule *Rule) *Rule {
+	if d == nil || rule.defaulted {
+		return rule
+	}
+	rule.defaulted = true
+
+	if len(d.IndexPrefix) > 0 {
+		// a wildcard table rule must have an index, it is checked later
+		if len(rule.Index) == 0 && regexp.QuoteMeta(rule.Table) == rule.Table {
+			rule.Index = strings.ToLower(rule.Table)
+		}
+		if len(rule.Index) > 0 {
+			rule.Index = d.IndexPrefix + rule.Index
+		}
+	}
+
+	if len(d.ActionMapping) > 0 && rule.ActionMapping == nil {
+		rule.ActionMapping = make(map[string]string, len(d.ActionMapping))
+	}
+	for action, esAction := range d.ActionMapping {
+		if _, ok := rule.ActionMapping[action]; !ok {
+			rule.ActionMapping[action] = esAction
+		}
+	}
+	if len(d.ActionPipeline) > 0 && rule.ActionPipeline == nil {
+		rule.ActionPipeline = make(map[string]string, len(d.ActionPipeline))
+	}
+	for action, pipeline := range d.ActionPipeline {
+		if _, ok := rule.ActionPipeline[action]; !ok {
+			rule.ActionPipeline[action] = pipeline
+		}
+	}
+
+	strs := []struct {
+		value *string
+		def   string
+	}{
+		{&rule.Pipeline, d.Pipeline},
+		{&rule.IDSeparator, d.IDSeparator},
+		{&rule.NullHandling, d.NullHandling},
+		{&rule.InvalidDate, d.InvalidDate},
+		{&rule.InvalidDateSentinel, d.InvalidDateSentinel},
+		{&rule.TimeFormat, d.TimeFormat},
+		{&rule.BitFormat, d.BitFormat},
+		{&rule.TinyintFormat, d.TinyintFormat},
+		{&rule.GeneratedColumns, d.GeneratedColumns},
+		{&rule.UpdateMode, d.UpdateMode},
+		{&rule.NoopUpdate, d.NoopUpdate},
+		{&rule.DeleteMode, d.DeleteMode},
+		{&rule.PKChange, d.PKChange},
+		{&rule.MetaField, d.MetaField},
+		{&rule.FieldPreset, d.FieldPreset},
+		{&rule.MissingIndex, d.MissingIndex},
+		{&rule.Truncate, d.Truncate},
+		{&rule.Cluster, d.Cluster},
+		{&rule.Priority, d.Priority},
+	}
+	for _, s := range strs {
+		if len(*s.value) == 0 {
+			*s.value = s.def
+		}
+	}
+
+	if rule.RateLimitDocs == 0 {
+		rule.RateLimitDocs = d.RateLimitDocs
+	}
+	if rule.BulkSize == 0 {
+		rule.BulkSize = d.BulkSize
+	}
+	if rule.FlushBulkTime.Duration == 0 {
+		rule.FlushBulkTime = d.FlushBulkTime
+	}
+	return rule
+}
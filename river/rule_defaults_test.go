@@ -0,0 +1,66 @@
+package river
+
+import (
+	"time"
+
+	"github.com/BurntSushi/toml"
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestRuleDefaults(c *C) {
+	str := `
+[rule_defaults]
+index_prefix = "app-"
+action = {delete = "update"}
+pipeline = "enrich"
+null_handling = "omit"
+flush_bulk_time = "10ms"
+
+[[rule]]
+schema = "test"
+table = "users"
+
+[[rule]]
+schema = "test"
+table = "orders"
+index = "orders"
+pipeline = ""
+null_handling = "null"
+action = {insert = "update"}
+
+[[rule]]
+schema = "test"
+table = "t_[0-9]{4}"
+`
+	var cfg Config
+	_, err := toml.Decode(str, &cfg)
+	c.Assert(err, IsNil)
+	cfg.applyRuleDefaults()
+	// once only
+	cfg.applyRuleDefaults()
+
+	users := cfg.Rules[0]
+	c.Assert(users.Index, Equals, "app-users")
+	c.Assert(users.Pipeline, Equals, "enrich")
+	c.Assert(users.NullHandling, Equals, NullHandlingOmit)
+	c.Assert(users.FlushBulkTime.Duration, Equals, 10*time.Millisecond)
+	c.Assert(users.prepare(), IsNil)
+	c.Assert(users.ActionMapping[canal.DeleteAction], Equals, elastic.ActionUpdate)
+	c.Assert(users.ActionMapping[canal.InsertAction], Equals, elastic.ActionIndex)
+
+	orders := cfg.Rules[1]
+	c.Assert(orders.Index, Equals, "app-orders")
+	// the empty pipeline in the rule is not distinguished from unset
+	c.Assert(orders.Pipeline, Equals, "enrich")
+	c.Assert(orders.NullHandling, Equals, NullHandlingNull)
+	c.Assert(orders.ActionMapping, DeepEquals, map[string]string{canal.InsertAction: elastic.ActionUpdate, canal.DeleteAction: elastic.ActionUpdate})
+
+	// the wildcard table rule must have an index
+	c.Assert(cfg.Rules[2].Index, Equals, "")
+
+	rule := cfg.RuleDefaults.apply(newDefaultRule("test", "Logs"))
+	c.Assert(rule.Index, Equals, "app-logs")
+	c.Assert((*RuleDefaults)(nil).apply(newDefaultRule("test", "t")).Index, Equals, "t")
+}
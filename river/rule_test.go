@@ -0,0 +1,193 @@
+package river
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestRuleBatch(c *C) {
+	bodies := make(chan string, 8)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer es.Close()
+
+	fast := &Rule{Schema: "test", Table: "fast", Index: "fast", FlushBulkTime: TomlDuration{10 * time.Millisecond}}
+	bulky := &Rule{Schema: "test", Table: "bulky", Index: "bulky", BulkSize: 2}
+	c.Assert(fast.prepare(), IsNil)
+	c.Assert(bulky.prepare(), IsNil)
+	c.Assert(fast.hasOwnBatch(), IsTrue)
+	c.Assert((&Rule{}).hasOwnBatch(), IsFalse)
+
+	cfg := &Config{BulkSize: 100, FlushBulkTime: TomlDuration{time.Hour}, Rules: []*Rule{fast, bulky}}
+	r := &River{c: cfg, st: &stat{}, limits: newRateLimits(0, 0), syncCh: make(chan interface{}, 16)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	r.wg.Add(1)
+	go r.syncLoop()
+	defer func() {
+		r.cancel()
+		r.wg.Wait()
+	}()
+
+	newReq := func(index string) *elastic.BulkRequest {
+		return &elastic.BulkRequest{Action: elastic.ActionIndex, Index: index, ID: "1", Data: map[string]interface{}{"a": 1}}
+	}
+	r.syncCh <- []*elastic.BulkRequest{newReq("normal")}
+	r.syncCh <- ruleRequests{rule: fast, reqs: []*elastic.BulkRequest{newReq("fast")}}
+	c.Assert(<-bodies, Matches, `(?s).*"fast".*`)
+
+	r.syncCh <- ruleRequests{rule: bulky, reqs: []*elastic.BulkRequest{newReq("bulky")}}
+	r.syncCh <- ruleRequests{rule: bulky, reqs: []*elastic.BulkRequest{newReq("bulky")}}
+	body := <-bodies
+	c.Assert(strings.Count(body, `"bulky"`), Equals, 2)
+
+	// the normal requests wait for the global flush_bulk_time
+	select {
+	case body = <-bodies:
+		c.Fatalf("unexpected bulk %s", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", BulkSize: -1}
+	c.Assert(rule.prepare(), NotNil)
+}
+
+func (s *unitTestSuite) TestSourceExclude(c *C) {
+	cfg := &Config{Sources: []SourceConfig{{Schema: "app", Tables: []string{"*"}, Exclude: []string{"migrations", "tmp_.*"}}}}
+	r := &River{c: cfg, wildRules: map[string]*Rule{ruleKey("app", "*"): {Schema: "app", Table: "*"}}}
+	var err error
+	r.excludeTableRegex, err = compileExcludes(cfg)
+	c.Assert(err, IsNil)
+
+	c.Assert(r.isIgnoredTable("app", "users"), IsFalse)
+	c.Assert(r.isIgnoredTable("APP", "Migrations"), IsTrue)
+	c.Assert(r.isIgnoredTable("app", "tmp_users"), IsTrue)
+	c.Assert(r.isIgnoredTable("app", "users_tmp_1"), IsFalse)
+	c.Assert(r.isIgnoredTable("other", "migrations"), IsFalse)
+
+	// the new tables are synced with the default rules
+	rule, err := r.matchWildcardRule("app", "Orders")
+	c.Assert(err, IsNil)
+	c.Assert(rule.Index, Equals, "orders")
+	rule, err = r.matchWildcardRule("app", "migrations")
+	c.Assert(err, IsNil)
+	c.Assert(rule, IsNil)
+
+	_, err = compileExcludes(&Config{Sources: []SourceConfig{{Schema: "app", Exclude: []string{"("}}}})
+	c.Assert(err, NotNil)
+}
+
+func (s *unitTestSuite) TestExcludeTables(c *C) {
+	cfg := &Config{ExcludeTables: []string{"app.sessions", "shop.tmp_[0-9]+", "log.*"}}
+	r := &River{c: cfg}
+	var err error
+	r.excludeTableRegex, err = compileExcludes(cfg)
+	c.Assert(err, IsNil)
+
+	c.Assert(r.isIgnoredTable("app", "sessions"), IsTrue)
+	c.Assert(r.isIgnoredTable("app", "sessions_2"), IsFalse)
+	c.Assert(r.isIgnoredTable("shop", "sessions"), IsFalse)
+	c.Assert(r.isIgnoredTable("shop", "TMP_12"), IsTrue)
+	c.Assert(r.isIgnoredTable("log", "access"), IsTrue)
+
+	for _, name := range []string{"sessions", ".sessions", "app.", "app.("} {
+		_, err = compileExcludes(&Config{ExcludeTables: []string{name}})
+		c.Assert(err, NotNil, Commentf("%s", name))
+	}
+}
+
+func (s *unitTestSuite) TestCopyField(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("created_at", "datetime", "", "")
+	ta.PKColumns = []int{0}
+
+	c.Assert((&Rule{Schema: "test", Table: "t", CopyField: map[string]string{"ts": ",timestamp"}}).prepare(), NotNil)
+
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta,
+		Filter:    []string{"id", "created_at"},
+		CopyField: map[string]string{"created_ts": "created_at,timestamp", "name_tags": "name,list"},
+		Where:     map[string]interface{}{"id": int32(1)}}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+	c.Assert(rule.fields, HasLen, 4)
+	c.Assert(rule.fields[2].esField, Equals, "created_at")
+	c.Assert(rule.fields[3].esField, Equals, "created_ts")
+
+	created := time.Date(2026, 10, 16, 8, 30, 0, 0, time.Local)
+	data := r.makeFieldData(rule, []interface{}{int32(1), "a,b", created.Format(mysql.TimeFormat)})
+	c.Assert(data, HasLen, 4)
+	c.Assert(data["id"], Equals, int32(1))
+	c.Assert(data["name_tags"], DeepEquals, []string{"a", "b"})
+	c.Assert(data["created_at"], Equals, created.Format(time.RFC3339))
+	c.Assert(data["created_ts"], Equals, created.Unix())
+	c.Assert(r.makeFieldData(rule, []interface{}{int32(2), "a,b", created.Format(mysql.TimeFormat)}), IsNil)
+
+	properties := r.makeMappingProperties(rule, ta.Columns)
+	c.Assert(properties["created_at"], DeepEquals, map[string]interface{}{"type": "date"})
+	c.Assert(properties["created_ts"], DeepEquals, map[string]interface{}{"type": "long"})
+	c.Assert(properties["name_tags"], DeepEquals, map[string]interface{}{"type": "keyword"})
+	c.Assert(properties["name"], IsNil)
+}
+
+func (s *unitTestSuite) TestValueMap(c *C) {
+	str := `
+[[rule]]
+schema = "test"
+table = "t"
+copy_field = {status_code = "status"}
+
+[rule.value_map.status]
+1 = "active"
+2 = "archived"
+
+[rule.value_map.kind]
+a = "apple"
+`
+	var cfg Config
+	_, err := toml.Decode(str, &cfg)
+	c.Assert(err, IsNil)
+	rule := cfg.Rules[0]
+	c.Assert(rule.ValueMap["status"], DeepEquals, map[string]string{"1": "active", "2": "archived"})
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("status", "tinyint(4)", "", "")
+	ta.AddColumn("kind", "varchar(8)", "", "")
+	ta.PKColumns = []int{0}
+	rule.TableInfo = ta
+	rule.Where = map[string]interface{}{"status": int8(1)}
+	c.Assert(rule.prepare(), IsNil)
+
+	r := &River{c: &Config{}, st: &stat{}}
+	r.setFieldMapping(rule)
+
+	// the where is checked with the value, and the copy keeps it
+	data := r.makeFieldData(rule, []interface{}{int32(1), int8(1), []byte("a")})
+	c.Assert(data, DeepEquals, map[string]interface{}{"id": int32(1), "status": "active", "status_code": int8(1), "kind": "apple"})
+	c.Assert(r.makeFieldData(rule, []interface{}{int32(1), int8(2), "a"}), IsNil)
+
+	// the values not in the map are kept
+	rule.Where = nil
+	data = r.makeFieldData(rule, []interface{}{int32(2), int8(3), nil})
+	c.Assert(data, DeepEquals, map[string]interface{}{"id": int32(2), "status": int8(3), "status_code": int8(3), "kind": nil})
+
+	properties := r.makeMappingProperties(rule, ta.Columns)
+	c.Assert(properties["status"], DeepEquals, map[string]interface{}{"type": "keyword"})
+	c.Assert(properties["status_code"], DeepEquals, map[string]interface{}{"type": "long"})
+}
@@ -0,0 +1,159 @@
+package river
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// ThrottleWindow is a time window of the throttle schedule, the rate limits
+// are replaced by the ones of the window in it.
+type ThrottleWindow struct {
+	// Days of week like ["mon", "tue"], all days if empty
+	Days []string `toml:"days"`
+	// Local time like "09:00", the window ends at the next day if end <= start
+	Start string `toml:"start"`
+	End   string `toml:"end"`
+
+	RateLimitDocs  int64 `toml:"rate_limit_docs"`
+	RateLimitBytes int64 `toml:"rate_limit_bytes"`
+
+	// Pause the dump in the window, the binlog is still synced
+	PauseDump bool `toml:"pause_dump"`
+
+	days  [7]bool
+	start int
+	end   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseClock parses "HH:MM" into the minutes of the day.
+func parseClock(s string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil ||
+		hour < 0 || hour > 24 || minute < 0 || minute > 59 || hour == 24 && minute > 0 {
+		return 0, errors.Errorf("invalid time %q, must be HH:MM", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func (w *ThrottleWindow) prepare() error {
+	var err error
+	if w.start, err = parseClock(w.Start); err != nil {
+		return errors.Trace(err)
+	}
+	if w.end, err = parseClock(w.End); err != nil {
+		return errors.Trace(err)
+	}
+
+	for i := range w.days {
+		w.days[i] = len(w.Days) == 0
+	}
+	for _, day := range w.Days {
+		d, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return errors.Errorf("invalid day %s", day)
+		}
+		w.days[d] = true
+	}
+	return nil
+}
+
+// contains checks whether the time is in the window, a window which ends at
+// the next day belongs to the day it starts.
+func (w *ThrottleWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+	if minute >= w.start {
+		return w.days[t.Weekday()]
+	}
+	yesterday := (t.Weekday() + 6) % 7
+	return w.days[yesterday] && minute < w.end
+}
+
+// activeWindow returns the index of the first window containing the time, -1 if none.
+func (r *River) activeWindow(t time.Time) int {
+	for i, w := range r.c.ThrottleSchedule {
+		if w.contains(t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyWindow sets the rate limits of the window, or the configured ones if none.
+func (r *River) applyWindow(index int) {
+	docs, size, pause := r.c.RateLimitDocs, r.c.RateLimitBytes, false
+	if index >= 0 {
+		w := r.c.ThrottleSchedule[index]
+		docs, size, pause = w.RateLimitDocs, w.RateLimitBytes, w.PauseDump
+		log.Infof("enter throttle window %s-%s, %d docs/s, %d bytes/s, pause dump %v", w.Start, w.End, docs, size, pause)
+	} else {
+		log.Infof("leave throttle windows, %d docs/s, %d bytes/s", docs, size)
+	}
+
+	r.limits.docs.SetRate(docs)
+	r.limits.bytes.SetRate(size)
+	r.dumpPaused.Set(pause)
+}
+
+// runThrottleSchedule applies the throttle windows when they are entered or left,
+// so the limits changed by the API are kept until the next change of windows.
+func (r *River) runThrottleSchedule() {
+	defer r.wg.Done()
+
+	current := r.activeWindow(time.Now())
+	if current >= 0 {
+		r.applyWindow(current)
+	}
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if index := r.activeWindow(time.Now()); index != current {
+				current = index
+				r.applyWindow(current)
+			}
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// waitDumpResumed blocks the dump while it is paused by the throttle schedule.
+func (r *River) waitDumpResumed() error {
+	r = r.root()
+	if !r.dumpPaused.Get() {
+		return nil
+	}
+
+	log.Infof("dump is paused by the throttle schedule")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for r.dumpPaused.Get() {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+	log.Infof("dump is resumed")
+	return nil
+}
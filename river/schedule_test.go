@@ -0,0 +1,31 @@
+package river
+
+import (
+	"time"
+
+	. "github.com/pingcap/check"
+)
+
+func (s *unitTestSuite) TestThrottleWindow(c *C) {
+	w := &ThrottleWindow{Days: []string{"mon", "fri"}, Start: "09:00", End: "18:00"}
+	c.Assert(w.prepare(), IsNil)
+	// 2026-10-16 is a Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.Local)
+	}
+	c.Assert(w.contains(at(16, 9, 0)), IsTrue)
+	c.Assert(w.contains(at(16, 17, 59)), IsTrue)
+	c.Assert(w.contains(at(16, 18, 0)), IsFalse)
+	c.Assert(w.contains(at(17, 10, 0)), IsFalse)
+
+	// the night window of Friday ends on Saturday
+	w = &ThrottleWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}
+	c.Assert(w.prepare(), IsNil)
+	c.Assert(w.contains(at(16, 23, 0)), IsTrue)
+	c.Assert(w.contains(at(17, 5, 59)), IsTrue)
+	c.Assert(w.contains(at(16, 5, 0)), IsFalse)
+	c.Assert(w.contains(at(17, 22, 0)), IsFalse)
+
+	c.Assert((&ThrottleWindow{Start: "9", End: "18:00"}).prepare(), NotNil)
+	c.Assert((&ThrottleWindow{Days: []string{"someday"}, Start: "09:00", End: "18:00"}).prepare(), NotNil)
+}
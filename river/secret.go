@@ -0,0 +1,204 @@
+package river
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const redacted = "******"
+
+// resolveSecrets reads the secrets from the *_file options, and resolves the secret values
+// like "$__env{NAME}" from the environment and "$__vault{path#field}" from Vault.
+func (c *Config) resolveSecrets() error {
+	var err error
+	if c.VaultToken, err = resolveSecret("vault_token", c.VaultToken, c.VaultTokenFile, nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	v := &vaultClient{addr: c.VaultAddr, token: c.VaultToken}
+	secrets := []struct {
+		name  string
+		value *string
+		file  string
+	}{
+		{"my_pass", &c.MyPassword, c.MyPasswordFile},
+		{"es_pass", &c.ESPassword, c.ESPasswordFile},
+		{"es_api_key", &c.ESAPIKey, c.ESAPIKeyFile},
+		{"es_secondary_pass", &c.ESSecondaryPassword, c.ESSecondaryPasswordFile},
+		{"kafka_rest_pass", &c.KafkaRestPassword, ""},
+		{"webhook_secret", &c.WebhookSecret, ""},
+		{"redis_pass", &c.RedisPassword, ""},
+		{"etcd_pass", &c.EtcdPassword, ""},
+	}
+	for _, s := range secrets {
+		if *s.value, err = resolveSecret(s.name, *s.value, s.file, v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for _, cc := range c.Clusters {
+		if cc.ESPassword, err = resolveSecret("cluster es_pass", cc.ESPassword, "", v); err != nil {
+			return errors.Trace(err)
+		}
+		if cc.ESAPIKey, err = resolveSecret("cluster es_api_key", cc.ESAPIKey, "", v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for _, u := range c.Upstreams {
+		if u.MyPassword, err = resolveSecret("upstream my_pass", u.MyPassword, "", v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for _, a := range c.StatAuth {
+		if a.Password, err = resolveSecret("stat_auth pass", a.Password, "", v); err != nil {
+			return errors.Trace(err)
+		}
+		if a.Token, err = resolveSecret("stat_auth token", a.Token, "", v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// resolveSecret never puts the secret into the error.
+func resolveSecret(name string, value string, file string, v *vaultClient) (string, error) {
+	if len(file) > 0 {
+		if len(value) > 0 {
+			return "", errors.Errorf("%s and %s_file can't be both set", name, name)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", errors.Annotatef(err, "read %s_file", name)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if ref, ok := secretRef(value, "$__env{"); ok {
+		secret, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", errors.Errorf("environment variable %s of %s is not set", ref, name)
+		}
+		return secret, nil
+	}
+
+	if ref, ok := secretRef(value, "$__vault{"); ok {
+		if v == nil {
+			return "", errors.Errorf("%s can't be read from Vault", name)
+		}
+		secret, err := v.read(ref)
+		return secret, errors.Annotatef(err, "read %s from Vault", name)
+	}
+
+	return value, nil
+}
+
+func secretRef(value string, prefix string) (string, bool) {
+	if strings.HasPrefix(value, prefix) && strings.HasSuffix(value, "}") {
+		return value[len(prefix) : len(value)-1], true
+	}
+	return "", false
+}
+
+// vaultClient reads the secrets from the KV secrets engine of Vault,
+// the address and token are from VAULT_ADDR and VAULT_TOKEN if not set.
+type vaultClient struct {
+	addr  string
+	token string
+}
+
+// read reads the field of the secret by "path#field", like "secret/data/river#es_pass".
+func (v *vaultClient) read(ref string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i <= 0 || i == len(ref)-1 {
+		return "", errors.Errorf("invalid Vault secret %s, must be path#field", ref)
+	}
+	path, field := ref[:i], ref[i+1:]
+
+	addr, token := v.addr, v.token
+	if len(addr) == 0 {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if len(token) == 0 {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if len(addr) == 0 || len(token) == 0 {
+		return "", errors.Errorf("vault_addr and vault_token must be set")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("read Vault secret %s error: %s", path, resp.Status)
+	}
+
+	var ret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	data := ret.Data
+	// KV version 2 has the secret in data.data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok = data["metadata"]; ok {
+			data = inner
+		}
+	}
+	secret, ok := data[field].(string)
+	if !ok {
+		return "", errors.Errorf("field %s not found in Vault secret %s", field, path)
+	}
+	return secret, nil
+}
+
+// Redacted returns a copy of the config with the secrets masked, for logging and the API.
+func (c *Config) Redacted() *Config {
+	rc := *c
+	secrets := []*string{&rc.MyPassword, &rc.ESPassword, &rc.ESAPIKey, &rc.ESSecondaryPassword, &rc.VaultToken, &rc.KafkaRestPassword,
+		&rc.WebhookSecret, &rc.RedisPassword, &rc.EtcdPassword}
+
+	rc.StatAuth = make([]*StatAuth, 0, len(c.StatAuth))
+	for _, a := range c.StatAuth {
+		ra := *a
+		rc.StatAuth = append(rc.StatAuth, &ra)
+		secrets = append(secrets, &ra.Password, &ra.Token)
+	}
+
+	rc.Clusters = make([]*ClusterConfig, 0, len(c.Clusters))
+	for _, cc := range c.Clusters {
+		rcc := *cc
+		rc.Clusters = append(rc.Clusters, &rcc)
+		secrets = append(secrets, &rcc.ESPassword, &rcc.ESAPIKey)
+	}
+
+	rc.Upstreams = make([]*UpstreamConfig, 0, len(c.Upstreams))
+	for _, u := range c.Upstreams {
+		ru := *u
+		rc.Upstreams = append(rc.Upstreams, &ru)
+		secrets = append(secrets, &ru.MyPassword)
+	}
+
+	for _, s := range secrets {
+		if len(*s) > 0 {
+			*s = redacted
+		}
+	}
+	return &rc
+}
@@ -0,0 +1,55 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/pingcap/check"
+)
+
+func (s *unitTestSuite) TestResolveSecrets(c *C) {
+	f, err := ioutil.TempFile("", "river_secret")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString("file-secret\n")
+	f.Close()
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" || r.URL.Path != "/v1/secret/data/river" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"es_pass": "vault-secret"}, "metadata": {}}}`))
+	}))
+	defer vault.Close()
+
+	os.Setenv("RIVER_TEST_SECRET", "env-secret")
+	defer os.Unsetenv("RIVER_TEST_SECRET")
+
+	cfg := &Config{
+		MyPasswordFile:      f.Name(),
+		ESPassword:          "$__vault{secret/data/river#es_pass}",
+		ESAPIKey:            "$__env{RIVER_TEST_SECRET}",
+		ESSecondaryPassword: "plain",
+		VaultAddr:           vault.URL,
+		VaultToken:          "token",
+	}
+	c.Assert(cfg.resolveSecrets(), IsNil)
+	c.Assert(cfg.MyPassword, Equals, "file-secret")
+	c.Assert(cfg.ESPassword, Equals, "vault-secret")
+	c.Assert(cfg.ESAPIKey, Equals, "env-secret")
+	c.Assert(cfg.ESSecondaryPassword, Equals, "plain")
+
+	rc := cfg.Redacted()
+	c.Assert(rc.MyPassword, Equals, redacted)
+	c.Assert(rc.VaultToken, Equals, redacted)
+	c.Assert(cfg.MyPassword, Equals, "file-secret")
+
+	cfg = &Config{ESPassword: "$__vault{secret/data/river#es_pass}", VaultAddr: vault.URL, VaultToken: "bad"}
+	err = cfg.resolveSecrets()
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "bad"), IsFalse)
+}
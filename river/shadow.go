@@ -0,0 +1,235 @@
+package river
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// SinkShadow fetches the current docs from ES and logs the diffs against the docs
+// the river would write, nothing is written to ES.
+const SinkShadow = "shadow"
+
+// shadowSink compares the docs of the bulk requests with the current ones in ES, it is
+// used to check the rules before taking over the indices maintained by another tool.
+type shadowSink struct {
+	r *River
+}
+
+func newShadowSink(r *River) *shadowSink {
+	return &shadowSink{r: r}
+}
+
+// shadowDoc is a doc of the requests in a bulk, its requests are applied in order
+// to the ES doc to make the doc the river would write.
+type shadowDoc struct {
+	reqs []*elastic.BulkRequest
+
+	found  bool
+	source map[string]interface{}
+}
+
+// shadowFieldDiff is a field of the doc changed by the river.
+type shadowFieldDiff struct {
+	ES    interface{} `json:"es"`
+	River interface{} `json:"river"`
+}
+
+// shadowDiff is the diff of a doc logged in the shadow mode, the fields added, removed
+// and changed by the river are compared at the top level.
+type shadowDiff struct {
+	Index   string                     `json:"index"`
+	Type    string                     `json:"type,omitempty"`
+	ID      string                     `json:"id"`
+	Actions []string                   `json:"actions"`
+	Found   bool                       `json:"found"`
+	Deleted bool                       `json:"deleted,omitempty"`
+	Added   map[string]interface{}     `json:"added,omitempty"`
+	Removed map[string]interface{}     `json:"removed,omitempty"`
+	Changed map[string]shadowFieldDiff `json:"changed,omitempty"`
+}
+
+func (s *shadowSink) write(reqs []*elastic.BulkRequest) error {
+	docs := make(map[docKey]*shadowDoc, len(reqs))
+	// the docs in the order of their first requests
+	ordered := make([]*shadowDoc, 0, len(reqs))
+	// the docs to fetch by cluster
+	fetches := make(map[string][]*shadowDoc)
+	for _, req := range reqs {
+		if len(req.ID) == 0 {
+			// the ids are generated by ES, every request is a new doc
+			ordered = append(ordered, &shadowDoc{reqs: []*elastic.BulkRequest{req}})
+			continue
+		}
+		key := docKey{req.Cluster, req.Index, req.Type, req.ID, req.Parent, req.Routing}
+		doc, ok := docs[key]
+		if !ok {
+			doc = new(shadowDoc)
+			docs[key] = doc
+			ordered = append(ordered, doc)
+			fetches[req.Cluster] = append(fetches[req.Cluster], doc)
+		}
+		doc.reqs = append(doc.reqs, req)
+	}
+
+	for cluster, fetched := range fetches {
+		items := make([]*elastic.BulkRequest, 0, len(fetched))
+		for _, doc := range fetched {
+			items = append(items, doc.reqs[0])
+		}
+		resp, err := s.r.esClient(cluster).MGet(items)
+		if err != nil {
+			return errors.Annotatef(err, "fetch %d docs for shadow diff", len(items))
+		}
+		for i, doc := range fetched {
+			doc.found = resp[i].Found
+			doc.source = resp[i].Source
+		}
+	}
+
+	for _, doc := range ordered {
+		diff, err := doc.diff()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		s.r.st.ShadowDocNum.Add(1)
+		if diff == nil {
+			continue
+		}
+		s.r.st.ShadowDiffNum.Add(1)
+		data, err := json.Marshal(diff)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		log.Warnf("shadow diff %s", data)
+	}
+	return nil
+}
+
+// Close implements bulkSink, nothing to close.
+func (s *shadowSink) Close() error {
+	return nil
+}
+
+// diff applies the requests to the ES doc and compares the result with it, nil if the
+// river writes the same doc, or its state can't be known, like with the scripted updates.
+func (d *shadowDoc) diff() (*shadowDiff, error) {
+	exists := d.found
+	var state map[string]interface{}
+	if d.found {
+		state = copyShadowDoc(d.source)
+	}
+
+	actions := make([]string, 0, len(d.reqs))
+	for _, req := range d.reqs {
+		actions = append(actions, req.Action)
+		data, err := normalizeShadowDoc(req.Data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		switch {
+		case req.Action == elastic.ActionDelete:
+			exists, state = false, nil
+		case req.Action == elastic.ActionCreate && exists:
+			// the create fails with the conflict
+		case req.Action == elastic.ActionIndex || req.Action == elastic.ActionCreate:
+			exists, state = true, data
+		case !exists:
+			// the update fails without upsert, as the doc is missing
+			if req.Upsert {
+				exists, state = true, data
+			}
+		case req.Script != nil:
+			log.Debugf("skip shadow diff of doc %s of index %s, it is updated by script", req.ID, req.Index)
+			return nil, nil
+		default:
+			mergeShadowDoc(state, data)
+		}
+	}
+
+	req := d.reqs[0]
+	diff := &shadowDiff{Index: req.Index, Type: req.Type, ID: req.ID, Actions: actions, Found: d.found}
+	switch {
+	case !d.found && !exists:
+		return nil, nil
+	case !exists:
+		diff.Deleted = true
+		return diff, nil
+	case !d.found:
+		diff.Added = state
+		return diff, nil
+	}
+
+	for field, value := range state {
+		old, ok := d.source[field]
+		if !ok {
+			if diff.Added == nil {
+				diff.Added = make(map[string]interface{})
+			}
+			diff.Added[field] = value
+		} else if !reflect.DeepEqual(old, value) {
+			if diff.Changed == nil {
+				diff.Changed = make(map[string]shadowFieldDiff)
+			}
+			diff.Changed[field] = shadowFieldDiff{ES: old, River: value}
+		}
+	}
+	for field, value := range d.source {
+		if _, ok := state[field]; !ok {
+			if diff.Removed == nil {
+				diff.Removed = make(map[string]interface{})
+			}
+			diff.Removed[field] = value
+		}
+	}
+	if diff.Added == nil && diff.Removed == nil && diff.Changed == nil {
+		return nil, nil
+	}
+	return diff, nil
+}
+
+// normalizeShadowDoc encodes the doc and decodes it again, so its values are compared
+// with the ones of the ES doc in the same JSON types.
+func normalizeShadowDoc(data map[string]interface{}) (map[string]interface{}, error) {
+	if data == nil {
+		return map[string]interface{}{}, nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return doc, nil
+}
+
+func copyShadowDoc(doc map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		if m, ok := v.(map[string]interface{}); ok {
+			v = copyShadowDoc(m)
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// mergeShadowDoc merges the partial doc into the doc like the update of ES,
+// the objects are merged recursively.
+func mergeShadowDoc(doc map[string]interface{}, partial map[string]interface{}) {
+	for k, v := range partial {
+		if m, ok := v.(map[string]interface{}); ok {
+			if old, ok := doc[k].(map[string]interface{}); ok {
+				mergeShadowDoc(old, m)
+				continue
+			}
+		}
+		doc[k] = v
+	}
+}
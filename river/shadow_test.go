@@ -0,0 +1,75 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestShadowSink(c *C) {
+	var bodies []string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.URL.Path, Equals, "/_mget")
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		w.Write([]byte(`{"docs":[` +
+			`{"_index":"t","_id":"1","found":true,"_source":{"id":1,"name":"a","meta":{"a":1,"b":2},"old":true}},` +
+			`{"_index":"t","_id":"2","found":true,"_source":{"id":2,"name":"b"}},` +
+			`{"_index":"t","_id":"3","found":false},` +
+			`{"_index":"t","_id":"4","found":true,"_source":{"id":4}},` +
+			`{"_index":"t","_id":"5","found":true,"_source":{"id":5}}]}`))
+	}))
+	defer es.Close()
+
+	r := &River{c: &Config{Sink: SinkShadow}, st: &stat{}}
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	sink := newShadowSink(r)
+
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"id": int64(1), "name": "a", "meta": map[string]interface{}{"a": 1, "b": 2}}},
+		{Action: elastic.ActionUpdate, Index: "t", ID: "2", Routing: "r", Data: map[string]interface{}{"name": "b"}},
+		{Action: elastic.ActionUpdate, Index: "t", ID: "3", Data: map[string]interface{}{"name": "c"}, Upsert: true},
+		{Action: elastic.ActionDelete, Index: "t", ID: "4"},
+		{Action: elastic.ActionUpdate, Index: "t", ID: "5", Script: map[string]interface{}{"source": "ctx._source.n++"}},
+		// the requests of the same doc are applied in order
+		{Action: elastic.ActionUpdate, Index: "t", ID: "2", Routing: "r", Data: map[string]interface{}{"name": "c"}},
+	}
+	c.Assert(sink.write(reqs), IsNil)
+	c.Assert(bodies, HasLen, 1)
+	c.Assert(bodies[0], Equals, `{"docs":[{"_id":"1","_index":"t"},{"_id":"2","_index":"t","routing":"r"},`+
+		`{"_id":"3","_index":"t"},{"_id":"4","_index":"t"},{"_id":"5","_index":"t"}]}`)
+	c.Assert(r.st.ShadowDocNum.Get(), Equals, int64(5))
+	c.Assert(r.st.ShadowDiffNum.Get(), Equals, int64(4))
+
+	docs := []*shadowDoc{
+		{reqs: reqs[:1], found: true, source: map[string]interface{}{"id": float64(1), "name": "a",
+			"meta": map[string]interface{}{"a": float64(1), "b": float64(2)}, "old": true}},
+		{reqs: []*elastic.BulkRequest{reqs[1], reqs[5]}, found: true, source: map[string]interface{}{"id": float64(2), "name": "b"}},
+		{reqs: reqs[2:3]},
+		{reqs: reqs[3:4], found: true, source: map[string]interface{}{"id": float64(4)}},
+		{reqs: reqs[4:5], found: true, source: map[string]interface{}{"id": float64(5)}},
+	}
+	diffs := []*shadowDiff{
+		{Index: "t", ID: "1", Actions: []string{"index"}, Found: true, Removed: map[string]interface{}{"old": true}},
+		{Index: "t", ID: "2", Actions: []string{"update", "update"}, Found: true,
+			Changed: map[string]shadowFieldDiff{"name": {ES: "b", River: "c"}}},
+		{Index: "t", ID: "3", Actions: []string{"update"}, Added: map[string]interface{}{"name": "c"}},
+		{Index: "t", ID: "4", Actions: []string{"delete"}, Found: true, Deleted: true},
+		// the scripted updates are not diffed
+		nil,
+	}
+	for i, doc := range docs {
+		diff, err := doc.diff()
+		c.Assert(err, IsNil)
+		c.Assert(diff, DeepEquals, diffs[i], Commentf("doc %d", i))
+	}
+
+	// the partial docs are merged recursively
+	doc := map[string]interface{}{"meta": map[string]interface{}{"a": 1, "b": 2}}
+	mergeShadowDoc(doc, map[string]interface{}{"meta": map[string]interface{}{"b": 3}, "id": 1})
+	c.Assert(doc, DeepEquals, map[string]interface{}{"meta": map[string]interface{}{"a": 1, "b": 3}, "id": 1})
+}
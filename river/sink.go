@@ -0,0 +1,115 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// Where the bulk requests are sent.
+const (
+	SinkES = "es"
+	// write the bulk bodies to the rotating NDJSON files in sink_dir
+	SinkFile = "file"
+)
+
+// bulkSink is where the bulk requests are sent instead of ES.
+type bulkSink interface {
+	write(reqs []*elastic.BulkRequest) error
+	Close() error
+}
+
+const defaultSinkFileSize = 64 * 1024 * 1024
+
+// fileSink writes the bulk bodies to the files, every file is a valid
+// body of the bulk API, so it can be replayed into ES later.
+type fileSink struct {
+	dir     string
+	maxSize int64
+	// prefix of the file names, default is bulk
+	prefix string
+
+	f    *os.File
+	size int64
+	seq  int
+	buf  bytes.Buffer
+}
+
+func newFileSink(c *Config) (*fileSink, error) {
+	dir := c.SinkDir
+	if len(dir) == 0 {
+		dir = path.Join(c.DataDir, "sink")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s := &fileSink{dir: dir, maxSize: c.SinkFileSize}
+	if s.maxSize <= 0 {
+		s.maxSize = defaultSinkFileSize
+	}
+	return s, nil
+}
+
+// rotate closes the current file and opens a new one.
+func (s *fileSink) rotate() error {
+	if err := s.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	prefix := s.prefix
+	if len(prefix) == 0 {
+		prefix = "bulk"
+	}
+	s.seq++
+	name := path.Join(s.dir, fmt.Sprintf("%s-%s-%06d.ndjson", prefix, time.Now().Format("20060102T150405"), s.seq))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Infof("write %s requests to %s", prefix, name)
+	s.f = f
+	s.size = 0
+	return nil
+}
+
+// write writes the requests as a bulk body, a body is never split into two files.
+func (s *fileSink) write(reqs []*elastic.BulkRequest) error {
+	s.buf.Reset()
+	if err := elastic.EncodeBulk(&s.buf, reqs); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.writeBody(s.buf.Bytes()))
+}
+
+// writeBody writes the lines to the current file, they are never split into two files.
+func (s *fileSink) writeBody(body []byte) error {
+	if s.f == nil || s.size > 0 && s.size+int64(len(body)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	n, err := s.f.Write(body)
+	s.size += int64(n)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// the position is saved after the flush
+	return errors.Trace(s.f.Sync())
+}
+
+func (s *fileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return errors.Trace(err)
+}
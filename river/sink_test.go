@@ -0,0 +1,36 @@
+package river
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/pingcap/check"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestFileSink(c *C) {
+	dir, err := ioutil.TempDir("", "river_sink")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	sink, err := newFileSink(&Config{SinkDir: dir, SinkFileSize: 100})
+	c.Assert(err, IsNil)
+
+	req := &elastic.BulkRequest{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"name": "a"}}
+	body := "{\"index\":{\"_id\":\"1\",\"_index\":\"t\"}}\n{\"name\":\"a\"}\n"
+	c.Assert(sink.write([]*elastic.BulkRequest{req}), IsNil)
+	c.Assert(sink.write([]*elastic.BulkRequest{req}), IsNil)
+	// the third body exceeds the file size
+	c.Assert(sink.write([]*elastic.BulkRequest{req}), IsNil)
+	c.Assert(sink.Close(), IsNil)
+
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+	data, err := ioutil.ReadFile(dir + "/" + files[0].Name())
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, body+body)
+	data, err = ioutil.ReadFile(dir + "/" + files[1].Name())
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, body)
+}
@@ -0,0 +1,85 @@
+package river
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+// SkipEvents skips the next n row events of the synced tables, to jump over a
+// poison event which fails the sync every time.
+func (r *River) SkipEvents(n int64) int64 {
+	return r.skipEvents.Add(n)
+}
+
+// takeSkip takes one of the events to skip, false if none.
+func (r *River) takeSkip() bool {
+	r = r.root()
+	for {
+		n := r.skipEvents.Get()
+		if n <= 0 {
+			return false
+		}
+		if r.skipEvents.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
+
+// skipEvent skips the rows event if asked by POST /skip or -skip_events, and
+// records it in the audit log.
+func (h *eventHandler) skipEvent(rule *Rule, e *canal.RowsEvent) (bool, error) {
+	if !h.r.takeSkip() {
+		return false, nil
+	}
+
+	record := h.newAuditRecord(rule, AuditReasonSkip)
+	record.Type = rule.Type
+	record.Action = e.Action
+	record.Rows = len(e.Rows)
+	if e.Header != nil {
+		record.BinlogPos = e.Header.LogPos
+	}
+	log.Warnf("skip %s event of %s.%s with %d rows at (%s, %d)", e.Action, rule.Schema, rule.Table,
+		len(e.Rows), record.BinlogFile, record.BinlogPos)
+	h.r.st.addError("skip %s event of %s.%s at (%s, %d)", e.Action, rule.Schema, rule.Table,
+		record.BinlogFile, record.BinlogPos)
+
+	if h.r.audit == nil {
+		return true, nil
+	}
+	reqs, err := h.r.audit.write([]*auditRecord{record})
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if len(reqs) > 0 {
+		h.r.syncCh <- reqs
+	}
+	return true, nil
+}
+
+// serveSkip skips the next row events with POST, the count is 1 by default.
+func (s *stat) serveSkip(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	count := int64(1)
+	if v := r.FormValue("count"); len(v) > 0 {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("invalid count %s\n", v)))
+			return
+		}
+		count = n
+	}
+	log.Warnf("skip %d events by %s", count, r.RemoteAddr)
+	n := s.r.SkipEvents(count)
+	w.Write([]byte(fmt.Sprintf("skip next %d events\n", n)))
+}
@@ -0,0 +1,67 @@
+package river
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestSkipEvents(c *C) {
+	dir, err := ioutil.TempDir("", "skip")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", Type: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+
+	cfg := &Config{AuditFile: filepath.Join(dir, "audit.log"), AuditIndex: "river-audit"}
+	r := &River{c: cfg, ctx: context.Background(), st: &stat{}, syncCh: make(chan interface{}, 4),
+		rules: map[string]*Rule{ruleKey("test", "t"): rule}, limits: newRateLimits(0, 0), replayPos: mysql.Position{Name: "mysql-bin.000001"}}
+	r.st.r = r
+	r.audit, err = newAuditLog(cfg)
+	c.Assert(err, IsNil)
+	defer r.audit.Close()
+	h := &eventHandler{r: r}
+
+	w := httptest.NewRecorder()
+	r.st.serveSkip(w, httptest.NewRequest("POST", "/skip?count=x", nil))
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	w = httptest.NewRecorder()
+	r.st.serveSkip(w, httptest.NewRequest("POST", "/skip", nil))
+	c.Assert(w.Body.String(), Equals, "skip next 1 events\n")
+
+	e := &canal.RowsEvent{Action: canal.InsertAction, Table: ta, Rows: [][]interface{}{{int32(1)}}, Header: &replication.EventHeader{LogPos: 120}}
+	c.Assert(h.OnRow(e), IsNil)
+	c.Assert(r.skipEvents.Get(), Equals, int64(0))
+	c.Assert(r.takeSkip(), IsFalse)
+
+	// only the audit record is sent
+	c.Assert(r.syncCh, HasLen, 1)
+	reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Index, Equals, "river-audit")
+	c.Assert(reqs[0].Data["reason"], Equals, AuditReasonSkip)
+	c.Assert(reqs[0].Data["action"], Equals, canal.InsertAction)
+	c.Assert(reqs[0].Data["binlog_pos"], Equals, float64(120))
+	data, err := ioutil.ReadFile(cfg.AuditFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, `(?s).*"reason":"skip".*"rows":1.*`)
+
+	// the next one is synced
+	c.Assert(h.OnRow(e), IsNil)
+	reqs = (<-r.syncCh).([]*elastic.BulkRequest)
+	c.Assert(reqs[0].Index, Equals, "t")
+}
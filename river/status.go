@@ -2,11 +2,19 @@ package river
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/juju/errors"
 	"github.com/siddontang/go-log/log"
 	"github.com/siddontang/go/sync2"
 )
@@ -19,6 +27,65 @@ type stat struct {
 	InsertNum sync2.AtomicInt64
 	UpdateNum sync2.AtomicInt64
 	DeleteNum sync2.AtomicInt64
+
+	// updates skipped by noop_update
+	NoopUpdateNum sync2.AtomicInt64
+
+	InvalidDateNum sync2.AtomicInt64
+
+	// row events out of the time window of ignore_before_ts and ignore_after_ts
+	TimeWindowSkipNum sync2.AtomicInt64
+
+	// bulk items failed with 4xx and 5xx, and retried with 429 and 503
+	BulkClientErrorNum sync2.AtomicInt64
+	BulkServerErrorNum sync2.AtomicInt64
+	BulkRetryNum       sync2.AtomicInt64
+
+	// docs failed to write to the secondary cluster
+	SecondaryErrorNum sync2.AtomicInt64
+
+	// doc operations published to Kafka
+	KafkaMessageNum sync2.AtomicInt64
+
+	// doc operations posted to the webhooks, and the retried posts
+	WebhookNum      sync2.AtomicInt64
+	WebhookRetryNum sync2.AtomicInt64
+	// cache keys deleted in Redis
+	RedisKeyNum sync2.AtomicInt64
+
+	// string fields truncated or dropped with field_limit, and the docs written to the dlq
+	FieldTruncateNum sync2.AtomicInt64
+	FieldDropNum     sync2.AtomicInt64
+	DeadLetterNum    sync2.AtomicInt64
+	// docs sent again without the field rejected by the mapping
+	MappingConflictNum sync2.AtomicInt64
+	// docs compared with ES by the shadow sink, and the ones differing
+	ShadowDocNum  sync2.AtomicInt64
+	ShadowDiffNum sync2.AtomicInt64
+	// docs verified with verify_interval, and the missing or different ones
+	VerifyDocNum     sync2.AtomicInt64
+	VerifyDivergeNum sync2.AtomicInt64
+
+	// bulks sent by the workers with max_inflight_bulks but not done
+	InflightBulkNum sync2.AtomicInt64
+	// requests in the sync loop not sent yet
+	PendingReqNum sync2.AtomicInt64
+	// the last time a bulk is done in ES, in nanoseconds
+	LastBulkTime sync2.AtomicInt64
+
+	// the estimated bytes of the requests buffered and in flight with max_buffer_size,
+	// and the times they are flushed or waited for as they exceed it
+	BufferedBytes  sync2.AtomicInt64
+	BufferFlushNum sync2.AtomicInt64
+	BufferWaitNum  sync2.AtomicInt64
+
+	Binlog binlogStat
+
+	dash dashboardStat
+
+	// the lanes of the rules with isolate
+	isolatedMu    sync.Mutex
+	isolatedLanes []*isolatedLane
 }
 
 func (s *stat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -42,27 +109,225 @@ func (s *stat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	buf.WriteString(fmt.Sprintf("insert_num:%d\n", s.InsertNum.Get()))
 	buf.WriteString(fmt.Sprintf("update_num:%d\n", s.UpdateNum.Get()))
 	buf.WriteString(fmt.Sprintf("delete_num:%d\n", s.DeleteNum.Get()))
+	buf.WriteString(fmt.Sprintf("noop_update_num:%d\n", s.NoopUpdateNum.Get()))
+	buf.WriteString(fmt.Sprintf("invalid_date_num:%d\n", s.InvalidDateNum.Get()))
+	buf.WriteString(fmt.Sprintf("bulk_client_error_num:%d\n", s.BulkClientErrorNum.Get()))
+	buf.WriteString(fmt.Sprintf("bulk_server_error_num:%d\n", s.BulkServerErrorNum.Get()))
+	buf.WriteString(fmt.Sprintf("bulk_retry_num:%d\n", s.BulkRetryNum.Get()))
+	buf.WriteString(fmt.Sprintf("inflight_bulk_num:%d\n", s.InflightBulkNum.Get()))
+	buf.WriteString(fmt.Sprintf("webhook_num:%d\n", s.WebhookNum.Get()))
+	buf.WriteString(fmt.Sprintf("webhook_retry_num:%d\n", s.WebhookRetryNum.Get()))
+	buf.WriteString(fmt.Sprintf("redis_key_num:%d\n", s.RedisKeyNum.Get()))
+	buf.WriteString(fmt.Sprintf("field_truncate_num:%d\n", s.FieldTruncateNum.Get()))
+	buf.WriteString(fmt.Sprintf("field_drop_num:%d\n", s.FieldDropNum.Get()))
+	buf.WriteString(fmt.Sprintf("dead_letter_num:%d\n", s.DeadLetterNum.Get()))
+	buf.WriteString(fmt.Sprintf("mapping_conflict_num:%d\n", s.MappingConflictNum.Get()))
+	buf.WriteString(fmt.Sprintf("buffered_bytes:%d\n", s.BufferedBytes.Get()))
+	buf.WriteString(fmt.Sprintf("buffer_flush_num:%d\n", s.BufferFlushNum.Get()))
+	buf.WriteString(fmt.Sprintf("buffer_wait_num:%d\n", s.BufferWaitNum.Get()))
+	buf.WriteString(fmt.Sprintf("skip_events:%d\n", s.r.skipEvents.Get()))
+	buf.WriteString(fmt.Sprintf("time_window_skip_num:%d\n", s.TimeWindowSkipNum.Get()))
+	eventRate, rowRate, byteRate := s.Binlog.Rates()
+	buf.WriteString(fmt.Sprintf("binlog_events_per_second:%.1f\n", eventRate))
+	buf.WriteString(fmt.Sprintf("binlog_rows_per_second:%.1f\n", rowRate))
+	buf.WriteString(fmt.Sprintf("binlog_bytes_per_second:%.1f\n", byteRate))
+	buf.WriteString(fmt.Sprintf("binlog_transaction_rows_max:%d\n", s.Binlog.TxnRows.data().Max))
+	if s.r.secondaryES != nil {
+		buf.WriteString(fmt.Sprintf("secondary_error_num:%d\n", s.SecondaryErrorNum.Get()))
+	}
+	if s.r.c.Sink == SinkShadow {
+		buf.WriteString(fmt.Sprintf("shadow_doc_num:%d\n", s.ShadowDocNum.Get()))
+		buf.WriteString(fmt.Sprintf("shadow_diff_num:%d\n", s.ShadowDiffNum.Get()))
+	}
+	if s.r.c.VerifyInterval.Duration > 0 {
+		buf.WriteString(fmt.Sprintf("verify_doc_num:%d\n", s.VerifyDocNum.Get()))
+		buf.WriteString(fmt.Sprintf("verify_diverge_num:%d\n", s.VerifyDivergeNum.Get()))
+	}
+	if s.r.kafka != nil {
+		buf.WriteString(fmt.Sprintf("kafka_message_num:%d\n", s.KafkaMessageNum.Get()))
+	}
+	if s.r.queue != nil {
+		buf.WriteString(fmt.Sprintf("queue_size:%d\n", s.r.queue.Size()))
+	}
+	if s.r.coord != nil {
+		buf.WriteString(fmt.Sprintf("cluster_members:%s\n", strings.Join(s.r.coord.Members(), ",")))
+	}
+	if f := s.r.es.Fault; f != nil {
+		buf.WriteString(fmt.Sprintf("fault_error_num:%d\n", f.ErrorNum.Get()))
+		buf.WriteString(fmt.Sprintf("fault_fail_num:%d\n", f.FailNum.Get()))
+		buf.WriteString(fmt.Sprintf("fault_delay_num:%d\n", f.DelayNum.Get()))
+		buf.WriteString(fmt.Sprintf("fault_reject_num:%d\n", f.RejectNum.Get()))
+	}
+
+	if s.r.hb != nil {
+		buf.WriteString(fmt.Sprintf("heartbeat_lag:%s\n", s.r.hb.Lag()))
+	}
+	for _, l := range s.isolatedStatus() {
+		buf.WriteString(fmt.Sprintf("isolated_rule:%s pending:%d inflight_seconds:%.1f last_bulk_seconds:%.1f\n",
+			l.name, l.pending.Get(), l.inflightSeconds(), time.Duration(l.lastBulkTime.Get()).Seconds()))
+	}
+
+	w.Write(buf.Bytes())
+}
+
+// serveRateLimit shows the rate limits, or changes them with POST like
+// "docs=1000&bytes=10485760" for the global limits and "schema=test&table=t&docs=100"
+// for the table, 0 means no limit.
+func (s *stat) serveRateLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := s.setRateLimit(r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	limits := s.r.limits
+	buf.WriteString(fmt.Sprintf("docs:%d\n", limits.docs.Rate()))
+	buf.WriteString(fmt.Sprintf("bytes:%d\n", limits.bytes.Rate()))
+
+	rates := limits.tableRates()
+	keys := make([]string, 0, len(rates))
+	for key := range rates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteString(fmt.Sprintf("table %s docs:%d\n", key, rates[key]))
+	}
 
 	w.Write(buf.Bytes())
 }
 
+func (s *stat) setRateLimit(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	parse := func(name string) (int64, bool, error) {
+		v := r.Form.Get(name)
+		if len(v) == 0 {
+			return 0, false, nil
+		}
+		rate, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || rate < 0 {
+			return 0, false, errors.Errorf("invalid %s %s", name, v)
+		}
+		return rate, true, nil
+	}
+
+	docs, hasDocs, err := parse("docs")
+	if err != nil {
+		return err
+	}
+	size, hasSize, err := parse("bytes")
+	if err != nil {
+		return err
+	}
+
+	schema, table := r.Form.Get("schema"), r.Form.Get("table")
+	if len(schema) > 0 || len(table) > 0 {
+		if len(schema) == 0 || len(table) == 0 || !hasDocs || hasSize {
+			return errors.Errorf("schema, table and docs must be set for the table limit")
+		}
+		log.Infof("set rate limit of %s.%s to %d docs/s", schema, table, docs)
+		s.r.limits.setTable(schema, table, docs)
+		return nil
+	}
+
+	if hasDocs {
+		log.Infof("set rate limit to %d docs/s", docs)
+		s.r.limits.docs.SetRate(docs)
+	}
+	if hasSize {
+		log.Infof("set rate limit to %d bytes/s", size)
+		s.r.limits.bytes.SetRate(size)
+	}
+	return nil
+}
+
+// serveConfig serves the effective config with the secrets masked.
+func (s *stat) serveConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(s.r.c.Redacted(), "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("marshal config error %v", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// logLevels are the log levels which can be set by PUT /loglevel.
+var logLevels = map[string]log.Level{
+	"trace": log.LevelTrace,
+	"debug": log.LevelDebug,
+	"info":  log.LevelInfo,
+	"warn":  log.LevelWarn,
+	"error": log.LevelError,
+	"fatal": log.LevelFatal,
+}
+
+// serveLogLevel serves the log level with GET, and changes it with PUT like
+// "level=debug" without a restart.
+func (s *stat) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		name := r.FormValue("level")
+		level, ok := logLevels[strings.ToLower(name)]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("invalid log level %s\n", name)))
+			return
+		}
+		old := log.GetLevel()
+		log.SetLevel(level)
+		log.Infof("log level is changed from %s to %s by %s", old, level, r.RemoteAddr)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("%s\n", log.GetLevel())))
+}
+
 func (s *stat) Run(addr string) {
 	if len(addr) == 0 {
 		return
 	}
+	tlsConfig, err := s.newStatTLSConfig()
+	if err != nil {
+		log.Errorf("stat TLS config err %v", err)
+		return
+	}
+
 	log.Infof("run status http server %s", addr)
-	var err error
 	s.l, err = net.Listen("tcp", addr)
 	if err != nil {
 		log.Errorf("listen stat addr %s err %v", addr, err)
 		return
 	}
+	if tlsConfig != nil {
+		s.l = tls.NewListener(s.l, tlsConfig)
+	}
 
 	srv := http.Server{}
 	mux := http.NewServeMux()
 	mux.Handle("/stat", s)
+	mux.HandleFunc("/ratelimit", s.serveRateLimit)
+	mux.HandleFunc("/config", s.serveConfig)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.HandleFunc("/debug/vars", s.serveVars)
+	mux.HandleFunc("/pause", s.servePause)
+	mux.HandleFunc("/resume", s.serveResume)
+	mux.HandleFunc("/skip", s.serveSkip)
+	mux.HandleFunc("/redump", s.serveRedump)
+	mux.HandleFunc("/timewindow", s.serveTimeWindow)
+	mux.HandleFunc("/loglevel", s.serveLogLevel)
+	mux.HandleFunc("/position", s.servePosition)
+	mux.HandleFunc("/", s.serveDashboard)
 	mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
-	srv.Handler = mux
+	srv.Handler = s.authHandler(mux)
 
 	srv.Serve(s.l)
 }
@@ -0,0 +1,121 @@
+package river
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// StatAuth is a user of the stat HTTP server, with the basic auth user and pass,
+// or the bearer token. A read-only user can't change anything like the rate limits.
+type StatAuth struct {
+	User     string `toml:"user"`
+	Password string `toml:"pass"`
+	Token    string `toml:"token"`
+	ReadOnly bool   `toml:"read_only"`
+}
+
+func (a *StatAuth) match(r *http.Request) bool {
+	if len(a.Token) > 0 {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(a.Token)) == 1
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// compare both to not leak which one is wrong
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.User)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.Password)) == 1
+	return userOK && passOK
+}
+
+func (c *Config) checkStatAuth() error {
+	for i, a := range c.StatAuth {
+		if len(a.Token) > 0 == (len(a.User) > 0 || len(a.Password) > 0) {
+			return errors.Errorf("stat_auth %d must have either user and pass or token", i)
+		}
+		if len(a.Token) == 0 && (len(a.User) == 0 || len(a.Password) == 0) {
+			return errors.Errorf("stat_auth %d must have both user and pass", i)
+		}
+	}
+	return nil
+}
+
+// isMutating checks whether the request may change anything,
+// pprof is treated as mutating because it exposes the process internals.
+func isMutating(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+		return true
+	}
+	return r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+// authHandler checks the users in stat_auth, every request is allowed if not set.
+func (s *stat) authHandler(h http.Handler) http.Handler {
+	users := s.r.c.StatAuth
+	if len(users) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *StatAuth
+		for _, a := range users {
+			if a.match(r) {
+				user = a
+				break
+			}
+		}
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-mysql-elasticsearch"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if user.ReadOnly && isMutating(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newStatTLSConfig returns nil if TLS is not enabled for the stat HTTP server,
+// the client certificates are required and verified with stat_ssl_ca if set.
+func (s *stat) newStatTLSConfig() (*tls.Config, error) {
+	c := s.r.c
+	if len(c.StatSSLCert) == 0 && len(c.StatSSLKey) == 0 {
+		if len(c.StatSSLCA) > 0 {
+			return nil, errors.Errorf("stat_ssl_cert and stat_ssl_key must be set with stat_ssl_ca")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.StatSSLCert, c.StatSSLKey)
+	if err != nil {
+		return nil, errors.Annotatef(err, "load stat_ssl_cert and stat_ssl_key")
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if len(c.StatSSLCA) > 0 {
+		pem, err := ioutil.ReadFile(c.StatSSLCA)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate in stat_ssl_ca %s", c.StatSSLCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
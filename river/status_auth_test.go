@@ -0,0 +1,42 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/pingcap/check"
+)
+
+func (s *unitTestSuite) TestStatAuth(c *C) {
+	cfg := &Config{StatAuth: []*StatAuth{
+		{User: "admin", Password: "secret"},
+		{Token: "reader", ReadOnly: true},
+	}}
+	c.Assert(cfg.checkStatAuth(), IsNil)
+	st := &stat{r: &River{c: cfg}}
+	h := st.authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(method, path string, auth func(*http.Request)) int {
+		req := httptest.NewRequest(method, path, nil)
+		if auth != nil {
+			auth(req)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	admin := func(r *http.Request) { r.SetBasicAuth("admin", "secret") }
+	reader := func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader") }
+
+	c.Assert(serve("GET", "/stat", nil), Equals, http.StatusUnauthorized)
+	c.Assert(serve("GET", "/stat", func(r *http.Request) { r.SetBasicAuth("admin", "bad") }), Equals, http.StatusUnauthorized)
+	c.Assert(serve("POST", "/ratelimit", admin), Equals, http.StatusOK)
+	c.Assert(serve("GET", "/stat", reader), Equals, http.StatusOK)
+	c.Assert(serve("POST", "/ratelimit", reader), Equals, http.StatusForbidden)
+	c.Assert(serve("GET", "/debug/pprof/", reader), Equals, http.StatusForbidden)
+
+	cfg.StatAuth = []*StatAuth{{User: "admin", Token: "t"}}
+	c.Assert(cfg.checkStatAuth(), NotNil)
+	cfg.StatAuth = []*StatAuth{{User: "admin"}}
+	c.Assert(cfg.checkStatAuth(), NotNil)
+}
@@ -0,0 +1,40 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-log/log"
+)
+
+func (s *unitTestSuite) TestLogLevel(c *C) {
+	st := &stat{r: &River{c: &Config{}}}
+	defer log.SetLevel(log.GetLevel())
+
+	w := httptest.NewRecorder()
+	st.serveLogLevel(w, httptest.NewRequest("PUT", "/loglevel?level=debug", nil))
+	c.Assert(w.Body.String(), Equals, "debug\n")
+	c.Assert(log.GetLevel(), Equals, log.LevelDebug)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/loglevel", strings.NewReader("level=WARN"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	st.serveLogLevel(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(log.GetLevel(), Equals, log.LevelWarn)
+
+	w = httptest.NewRecorder()
+	st.serveLogLevel(w, httptest.NewRequest("PUT", "/loglevel?level=verbose", nil))
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	c.Assert(log.GetLevel(), Equals, log.LevelWarn)
+
+	w = httptest.NewRecorder()
+	st.serveLogLevel(w, httptest.NewRequest("GET", "/loglevel", nil))
+	c.Assert(w.Body.String(), Equals, "warn\n")
+
+	w = httptest.NewRecorder()
+	st.serveLogLevel(w, httptest.NewRequest("POST", "/loglevel", nil))
+	c.Assert(w.Code, Equals, http.StatusMethodNotAllowed)
+}
@@ -1,11 +1,12 @@
 package river
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"reflect"
+	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/errors"
@@ -31,17 +32,62 @@ const (
 	fieldTypeDate = "date"
 	// transfer datetime to timestamp
 	filedTypeTimestamp = "timestamp"
+	// convert the geometry columns to GeoJSON for geo_shape,
+	// or the POINT columns to {"lat", "lon"} for geo_point
+	fieldTypeGeoShape = "geo_shape"
+	fieldTypeGeoPoint = "geo_point"
+	// convert the integer columns to the booleans, 0 is false
+	fieldTypeBool = "bool"
 )
 
 const mysqlDateFormat = "2006-01-02"
 
+var (
+	expTruncateTable = regexp.MustCompile("(?i)^TRUNCATE\\s+(?:TABLE\\s+)?`{0,1}(.*?)`{0,1}\\.{0,1}`{0,1}([^`\\.]+?)`{0,1}(?:$|\\s|;)")
+	// RENAME TABLE a TO b, c TO d
+	expRenameTable = regexp.MustCompile("(?is)^RENAME\\s+TABLES?\\s+(.+?)\\s*;?\\s*$")
+	expRenamePair  = regexp.MustCompile("(?is)^(\\S+)\\s+TO\\s+(\\S+)$")
+	// ALTER TABLE a RENAME [TO|AS] b
+	expAlterRename = regexp.MustCompile("(?is)^ALTER\\s+TABLE\\s+(\\S+)\\s+RENAME\\s+(?:(?:TO|AS)\\s+)?(\\S+?)\\s*;?\\s*$")
+)
+
 type posSaver struct {
 	pos   mysql.Position
 	force bool
+	// the master info of the upstream the position is of
+	master *masterInfo
+}
+
+// priorityRequests are the requests of the high priority rules.
+type priorityRequests []*elastic.BulkRequest
+
+// ruleRequests are the requests of the rule with its own batch, see Rule.hasOwnBatch.
+type ruleRequests struct {
+	rule *Rule
+	reqs []*elastic.BulkRequest
+}
+
+// truncateTable is sent after all the pending requests of the truncated table.
+type truncateTable struct {
+	rule *Rule
 }
 
 type eventHandler struct {
 	r *River
+
+	// the table in the current DDL is ignored, OnTableChanged is called before OnDDL
+	ignoredDDL bool
+
+	// GTID of the current transaction
+	gtid string
+
+	// the docs of the older dumps are cleaned up after the dump
+	dumpCleaned bool
+
+	// the record of the current DDL for ddl_log, nil if its table is not synced
+	ddl *ddlRecord
+
+	binlog binlogCursor
 }
 
 func (h *eventHandler) OnRotate(e *replication.RotateEvent) error {
@@ -49,64 +95,402 @@ func (h *eventHandler) OnRotate(e *replication.RotateEvent) error {
 		Name: string(e.NextLogName),
 		Pos:  uint32(e.Position),
 	}
+	h.r.st.Binlog.rotate(&h.binlog, pos.Pos)
 
-	h.r.syncCh <- posSaver{pos, true}
+	h.r.syncCh <- posSaver{pos, true, h.r.master}
 
 	return h.r.ctx.Err()
 }
 
-func (h *eventHandler) OnTableChanged(schema, table string) error {
-	err := h.r.updateRule(schema, table)
-	if err != nil && err != ErrRuleNotExist {
+func (h *eventHandler) OnTableChanged(db, table string) error {
+	h.ddl = nil
+	h.ignoredDDL = h.r.isIgnoredTable(db, table)
+	if h.ignoredDDL {
+		return nil
+	}
+
+	var record *ddlRecord
+	var oldInfo *schema.Table
+	if h.r.ddlLog != nil {
+		record = &ddlRecord{Schema: db, Table: table}
+		if rule, ok := h.r.getRule(ruleKey(db, table)); ok {
+			oldInfo = rule.TableInfo
+			h.ddl = record
+		}
+	}
+
+	err := h.r.updateRule(db, table)
+	action := DDLActionUpdateRule
+	if err == ErrRuleNotExist {
+		// a new table of the wildcard rules, the renamed ones are added in OnDDL
+		err = h.r.addCreatedTable(db, table)
+		action = DDLActionAddRule
+	}
+	if err != nil && err != ErrRuleNotExist && errors.Cause(err) != schema.ErrTableNotExist {
 		return errors.Trace(err)
 	}
+
+	if rule, ok := h.r.getRule(ruleKey(db, table)); ok && record != nil && err == nil {
+		h.ddl = record
+		record.Actions = append(record.Actions, action)
+		if rule.UpdateMapping && action == DDLActionUpdateRule {
+			record.Actions = append(record.Actions, DDLActionUpdateMapping)
+		}
+		record.AddedColumns, record.DroppedColumns = diffColumns(oldInfo, rule.TableInfo)
+	}
 	return nil
 }
 
-func (h *eventHandler) OnDDL(nextPos mysql.Position, _ *replication.QueryEvent) error {
-	h.r.syncCh <- posSaver{nextPos, true}
+// parseTableName parses `db`.`table` or table, schema is used if no db.
+func parseTableName(schema string, name string) (string, string) {
+	name = strings.Replace(name, "`", "", -1)
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return schema, name
+}
+
+// parseRenameTable returns the [old, new] pairs of the renamed tables.
+func parseRenameTable(schema string, query string) [][2][2]string {
+	var pairs [][2][2]string
+	if mb := expAlterRename.FindStringSubmatch(query); mb != nil {
+		oldSchema, oldTable := parseTableName(schema, mb[1])
+		newSchema, newTable := parseTableName(schema, mb[2])
+		return append(pairs, [2][2]string{{oldSchema, oldTable}, {newSchema, newTable}})
+	}
+
+	mb := expRenameTable.FindStringSubmatch(query)
+	if mb == nil {
+		return nil
+	}
+	for _, part := range strings.Split(mb[1], ",") {
+		pb := expRenamePair.FindStringSubmatch(strings.TrimSpace(part))
+		if pb == nil {
+			continue
+		}
+		oldSchema, oldTable := parseTableName(schema, pb[1])
+		newSchema, newTable := parseTableName(schema, pb[2])
+		pairs = append(pairs, [2][2]string{{oldSchema, oldTable}, {newSchema, newTable}})
+	}
+	return pairs
+}
+
+func (h *eventHandler) OnDDL(nextPos mysql.Position, e *replication.QueryEvent) error {
+	h.r.st.Binlog.onEvent(&h.binlog, nextPos.Pos)
+
+	ignored := h.ignoredDDL
+	h.ignoredDDL = false
+	if ignored {
+		h.r.syncCh <- posSaver{nextPos, false, h.r.master}
+		return h.r.ctx.Err()
+	}
+	if h.r.isSkippedDDL(string(e.Query)) {
+		if h.ddl != nil {
+			h.ddl.Actions = append(h.ddl.Actions, DDLActionSkip)
+		}
+		if err := h.logDDL(nextPos, e.Query); err != nil {
+			h.r.cancel()
+			return errors.Errorf("log DDL err %v, close sync", err)
+		}
+		// no need to flush for the skipped DDL
+		h.r.syncCh <- posSaver{nextPos, false, h.r.master}
+		return h.r.ctx.Err()
+	}
+
+	if mb := expTruncateTable.FindSubmatch(e.Query); mb != nil {
+		schema := string(mb[1])
+		if len(schema) == 0 {
+			schema = string(e.Schema)
+		}
+		if rule, ok := h.r.getRule(ruleKey(schema, string(mb[2]))); ok {
+			for _, target := range rule.targets() {
+				if h.r.audit != nil && target.Truncate != TruncateWarn {
+					auditReqs, err := h.auditTruncate(target, nextPos)
+					if err != nil {
+						h.r.cancel()
+						return errors.Errorf("audit truncate %s.%s err %v, close sync", target.Schema, target.Table, err)
+					}
+					h.r.syncCh <- auditReqs
+				}
+				h.r.syncCh <- truncateTable{target}
+			}
+			if h.ddl != nil {
+				h.ddl.Actions = append(h.ddl.Actions, DDLActionTruncate)
+				h.ddl.Truncate = rule.Truncate
+			}
+		}
+	}
+
+	for _, pair := range parseRenameTable(string(e.Schema), string(e.Query)) {
+		if err := h.r.renameRule(pair[0][0], pair[0][1], pair[1][0], pair[1][1]); err != nil {
+			return errors.Trace(err)
+		}
+		if h.ddl != nil {
+			h.ddl.Actions = append(h.ddl.Actions, DDLActionRenameRule)
+		}
+	}
+
+	if err := h.logDDL(nextPos, e.Query); err != nil {
+		h.r.cancel()
+		return errors.Errorf("log DDL err %v, close sync", err)
+	}
+	h.r.syncCh <- posSaver{nextPos, true, h.r.master}
 	return h.r.ctx.Err()
 }
 
 func (h *eventHandler) OnXID(nextPos mysql.Position) error {
-	h.r.syncCh <- posSaver{nextPos, false}
+	h.r.st.Binlog.onXID(&h.binlog, nextPos.Pos)
+	h.r.syncCh <- posSaver{nextPos, false, h.r.master}
 	return h.r.ctx.Err()
 }
 
 func (h *eventHandler) OnRow(e *canal.RowsEvent) error {
-	rule, ok := h.r.rules[ruleKey(e.Table.Schema, e.Table.Name)]
-	if !ok {
+	if e.Header != nil {
+		rows := int64(len(e.Rows))
+		if e.Action == canal.UpdateAction {
+			// the before and after images of the updated rows
+			rows /= 2
+		}
+		h.r.st.Binlog.onRows(&h.binlog, e.Header.LogPos, rows)
+	}
+
+	if h.r.hb != nil && h.r.hb.match(e.Table.Schema, e.Table.Name) {
+		h.r.hb.onRow(e)
+		return h.r.ctx.Err()
+	}
+
+	rule, ok := h.r.getRule(ruleKey(e.Table.Schema, e.Table.Name))
+	if !ok || h.r.isIgnoredTable(e.Table.Schema, e.Table.Name) || !h.r.assignsTable(e.Table.Schema, e.Table.Name) {
 		return nil
 	}
 
+	if h.r.recorder != nil {
+		if err := h.r.recorder.record(h, e); err != nil {
+			h.r.cancel()
+			return errors.Errorf("record %s.%s err %v, close sync", e.Table.Schema, e.Table.Name, err)
+		}
+	}
+
+	if err := h.r.waitSyncResumed(); err != nil {
+		return errors.Trace(err)
+	}
+	if e.Header != nil {
+		// wait for the re-dump of a table
+		root := h.r.root()
+		root.redumpMu.RLock()
+		defer root.redumpMu.RUnlock()
+	}
+
+	if skipped, err := h.skipEvent(rule, e); err != nil {
+		h.r.cancel()
+		return errors.Errorf("audit skipped event of %s.%s err %v, close sync", e.Table.Schema, e.Table.Name, err)
+	} else if skipped {
+		return h.r.ctx.Err()
+	}
+
+	if e.Header != nil && h.r.outOfTimeWindow(e.Header.Timestamp) {
+		h.r.st.TimeWindowSkipNum.Add(1)
+		return h.r.ctx.Err()
+	}
+
+	// no header for the dumped rows
+	if e.Header == nil {
+		if err := h.r.waitDumpResumed(); err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		// the binlog rows are in the column charsets, the dumped ones are UTF-8
+		h.r.transcodeRows(e.Table, e.Rows)
+		if err := h.r.resolveJSONDiffs(e); err != nil {
+			h.r.cancel()
+			return errors.Errorf("%v, close sync", err)
+		}
+	}
+
 	var reqs []*elastic.BulkRequest
 	var err error
-	switch e.Action {
-	case canal.InsertAction:
-		reqs, err = h.r.makeInsertRequest(rule, e.Rows)
-	case canal.DeleteAction:
-		reqs, err = h.r.makeDeleteRequest(rule, e.Rows)
-	case canal.UpdateAction:
-		reqs, err = h.r.makeUpdateRequest(rule, e.Rows)
-	default:
-		err = errors.Errorf("invalid rows action %s", e.Action)
+	rows := e.Rows
+	fetch := h.r.c.PartialRowImage == PartialRowFetch
+	partial := false
+	if h.r.c.PartialRowImage == PartialRowUpdate && e.Action == canal.UpdateAction && isPartialRowsEvent(e) {
+		if partial, err = h.r.updatesPartially(rule, e); err != nil {
+			h.r.cancel()
+			return errors.Errorf("check doc id of %s.%s err %v, close sync", rule.Schema, rule.Table, err)
+		}
+		// the updates of the rewriting rules need the whole rows
+		fetch = !partial || rule.rewritesUpdate()
+	}
+	if fetch {
+		if rows, err = h.r.fetchPartialRows(rule, e); err != nil {
+			h.r.cancel()
+			return errors.Errorf("fetch missing columns of %s.%s err %v, close sync", rule.Schema, rule.Table, err)
+		}
+	}
+	if e.Header != nil {
+		if rows, err = h.r.fetchGeneratedRows(rule, e.Action, rows); err != nil {
+			h.r.cancel()
+			return errors.Errorf("fetch generated columns of %s.%s err %v, close sync", rule.Schema, rule.Table, err)
+		}
 	}
 
-	if err != nil {
-		h.r.cancel()
-		return errors.Errorf("make %s ES request err %v, close sync", e.Action, err)
+	var highReqs []*elastic.BulkRequest
+	var ruleReqs []ruleRequests
+	var queries deleteQueries
+	var rollupReqs []*elastic.BulkRequest
+	for _, target := range rule.targets() {
+		if target.indexMissing {
+			continue
+		}
+		var targetReqs []*elastic.BulkRequest
+		switch {
+		case e.Action == canal.DeleteAction && target.deletesByQuery():
+			var q *deleteQuery
+			if q, err = h.r.makeDeleteQuery(target, rows); err == nil {
+				queries = append(queries, q)
+			}
+		case target.AppendOnly:
+			targetReqs, err = h.makeAppendRequest(target, e, rows)
+		case e.Action == canal.InsertAction:
+			targetReqs, err = h.r.makeInsertRequest(target, rows)
+		case e.Action == canal.DeleteAction:
+			targetReqs, err = h.r.makeDeleteRequest(target, rows)
+		case e.Action == canal.UpdateAction:
+			if partial && target.updatesPartially() {
+				targetReqs, err = h.r.makePartialUpdateRequest(target, e)
+			} else {
+				targetReqs, err = h.r.makeUpdateRequest(target, rows)
+			}
+		default:
+			err = errors.Errorf("invalid rows action %s", e.Action)
+		}
+
+		if err != nil {
+			h.r.cancel()
+			return errors.Errorf("make %s ES request err %v, close sync", e.Action, err)
+		}
+		if len(target.Rollup) > 0 {
+			ruReqs, err := h.r.makeRollupRequests(target, e.Action, rows)
+			if err != nil {
+				h.r.cancel()
+				return errors.Errorf("make rollup requests of %s.%s err %v, close sync", target.Schema, target.Table, err)
+			}
+			rollupReqs = append(rollupReqs, ruReqs...)
+		}
+		h.r.st.addRuleDocs(target, len(targetReqs))
+		if len(target.Cluster) > 0 {
+			for _, req := range targetReqs {
+				req.Cluster = target.Cluster
+			}
+		}
+		if e.Header == nil && target.DumpCleanup && h.r.dumpGeneration > 0 {
+			h.r.tagDumpGeneration(target, targetReqs)
+		}
+		if target.DeleteMode == DeleteModeTombstone {
+			tombstoneDeletes(target, targetReqs, e)
+		}
+		if len(target.MetaField) > 0 {
+			h.setMeta(target, targetReqs, e)
+		}
+		if target.FieldPreset == FieldPresetECS {
+			h.setECS(target, targetReqs, e)
+		}
+		if len(target.FieldLimit) > 0 {
+			if targetReqs, err = h.r.limitFields(target, targetReqs); err != nil {
+				h.r.cancel()
+				return errors.Errorf("limit fields of %s.%s err %v, close sync", target.Schema, target.Table, err)
+			}
+		}
+		if h.r.audit != nil {
+			auditReqs, err := h.auditDeletes(target, targetReqs, e)
+			if err != nil {
+				h.r.cancel()
+				return errors.Errorf("audit %s.%s err %v, close sync", target.Schema, target.Table, err)
+			}
+			if len(target.Webhook) > 0 {
+				// the audit records are written to ES, not posted to the webhook
+				reqs = append(reqs, auditReqs...)
+			} else {
+				targetReqs = append(targetReqs, auditReqs...)
+			}
+		}
+		if len(target.Webhook) > 0 && e.Header == nil {
+			// the dumped rows are not changes, they are not posted to the webhook
+			if !target.WebhookOnly {
+				reqs = append(reqs, targetReqs...)
+			}
+		} else if target.hasOwnBatch() {
+			if len(targetReqs) > 0 {
+				ruleReqs = append(ruleReqs, ruleRequests{rule: target, reqs: targetReqs})
+			}
+		} else if target.Priority == PriorityHigh {
+			highReqs = append(highReqs, targetReqs...)
+		} else {
+			reqs = append(reqs, targetReqs...)
+		}
+	}
+	// the rollup docs are in their own indices, they are sent in the normal lane after the docs
+	reqs = append(reqs, rollupReqs...)
+
+	lanes := [][]*elastic.BulkRequest{reqs, highReqs}
+	for _, rr := range ruleReqs {
+		lanes = append(lanes, rr.reqs)
+	}
+	docs := 0
+	for _, lane := range lanes {
+		docs += len(lane)
+	}
+	if err = h.r.limits.table(rule).Wait(h.r.ctx, docs); err != nil {
+		return errors.Trace(err)
 	}
 
-	h.r.syncCh <- reqs
+	// no binlog position for dump, the dumped docs are not versioned
+	if len(h.r.c.VersionType) > 0 && e.Header != nil {
+		for _, lane := range lanes {
+			if err = h.r.setVersion(lane, e.Header.LogPos); err != nil {
+				h.r.cancel()
+				return errors.Errorf("set version err %v, close sync", err)
+			}
+		}
+	}
+
+	// the dumped rows are not changes
+	if h.r.redis != nil && e.Header != nil {
+		if err = h.r.invalidateRows(rule, rows); err != nil {
+			h.r.cancel()
+			return errors.Errorf("invalidate cache of %s.%s err %v, close sync", rule.Schema, rule.Table, err)
+		}
+	}
+
+	if len(highReqs) > 0 {
+		h.r.syncCh <- priorityRequests(highReqs)
+	}
+	for _, rr := range ruleReqs {
+		h.r.syncCh <- rr
+	}
+	if len(reqs) > 0 {
+		h.r.syncCh <- reqs
+	}
+	if len(queries) > 0 {
+		h.r.syncCh <- queries
+	}
 
 	return h.r.ctx.Err()
 }
 
 func (h *eventHandler) OnGTID(gtid mysql.GTIDSet) error {
+	h.gtid = gtid.String()
+	h.r.st.Binlog.EventNum.Add(1)
 	return nil
 }
 
 func (h *eventHandler) OnPosSynced(pos mysql.Position, force bool) error {
+	// canal syncs the position after the dump is done, and when it is closed
+	if h.r.dumpGeneration > 0 && !h.dumpCleaned && h.r.ctx.Err() == nil {
+		h.dumpCleaned = true
+		if indices := h.r.dumpCleanupIndices(); len(indices) > 0 {
+			h.r.syncCh <- dumpCleanup{indices}
+		}
+	}
 	return nil
 }
 
@@ -114,6 +498,26 @@ func (h *eventHandler) String() string {
 	return "ESRiverEventHandler"
 }
 
+// ruleBatch batches the requests of a rule with its own bulk_size and flush_bulk_time.
+type ruleBatch struct {
+	rule          *Rule
+	size          int
+	interval      time.Duration
+	lastFlushTime time.Time
+	reqs          []*elastic.BulkRequest
+}
+
+func newRuleBatch(rule *Rule, bulkSize int, interval time.Duration) *ruleBatch {
+	b := &ruleBatch{rule: rule, size: rule.BulkSize, interval: rule.FlushBulkTime.Duration, lastFlushTime: time.Now()}
+	if b.size == 0 {
+		b.size = bulkSize
+	}
+	if b.interval == 0 {
+		b.interval = interval
+	}
+	return b
+}
+
 func (r *River) syncLoop() {
 	bulkSize := r.c.BulkSize
 	if bulkSize == 0 {
@@ -125,56 +529,380 @@ func (r *River) syncLoop() {
 		interval = 200 * time.Millisecond
 	}
 
-	ticker := time.NewTicker(interval)
+	// tick at the shortest flush_bulk_time of the rules
+	tick := interval
+	for _, rule := range r.c.Rules {
+		if d := rule.FlushBulkTime.Duration; d > 0 && d < tick {
+			tick = d
+		}
+	}
+	ticker := time.NewTicker(tick)
 	defer ticker.Stop()
 	defer r.wg.Done()
 
-	lastSavedTime := time.Now()
+	// the positions of every upstream are saved on their own
+	startTime := time.Now()
+	lastSavedTimes := make(map[*masterInfo]time.Time)
+	lastFlushTime := time.Now()
 	reqs := make([]*elastic.BulkRequest, 0, 1024)
+	// the requests of the high priority rules, they are sent first in every flush
+	highReqs := make([]*elastic.BulkRequest, 0, 1024)
+	// the requests of the rules with their own batches
+	batches := make(map[*Rule]*ruleBatch)
 
 	var pos mysql.Position
+	var master *masterInfo
+
+	// the estimated bytes of the requests in every lane with max_buffer_size
+	maxBuffer := r.c.MaxBufferSize
+	laneBytes := make(map[*[]*elastic.BulkRequest]int64)
+
+	// buffer appends the requests to the lane
+	buffer := func(lane *[]*elastic.BulkRequest, add []*elastic.BulkRequest) {
+		*lane = append(*lane, add...)
+		if maxBuffer > 0 {
+			n := requestsSize(add)
+			laneBytes[lane] += n
+			r.st.BufferedBytes.Add(n)
+		}
+	}
+
+	savePos := func(master *masterInfo, pos mysql.Position) bool {
+		if err := master.Save(pos); err != nil {
+			log.Errorf("save sync position %s err %v, close sync", pos, err)
+			r.st.addError("save sync position %s err %v, close sync", pos, err)
+			r.cancel()
+			return false
+		}
+		return true
+	}
+
+	// the bulks are sent by the workers with max_inflight_bulks, the queue and
+	// the file sink are written in order
+	var tracker *bulkTracker
+	var bulkDone <-chan struct{}
+	if r.c.MaxInflightBulks > 1 && r.queue == nil && r.sink == nil {
+		tracker = newBulkTracker(r, r.c.MaxInflightBulks, maxBuffer)
+		bulkDone = tracker.doneCh
+		defer func() {
+			for _, p := range tracker.close() {
+				savePos(p.master, p.pos)
+			}
+		}()
+	}
+
+	// the rules with isolate are sent in their own workers, the queue and the file sink
+	// are written in order
+	var iso *isolation
+	var isolatedDone <-chan struct{}
+	if r.queue == nil && r.sink == nil {
+		iso = newIsolation(r, bulkSize, interval, maxBuffer)
+		isolatedDone = iso.doneCh
+		// before the tracker is closed, the positions are saved by it
+		defer func() {
+			for _, p := range iso.close() {
+				if tracker != nil {
+					tracker.savePos(p.master, p.pos)
+				} else {
+					savePos(p.master, p.pos)
+				}
+			}
+		}()
+	}
+
+	bulkFailed := func(err error) bool {
+		log.Errorf("do ES bulk err %v, close sync", err)
+		r.st.addError("do ES bulk err %v, close sync", err)
+		r.cancel()
+		return false
+	}
+
+	send := func(lane *[]*elastic.BulkRequest) bool {
+		if len(*lane) == 0 {
+			return true
+		}
+		size := laneBytes[lane]
+		delete(laneBytes, lane)
+
+		var err error
+		if r.queue != nil {
+			// the queue is drained to ES by drainQueue
+			err = r.queue.putEntry(r.ctx, &queueEntry{Reqs: *lane})
+		} else if tracker != nil {
+			err = tracker.send(*lane, size)
+		} else {
+			// TODO: retry some times?
+			err = r.doBulk(*lane)
+		}
+		if err != nil {
+			return bulkFailed(err)
+		}
+		if tracker != nil {
+			// the requests and their bytes are released by the worker
+			*lane = make([]*elastic.BulkRequest, 0, cap(*lane))
+			return true
+		}
+		r.st.BufferedBytes.Add(-size)
+		elastic.ReleaseBulkRequests(*lane)
+		*lane = (*lane)[0:0]
+		return true
+	}
+
+	// the requests of the rules with webhook are written in place, so the webhook
+	// is called after the docs are written to ES
+	sendWebhook := func(b *ruleBatch) bool {
+		if len(b.reqs) == 0 {
+			return true
+		}
+		size := laneBytes[&b.reqs]
+		delete(laneBytes, &b.reqs)
+
+		if !b.rule.WebhookOnly {
+			if err := r.doBulk(b.reqs); err != nil {
+				return bulkFailed(err)
+			}
+		}
+		if err := r.postWebhook(b.rule, b.reqs); err != nil {
+			log.Errorf("%v, close sync", err)
+			r.st.addError("%v, close sync", err)
+			r.cancel()
+			return false
+		}
+		r.st.BufferedBytes.Add(-size)
+		elastic.ReleaseBulkRequests(b.reqs)
+		b.reqs = b.reqs[0:0]
+		return true
+	}
+
+	flushBatch := func(b *ruleBatch) bool {
+		b.lastFlushTime = time.Now()
+		if len(b.rule.Webhook) > 0 {
+			return sendWebhook(b)
+		}
+		return send(&b.reqs)
+	}
+
+	flushLanes := func() bool {
+		lastFlushTime = time.Now()
+		return send(&highReqs) && send(&reqs)
+	}
+
+	// flush sends all the pending requests, before saving the position, the isolated
+	// lanes send theirs when they are idle
+	flush := func() bool {
+		if !send(&highReqs) {
+			return false
+		}
+		if iso != nil {
+			iso.flush(true)
+		}
+		for _, b := range batches {
+			if !flushBatch(b) {
+				return false
+			}
+		}
+		return flushLanes()
+	}
+
+	// drain sends all the pending requests, and waits for the in-flight bulks
+	drain := func() bool {
+		if !flush() {
+			return false
+		}
+		if tracker != nil {
+			if err := tracker.wait(); err != nil {
+				return bulkFailed(err)
+			}
+		}
+		if iso != nil {
+			if err := iso.wait(); err != nil {
+				return bulkFailed(err)
+			}
+		}
+		return true
+	}
 
 	for {
 		needFlush := false
+		needFlushLanes := false
 		needSavePos := false
 
 		select {
 		case v := <-r.syncCh:
 			switch v := v.(type) {
 			case posSaver:
+				if v.master == nil {
+					v.master = r.master
+				}
 				now := time.Now()
-				if v.force || now.Sub(lastSavedTime) > 3*time.Second {
-					lastSavedTime = now
+				last, ok := lastSavedTimes[v.master]
+				if !ok {
+					last = startTime
+				}
+				if v.force || now.Sub(last) > 3*time.Second {
+					lastSavedTimes[v.master] = now
 					needFlush = true
 					needSavePos = true
 					pos = v.pos
+					master = v.master
 				}
 			case []*elastic.BulkRequest:
-				reqs = append(reqs, v...)
-				needFlush = len(reqs) >= bulkSize
+				buffer(&reqs, v)
+				needFlushLanes = len(reqs) >= bulkSize
+			case priorityRequests:
+				buffer(&highReqs, v)
+				needFlushLanes = len(highReqs) >= bulkSize
+			case ruleRequests:
+				if iso != nil && v.rule.Isolate {
+					if err := iso.add(v.rule, v.reqs); err != nil {
+						bulkFailed(err)
+						return
+					}
+					break
+				}
+				b, ok := batches[v.rule]
+				if !ok {
+					b = newRuleBatch(v.rule, bulkSize, interval)
+					batches[v.rule] = b
+				}
+				buffer(&b.reqs, v.reqs)
+				if len(b.reqs) >= b.size && !flushBatch(b) {
+					return
+				}
+			case syncDone:
+				if !drain() {
+					return
+				}
+				close(v.done)
+			case dumpCleanup:
+				// the dumped docs must be written first
+				if !drain() {
+					return
+				}
+
+				var err error
+				if r.queue != nil {
+					err = r.queue.putEntry(r.ctx, &queueEntry{DumpCleanup: v.indices})
+				} else {
+					err = r.doDumpCleanup(v.indices)
+				}
+				if err != nil {
+					log.Errorf("clean up the docs of the older dumps err %v, close sync", err)
+					r.st.addError("clean up the docs of the older dumps err %v, close sync", err)
+					r.cancel()
+					return
+				}
+			case deleteQueries:
+				// the docs may be written by the requests before
+				if !drain() {
+					return
+				}
+
+				var err error
+				if r.queue != nil {
+					err = r.queue.putEntry(r.ctx, &queueEntry{DeleteQuery: v})
+				} else {
+					err = r.doDeleteQueries(v)
+				}
+				if err != nil {
+					log.Errorf("delete the docs by query err %v, close sync", err)
+					r.st.addError("delete the docs by query err %v, close sync", err)
+					r.cancel()
+					return
+				}
+			case truncateTable:
+				// requests before TRUNCATE must be done first
+				if !drain() {
+					return
+				}
+
+				var err error
+				if r.queue != nil {
+					err = r.queue.putEntry(r.ctx, &queueEntry{Truncate: newQueueTruncate(v.rule)})
+				} else {
+					err = r.doTruncate(v.rule)
+				}
+				if err != nil {
+					log.Errorf("truncate %s.%s in ES err %v, close sync", v.rule.Schema, v.rule.Table, err)
+					r.st.addError("truncate %s.%s in ES err %v, close sync", v.rule.Schema, v.rule.Table, err)
+					r.cancel()
+					return
+				}
 			}
 		case <-ticker.C:
-			needFlush = true
+			now := time.Now()
+			// a little earlier for the jitter of the ticker
+			needFlushLanes = now.Sub(lastFlushTime) >= interval-tick/2
+			for _, b := range batches {
+				if now.Sub(b.lastFlushTime) >= b.interval-tick/2 && !flushBatch(b) {
+					return
+				}
+			}
+			if iso != nil {
+				iso.flush(false)
+			}
+		case <-bulkDone:
+		case <-isolatedDone:
 		case <-r.ctx.Done():
 			return
 		}
 
-		if needFlush {
-			// TODO: retry some times?
-			if err := r.doBulk(reqs); err != nil {
-				log.Errorf("do ES bulk err %v, close sync", err)
-				r.cancel()
+		// flush in the middle of a giant transaction, the position is still saved after it
+		if maxBuffer > 0 && !needFlush && r.st.BufferedBytes.Get() > maxBuffer {
+			log.Infof("buffered requests of %d bytes exceed max_buffer_size %d, flush them", r.st.BufferedBytes.Get(), maxBuffer)
+			r.st.BufferFlushNum.Add(1)
+			needFlush = true
+		}
+
+		if needFlush && !flush() {
+			return
+		} else if !needFlush && needFlushLanes && !flushLanes() {
+			return
+		}
+
+		pending := len(reqs) + len(highReqs)
+		for _, b := range batches {
+			pending += len(b.reqs)
+		}
+		if iso != nil {
+			pending += iso.pendingReqs()
+		}
+		r.st.PendingReqNum.Set(int64(pending))
+
+		if needSavePos {
+			if iso != nil && iso.holds() {
+				iso.savePos(master, pos)
+			} else if tracker != nil {
+				tracker.savePos(master, pos)
+			} else if !savePos(master, pos) {
 				return
 			}
-			reqs = reqs[0:0]
 		}
 
-		if needSavePos {
-			if err := r.master.Save(pos); err != nil {
-				log.Errorf("save sync position %s err %v, close sync", pos, err)
-				r.cancel()
+		if iso != nil {
+			if err := iso.reap(); err != nil {
+				bulkFailed(err)
 				return
 			}
+			for _, p := range iso.completedPos() {
+				if tracker != nil {
+					tracker.savePos(p.master, p.pos)
+				} else if !savePos(p.master, p.pos) {
+					return
+				}
+			}
+		}
+
+		if tracker != nil {
+			if err := tracker.reap(); err != nil {
+				bulkFailed(err)
+				return
+			}
+			for _, p := range tracker.completedPos() {
+				if !savePos(p.master, p.pos) {
+					return
+				}
+			}
 		}
 	}
 }
@@ -200,13 +928,31 @@ func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]
 				return nil, errors.Trace(err)
 			}
 		}
+		index, err := rule.rowIndex(values)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		routing, err := r.getRouting(rule, values)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 
+		if esAction == ScriptAction {
+			if req := r.makeScriptReqData(rule, action, nil, values, id, parentID); req != nil {
+				req.Index = index
+				req.Routing = routing
+				r.st.UpdateNum.Add(1)
+				reqs = append(reqs, req)
+			}
+			continue
+		}
 		if esAction == elastic.ActionDelete {
 			req := &elastic.BulkRequest{
-				Index:    rule.Index,
+				Index:    index,
 				Type:     rule.Type,
 				ID:       id,
 				Parent:   parentID,
+				Routing:  routing,
 				Pipeline: rule.Pipeline,
 				Action:   elastic.ActionDelete,
 			}
@@ -218,6 +964,8 @@ func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]
 		if req == nil {
 			continue
 		}
+		req.Index = index
+		req.Routing = routing
 		if esAction == elastic.ActionIndex {
 			r.st.InsertNum.Add(1)
 		} else {
@@ -269,34 +1017,107 @@ func (r *River) makeUpdateRequest(rule *Rule, rows [][]interface{}) ([]*elastic.
 			}
 		}
 
-		if beforeID != afterID || beforeParentID != afterParentID {
+		beforeIndex, err := rule.rowIndex(rows[i])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		afterIndex, err := rule.rowIndex(rows[i+1])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		beforeRouting, err := r.getRouting(rule, rows[i])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		afterRouting, err := r.getRouting(rule, rows[i+1])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// the doc moves to another tenant index or shard like the id change, the old one
+		// is only found with the old index and routing
+		if beforeID != afterID || beforeParentID != afterParentID || beforeIndex != afterIndex || beforeRouting != afterRouting {
+			if rule.PKChange == PKChangeReject && (beforeID != afterID || beforeParentID != afterParentID) {
+				return nil, errors.Errorf("doc id of %s.%s is changed from %s to %s, but pk_change is %s",
+					rule.Schema, rule.Table, beforeID, afterID, rule.PKChange)
+			}
+
+			// delete the old doc and index the new one
 			req := &elastic.BulkRequest{
-				Index:  rule.Index,
-				Type:   rule.Type,
-				ID:     beforeID,
-				Parent: beforeParentID,
-				Action: elastic.ActionDelete,
+				Index:   beforeIndex,
+				Type:    rule.Type,
+				ID:      beforeID,
+				Parent:  beforeParentID,
+				Routing: beforeRouting,
+				Action:  elastic.ActionDelete,
 			}
 			r.st.DeleteNum.Add(1)
 			reqs = append(reqs, req)
 
-			req = r.makeInsertReqData(rule, rows[i+1], elastic.ActionDelete, afterID, afterParentID)
+			req = r.makeInsertReqData(rule, rows[i+1], elastic.ActionIndex, afterID, afterParentID)
 			if req == nil {
 				continue
 			}
+			req.Index = afterIndex
+			req.Routing = afterRouting
 			r.st.InsertNum.Add(1)
 			reqs = append(reqs, req)
 			continue
 		}
+		if esAction == ScriptAction {
+			if req := r.makeScriptReqData(rule, canal.UpdateAction, rows[i], rows[i+1], beforeID, beforeParentID); req != nil {
+				req.Index = afterIndex
+				req.Routing = afterRouting
+				r.st.UpdateNum.Add(1)
+				reqs = append(reqs, req)
+			}
+			continue
+		}
+		// the scripted updates may use the columns not in the doc
+		if rule.NoopUpdate == NoopUpdateSkip && len(rule.Script) == 0 && r.isNoopUpdate(rule, rows[i], rows[i+1]) {
+			r.st.NoopUpdateNum.Add(1)
+			continue
+		}
+
+		if rule.UpdateMode == UpdateModeDeleteIndex {
+			req := &elastic.BulkRequest{
+				Index:   afterIndex,
+				Type:    rule.Type,
+				ID:      beforeID,
+				Parent:  beforeParentID,
+				Routing: afterRouting,
+				Action:  elastic.ActionDelete,
+			}
+			r.st.DeleteNum.Add(1)
+			reqs = append(reqs, req)
+		}
+
 		var req *elastic.BulkRequest
-		if len(rule.Pipeline) > 0 {
+		pipeline := rule.GetPipeline(canal.UpdateAction)
+		if rule.UpdateMode != UpdateModeUpdate || len(pipeline) > 0 || (len(r.c.VersionType) > 0 && len(rule.Script) == 0) {
+			// pipeline and external version don't work for partial update, so index the whole doc
 			req = r.makeInsertReqData(rule, rows[i+1], elastic.ActionIndex, beforeID, beforeParentID)
+			if req != nil {
+				req.Pipeline = pipeline
+			} else if rule.UpdateMode == UpdateModeReindex {
+				// the new row doesn't match the where, delete the doc like the update
+				req = &elastic.BulkRequest{
+					Index:   afterIndex,
+					Type:    rule.Type,
+					ID:      beforeID,
+					Parent:  beforeParentID,
+					Routing: afterRouting,
+					Action:  elastic.ActionDelete,
+				}
+			}
 		} else {
 			req = r.makeUpdateReqData(rule, rows[i], rows[i+1], beforeID, beforeParentID)
 		}
 		if req == nil {
 			continue
 		}
+		req.Index = afterIndex
+		req.Routing = afterRouting
 		r.st.UpdateNum.Add(1)
 		reqs = append(reqs, req)
 	}
@@ -333,15 +1154,18 @@ func (r *River) makeReqColumnData(col *schema.TableColumn, value interface{}) in
 			return strings.Join(sets, ",")
 		}
 	case schema.TYPE_BIT:
-		switch value := value.(type) {
-		case string:
-			// for binlog, BIT is int64, but for dump, BIT is string
-			// for dump 0x01 is for 1, \0 is for 0
-			if value == "\x01" {
-				return int64(1)
+		switch value.(type) {
+		case string, []byte:
+			// for binlog, BIT is int64, but for dump, BIT is the big-endian bytes
+			if n, ok := decodeBit(value); ok {
+				return n
 			}
-
-			return int64(0)
+			log.Warnf("invalid bit value %q for field %s", value, col.Name)
+			return nil
+		}
+	case schema.TYPE_NUMBER:
+		if isYearColumn(col) {
+			return makeYearColumnData(value)
 		}
 	case schema.TYPE_STRING:
 		switch value := value.(type) {
@@ -363,11 +1187,12 @@ func (r *River) makeReqColumnData(col *schema.TableColumn, value interface{}) in
 	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
 		switch v := value.(type) {
 		case string:
+			// the fraction like .123 is parsed too
 			vt, err := time.ParseInLocation(mysql.TimeFormat, string(v), time.Local)
 			if err != nil || vt.IsZero() { // failed to parse date or zero date
 				return nil
 			}
-			return vt.Format(time.RFC3339)
+			return vt.Format(dateTimeLayout(col))
 		}
 	case schema.TYPE_DATE:
 		switch v := value.(type) {
@@ -401,22 +1226,23 @@ func (r *River) getFieldParts(k string, v string) (string, string, string) {
 }
 
 func (r *River) makeFieldData(rule *Rule, values []interface{}) map[string]interface{}  {
-	data := make(map[string]interface{}, len(rule.FieldMapping))
-	for key, value := range rule.FieldMapping {
-		esField, mysqlField, fieldType := r.getFieldParts(key, value)
-		i := rule.TableFields[mysqlField]
-		c := rule.TableInfo.Columns[i]
-		var value interface{}
-		if fieldType == "" {
-			value = r.makeReqColumnData(&c, values[i])
-		} else {
-			value = r.getFieldValue(&c, fieldType, values[i])
-		}
-		_, pass := rule.CheckWhere(c.Name, value)
-		if !pass {
+	return r.makeDocFieldData(rule, values, rule.NullHandling == NullHandlingOmit)
+}
+
+// makeDocFieldData makes the fields of the doc, the NULL columns are left out with omitNull.
+func (r *River) makeDocFieldData(rule *Rule, values []interface{}, omitNull bool) map[string]interface{} {
+	data := elastic.NewBulkData()
+	for _, f := range rule.fields {
+		c := rule.TableInfo.Columns[f.column]
+		value := f.value(rule, values)
+		if _, pass := rule.CheckWhere(c.Name, value); !pass && !f.derived {
+			elastic.ReleaseBulkData(data)
 			return nil
 		}
-		data[esField] = value
+		if _, ok := value.(skipField); ok || value == nil && omitNull {
+			continue
+		}
+		data[f.esField] = f.label(value)
 	}
 	return data
 }
@@ -427,124 +1253,518 @@ func (r *River) makeInsertReqData(rule *Rule, values []interface{}, action, id,
 		return nil
 	}
 
-	return &elastic.BulkRequest{
-		Index:    rule.Index,
-		Type:     rule.Type,
-		ID:       id,
-		Parent:   parentID,
-		Pipeline: rule.Pipeline,
-		Action:   action,
-		Data:     data,
-	}
+	req := elastic.NewBulkRequest()
+	req.Index = rule.Index
+	req.Type = rule.Type
+	req.ID = id
+	req.Parent = parentID
+	req.Pipeline = rule.GetPipeline(canal.InsertAction)
+	req.Action = action
+	req.Data = data
+	req.Encoder = rule.encoder
+	return req
 }
 
 func (r *River) makeUpdateReqData(rule *Rule, beforeValues []interface{}, afterValues []interface{}, id, parentID string) *elastic.BulkRequest {
-	req := &elastic.BulkRequest{
-		Index:    rule.Index,
-		Type:     rule.Type,
-		ID:       id,
-		Parent:   parentID,
-		Pipeline: rule.Pipeline,
-		Action:   elastic.ActionUpdate,
-		Data: make(map[string]interface{}, len(beforeValues)),
-	}
+	req := elastic.NewBulkRequest()
+	req.Index = rule.Index
+	req.Type = rule.Type
+	req.ID = id
+	req.Parent = parentID
+	req.Pipeline = rule.Pipeline
+	req.Action = elastic.ActionUpdate
+	req.Data = elastic.NewBulkData()
+	req.Encoder = rule.encoder
 	for i, c := range rule.TableInfo.Columns {
 		exist, pass := rule.CheckWhere(c.Name, r.makeReqColumnData(&c, afterValues[i]))
 		if exist && !pass {
 			req.Action = elastic.ActionDelete
 			return req
 		}
-		if exist && !reflect.DeepEqual(afterValues[i], beforeValues[i]) {
+		if exist && !valueEqual(afterValues[i], beforeValues[i]) {
 			req.Action = elastic.ActionIndex
 		}
 	}
 
-	afterData := r.makeFieldData(rule, afterValues)
+	// the NULL columns are kept to clear the fields of the partial update
+	afterData := r.makeDocFieldData(rule, afterValues, false)
 	if afterData == nil {
+		elastic.ReleaseBulkRequest(req)
 		return nil
 	}
-	beforeData := r.makeFieldData(rule, beforeValues)
+	beforeData := r.makeDocFieldData(rule, beforeValues, false)
+	if rule.NullHandling == NullHandlingOmit {
+		for key, value := range afterData {
+			// only the fields set before are cleared, the indexed doc has no nulls
+			if v := beforeData[key]; value == nil && (v == nil || req.Action == elastic.ActionIndex) {
+				delete(afterData, key)
+			}
+		}
+	}
 	for key, value := range afterData {
 		v, ok := beforeData[key]
-		if ok && reflect.DeepEqual(value, v) && req.Action != elastic.ActionIndex {
+		if ok && valueEqual(value, v) && req.Action != elastic.ActionIndex {
 			continue
 		}
 		req.Data[key] = value
 	}
+	elastic.ReleaseBulkData(beforeData)
 	if len(req.Data) == 0 {
+		elastic.ReleaseBulkRequest(req)
+		elastic.ReleaseBulkData(afterData)
 		return nil
 	}
-	return req
-}
 
-// If id in toml file is none, get primary keys in one row and format them into a string, and PK must not be nil
-// Else get the ID's column in one row and format them into a string
-func (r *River) getDocID(rule *Rule, row []interface{}) (string, error) {
-	var (
-		ids []interface{}
-		err error
-	)
-	if rule.ID == nil {
-		ids, err = rule.TableInfo.GetPKValues(row)
-		if err != nil {
-			return "", err
+	if req.Action == elastic.ActionUpdate {
+		if rule.Upsert {
+			// the doc may be missing, so send the whole row
+			elastic.ReleaseBulkData(req.Data)
+			req.Data = afterData
+			req.Upsert = true
+			afterData = nil
 		}
-	} else {
-		ids = make([]interface{}, 0, len(rule.ID))
-		for _, column := range rule.ID {
-			value, err := rule.TableInfo.GetColumnValue(column, row)
-			if err != nil {
-				return "", err
-			}
-			ids = append(ids, value)
+		if len(rule.Script) > 0 {
+			req.Script = r.makeScript(rule, beforeValues, afterValues)
 		}
 	}
+	elastic.ReleaseBulkData(afterData)
+	return req
+}
 
-	var buf bytes.Buffer
-
-	sep := ""
-	for i, value := range ids {
-		if value == nil {
-			return "", errors.Errorf("The %ds id or PK value is nil", i)
-		}
+// makeScriptReqData makes the update with the action_script of the action mapped to script,
+// beforeValues is nil except for update. Nil is returned if the row doesn't match the where.
+func (r *River) makeScriptReqData(rule *Rule, action string, beforeValues []interface{}, values []interface{}, id, parentID string) *elastic.BulkRequest {
+	data := r.makeFieldData(rule, values)
+	if data == nil {
+		return nil
+	}
 
-		buf.WriteString(fmt.Sprintf("%s%v", sep, value))
-		sep = ":"
+	script := rule.ActionScript[action]
+	req := elastic.NewBulkRequest()
+	req.Index = rule.Index
+	req.Type = rule.Type
+	req.ID = id
+	req.Parent = parentID
+	req.Action = elastic.ActionUpdate
+	req.Encoder = rule.encoder
+	req.Script = r.makeParamsScript(rule, script.Source, script.Params, beforeValues, values)
+	if script.Upsert {
+		req.Data = data
+		req.Upsert = true
+	} else {
+		elastic.ReleaseBulkData(data)
 	}
+	return req
+}
 
-	return buf.String(), nil
+// makeScript makes the update script with the params from the row.
+func (r *River) makeScript(rule *Rule, beforeValues []interface{}, afterValues []interface{}) map[string]interface{} {
+	return r.makeParamsScript(rule, rule.Script, rule.ScriptParams, beforeValues, afterValues)
 }
 
-func (r *River) getParentID(rule *Rule, row []interface{}, columnName string) (string, error) {
-	index := rule.TableInfo.FindColumn(columnName)
-	if index < 0 {
-		return "", errors.Errorf("parent id not found %s(%s)", rule.TableInfo.Name, columnName)
+// makeParamsScript makes the script with the params from the row, and params.before
+// from the row before update if beforeValues is not nil.
+func (r *River) makeParamsScript(rule *Rule, source string, columns map[string]string, beforeValues []interface{}, values []interface{}) map[string]interface{} {
+	params := make(map[string]interface{}, len(columns)+1)
+	before := make(map[string]interface{}, len(columns))
+	for name, column := range columns {
+		i := rule.TableInfo.FindColumn(column)
+		if i < 0 {
+			continue
+		}
+		c := &rule.TableInfo.Columns[i]
+		params[name] = r.makeReqColumnData(c, values[i])
+		if beforeValues != nil {
+			before[name] = r.makeReqColumnData(c, beforeValues[i])
+		}
+	}
+	if beforeValues != nil {
+		params["before"] = before
 	}
 
-	return fmt.Sprint(row[index]), nil
+	return map[string]interface{}{
+		"source": source,
+		"lang":   "painless",
+		"params": params,
+	}
 }
 
+// doBulk sends the requests, the requests of different indices are sent concurrently,
+// the order only matters for the same doc, which is always in the same index.
 func (r *River) doBulk(reqs []*elastic.BulkRequest) error {
 	if len(reqs) == 0 {
 		return nil
 	}
-	if resp, err := r.es.Bulk(reqs); err != nil {
-		log.Errorf("sync docs err %v after binlog %s", err, r.canal.SyncedPosition())
+
+	if r.c.BulkDedup {
+		// the dropped requests are released with reqs by the caller
+		reqs = dedupRequests(reqs)
+	}
+
+	if r.sink != nil {
+		return errors.Trace(r.sink.write(reqs))
+	}
+
+	if err := r.writeES(reqs); err != nil {
 		return errors.Trace(err)
-	} else if resp.Code/100 == 2 || resp.Errors {
-		for i := 0; i < len(resp.Items); i++ {
-			for action, item := range resp.Items[i] {
-				if len(item.Error) > 0 {
-					log.Errorf("%s index: %s, type: %s, id: %s, status: %d, error: %s",
-						action, item.Index, item.Type, item.ID, item.Status, item.Error)
+	}
+
+	if r.kafka != nil {
+		// after the docs are written to ES, and before the position is saved
+		if err := r.kafka.publish(reqs); err != nil {
+			log.Errorf("publish %d docs to kafka err %v", len(reqs), err)
+			r.st.addError("publish %d docs to kafka err %v", len(reqs), err)
+			return errors.Trace(err)
+		}
+		r.st.KafkaMessageNum.Add(int64(len(reqs)))
+	}
+	return nil
+}
+
+// writeES writes the requests to ES, and to the secondary cluster.
+func (r *River) writeES(reqs []*elastic.BulkRequest) error {
+	if r.secondaryES != nil {
+		// only the requests of the default cluster are written to the secondary one
+		secondaryReqs := reqs
+		if len(r.clusters) > 0 {
+			secondaryReqs = make([]*elastic.BulkRequest, 0, len(reqs))
+			for _, req := range reqs {
+				if len(req.Cluster) == 0 {
+					secondaryReqs = append(secondaryReqs, req)
 				}
 			}
 		}
+		if len(secondaryReqs) > 0 {
+			// the requests are released after doBulk, so wait for the secondary write
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				r.sendSecondaryBulk(secondaryReqs)
+			}()
+			defer func() { <-done }()
+		}
 	}
 
+	// delay the flush if ES asks to slow down, and send the indices one by one for a while
+	until := time.Unix(0, r.slowDownUntil.Get())
+	if d := time.Until(until); d > 0 {
+		log.Infof("ES asks to slow down, delay bulk for %s", d)
+		select {
+		case <-time.After(d):
+		case <-r.ctx.Done():
+			return errors.Trace(r.ctx.Err())
+		}
+	}
+
+	groups := groupByIndex(reqs)
+	if len(groups) == 1 {
+		return r.sendBulk(reqs)
+	} else if time.Since(until) < slowDownPeriod {
+		for _, group := range groups {
+			if err := r.sendBulk(group); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(groups))
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group []*elastic.BulkRequest) {
+			defer wg.Done()
+			errs[i] = r.sendBulk(group)
+		}(i, group)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
 	return nil
 }
 
+// the indices are sent one by one in the period after ES asks to slow down
+const slowDownPeriod = time.Minute
+
+// groupByIndex groups the requests by cluster and index, the order in each group is kept.
+func groupByIndex(reqs []*elastic.BulkRequest) [][]*elastic.BulkRequest {
+	indices := make(map[[2]string]int)
+	var groups [][]*elastic.BulkRequest
+	for _, req := range reqs {
+		key := [2]string{req.Cluster, req.Index}
+		i, ok := indices[key]
+		if !ok {
+			i = len(groups)
+			indices[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], req)
+	}
+	return groups
+}
+
+// sendBulk sends the requests, and retries the rejected ones with 429 or 503 with backoff.
+func (r *River) sendBulk(reqs []*elastic.BulkRequest) error {
+	maxRetries := r.c.BulkMaxRetries
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+	backoff := time.Second
+	start := time.Now()
+
+	for retry := 0; ; retry++ {
+		retryReqs, retryAfter, err := r.sendBulkOnce(reqs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(retryReqs) == 0 {
+			r.st.LastBulkTime.Set(time.Now().UnixNano())
+			return nil
+		}
+		if retry >= maxRetries {
+			return errors.Errorf("%d docs are still not synced after %d retries in %s", len(retryReqs), retry, time.Since(start))
+		}
+
+		wait := backoff
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if maxTime := r.c.BulkMaxRetryTime.Duration; maxTime > 0 && time.Since(start)+wait > maxTime {
+			return errors.Errorf("%d docs are still not synced after %d retries in %s, exceed bulk_max_retry_time %s",
+				len(retryReqs), retry, time.Since(start), maxTime)
+		}
+		// the following flushes wait too
+		r.slowDownUntil.Set(time.Now().Add(wait).UnixNano())
+
+		r.st.BulkRetryNum.Add(int64(len(retryReqs)))
+		log.Warnf("%d docs are not synced, retry after %s", len(retryReqs), wait)
+		select {
+		case <-time.After(wait):
+		case <-r.ctx.Done():
+			return errors.Trace(r.ctx.Err())
+		}
+		backoff *= 2
+		reqs = retryReqs
+	}
+}
+
+// sendSecondaryBulk writes the requests to the secondary cluster, the failures are only logged.
+func (r *River) sendSecondaryBulk(reqs []*elastic.BulkRequest) {
+	resp, err := r.secondaryES.Bulk(reqs)
+	if err != nil {
+		r.st.SecondaryErrorNum.Add(int64(len(reqs)))
+		log.Errorf("sync %d docs to secondary ES err %v", len(reqs), err)
+		return
+	} else if resp.Code/100 != 2 {
+		r.st.SecondaryErrorNum.Add(int64(len(reqs)))
+		log.Errorf("sync %d docs to secondary ES err: %s, code: %d", len(reqs), http.StatusText(resp.Code), resp.Code)
+		return
+	} else if !resp.Errors {
+		return
+	}
+
+	for i := 0; i < len(resp.Items); i++ {
+		for action, item := range resp.Items[i] {
+			if item.Status/100 == 2 || item.Status == http.StatusConflict && len(r.c.VersionType) > 0 {
+				continue
+			}
+			r.st.SecondaryErrorNum.Add(1)
+			log.Errorf("secondary ES %s index: %s, type: %s, id: %s, status: %d, error: %s",
+				action, item.Index, item.Type, item.ID, item.Status, item.Error)
+		}
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// sendBulkOnce sends the requests and returns the ones to retry with the Retry-After
+// hint of ES. Besides the rejected ones, the following requests of the same docs are
+// retried too to keep the order. The docs rejected by the mapping are sent again at once
+// without the rejected field with mapping_conflict drop_field, the other client errors
+// are written to the dlq with bulk_client_error dlq or skipped, the server errors fail the sync.
+func (r *River) sendBulkOnce(reqs []*elastic.BulkRequest) ([]*elastic.BulkRequest, time.Duration, error) {
+	start := time.Now()
+	resp, err := r.esClient(reqs[0].Cluster).Bulk(reqs)
+	if err != nil {
+		log.Errorf("sync %d docs err %v in %s after binlog %s", len(reqs), err, time.Since(start), r.syncedPosition())
+		r.st.addError("sync %d docs err %v", len(reqs), err)
+		if _, ok := errors.Cause(err).(*url.Error); ok {
+			// network errors like timeout
+			return reqs, 0, nil
+		}
+		return nil, 0, errors.Trace(err)
+	}
+
+	if isRetryableStatus(resp.Code) {
+		return reqs, resp.RetryAfter, nil
+	} else if resp.Code/100 != 2 {
+		return nil, 0, errors.Errorf("bulk error: %s, code: %d", http.StatusText(resp.Code), resp.Code)
+	} else if !resp.Errors {
+		return nil, 0, nil
+	}
+
+	if len(resp.Items) != len(reqs) {
+		return nil, 0, errors.Errorf("bulk response has %d items, but %d requests", len(resp.Items), len(reqs))
+	}
+
+	var retryReqs, fixedReqs []*elastic.BulkRequest
+	var serverErr error
+	retryDocs := make(map[[2]string]bool)
+	fixedDocs := make(map[[2]string]bool)
+	for i, req := range reqs {
+		doc := [2]string{req.Index, req.ID}
+		for action, item := range resp.Items[i] {
+			if item.Status/100 == 4 && r.c.MappingConflict == MappingConflictDropField && len(req.Data) > 0 {
+				fixed, err := r.dropConflictField(req, item)
+				if err != nil {
+					return nil, 0, errors.Trace(err)
+				} else if fixed != nil {
+					if len(req.ID) > 0 {
+						fixedDocs[doc] = true
+					}
+					fixedReqs = append(fixedReqs, fixed)
+					continue
+				}
+			}
+
+			switch {
+			case item.Status/100 == 2:
+				if retryDocs[doc] {
+					retryReqs = append(retryReqs, req)
+				} else if fixedDocs[doc] {
+					// sent again after the fixed one to keep the order
+					fixedReqs = append(fixedReqs, req)
+				}
+			case item.Status == http.StatusConflict && len(r.c.VersionType) > 0:
+				// the doc has a newer version, the request is replayed
+			case isRetryableStatus(item.Status):
+				// the docs with the ES generated ids are never written again
+				if len(req.ID) > 0 {
+					retryDocs[doc] = true
+				}
+				retryReqs = append(retryReqs, req)
+			case item.Status/100 == 4:
+				r.st.BulkClientErrorNum.Add(1)
+				log.Errorf("%s index: %s, type: %s, id: %s, status: %d, error: %s",
+					action, item.Index, item.Type, item.ID, item.Status, item.Error)
+				r.st.addError("%s index: %s, type: %s, id: %s, status: %d, error: %s",
+					action, item.Index, item.Type, item.ID, item.Status, item.Error)
+				if r.c.BulkClientError == BulkClientErrorDLQ && r.dlq != nil {
+					if err := r.dlq.writeRejected(req, item); err != nil {
+						return nil, 0, errors.Annotatef(err, "write doc %s of index %s to dlq", req.ID, req.Index)
+					}
+					r.st.DeadLetterNum.Add(1)
+				}
+			default:
+				r.st.BulkServerErrorNum.Add(1)
+				log.Errorf("%s index: %s, type: %s, id: %s, status: %d, error: %s",
+					action, item.Index, item.Type, item.ID, item.Status, item.Error)
+				r.st.addError("%s index: %s, type: %s, id: %s, status: %d, error: %s",
+					action, item.Index, item.Type, item.ID, item.Status, item.Error)
+				serverErr = errors.Errorf("%s index: %s, type: %s, id: %s, status: %d",
+					action, item.Index, item.Type, item.ID, item.Status)
+			}
+		}
+	}
+
+	if serverErr != nil {
+		return nil, 0, serverErr
+	}
+
+	retryAfter := resp.RetryAfter
+	if len(fixedReqs) > 0 {
+		// every round drops a field, so it ends
+		moreReqs, moreRetryAfter, err := r.sendBulkOnce(fixedReqs)
+		if err != nil {
+			return nil, 0, errors.Trace(err)
+		}
+		retryReqs = append(retryReqs, moreReqs...)
+		if moreRetryAfter > retryAfter {
+			retryAfter = moreRetryAfter
+		}
+	}
+	return retryReqs, retryAfter, nil
+}
+
+func (r *River) doTruncate(rule *Rule) error {
+	if r.sink != nil && rule.Truncate != TruncateWarn {
+		log.Warnf("table %s.%s is truncated, but truncate %s is not supported with sink %s",
+			rule.Schema, rule.Table, rule.Truncate, r.c.Sink)
+		return nil
+	}
+
+	others, sameTables := r.indexSharers(rule)
+	switch rule.Truncate {
+	case TruncateDeleteByQuery:
+		query := map[string]interface{}{"match_all": map[string]interface{}{}}
+		if sameTables > 1 || others && len(rule.MetaField) == 0 {
+			r.keepTruncatedDocs(rule)
+			return nil
+		} else if others {
+			// only the docs of the table, the other tables are in the index too
+			query = map[string]interface{}{"bool": map[string]interface{}{"filter": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{rule.MetaField + ".schema": rule.Schema}},
+				map[string]interface{}{"term": map[string]interface{}{rule.MetaField + ".table": rule.Table}},
+			}}}
+		}
+		log.Infof("table %s.%s is truncated, delete its docs in index %s, type %s", rule.Schema, rule.Table, rule.indexPattern(), rule.Type)
+		return errors.Trace(r.esClient(rule.Cluster).DeleteByQuery(rule.indexPattern(), rule.Type, query))
+	case TruncateRecreate:
+		if others || sameTables > 1 {
+			r.keepTruncatedDocs(rule)
+			return nil
+		}
+		log.Infof("table %s.%s is truncated, recreate index %s", rule.Schema, rule.Table, rule.Index)
+		if err := r.esClient(rule.Cluster).DeleteIndex(rule.Index); err != nil {
+			return errors.Trace(err)
+		}
+		var body map[string]interface{}
+		if len(rule.Aliases) > 0 {
+			// keep the aliases of the deleted index
+			body = map[string]interface{}{"aliases": makeAliases(rule)}
+		}
+		return errors.Trace(r.esClient(rule.Cluster).CreateIndex(rule.Index, body))
+	default:
+		log.Warnf("!!! table %s.%s is truncated, but docs in index %s, type %s are kept, they are stale now !!!",
+			rule.Schema, rule.Table, rule.Index, rule.Type)
+		return nil
+	}
+}
+
+// indexSharers returns whether the rules of the other tables write to the index of the rule,
+// and the number of the rules of its table which do, like the same table of the upstreams.
+func (r *River) indexSharers(rule *Rule) (others bool, sameTables int) {
+	root := r.root()
+	for _, u := range append([]*River{root}, root.upstreams...) {
+		for _, other := range u.allRules() {
+			if other.Cluster != rule.Cluster || other.indexPattern() != rule.indexPattern() || other.Type != rule.Type {
+				continue
+			}
+			if other.Schema == rule.Schema && other.Table == rule.Table {
+				sameTables++
+			} else {
+				others = true
+			}
+		}
+	}
+	return others, sameTables
+}
+
+// keepTruncatedDocs warns that the docs of the truncated table can't be deleted without
+// the docs of the other tables in the same index.
+func (r *River) keepTruncatedDocs(rule *Rule) {
+	log.Warnf("!!! table %s.%s is truncated, but index %s, type %s is shared with other tables, its docs are kept for truncate %s !!!",
+		rule.Schema, rule.Table, rule.indexPattern(), rule.Type, rule.Truncate)
+	r.st.addError("table %s.%s is truncated, but index %s is shared with other tables, its docs are kept",
+		rule.Schema, rule.Table, rule.indexPattern())
+}
+
 // get mysql field value and convert it to specific value to es
 func (r *River) getFieldValue(col *schema.TableColumn, fieldType string, value interface{}) interface{} {
 	var fieldValue interface{}
@@ -558,14 +1778,45 @@ func (r *River) getFieldValue(col *schema.TableColumn, fieldType string, value i
 		}
 	case fieldTypeString:
 		fieldValue = value.(string)
+	case fieldTypeBool:
+		fieldValue = makeBoolColumnData(col, value)
+	case fieldTypeGeoShape, fieldTypeGeoPoint:
+		if value == nil {
+			return nil
+		}
+		var err error
+		if fieldType == fieldTypeGeoShape {
+			fieldValue, err = makeGeoShape(value)
+		} else {
+			fieldValue, err = makeGeoPoint(value)
+		}
+		if err != nil {
+			// the binary value is useless for ES
+			log.Warnf("convert field %s to %s fail %v, set it null", col.Name, fieldType, err)
+			return nil
+		}
 	case fieldTypeDate:
 		if col.Type == schema.TYPE_NUMBER {
 			col.Type = schema.TYPE_DATETIME
 
-			v := reflect.ValueOf(value)
-			switch v.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				fieldValue = r.makeReqColumnData(col, time.Unix(v.Int(), 0).Format(mysql.TimeFormat))
+			var sec int64
+			ok := true
+			switch v := value.(type) {
+			case int:
+				sec = int64(v)
+			case int8:
+				sec = int64(v)
+			case int16:
+				sec = int64(v)
+			case int32:
+				sec = int64(v)
+			case int64:
+				sec = v
+			default:
+				ok = false
+			}
+			if ok {
+				fieldValue = r.makeReqColumnData(col, time.Unix(sec, 0).Format(mysql.TimeFormat))
 			}
 		}
 	case filedTypeTimestamp:
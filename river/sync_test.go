@@ -0,0 +1,506 @@
+package river
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestValueEqual(c *C) {
+	values := []interface{}{nil, int32(1), int64(1), uint64(1), float64(1), "1", []byte("1"), []byte{},
+		[]interface{}{"1"}, map[string]interface{}{"a": "1"}}
+	for i, a := range values {
+		for j, b := range values {
+			c.Assert(valueEqual(a, b), Equals, reflect.DeepEqual(a, b), Commentf("%v %v", i, j))
+		}
+	}
+	c.Assert(valueEqual([]byte("1"), []byte("1")), IsTrue)
+	c.Assert(valueEqual([]interface{}{"1"}, []interface{}{"1"}), IsTrue)
+}
+
+func (s *unitTestSuite) TestGroupByIndex(c *C) {
+	reqs := []*elastic.BulkRequest{
+		{Index: "a", ID: "1"},
+		{Index: "b", ID: "1"},
+		{Index: "a", ID: "2"},
+		{Index: "a", ID: "1"},
+	}
+	groups := groupByIndex(reqs)
+	c.Assert(groups, HasLen, 2)
+	c.Assert(groups[0], DeepEquals, []*elastic.BulkRequest{reqs[0], reqs[2], reqs[3]})
+	c.Assert(groups[1], DeepEquals, []*elastic.BulkRequest{reqs[1]})
+}
+
+func (s *unitTestSuite) TestUpdateMode(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("age", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.UpdateMode, Equals, UpdateModeUpdate)
+	c.Assert(rule.rewritesUpdate(), IsFalse)
+	r.setFieldMapping(rule)
+
+	rows := [][]interface{}{{int32(1), "a", int32(10)}, {int32(1), "b", int32(10)}}
+	reqs, err := r.makeUpdateRequest(rule, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"name": "b"})
+
+	rule.UpdateMode = UpdateModeReindex
+	c.Assert(rule.rewritesUpdate(), IsTrue)
+	reqs, err = r.makeUpdateRequest(rule, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionIndex)
+	c.Assert(reqs[0].ID, Equals, "1")
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "name": "b", "age": int32(10)})
+
+	rule.UpdateMode = UpdateModeDeleteIndex
+	reqs, err = r.makeUpdateRequest(rule, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionDelete)
+	c.Assert(reqs[1].Action, Equals, elastic.ActionIndex)
+	c.Assert(reqs[1].ID, Equals, reqs[0].ID)
+
+	// the rewritten doc is not audited as deleted
+	h := &eventHandler{r: &River{c: &Config{}, audit: new(auditLog)}}
+	audited, err := h.auditDeletes(rule, reqs, &canal.RowsEvent{Action: canal.UpdateAction})
+	c.Assert(err, IsNil)
+	c.Assert(audited, HasLen, 0)
+
+	// the doc is deleted if the new row doesn't match the where
+	rule.UpdateMode = UpdateModeReindex
+	rule.Where = map[string]interface{}{"name": "a"}
+	reqs, err = r.makeUpdateRequest(rule, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionDelete)
+
+	rule = &Rule{Schema: "test", Table: "t", Index: "t", UpdateMode: "replace"}
+	c.Assert(rule.prepare(), NotNil)
+}
+
+func (s *unitTestSuite) TestActionScript(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.PKColumns = []int{0}
+
+	bad := []*Rule{
+		{Schema: "test", Table: "t", ActionMapping: map[string]string{canal.DeleteAction: ScriptAction}},
+		{Schema: "test", Table: "t", ActionScript: map[string]*ActionScript{"truncate": {Source: "ctx.op = 'noop'"}}},
+		{Schema: "test", Table: "t", ActionScript: map[string]*ActionScript{canal.DeleteAction: {}}},
+		{Schema: "test", Table: "t", AppendOnly: true, ActionMapping: map[string]string{canal.InsertAction: ScriptAction},
+			ActionScript: map[string]*ActionScript{canal.InsertAction: {Source: "ctx.op = 'noop'"}}},
+	}
+	for _, rule := range bad {
+		c.Assert(rule.prepare(), NotNil)
+	}
+
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta,
+		ActionMapping: map[string]string{canal.DeleteAction: ScriptAction, canal.UpdateAction: ScriptAction},
+		ActionScript: map[string]*ActionScript{
+			canal.DeleteAction: {Source: "ctx._source.history.add(params.name); ctx._source.deleted = true", Params: map[string]string{"name": "name"}},
+			canal.UpdateAction: {Source: "ctx._source.history.add(params.before.name)", Params: map[string]string{"name": "name"}, Upsert: true},
+		}}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.rewritesUpdate(), IsTrue)
+	r.setFieldMapping(rule)
+
+	// the deleted row is the params, and the doc is not deleted
+	reqs, err := r.makeDeleteRequest(rule, [][]interface{}{{int32(1), "a"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].ID, Equals, "1")
+	c.Assert(reqs[0].Upsert, IsFalse)
+	c.Assert(reqs[0].Data, IsNil)
+	c.Assert(reqs[0].Script, DeepEquals, map[string]interface{}{
+		"source": "ctx._source.history.add(params.name); ctx._source.deleted = true",
+		"lang":   "painless",
+		"params": map[string]interface{}{"name": "a"},
+	})
+
+	// the update has params.before, and the row as the upsert doc
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), "a"}, {int32(1), "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].Upsert, IsTrue)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "name": "b"})
+	c.Assert(reqs[0].Script["params"], DeepEquals, map[string]interface{}{"name": "b", "before": map[string]interface{}{"name": "a"}})
+
+	var buf bytes.Buffer
+	c.Assert(elastic.EncodeBulk(&buf, reqs), IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*\{"script":\{.*\},"upsert":\{.*"name":"b".*\}\}\n`)
+
+	// the doc id change is still handled by pk_change
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), "a"}, {int32(2), "a"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionDelete)
+	c.Assert(reqs[1].Action, Equals, elastic.ActionIndex)
+
+	// insert is not mapped
+	reqs, err = r.makeInsertRequest(rule, [][]interface{}{{int32(3), "c"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionIndex)
+	c.Assert(reqs[0].Script, IsNil)
+}
+
+func (s *unitTestSuite) TestRoutingChange(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "orders"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("user_id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(32)", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "orders", Index: "orders", TableInfo: ta, Routing: "user_id", PKChange: PKChangeReject}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.rewritesUpdate(), IsTrue)
+
+	r := &River{c: &Config{}, st: &stat{}}
+	r.setFieldMapping(rule)
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int32(1), int32(7), "a"}, {int32(2), nil, "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Routing, Equals, "7")
+	c.Assert(reqs[1].Routing, Equals, "")
+
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), int32(7), "a"}, {int32(1), int32(7), "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].Routing, Equals, "7")
+
+	// the old doc is deleted with the old routing, and the new one is indexed with the new routing
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), int32(7), "b"}, {int32(1), int32(8), "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionDelete)
+	c.Assert(reqs[0].Routing, Equals, "7")
+	c.Assert(reqs[1].Action, Equals, elastic.ActionIndex)
+	c.Assert(reqs[1].Routing, Equals, "8")
+
+	// the delete is not superseded by the index of the same id
+	c.Assert(dedupRequests(reqs), HasLen, 2)
+
+	reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{int32(1), int32(8), "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Routing, Equals, "8")
+}
+
+// newFakeESRiver returns a river sending the bulks to a fake ES answering with the responses
+// in order, the last one is repeated, and the bodies of the bulks received.
+func newFakeESRiver(c *C, cfg *Config, retryAfter string, responses ...string) (*River, *[]string, func()) {
+	var mu sync.Mutex
+	var bodies []string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		n := len(bodies)
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if n >= len(responses) {
+			n = len(responses) - 1
+		}
+		if len(retryAfter) > 0 {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		resp := responses[n]
+		if resp == "slow" {
+			time.Sleep(200 * time.Millisecond)
+			resp = `{"errors":false}`
+		}
+		if code, err := strconv.Atoi(resp); err == nil {
+			w.WriteHeader(code)
+			return
+		}
+		w.Write([]byte(resp))
+	}))
+
+	r := &River{c: cfg, ctx: context.Background(), st: &stat{}}
+	r.es = elastic.NewClient(&elastic.ClientConfig{
+		Addr:        strings.TrimPrefix(es.URL, "http://"),
+		BulkTimeout: cfg.BulkTimeout.Duration,
+	})
+	return r, &bodies, es.Close
+}
+
+func (s *unitTestSuite) TestSendBulkOnce(c *C) {
+	dir, err := ioutil.TempDir("", "river_bulk")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{DataDir: dir, VersionType: "external", BulkClientError: BulkClientErrorDLQ}
+	r, bodies, closeES := newFakeESRiver(c, cfg, "", `{"errors":true,"items":[`+
+		`{"index":{"status":201}},`+
+		`{"index":{"status":409,"error":{"type":"version_conflict_engine_exception"}}},`+
+		`{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},`+
+		`{"delete":{"status":403,"error":{"type":"cluster_block_exception"}}},`+
+		`{"index":{"status":400,"error":{"type":"illegal_argument_exception","reason":"bad"}}},`+
+		`{"index":{"status":200}}]}`)
+	defer closeES()
+	r.dlq, err = newDeadLetters(cfg)
+	c.Assert(err, IsNil)
+
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"a": 1}},
+		{Action: elastic.ActionIndex, Index: "t", ID: "2", Data: map[string]interface{}{"a": 2}},
+		{Action: elastic.ActionIndex, Index: "t", ID: "3", Data: map[string]interface{}{"a": 3}},
+		{Action: elastic.ActionDelete, Index: "t", ID: "4"},
+		{Action: elastic.ActionIndex, Index: "t", ID: "5", Data: map[string]interface{}{"a": "x"}},
+		// the following request of the rejected doc is retried too
+		{Action: elastic.ActionIndex, Index: "t", ID: "3", Data: map[string]interface{}{"a": 4}},
+	}
+	retryReqs, retryAfter, err := r.sendBulkOnce(reqs)
+	c.Assert(err, IsNil)
+	c.Assert(*bodies, HasLen, 1)
+	c.Assert(retryReqs, DeepEquals, []*elastic.BulkRequest{reqs[2], reqs[5]})
+	c.Assert(retryAfter, Equals, time.Duration(0))
+	c.Assert(r.st.BulkClientErrorNum.Get(), Equals, int64(2))
+	c.Assert(r.st.DeadLetterNum.Get(), Equals, int64(2))
+	c.Assert(r.dlq.Close(), IsNil)
+
+	files, err := filepath.Glob(filepath.Join(dir, "dlq", "rejected-*.ndjson"))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	body, err := ioutil.ReadFile(files[0])
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals,
+		`{"status":403,"error":{"type":"cluster_block_exception"},"action":{"delete":{"_id":"4","_index":"t"}}}`+"\n"+
+			`{"status":400,"error":{"type":"illegal_argument_exception","reason":"bad"},"action":{"index":{"_id":"5","_index":"t"}},"doc":{"a":"x"}}`+"\n")
+
+	// the server errors fail the sync
+	r, _, closeES = newFakeESRiver(c, &Config{}, "", `{"errors":true,"items":[{"index":{"status":500}}]}`)
+	defer closeES()
+	_, _, err = r.sendBulkOnce(reqs[:1])
+	c.Assert(err, ErrorMatches, ".*status: 500")
+
+	// the rejected bulk is retried with the Retry-After of ES
+	r, _, closeES = newFakeESRiver(c, &Config{}, "2", "429")
+	defer closeES()
+	retryReqs, retryAfter, err = r.sendBulkOnce(reqs)
+	c.Assert(err, IsNil)
+	c.Assert(retryReqs, DeepEquals, reqs)
+	c.Assert(retryAfter, Equals, 2*time.Second)
+
+	// the other bulk errors fail the sync
+	r, _, closeES = newFakeESRiver(c, &Config{}, "", "400")
+	defer closeES()
+	_, _, err = r.sendBulkOnce(reqs)
+	c.Assert(err, ErrorMatches, ".*code: 400")
+
+	// the timeout is retried
+	r, _, closeES = newFakeESRiver(c, &Config{BulkTimeout: TomlDuration{10 * time.Millisecond}}, "", "slow")
+	defer closeES()
+	retryReqs, _, err = r.sendBulkOnce(reqs[:1])
+	c.Assert(err, IsNil)
+	c.Assert(retryReqs, DeepEquals, reqs[:1])
+}
+
+func (s *unitTestSuite) TestSendBulkRetry(c *C) {
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionIndex, Index: "t", ID: "1", Data: map[string]interface{}{"a": 1}},
+		{Action: elastic.ActionIndex, Index: "t", ID: "2", Data: map[string]interface{}{"a": 2}},
+	}
+
+	// only the rejected doc is sent again
+	r, bodies, closeES := newFakeESRiver(c, &Config{BulkMaxRetries: 1}, "",
+		`{"errors":true,"items":[{"index":{"status":200}},{"index":{"status":503}}]}`,
+		`{"errors":false,"items":[{"index":{"status":200}}]}`)
+	defer closeES()
+	c.Assert(r.sendBulk(reqs), IsNil)
+	c.Assert(*bodies, HasLen, 2)
+	c.Assert((*bodies)[1], Equals, "{\"index\":{\"_id\":\"2\",\"_index\":\"t\"}}\n{\"a\":2}\n")
+	c.Assert(r.st.BulkRetryNum.Get(), Equals, int64(1))
+	c.Assert(r.st.LastBulkTime.Get() > 0, IsTrue)
+	// the following flushes are delayed too
+	c.Assert(r.slowDownUntil.Get() > 0, IsTrue)
+
+	// the sync fails after bulk_max_retries
+	r, bodies, closeES = newFakeESRiver(c, &Config{BulkMaxRetries: 1}, "", "429")
+	defer closeES()
+	c.Assert(r.sendBulk(reqs), ErrorMatches, "2 docs are still not synced after 1 retries.*")
+	c.Assert(*bodies, HasLen, 2)
+
+	// the Retry-After longer than bulk_max_retry_time fails the sync at once
+	r, bodies, closeES = newFakeESRiver(c, &Config{BulkMaxRetryTime: TomlDuration{time.Second}}, "30", "429")
+	defer closeES()
+	start := time.Now()
+	c.Assert(r.sendBulk(reqs), ErrorMatches, ".*exceed bulk_max_retry_time 1s")
+	c.Assert(time.Since(start) < time.Second, IsTrue)
+	c.Assert(*bodies, HasLen, 1)
+
+	// the retry is stopped with the river
+	r, _, closeES = newFakeESRiver(c, &Config{}, "30", "429")
+	defer closeES()
+	var cancel context.CancelFunc
+	r.ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	c.Assert(r.sendBulk(reqs), ErrorMatches, ".*context canceled")
+}
+
+func (s *unitTestSuite) TestTruncate(c *C) {
+	es := newFakeES(nil)
+	defer es.Close()
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", Type: "_doc", Truncate: TruncateDeleteByQuery}
+	r := &River{c: &Config{}, st: &stat{}, es: es.client(), rules: map[string]*Rule{ruleKey("test", "t"): rule}}
+
+	// all the docs of the index are the table's
+	c.Assert(r.doTruncate(rule), IsNil)
+	c.Assert(es.takeRequests(), DeepEquals, []string{
+		`POST /t/_doc/_delete_by_query?conflicts=proceed {"query":{"match_all":{}}}`})
+
+	// the other table in the index is kept, the docs are told apart by meta_field
+	other := &Rule{Schema: "test", Table: "t2", Index: "t", Type: "_doc"}
+	r.rules[ruleKey("test", "t2")] = other
+	c.Assert(r.doTruncate(rule), IsNil)
+	c.Assert(es.takeRequests(), HasLen, 0)
+	rule.MetaField = "_meta"
+	c.Assert(r.doTruncate(rule), IsNil)
+	c.Assert(es.takeRequests(), DeepEquals, []string{`POST /t/_doc/_delete_by_query?conflicts=proceed ` +
+		`{"query":{"bool":{"filter":[{"term":{"_meta.schema":"test"}},{"term":{"_meta.table":"t"}}]}}}`})
+
+	// the index is not recreated
+	rule.Truncate = TruncateRecreate
+	c.Assert(r.doTruncate(rule), IsNil)
+	c.Assert(es.takeRequests(), HasLen, 0)
+
+	// the other index and the rule from the disk queue
+	other.Index = "t2"
+	c.Assert(r.doTruncate(newQueueTruncate(rule).rule()), IsNil)
+	c.Assert(es.takeRequests(), DeepEquals, []string{"DELETE /t", "PUT /t"})
+
+	// the same table of the upstream can't be told apart
+	rule.Truncate = TruncateDeleteByQuery
+	u := &River{primary: r, st: r.st, es: r.es, rules: map[string]*Rule{ruleKey("test", "t"): rule.clone()}}
+	r.upstreams = []*River{u}
+	c.Assert(u.doTruncate(u.rules[ruleKey("test", "t")]), IsNil)
+	c.Assert(es.takeRequests(), HasLen, 0)
+	c.Assert(r.st.dash.errors, HasLen, 3)
+}
+
+func (s *unitTestSuite) TestNullHandling(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("age", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta, NullHandling: NullHandlingOmit}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+
+	// the inserted doc has no nulls
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int32(1), nil, int32(10)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "age": int32(10)})
+
+	// the field set before is cleared, the one NULL before is still omitted
+	rows := [][]interface{}{{int32(1), "a", nil}, {int32(1), nil, nil}}
+	reqs, err = r.makeUpdateRequest(rule, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"name": nil})
+
+	// the whole row of the upsert clears it too
+	rule.Upsert = true
+	reqs, err = r.makeUpdateRequest(rule, rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "name": nil})
+	rule.Upsert = false
+
+	// the doc indexed again for the new id has no nulls
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), "a", int32(10)}, {int32(2), nil, int32(10)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[1].Action, Equals, elastic.ActionIndex)
+	c.Assert(reqs[1].Data, DeepEquals, map[string]interface{}{"id": int32(2), "age": int32(10)})
+
+	// the partial row image, the NULL not in the before image clears the field
+	e := &canal.RowsEvent{Table: ta, Action: canal.UpdateAction, ColumnBitmap1: []byte{0x05}, ColumnBitmap2: []byte{0x07},
+		Rows: [][]interface{}{{int32(1), nil, nil}, {int32(1), nil, nil}}}
+	reqs, err = r.makePartialUpdateRequest(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "name": nil})
+
+	// explicit nulls by default
+	rule.NullHandling = NullHandlingNull
+	reqs, err = r.makeInsertRequest(rule, [][]interface{}{{int32(1), nil, int32(10)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1), "name": nil, "age": int32(10)})
+}
+
+func (s *unitTestSuite) TestPKChangeBulk(c *C) {
+	es := newFakeES(nil)
+	defer es.Close()
+
+	ta := &schema.Table{Schema: "test", Name: "orders"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("user_id", "int(11)", "", "")
+	ta.AddColumn("shop_id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(32)", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "orders", Index: "orders", Type: "order", TableInfo: ta,
+		Parent: "shop_id", Routing: "user_id"}
+	c.Assert(rule.prepare(), IsNil)
+
+	r := &River{c: &Config{}, ctx: context.Background(), st: &stat{}, es: es.client()}
+	r.setFieldMapping(rule)
+
+	// the old doc is deleted with its parent and routing before the new doc is indexed with the new ones
+	reqs, err := r.makeUpdateRequest(rule, [][]interface{}{{int32(1), int32(7), int32(3), "a"}, {int32(2), int32(8), int32(4), "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(r.doBulk(reqs), IsNil)
+	c.Assert(es.takeRequests(), DeepEquals, []string{"POST /_bulk " +
+		`{"delete":{"_id":"1","_index":"orders","_parent":"3","_type":"order","routing":"7"}}` + "\n" +
+		`{"index":{"_id":"2","_index":"orders","_parent":"4","_type":"order","routing":"8"}}` + "\n" +
+		`{"id":2,"user_id":8,"shop_id":4,"name":"b"}`})
+	c.Assert(r.st.DeleteNum.Get(), Equals, int64(1))
+	c.Assert(r.st.InsertNum.Get(), Equals, int64(1))
+
+	// the doc of the same id is moved like the id change if only the parent is changed,
+	// and the NULL routing is left to the parent
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(2), nil, int32(4), "b"}, {int32(2), nil, int32(5), "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(r.doBulk(reqs), IsNil)
+	c.Assert(es.takeRequests(), DeepEquals, []string{"POST /_bulk " +
+		`{"delete":{"_id":"2","_index":"orders","_parent":"4","_type":"order"}}` + "\n" +
+		`{"index":{"_id":"2","_index":"orders","_parent":"5","_type":"order"}}` + "\n" +
+		`{"id":2,"user_id":null,"shop_id":5,"name":"b"}`})
+
+	// the new row not matching the where only deletes the old doc
+	rule.Where = map[string]interface{}{"name": "b"}
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(2), int32(8), int32(4), "b"}, {int32(3), int32(8), int32(4), "c"}})
+	c.Assert(err, IsNil)
+	c.Assert(r.doBulk(reqs), IsNil)
+	c.Assert(es.takeRequests(), DeepEquals, []string{"POST /_bulk " +
+		`{"delete":{"_id":"2","_index":"orders","_parent":"4","_type":"order","routing":"8"}}`})
+}
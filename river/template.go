@@ -0,0 +1,180 @@
+package river
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// putTemplates installs or refreshes the ILM policies and index templates of rules
+// in the cluster, rules with the same template are merged into one.
+func (r *River) putTemplates(cluster string) error {
+	es := r.esClient(cluster)
+	policies := make(map[string]string)
+	templates := make(map[string]map[string]interface{})
+	// the patterns of the template, or the indices of its rules with * by default
+	patterns := make(map[string]map[string]bool)
+	defaultPatterns := make(map[string]map[string]bool)
+	for _, rule := range r.clusterRules(cluster) {
+		if len(rule.ILMPolicy) > 0 && len(rule.ILMPolicyFile) > 0 {
+			policies[rule.ILMPolicy] = rule.ILMPolicyFile
+		}
+
+		if len(rule.Template) == 0 {
+			continue
+		}
+
+		t, ok := templates[rule.Template]
+		if !ok {
+			t = map[string]interface{}{
+				"settings": make(map[string]interface{}),
+				"mappings": make(map[string]interface{}),
+			}
+			templates[rule.Template] = t
+		}
+		if len(rule.TemplatePatterns) > 0 {
+			addPatterns(patterns, rule.Template, rule.TemplatePatterns...)
+		} else {
+			addPatterns(defaultPatterns, rule.Template, rule.Index+"*")
+		}
+
+		settings := t["settings"].(map[string]interface{})
+		for k, v := range rule.Settings {
+			settings[k] = v
+		}
+		if len(rule.ILMPolicy) > 0 {
+			settings["index.lifecycle.name"] = rule.ILMPolicy
+		}
+		if len(rule.ILMRolloverAlias) > 0 {
+			settings["index.lifecycle.rollover_alias"] = rule.ILMRolloverAlias
+		}
+
+		if len(rule.Aliases) > 0 {
+			aliases, ok := t["aliases"].(map[string]interface{})
+			if !ok {
+				aliases = make(map[string]interface{}, len(rule.Aliases))
+				t["aliases"] = aliases
+			}
+			for alias, v := range makeAliases(rule) {
+				aliases[alias] = v
+			}
+		}
+
+		mappings := t["mappings"].(map[string]interface{})
+		m, ok := mappings[rule.Type].(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{"properties": make(map[string]interface{})}
+			mappings[rule.Type] = m
+		}
+		properties := m["properties"].(map[string]interface{})
+		for field, fm := range r.makeRuleMapping(rule) {
+			properties[field] = fm
+		}
+	}
+
+	for name, file := range policies {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		var policy map[string]interface{}
+		if err = json.Unmarshal(data, &policy); err != nil {
+			return errors.Annotatef(err, "invalid ILM policy file %s", file)
+		}
+
+		log.Infof("put ILM policy %s from %s", name, file)
+		if err = es.PutILMPolicy(name, policy); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for name, t := range templates {
+		set, ok := patterns[name]
+		if !ok {
+			set = defaultPatterns[name]
+		}
+		p := make([]string, 0, len(set))
+		for pattern := range set {
+			p = append(p, pattern)
+		}
+		sort.Strings(p)
+		t["index_patterns"] = p
+		log.Infof("put index template %s", name)
+		if err := es.PutTemplate(name, t); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func addPatterns(patterns map[string]map[string]bool, template string, added ...string) {
+	set, ok := patterns[template]
+	if !ok {
+		set = make(map[string]bool, len(added))
+		patterns[template] = set
+	}
+	for _, pattern := range added {
+		set[pattern] = true
+	}
+}
+
+// ensureAliases adds the missing aliases of rules in the cluster to their indices in one atomic
+// request, the indices which don't exist yet are skipped, use a template to alias them on creation.
+func (r *River) ensureAliases(cluster string) error {
+	es := r.esClient(cluster)
+	var actions []map[string]interface{}
+	added := make(map[[2]string]bool)
+	for _, rule := range r.clusterRules(cluster) {
+		if len(rule.Aliases) == 0 {
+			continue
+		}
+
+		exists, err := es.ExistsIndex(rule.Index)
+		if err != nil {
+			return errors.Trace(err)
+		} else if !exists {
+			log.Warnf("index %s doesn't exist, skip adding aliases %v", rule.Index, rule.Aliases)
+			continue
+		}
+
+		for _, alias := range rule.Aliases {
+			key := [2]string{rule.Index, alias}
+			if added[key] {
+				continue
+			}
+			added[key] = true
+
+			if exists, err = es.ExistsAlias(rule.Index, alias); err != nil {
+				return errors.Trace(err)
+			} else if exists {
+				continue
+			}
+			actions = append(actions, aliasAction("add", rule.Index, alias))
+		}
+	}
+
+	if len(actions) == 0 {
+		return nil
+	}
+
+	log.Infof("add aliases %v", actions)
+	return errors.Trace(es.UpdateAliases(actions))
+}
+
+func aliasAction(action string, index string, alias string) map[string]interface{} {
+	return map[string]interface{}{
+		action: map[string]interface{}{"index": index, "alias": alias},
+	}
+}
+
+// makeAliases makes the aliases part of the create index or template body.
+func makeAliases(rule *Rule) map[string]interface{} {
+	aliases := make(map[string]interface{}, len(rule.Aliases))
+	for _, alias := range rule.Aliases {
+		aliases[alias] = map[string]interface{}{}
+	}
+	return aliases
+}
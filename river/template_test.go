@@ -0,0 +1,116 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestPutTemplates(c *C) {
+	dir, err := ioutil.TempDir("", "river_template")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	policyFile := filepath.Join(dir, "policy.json")
+	c.Assert(ioutil.WriteFile(policyFile, []byte(`{"policy":{"phases":{"hot":{"actions":{}}}}}`), 0644), IsNil)
+
+	es := newFakeES(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/_template/broken" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(`{"acknowledged":true}`))
+	})
+	defer es.Close()
+
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	r := &River{c: &Config{}, es: es.client()}
+	logs := &Rule{Schema: "test", Table: "t", Index: "logs-a", Type: "_doc", TableInfo: ta, Filter: []string{"id"},
+		Template: "logs", TemplatePatterns: []string{"logs-*"}, Settings: map[string]interface{}{"number_of_shards": 1},
+		ILMPolicy: "logs", ILMPolicyFile: policyFile, ILMRolloverAlias: "logs", Aliases: []string{"all"}}
+	more := &Rule{Schema: "test", Table: "t2", Index: "logs-b", Type: "_doc", TableInfo: ta, Filter: []string{"name"},
+		Template: "logs", Settings: map[string]interface{}{"number_of_replicas": 0}}
+	// the rules without a template are skipped
+	plain := &Rule{Schema: "test", Table: "t3", Index: "plain", Type: "_doc", TableInfo: ta}
+	other := &Rule{Schema: "test", Table: "t4", Index: "other", Type: "_doc", TableInfo: ta, Filter: []string{"id"},
+		Template: "other"}
+	archive := &Rule{Schema: "test", Table: "t5", Index: "archive", Type: "_doc", TableInfo: ta, Filter: []string{"id"},
+		Template: "other"}
+	for _, rule := range []*Rule{logs, more, plain, other, archive} {
+		r.setFieldMapping(rule)
+	}
+	r.rules = map[string]*Rule{"a": logs, "b": more, "c": plain, "d": other, "e": archive}
+
+	c.Assert(r.putTemplates(""), IsNil)
+	requests := es.takeRequests()
+	sort.Strings(requests)
+	c.Assert(requests, DeepEquals, []string{
+		`PUT /_ilm/policy/logs {"policy":{"phases":{"hot":{"actions":{}}}}}`,
+		// the rules of the same template are merged
+		`PUT /_template/logs {"aliases":{"all":{}},"index_patterns":["logs-*"],` +
+			`"mappings":{"_doc":{"properties":{"id":{"type":"long"},"name":{"fields":{"keyword":{"ignore_above":256,"type":"keyword"}},"type":"text"}}}},` +
+			`"settings":{"index.lifecycle.name":"logs","index.lifecycle.rollover_alias":"logs","number_of_replicas":0,"number_of_shards":1}}`,
+		// the patterns are the indices with * by default
+		`PUT /_template/other {"index_patterns":["archive*","other*"],"mappings":{"_doc":{"properties":{"id":{"type":"long"}}}},"settings":{}}`,
+	})
+
+	// the errors of ES and the invalid policy files fail the start
+	other.Template = "broken"
+	c.Assert(r.putTemplates(""), ErrorMatches, ".*code: 400")
+	es.takeRequests()
+	other.Template = "other"
+	c.Assert(ioutil.WriteFile(policyFile, []byte(`{"policy":`), 0644), IsNil)
+	c.Assert(r.putTemplates(""), ErrorMatches, "invalid ILM policy file .*")
+	logs.ILMPolicyFile = filepath.Join(dir, "missing.json")
+	c.Assert(r.putTemplates(""), NotNil)
+	c.Assert(strings.Contains(strings.Join(es.takeRequests(), "\n"), "/_ilm/policy/"), IsFalse)
+}
+
+func (s *unitTestSuite) TestEnsureAliases(c *C) {
+	es := newFakeES(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "HEAD /a", "HEAD /b", "HEAD /a/_alias/old", "POST /_aliases":
+		case "HEAD /locked":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("{}"))
+	})
+	defer es.Close()
+
+	a := &Rule{Schema: "test", Table: "a", Index: "a", Aliases: []string{"old", "all"}}
+	// the same alias of the same index is added once
+	a2 := &Rule{Schema: "test", Table: "a2", Index: "a", Aliases: []string{"all"}}
+	b := &Rule{Schema: "test", Table: "b", Index: "b", Aliases: []string{"all"}}
+	// the missing indices are skipped
+	missing := &Rule{Schema: "test", Table: "m", Index: "missing", Aliases: []string{"all"}}
+	r := &River{c: &Config{}, es: es.client(), rules: map[string]*Rule{"a": a, "a2": a2, "b": b, "m": missing,
+		"n": {Schema: "test", Table: "n", Index: "n"}}}
+
+	c.Assert(r.ensureAliases(""), IsNil)
+	var adds []string
+	for _, req := range es.takeRequests() {
+		if strings.HasPrefix(req, "POST ") {
+			adds = append(adds, req)
+		}
+	}
+	c.Assert(adds, HasLen, 1)
+	c.Assert(strings.Contains(adds[0], `{"add":{"alias":"all","index":"a"}}`), IsTrue)
+	c.Assert(strings.Contains(adds[0], `{"add":{"alias":"all","index":"b"}}`), IsTrue)
+	c.Assert(strings.Count(adds[0], `"add"`), Equals, 2)
+
+	// nothing to add
+	r.rules = map[string]*Rule{"a": {Schema: "test", Table: "a", Index: "a", Aliases: []string{"old"}}}
+	c.Assert(r.ensureAliases(""), IsNil)
+	c.Assert(es.takeRequests(), DeepEquals, []string{"HEAD /a", "HEAD /a/_alias/old"})
+
+	r.rules = map[string]*Rule{"l": {Schema: "test", Table: "l", Index: "locked", Aliases: []string{"all"}}}
+	c.Assert(r.ensureAliases(""), ErrorMatches, ".*code: 403")
+}
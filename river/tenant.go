@@ -0,0 +1,46 @@
+package river
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// the characters not allowed in the index names are replaced in the tenant suffixes
+var tenantSuffixReplacer = strings.NewReplacer(
+	`\`, "-", "/", "-", "*", "-", "?", "-", `"`, "-", "<", "-", ">", "-", "|", "-",
+	" ", "-", ",", "-", "#", "-", ":", "-",
+)
+
+// rowIndex returns the index of the row, the index with the tenant suffix of the
+// index_suffix_column like orders_acme, or the index itself without it.
+func (r *Rule) rowIndex(values []interface{}) (string, error) {
+	if len(r.IndexSuffixColumn) == 0 {
+		return r.Index, nil
+	}
+	value, err := r.TableInfo.GetColumnValue(r.IndexSuffixColumn, values)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if value == nil {
+		return "", errors.Errorf("the index_suffix_column %s value is nil", r.IndexSuffixColumn)
+	}
+
+	var buf bytes.Buffer
+	writePlainIDValue(&buf, value)
+	suffix := tenantSuffixReplacer.Replace(strings.ToLower(buf.String()))
+	if len(suffix) == 0 {
+		return "", errors.Errorf("the index_suffix_column %s value is empty", r.IndexSuffixColumn)
+	}
+	return r.Index + "_" + suffix, nil
+}
+
+// indexPattern returns the index, or the pattern of all the tenant indices with
+// index_suffix_column, for the requests of the whole rule like the truncate.
+func (r *Rule) indexPattern() string {
+	if len(r.IndexSuffixColumn) == 0 {
+		return r.Index
+	}
+	return r.Index + "_*"
+}
@@ -0,0 +1,76 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestIndexSuffixColumn(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "orders"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("tenant_id", "varchar(32)", "", "")
+	ta.AddColumn("name", "varchar(32)", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "orders", Index: "orders", TableInfo: ta, IndexSuffixColumn: "tenant_id",
+		Truncate: TruncateDeleteByQuery}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.Template, Equals, "orders")
+	c.Assert(rule.indexPattern(), Equals, "orders_*")
+
+	r := &River{c: &Config{AutoCreateIndex: true}, st: &stat{}}
+	r.setFieldMapping(rule)
+	c.Assert(r.createsIndex(rule), IsFalse)
+
+	index, err := rule.rowIndex([]interface{}{int32(1), "Acme Inc", "a"})
+	c.Assert(err, IsNil)
+	c.Assert(index, Equals, "orders_acme-inc")
+	_, err = rule.rowIndex([]interface{}{int32(1), nil, "a"})
+	c.Assert(err, NotNil)
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int32(1), "acme", "a"}, {int32(2), "globex", "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Index, Equals, "orders_acme")
+	c.Assert(reqs[1].Index, Equals, "orders_globex")
+
+	reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{int32(1), "acme", "a"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Index, Equals, "orders_acme")
+
+	// an update in the tenant updates the doc of its index
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), "acme", "a"}, {int32(1), "acme", "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].Index, Equals, "orders_acme")
+
+	// the doc moving to another tenant is deleted from the old index, even with pk_change reject
+	rule.PKChange = PKChangeReject
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), "acme", "b"}, {int32(1), "globex", "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionDelete)
+	c.Assert(reqs[0].Index, Equals, "orders_acme")
+	c.Assert(reqs[1].Action, Equals, elastic.ActionIndex)
+	c.Assert(reqs[1].Index, Equals, "orders_globex")
+	c.Assert(reqs[1].ID, Equals, "1")
+
+	// the appended docs too
+	h := &eventHandler{r: r}
+	e := &canal.RowsEvent{Action: canal.InsertAction, Table: ta, Rows: [][]interface{}{{int32(3), "initech", "c"}}}
+	reqs, err = h.makeAppendRequest(rule, e, e.Rows)
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Index, Equals, "orders_initech")
+
+	// the whole rule requests are sent to all the tenant indices
+	c.Assert(newQueueTruncate(rule).Index, Equals, "orders_*")
+
+	for _, bad := range []*Rule{
+		{Schema: "test", Table: "t", IndexSuffixColumn: "tenant_id", Truncate: TruncateRecreate},
+		{Schema: "test", Table: "t", IndexSuffixColumn: "tenant_id", MissingIndex: MissingIndexRequire},
+	} {
+		c.Assert(bad.prepare(), NotNil)
+	}
+}
@@ -0,0 +1,88 @@
+package river
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ruleTable is a table matched by a wildcard table or a schema regex of the sources.
+type ruleTable struct {
+	schema string
+	table  string
+}
+
+// isSchemaRegex checks whether the schema of the source or rule is a regex like
+// tenant_\d+, which matches the schemas of the tenants with the same tables.
+func isSchemaRegex(schema string) bool {
+	return regexp.QuoteMeta(schema) != schema
+}
+
+// compileSchemaRegex compiles the schema regex, it matches the whole schema names
+// case-insensitively.
+func compileSchemaRegex(schema string) (*regexp.Regexp, error) {
+	reg, err := regexp.Compile("(?i)^(?:" + schema + ")$")
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid schema regex %s", schema)
+	}
+	return reg, nil
+}
+
+// matchSchemas returns the schemas matching the schema regex, the ignored ones are skipped.
+func (r *River) matchSchemas(reg *regexp.Regexp) ([]string, error) {
+	res, err := r.canal.Execute("SELECT schema_name FROM information_schema.schemata")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var schemas []string
+next:
+	for i := 0; i < res.Resultset.RowNumber(); i++ {
+		schema, _ := res.GetString(i, 0)
+		if !reg.MatchString(schema) {
+			continue
+		}
+		for _, s := range r.c.IgnoreSchemas {
+			if strings.EqualFold(s, schema) {
+				continue next
+			}
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+// matchesSchema checks whether the schema is the one of the rule, or matches its schema regex.
+func (r *Rule) matchesSchema(schema string) bool {
+	if r.schemaRegex != nil {
+		return r.schemaRegex.MatchString(schema)
+	}
+	return strings.EqualFold(r.Schema, schema)
+}
+
+// schemaIndex returns the index of the rule for the schema, {name} and {n} in the index
+// are replaced by the named and numbered groups of the schema regex captured from the
+// schema, like orders_{tenant} with tenant_(?P<tenant>\d+).
+func (r *Rule) schemaIndex(schema string) string {
+	if r.schemaRegex == nil || !strings.Contains(r.Index, "{") {
+		return r.Index
+	}
+	groups := r.schemaRegex.FindStringSubmatch(schema)
+	if groups == nil {
+		return r.Index
+	}
+
+	var oldnew []string
+	for i, name := range r.schemaRegex.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		oldnew = append(oldnew, "{"+strconv.Itoa(i)+"}", groups[i])
+		if len(name) > 0 {
+			oldnew = append(oldnew, "{"+name+"}", groups[i])
+		}
+	}
+	return strings.NewReplacer(oldnew...).Replace(r.Index)
+}
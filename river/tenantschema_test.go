@@ -0,0 +1,48 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+)
+
+func (s *unitTestSuite) TestSchemaRegex(c *C) {
+	c.Assert(isSchemaRegex("tenant_1"), IsFalse)
+	c.Assert(isSchemaRegex(`tenant_\d+`), IsTrue)
+
+	w := &Rule{Schema: `tenant_(?P<tenant>\d+)`, Table: "orders", Index: "orders_{tenant}"}
+	c.Assert(w.prepare(), IsNil)
+	c.Assert(w.matchesSchema("Tenant_12"), IsTrue)
+	c.Assert(w.matchesSchema("tenant_12_old"), IsFalse)
+	c.Assert(w.matchesSchema("tenant_"), IsFalse)
+	c.Assert(w.schemaIndex("tenant_12"), Equals, "orders_12")
+	c.Assert((&Rule{Schema: "tenant_1", Index: "orders_{tenant}"}).schemaIndex("tenant_1"), Equals, "orders_{tenant}")
+
+	cfg := &Config{Sources: []SourceConfig{{Schema: w.Schema, Tables: []string{"orders"}, Exclude: []string{"orders_old"}}},
+		IgnoreSchemas: []string{"tenant_0"}}
+	r := &River{c: cfg, wildRules: map[string]*Rule{ruleKey(w.Schema, w.Table): w}}
+	var err error
+	r.excludeTableRegex, err = compileExcludes(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(r.isIgnoredTable("tenant_9", "orders_old"), IsTrue)
+	c.Assert(r.isIgnoredTable("tenant_9", "orders"), IsFalse)
+	c.Assert(r.isIgnoredTable("shop", "orders_old"), IsFalse)
+	c.Assert(r.isIgnoredTable("tenant_0", "orders"), IsTrue)
+
+	// the tables of the new schemas are synced into their own indices
+	rule, err := r.matchWildcardRule("tenant_7", "orders")
+	c.Assert(err, IsNil)
+	c.Assert(rule.Schema, Equals, "tenant_7")
+	c.Assert(rule.Index, Equals, "orders_7")
+	c.Assert(rule.schemaRegex, IsNil)
+	for _, t := range [][2]string{{"tenant_7", "orders_2"}, {"shop", "orders"}, {"tenant_0", "orders"}} {
+		rule, err = r.matchWildcardRule(t[0], t[1])
+		c.Assert(err, IsNil)
+		c.Assert(rule, IsNil)
+	}
+
+	// the numbered groups
+	w = &Rule{Schema: `(shop|tenant)_(\d+)`, Table: "*", Index: "{1}-{2}"}
+	c.Assert(w.prepare(), IsNil)
+	c.Assert(w.schemaIndex("shop_3"), Equals, "shop-3")
+
+	c.Assert((&Rule{Schema: `tenant_(\d+`, Table: "orders"}).prepare(), NotNil)
+}
@@ -0,0 +1,187 @@
+package river
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// mysqlTime is the TIME value, which may be negative and more than 24 hours.
+type mysqlTime struct {
+	negative bool
+	hours    int64
+	minutes  int64
+	seconds  int64
+	// the fraction digits, like "500" for .500
+	fraction string
+}
+
+// parseMySQLTime parses the TIME like -838:59:59.000000 from the binlog and the dump.
+func parseMySQLTime(s string) (*mysqlTime, error) {
+	t := new(mysqlTime)
+	v := s
+	if strings.HasPrefix(v, "-") {
+		t.negative = true
+		v = v[1:]
+	}
+	if i := strings.IndexByte(v, '.'); i >= 0 {
+		for _, c := range v[i+1:] {
+			if c < '0' || c > '9' {
+				return nil, errors.Errorf("invalid TIME %s", s)
+			}
+		}
+		t.fraction = strings.TrimRight(v[i+1:], "0")
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ":")
+	if len(parts) != 3 {
+		return nil, errors.Errorf("invalid TIME %s", s)
+	}
+	values := make([]int64, 3)
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || n < 0 || i > 0 && n > 59 {
+			return nil, errors.Errorf("invalid TIME %s", s)
+		}
+		values[i] = n
+	}
+	t.hours, t.minutes, t.seconds = values[0], values[1], values[2]
+	if t.hours == 0 && t.minutes == 0 && t.seconds == 0 && len(t.fraction) == 0 {
+		// -00:00:00 is 0
+		t.negative = false
+	}
+	return t, nil
+}
+
+// Seconds returns int64 without the fraction, or float64.
+func (t *mysqlTime) Seconds() interface{} {
+	total := t.hours*3600 + t.minutes*60 + t.seconds
+	if len(t.fraction) == 0 {
+		if t.negative {
+			return -total
+		}
+		return total
+	}
+	f, _ := strconv.ParseFloat(fmt.Sprintf("%d.%s", total, t.fraction), 64)
+	if t.negative {
+		return -f
+	}
+	return f
+}
+
+// Duration returns the ISO-8601 duration like PT1H2M3.5S, the zero parts are omitted.
+func (t *mysqlTime) Duration() string {
+	var b strings.Builder
+	if t.negative {
+		b.WriteByte('-')
+	}
+	b.WriteString("PT")
+	if t.hours > 0 {
+		fmt.Fprintf(&b, "%dH", t.hours)
+	}
+	if t.minutes > 0 {
+		fmt.Fprintf(&b, "%dM", t.minutes)
+	}
+	if t.seconds > 0 || len(t.fraction) > 0 || t.hours == 0 && t.minutes == 0 {
+		fmt.Fprintf(&b, "%d", t.seconds)
+		if len(t.fraction) > 0 {
+			b.WriteString("." + t.fraction)
+		}
+		b.WriteByte('S')
+	}
+	return b.String()
+}
+
+// makeTimeColumnData converts the TIME column in time_format of the rule,
+// the raw value is kept if it can't be parsed.
+func makeTimeColumnData(rule *Rule, col *schema.TableColumn, value interface{}) interface{} {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return value
+	}
+
+	t, err := parseMySQLTime(s)
+	if err != nil {
+		log.Warnf("convert field %s to %s fail %v, keep it raw", col.Name, rule.TimeFormat, err)
+		return s
+	}
+	if rule.TimeFormat == TimeFormatSeconds {
+		return t.Seconds()
+	}
+	return t.Duration()
+}
+
+// timeSecondsMapping is long for TIME, and double for TIME with the fraction like TIME(3).
+func timeSecondsMapping(col *schema.TableColumn) map[string]interface{} {
+	rawType := strings.ToLower(col.RawType)
+	if strings.HasPrefix(rawType, "time(") && !strings.HasPrefix(rawType, "time(0)") {
+		return map[string]interface{}{"type": "double"}
+	}
+	return map[string]interface{}{"type": "long"}
+}
+
+// dateTimeLayouts are the RFC3339 layouts with the fractional seconds
+// of DATETIME(fsp) and TIMESTAMP(fsp), the digits are kept for ordering.
+var dateTimeLayouts = [...]string{
+	time.RFC3339,
+	"2006-01-02T15:04:05.0Z07:00",
+	"2006-01-02T15:04:05.00Z07:00",
+	"2006-01-02T15:04:05.000Z07:00",
+	"2006-01-02T15:04:05.0000Z07:00",
+	"2006-01-02T15:04:05.00000Z07:00",
+	"2006-01-02T15:04:05.000000Z07:00",
+}
+
+// dateTimeLayout returns the layout of the fractional seconds precision of the column.
+func dateTimeLayout(col *schema.TableColumn) string {
+	rawType := col.RawType
+	start := strings.IndexByte(rawType, '(')
+	end := strings.IndexByte(rawType, ')')
+	if start < 0 || end < start {
+		return time.RFC3339
+	}
+	fsp, err := strconv.Atoi(rawType[start+1 : end])
+	if err != nil || fsp < 0 || fsp >= len(dateTimeLayouts) {
+		return time.RFC3339
+	}
+	return dateTimeLayouts[fsp]
+}
+
+func isYearColumn(col *schema.TableColumn) bool {
+	return strings.HasPrefix(strings.ToLower(col.RawType), "year")
+}
+
+// makeYearColumnData converts YEAR to int64, the binlog has int and the dump has int64,
+// the zero year 0000 is null, it is 1900 in the binlog.
+func makeYearColumnData(value interface{}) interface{} {
+	var year int64
+	switch v := value.(type) {
+	case int:
+		year = int64(v)
+	case int64:
+		year = v
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return value
+		}
+		year = n
+	default:
+		return value
+	}
+	if year == 0 || year == 1900 {
+		return nil
+	}
+	return year
+}
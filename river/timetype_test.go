@@ -0,0 +1,139 @@
+package river
+
+import (
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestTimeAndYear(c *C) {
+	tests := []struct {
+		raw      string
+		seconds  interface{}
+		duration string
+	}{
+		{"12:34:56", int64(45296), "PT12H34M56S"},
+		{"-838:59:59", int64(-3020399), "-PT838H59M59S"},
+		{"00:00:00", int64(0), "PT0S"},
+		{"-00:00:00", int64(0), "PT0S"},
+		{"-00:00:01.500000", -1.5, "-PT1.5S"},
+		{"100:00:00.000", int64(360000), "PT100H"},
+		{"00:01:00.25", 60.25, "PT1M0.25S"},
+	}
+	seconds := &Rule{TimeFormat: TimeFormatSeconds}
+	duration := &Rule{TimeFormat: TimeFormatDuration}
+	col := &schema.TableColumn{Name: "t", Type: schema.TYPE_TIME, RawType: "time"}
+	for _, t := range tests {
+		c.Assert(makeTimeColumnData(seconds, col, t.raw), Equals, t.seconds, Commentf("%s", t.raw))
+		c.Assert(makeTimeColumnData(duration, col, []byte(t.raw)), Equals, t.duration, Commentf("%s", t.raw))
+	}
+	for _, raw := range []string{"12:34", "12:60:00", "a:00:00", "00:00:00.1x"} {
+		_, err := parseMySQLTime(raw)
+		c.Assert(err, NotNil, Commentf("%s", raw))
+		c.Assert(makeTimeColumnData(seconds, col, raw), Equals, raw)
+	}
+	c.Assert(makeTimeColumnData(seconds, col, nil), IsNil)
+
+	c.Assert(timeSecondsMapping(col), DeepEquals, map[string]interface{}{"type": "long"})
+	c.Assert(timeSecondsMapping(&schema.TableColumn{RawType: "time(3)"}), DeepEquals, map[string]interface{}{"type": "double"})
+
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TimeFormat: "minutes"}
+	c.Assert(rule.prepare(), NotNil)
+
+	r := &River{}
+	year := &schema.TableColumn{Name: "y", Type: schema.TYPE_NUMBER, RawType: "year(4)"}
+	// binlog
+	c.Assert(r.makeReqColumnData(year, 2024), Equals, int64(2024))
+	c.Assert(r.makeReqColumnData(year, 1900), IsNil)
+	// dump
+	c.Assert(r.makeReqColumnData(year, int64(1999)), Equals, int64(1999))
+	c.Assert(r.makeReqColumnData(year, int64(0)), IsNil)
+	// not year
+	c.Assert(r.makeReqColumnData(&schema.TableColumn{Type: schema.TYPE_NUMBER, RawType: "int(11)"}, 0), Equals, 0)
+}
+
+func (s *unitTestSuite) TestDateTimeFraction(c *C) {
+	r := &River{}
+	loc := time.Local
+	defer func() { time.Local = loc }()
+	time.Local = time.UTC
+
+	tests := []struct {
+		rawType string
+		value   string
+		result  string
+	}{
+		{"datetime", "2026-10-16 08:30:00", "2026-10-16T08:30:00Z"},
+		{"datetime", "2026-10-16 08:30:00.123", "2026-10-16T08:30:00Z"},
+		{"datetime(3)", "2026-10-16 08:30:00.120", "2026-10-16T08:30:00.120Z"},
+		{"datetime(6)", "2026-10-16 08:30:00.000001", "2026-10-16T08:30:00.000001Z"},
+		{"timestamp(3)", "2026-10-16 08:30:00.999", "2026-10-16T08:30:00.999Z"},
+		{"timestamp(2)", "2026-10-16 08:30:00", "2026-10-16T08:30:00.00Z"},
+	}
+	for _, t := range tests {
+		col := &schema.TableColumn{Name: "t", Type: schema.TYPE_DATETIME, RawType: t.rawType}
+		c.Assert(r.makeReqColumnData(col, t.value), Equals, t.result, Commentf("%s %s", t.rawType, t.value))
+	}
+	col := &schema.TableColumn{Name: "t", Type: schema.TYPE_DATETIME, RawType: "datetime(3)"}
+	c.Assert(r.makeReqColumnData(col, "0000-00-00 00:00:00.000"), IsNil)
+}
+
+func (s *unitTestSuite) TestInvalidDate(c *C) {
+	loc := time.Local
+	defer func() { time.Local = loc }()
+	time.Local = time.UTC
+
+	date := &schema.TableColumn{Name: "d", Type: schema.TYPE_DATE, RawType: "date"}
+	datetime := &schema.TableColumn{Name: "dt", Type: schema.TYPE_DATETIME, RawType: "datetime"}
+	tests := []struct {
+		policy string
+		col    *schema.TableColumn
+		value  interface{}
+		result interface{}
+	}{
+		{InvalidDateNull, date, "0000-00-00", nil},
+		{InvalidDateNull, datetime, "0000-00-00 00:00:00", nil},
+		{InvalidDateNull, date, "2026-02-30", nil},
+		{InvalidDateSentinel, date, "0000-00-00", "1970-01-01"},
+		{InvalidDateSentinel, datetime, "0000-00-00 00:00:00", "1970-01-01"},
+		{InvalidDateRaw, date, "0000-00-00", "0000-00-00"},
+		{InvalidDateRaw, datetime, "0000-00-00 00:00:00", "0000-00-00 00:00:00"},
+		{InvalidDateRaw, date, "2026-02-30", "2026-02-30"},
+		{InvalidDateSkip, date, "0000-00-00", skipField{}},
+		{InvalidDateSkip, datetime, "0000-00-00 00:00:00", skipField{}},
+	}
+	for _, t := range tests {
+		r := &River{st: &stat{}}
+		rule := &Rule{InvalidDate: t.policy, InvalidDateSentinel: "1970-01-01"}
+		comment := Commentf("%s %s %v", t.policy, t.col.RawType, t.value)
+		c.Assert(r.makeDateColumnData(rule, t.col, t.value, r.makeReqColumnData), DeepEquals, t.result, comment)
+		c.Assert(r.st.InvalidDateNum.Get(), Equals, int64(1), comment)
+
+		// the valid dates and the NULLs are not handled by the policy
+		c.Assert(r.makeDateColumnData(rule, date, "2026-10-16", r.makeReqColumnData), Equals, "2026-10-16", comment)
+		c.Assert(r.makeDateColumnData(rule, datetime, "2026-10-16 08:30:00", r.makeReqColumnData), Equals, "2026-10-16T08:30:00Z", comment)
+		c.Assert(r.makeDateColumnData(rule, date, nil, r.makeReqColumnData), IsNil, comment)
+		c.Assert(r.st.InvalidDateNum.Get(), Equals, int64(1), comment)
+	}
+
+	// the skipped field is omitted from the doc
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("d", "date", "", "")
+	ta.PKColumns = []int{0}
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta, InvalidDate: InvalidDateSkip}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int32(1), "0000-00-00"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int32(1)})
+
+	for _, rule := range []*Rule{
+		{Schema: "test", Table: "t", Index: "t", InvalidDate: InvalidDateSentinel},
+		{Schema: "test", Table: "t", Index: "t", InvalidDate: "zero"},
+	} {
+		c.Assert(rule.prepare(), NotNil)
+	}
+}
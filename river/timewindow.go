@@ -0,0 +1,116 @@
+package river
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// windowUnix returns the unix seconds of the time, 0 for the zero time.
+func windowUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// setTimeWindow sets the time window from ignore_before_ts and ignore_after_ts.
+func (r *River) setTimeWindow() error {
+	before, after := windowUnix(r.c.IgnoreBeforeTS), windowUnix(r.c.IgnoreAfterTS)
+	if before > 0 && after > 0 && after < before {
+		return errors.Errorf("ignore_after_ts %s must not be earlier than ignore_before_ts %s",
+			formatWindowTime(after), formatWindowTime(before))
+	}
+	r.ignoreBeforeTS.Set(before)
+	r.ignoreAfterTS.Set(after)
+	if before > 0 || after > 0 {
+		log.Infof("only apply the binlog events in [%s, %s]", formatWindowTime(before), formatWindowTime(after))
+	}
+	return nil
+}
+
+// outOfTimeWindow checks whether the binlog event at ts in unix seconds is out of the
+// time window of ignore_before_ts and ignore_after_ts.
+func (r *River) outOfTimeWindow(ts uint32) bool {
+	r = r.root()
+	if before := r.ignoreBeforeTS.Get(); before > 0 && int64(ts) < before {
+		return true
+	}
+	if after := r.ignoreAfterTS.Get(); after > 0 && int64(ts) > after {
+		return true
+	}
+	return false
+}
+
+// parseWindowTime parses the time in RFC 3339 or unix seconds, empty is the zero time.
+func parseWindowTime(v string) (time.Time, error) {
+	if len(v) == 0 {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if sec == 0 {
+			return time.Time{}, nil
+		}
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, errors.Trace(err)
+}
+
+func formatWindowTime(sec int64) string {
+	if sec == 0 {
+		return "none"
+	}
+	return time.Unix(sec, 0).Format(time.RFC3339)
+}
+
+// serveTimeWindow serves the time window with GET, and changes it with POST like
+// "before=2026-10-01T00:00:00Z&after=1759363200", an empty or 0 time removes the limit,
+// the time not in the form is kept.
+func (s *stat) serveTimeWindow(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		root := s.r.root()
+		window := map[string]int64{"before": root.ignoreBeforeTS.Get(), "after": root.ignoreAfterTS.Get()}
+		for name := range window {
+			if _, ok := r.Form[name]; !ok {
+				continue
+			}
+			v := strings.TrimSpace(r.Form.Get(name))
+			t, err := parseWindowTime(v)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("invalid %s %s\n", name, v)))
+				return
+			}
+			window[name] = windowUnix(t)
+		}
+		before, after := window["before"], window["after"]
+		if before > 0 && after > 0 && after < before {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("after must not be earlier than before\n"))
+			return
+		}
+		root.ignoreBeforeTS.Set(before)
+		root.ignoreAfterTS.Set(after)
+		log.Warnf("time window is changed to [%s, %s] by %s", formatWindowTime(before), formatWindowTime(after), r.RemoteAddr)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	root := s.r.root()
+	w.Write([]byte(fmt.Sprintf("before:%s\nafter:%s\n", formatWindowTime(root.ignoreBeforeTS.Get()),
+		formatWindowTime(root.ignoreAfterTS.Get()))))
+}
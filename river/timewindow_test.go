@@ -0,0 +1,70 @@
+package river
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func (s *unitTestSuite) TestTimeWindow(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+
+	cfg := &Config{IgnoreBeforeTS: time.Unix(1000, 0), IgnoreAfterTS: time.Unix(2000, 0)}
+	r := &River{c: cfg, ctx: context.Background(), st: &stat{}, syncCh: make(chan interface{}, 4),
+		rules: map[string]*Rule{ruleKey("test", "t"): rule}, limits: newRateLimits(0, 0)}
+	r.st.r = r
+	c.Assert(r.setTimeWindow(), IsNil)
+	h := &eventHandler{r: r}
+
+	for ts, out := range map[uint32]bool{999: true, 1000: false, 2000: false, 2001: true} {
+		c.Assert(r.outOfTimeWindow(ts), Equals, out, Commentf("ts %d", ts))
+	}
+
+	e := &canal.RowsEvent{Action: canal.InsertAction, Table: ta, Rows: [][]interface{}{{int32(1)}},
+		Header: &replication.EventHeader{Timestamp: 500, LogPos: 120}}
+	c.Assert(h.OnRow(e), IsNil)
+	c.Assert(r.syncCh, HasLen, 0)
+	c.Assert(r.st.TimeWindowSkipNum.Get(), Equals, int64(1))
+	// the dumped rows have no time
+	e.Header = nil
+	c.Assert(h.OnRow(e), IsNil)
+	c.Assert(r.syncCh, HasLen, 1)
+	<-r.syncCh
+
+	// the window is changed by the API, the time not in the form is kept
+	w := httptest.NewRecorder()
+	r.st.serveTimeWindow(w, httptest.NewRequest("POST", "/timewindow?before=x", nil))
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	w = httptest.NewRecorder()
+	r.st.serveTimeWindow(w, httptest.NewRequest("POST", "/timewindow?after=100", nil))
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	w = httptest.NewRecorder()
+	r.st.serveTimeWindow(w, httptest.NewRequest("POST", "/timewindow?before=0", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "before:none\nafter:"+time.Unix(2000, 0).Format(time.RFC3339)+"\n")
+	c.Assert(r.outOfTimeWindow(500), IsFalse)
+	w = httptest.NewRecorder()
+	r.st.serveTimeWindow(w, httptest.NewRequest("POST", "/timewindow?after=&before=1970-01-01T00:10:00Z", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(r.ignoreBeforeTS.Get(), Equals, int64(600))
+	c.Assert(r.ignoreAfterTS.Get(), Equals, int64(0))
+	c.Assert(r.outOfTimeWindow(3000), IsFalse)
+
+	cfg.IgnoreAfterTS = time.Unix(500, 0)
+	c.Assert(r.setTimeWindow(), NotNil)
+
+	cfg, err := NewConfig("ignore_before_ts = 2026-10-01T00:00:00Z")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.IgnoreBeforeTS.Unix(), Equals, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC).Unix())
+	c.Assert(cfg.IgnoreAfterTS.IsZero(), IsTrue)
+}
@@ -0,0 +1,45 @@
+package river
+
+import (
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// How to sync the deletes for the rule.
+const (
+	// delete the doc
+	DeleteModeDelete = "delete"
+	// mark the doc deleted with the tombstone fields
+	DeleteModeTombstone = "tombstone"
+)
+
+// tombstoneDeletes replaces the delete requests of the rule with the updates which set the
+// tombstone fields, the deletion time is the binlog event time, or now for the dumped rows.
+// The deletes of update_mode delete_index are kept, the docs are indexed again.
+func tombstoneDeletes(rule *Rule, reqs []*elastic.BulkRequest, e *canal.RowsEvent) {
+	deletedAt := time.Now().UTC()
+	if e.Header != nil {
+		deletedAt = time.Unix(int64(e.Header.Timestamp), 0).UTC()
+	}
+
+	for i, req := range reqs {
+		if req.Action != elastic.ActionDelete || isReindexedDelete(reqs, i) {
+			continue
+		}
+		if req.Data == nil {
+			req.Data = elastic.NewBulkData()
+		}
+		req.Action = elastic.ActionUpdate
+		req.Pipeline = ""
+		req.Data[rule.TombstoneField] = true
+		req.Data[rule.TombstoneTimeField] = deletedAt.Format(time.RFC3339)
+	}
+}
+
+// isReindexedDelete returns whether the delete request is followed by the index of
+// the same doc, which is made by update_mode delete_index.
+func isReindexedDelete(reqs []*elastic.BulkRequest, i int) bool {
+	return i+1 < len(reqs) && reqs[i+1].Action == elastic.ActionIndex && reqs[i+1].ID == reqs[i].ID
+}
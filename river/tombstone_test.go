@@ -0,0 +1,57 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestTombstone(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.PKColumns = []int{0}
+
+	r := &River{c: &Config{}, st: &stat{}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta, DeleteMode: DeleteModeTombstone}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.TombstoneField, Equals, "deleted")
+	c.Assert(rule.TombstoneTimeField, Equals, "deleted_at")
+	r.setFieldMapping(rule)
+
+	rows := [][]interface{}{{int32(1), "a"}}
+	reqs, err := r.makeDeleteRequest(rule, rows)
+	c.Assert(err, IsNil)
+	tombstoneDeletes(rule, reqs, &canal.RowsEvent{Action: canal.DeleteAction, Header: &replication.EventHeader{Timestamp: 1500000000}})
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].ID, Equals, "1")
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"deleted": true, "deleted_at": "2017-07-14T02:40:00Z"})
+
+	// the deletes of delete_index are kept
+	rule.UpdateMode = UpdateModeDeleteIndex
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), "a"}, {int32(1), "b"}})
+	c.Assert(err, IsNil)
+	tombstoneDeletes(rule, reqs, &canal.RowsEvent{Action: canal.UpdateAction})
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionDelete)
+
+	// the old doc of the id change is tombstoned
+	rule.UpdateMode = UpdateModeUpdate
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int32(1), "a"}, {int32(2), "a"}})
+	c.Assert(err, IsNil)
+	tombstoneDeletes(rule, reqs, &canal.RowsEvent{Action: canal.UpdateAction})
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Action, Equals, elastic.ActionUpdate)
+	c.Assert(reqs[0].ID, Equals, "1")
+	c.Assert(reqs[0].Data["deleted"], Equals, true)
+
+	properties := r.makeRuleMapping(rule)
+	c.Assert(properties["deleted"], DeepEquals, map[string]interface{}{"type": "boolean"})
+	c.Assert(properties["deleted_at"], DeepEquals, map[string]interface{}{"type": "date"})
+
+	rule = &Rule{Schema: "test", Table: "t", Index: "t", DeleteMode: "soft"}
+	c.Assert(rule.prepare(), NotNil)
+}
@@ -0,0 +1,93 @@
+package river
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// ttlIndex is an index of the rules with ttl.
+type ttlIndex struct {
+	cluster string
+	index   string
+	typ     string
+	field   string
+	ttl     time.Duration
+}
+
+// ttlIndices returns the indices of the rules with ttl, one for the rules with the
+// same index, type, field and ttl. The wildcard rules and the fan-out ones are made
+// from the config rules, so they are not read at runtime.
+func (r *River) ttlIndices() []ttlIndex {
+	var indices []ttlIndex
+	seen := make(map[ttlIndex]bool)
+	for _, rule := range r.c.Rules {
+		if rule.TTL.Duration <= 0 {
+			continue
+		}
+		index := ttlIndex{rule.Cluster, rule.indexPattern(), rule.Type, rule.TTLField, rule.TTL.Duration}
+		if seen[index] {
+			continue
+		}
+		seen[index] = true
+		indices = append(indices, index)
+	}
+	return indices
+}
+
+// runTTL deletes the expired docs of the indices every ttl_interval, the errors are
+// logged and the docs are deleted in the next time.
+func (r *River) runTTL(indices []ttlIndex) {
+	defer r.wg.Done()
+
+	interval := r.c.TTLInterval.Duration
+	if interval == 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, index := range indices {
+			if err := r.expireDocs(index); err != nil {
+				log.Errorf("delete the expired docs in index %s err %v", index.index, err)
+				r.st.addError("delete the expired docs in index %s err %v", index.index, err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// expireDocs deletes at most ttl_max_docs docs whose field is older than the ttl.
+func (r *River) expireDocs(index ttlIndex) error {
+	maxDocs := r.c.TTLMaxDocs
+	if maxDocs == 0 {
+		maxDocs = 10000
+	}
+
+	query := map[string]interface{}{
+		"range": map[string]interface{}{
+			index.field: map[string]interface{}{
+				"lt": fmt.Sprintf("now-%ds", int64(index.ttl/time.Second)),
+			},
+		},
+	}
+	deleted, err := r.esClient(index.cluster).DeleteByQueryLimit(index.index, index.typ, query, maxDocs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if deleted > 0 {
+		log.Infof("delete %d docs older than %s in index %s", deleted, index.ttl, index.index)
+	}
+	if maxDocs > 0 && deleted >= int64(maxDocs) {
+		log.Warnf("%d docs of index %s reach ttl_max_docs, the others are deleted in the next time", deleted, index.index)
+	}
+	return nil
+}
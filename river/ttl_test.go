@@ -0,0 +1,46 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestTTL(c *C) {
+	bodies := make(chan string, 4)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- req.URL.Path + " " + string(body)
+		w.Write([]byte(`{"deleted":100}`))
+	}))
+	defer es.Close()
+
+	var d TomlDuration
+	c.Assert(d.UnmarshalText([]byte("30d")), IsNil)
+	c.Assert(d.Duration, Equals, 30*24*time.Hour)
+	c.Assert(d.UnmarshalText([]byte("1.5d")), IsNil)
+	c.Assert(d.Duration, Equals, 36*time.Hour)
+	c.Assert(d.UnmarshalText([]byte("90m")), IsNil)
+	c.Assert(d.Duration, Equals, 90*time.Minute)
+	c.Assert(d.UnmarshalText([]byte("d")), NotNil)
+
+	rule := &Rule{Schema: "test", Table: "logs", Index: "logs", Type: "logs", TTL: TomlDuration{24 * time.Hour}}
+	c.Assert(rule.prepare(), NotNil)
+	rule.TTLField = "created_at"
+	c.Assert(rule.prepare(), IsNil)
+	other := &Rule{Schema: "test", Table: "logs_2", Index: "logs", Type: "logs", TTL: TomlDuration{24 * time.Hour}, TTLField: "created_at"}
+
+	cfg := &Config{Rules: []*Rule{rule, other, {Schema: "test", Table: "t", Index: "t"}}, TTLMaxDocs: 100}
+	r := &River{c: cfg, st: &stat{}}
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	indices := r.ttlIndices()
+	c.Assert(indices, HasLen, 1)
+
+	c.Assert(r.expireDocs(indices[0]), IsNil)
+	c.Assert(<-bodies, Equals, `/logs/logs/_delete_by_query {"max_docs":100,"query":{"range":{"created_at":{"lt":"now-86400s"}}}}`)
+}
@@ -0,0 +1,215 @@
+package river
+
+import (
+	"path"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// UpstreamConfig is a MySQL server besides the one of my_addr, like another shard,
+// its tables are synced with the same sources and rules into the same indices.
+type UpstreamConfig struct {
+	Name       string `toml:"name"`
+	MyAddr     string `toml:"my_addr"`
+	MyUser     string `toml:"my_user"`
+	MyPassword string `toml:"my_pass"`
+	ServerID   uint32 `toml:"server_id"`
+}
+
+// checkUpstreams checks the upstreams, and the features which can't work with them.
+func (c *Config) checkUpstreams() error {
+	if len(c.Upstreams) == 0 {
+		return nil
+	}
+
+	names := make(map[string]bool, len(c.Upstreams))
+	for _, u := range c.Upstreams {
+		if len(u.Name) == 0 || strings.ContainsAny(u.Name, `/\`) || u.Name == "." || u.Name == ".." {
+			return errors.Errorf("invalid upstream name %q", u.Name)
+		} else if names[u.Name] {
+			return errors.Errorf("duplicate upstream %s", u.Name)
+		} else if len(u.MyAddr) == 0 {
+			return errors.Errorf("my_addr of upstream %s must be set", u.Name)
+		}
+		names[u.Name] = true
+	}
+
+	// the positions of the different servers can't be compared,
+	// and every upstream dumps on its own
+	switch {
+	case len(c.DataDir) == 0:
+		return errors.Errorf("data_dir must be set for the positions of the upstreams")
+	case len(c.VersionType) > 0:
+		return errors.Errorf("version_type can't be used with upstreams")
+	case len(c.RecordFile) > 0:
+		return errors.Errorf("record_file can't be used with upstreams")
+	case c.DumpTuneIndex:
+		return errors.Errorf("dump_tune_index can't be used with upstreams")
+	}
+	for _, rule := range c.Rules {
+		if rule.DumpCleanup {
+			return errors.Errorf("dump_cleanup of rule %s.%s can't be used with upstreams", rule.Schema, rule.Table)
+		}
+	}
+	return nil
+}
+
+// upstreamConfig returns the config of the upstream, the rules are copied as
+// they are prepared with the tables of every upstream.
+func (c *Config) upstreamConfig(u *UpstreamConfig) *Config {
+	uc := *c
+	uc.MyAddr = u.MyAddr
+	uc.MyUser = u.MyUser
+	uc.MyPassword = u.MyPassword
+	uc.MyPasswordFile = ""
+	if u.ServerID > 0 {
+		uc.ServerID = u.ServerID
+	}
+	uc.DataDir = path.Join(c.DataDir, u.Name)
+	uc.Upstreams = nil
+
+	uc.Rules = make([]*Rule, 0, len(c.Rules))
+	for _, rule := range c.Rules {
+		uc.Rules = append(uc.Rules, rule.clone())
+	}
+	return &uc
+}
+
+// newUpstream creates the river of the upstream, which only reads the binlog of its
+// MySQL server, the requests and positions are sent to the sync loop of r.
+func (r *River) newUpstream(c *Config, name string) (*River, error) {
+	u := new(River)
+
+	u.c = c
+	u.name = name
+	u.primary = r
+	u.rules = make(map[string]*Rule)
+	u.wildRules = make(map[string]*Rule)
+	u.syncCh = r.syncCh
+	u.ctx, u.cancel = r.ctx, r.cancel
+	u.skipDDLRegex = r.skipDDLRegex
+	u.ignoreTableRegex = r.ignoreTableRegex
+	u.excludeTableRegex = r.excludeTableRegex
+
+	var err error
+	if u.master, err = loadMasterInfo(c.DataDir); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(c.HeartbeatTable) > 0 {
+		if u.hb, err = newHeartbeat(u); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if err = u.newCanal(); err != nil {
+		return nil, errors.Annotatef(err, "upstream %s", name)
+	}
+
+	if err = u.prepareRule(); err != nil {
+		return nil, errors.Annotatef(err, "upstream %s", name)
+	}
+
+	if err = u.prepareCanal(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if u.hb != nil {
+		if err = u.hb.prepare(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if len(c.PartialRowImage) == 0 {
+		if err = u.canal.CheckBinlogRowImage("FULL"); err != nil {
+			return nil, errors.Annotatef(err, "upstream %s", name)
+		}
+	}
+	if c.BinlogCompression == BinlogCompressionReject {
+		if err = u.checkBinlogCompression(); err != nil {
+			return nil, errors.Annotatef(err, "upstream %s", name)
+		}
+	}
+
+	u.shareOutput(r)
+
+	return u, nil
+}
+
+// shareOutput makes the upstream u write to the outputs of its primary river r.
+func (u *River) shareOutput(r *River) {
+	u.es = r.es
+	u.secondaryES = r.secondaryES
+	u.clusters = r.clusters
+	u.limits = r.limits
+	u.audit = r.audit
+	u.ddlLog = r.ddlLog
+	u.sink = r.sink
+	u.queue = r.queue
+	u.kafka = r.kafka
+	u.webhook = r.webhook
+	u.redis = r.redis
+	u.dlq = r.dlq
+	u.st = r.st
+}
+
+// prepareUpstreams creates the rivers of the upstreams.
+func (r *River) prepareUpstreams(configs []*Config) error {
+	for i, c := range configs {
+		u, err := r.newUpstream(c, r.c.Upstreams[i].Name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return nil
+}
+
+// runUpstream prepares the indices of the upstream rules and reads its binlog,
+// any failure closes the sync.
+func (r *River) runUpstream(u *River) {
+	defer r.wg.Done()
+
+	if u.sink == nil {
+		if err := u.prepareES(); err != nil {
+			log.Errorf("prepare ES for upstream %s err %v, close sync", u.name, err)
+			r.st.addError("prepare ES for upstream %s err %v, close sync", u.name, err)
+			r.cancel()
+			return
+		}
+	}
+
+	if u.hb != nil {
+		u.wg.Add(1)
+		go u.hb.run()
+	}
+
+	pos := u.master.Position()
+	if err := u.canal.RunFrom(pos); err != nil && r.ctx.Err() == nil {
+		log.Errorf("start canal of upstream %s err %v, close sync", u.name, err)
+		r.st.addError("start canal of upstream %s err %v, close sync", u.name, err)
+		r.cancel()
+	}
+}
+
+// closeUpstreams closes the canals of the upstreams, and waits for them.
+func (r *River) closeUpstreams() {
+	for _, u := range r.upstreams {
+		u.canal.Close()
+	}
+	for _, u := range r.upstreams {
+		u.wg.Wait()
+		u.master.Close()
+	}
+}
+
+// root returns the primary river of the upstream, or r itself, the pause and
+// the skip of the /pause and /skip APIs apply to all the upstreams.
+func (r *River) root() *River {
+	if r.primary != nil {
+		return r.primary
+	}
+	return r
+}
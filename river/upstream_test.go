@@ -0,0 +1,78 @@
+package river
+
+import (
+	"context"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func (s *unitTestSuite) TestUpstreams(c *C) {
+	str := `
+data_dir = "./var"
+my_pass = "secret"
+
+[[upstream]]
+name = "shard2"
+my_addr = "127.0.0.1:3307"
+my_user = "root"
+my_pass = "secret2"
+server_id = 1002
+
+[[rule]]
+schema = "test"
+table = "t"
+index = "t"
+field = {title = "my_title"}
+`
+	cfg, err := NewConfig(str)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.checkUpstreams(), IsNil)
+	c.Assert(cfg.Redacted().Upstreams[0].MyPassword, Equals, redacted)
+	c.Assert(cfg.Upstreams[0].MyPassword, Equals, "secret2")
+
+	uc := cfg.upstreamConfig(cfg.Upstreams[0])
+	c.Assert(uc.MyAddr, Equals, "127.0.0.1:3307")
+	c.Assert(uc.MyPassword, Equals, "secret2")
+	c.Assert(uc.ServerID, Equals, uint32(1002))
+	c.Assert(uc.DataDir, Equals, "var/shard2")
+	c.Assert(uc.Upstreams, HasLen, 0)
+	c.Assert(uc.Rules[0], Not(Equals), cfg.Rules[0])
+	uc.Rules[0].FieldMapping["id"] = "id"
+	c.Assert(cfg.Rules[0].FieldMapping, HasLen, 1)
+
+	cfg.Upstreams = append(cfg.Upstreams, &UpstreamConfig{Name: "shard2", MyAddr: "127.0.0.1:3308"})
+	c.Assert(cfg.checkUpstreams(), ErrorMatches, "duplicate upstream shard2")
+	cfg.Upstreams[1].Name = "../shard3"
+	c.Assert(cfg.checkUpstreams(), ErrorMatches, "invalid upstream name.*")
+	cfg.Upstreams = cfg.Upstreams[:1]
+	cfg.VersionType = VersionExternal
+	c.Assert(cfg.checkUpstreams(), ErrorMatches, "version_type can't be used with upstreams")
+	cfg.VersionType = ""
+	cfg.Rules[0].DumpCleanup = true
+	c.Assert(cfg.checkUpstreams(), ErrorMatches, "dump_cleanup .*")
+
+	// the positions of every upstream are saved on their own
+	primary, upstream := new(masterInfo), new(masterInfo)
+	r := &River{c: &Config{}, st: &stat{}, limits: newRateLimits(0, 0), master: primary, syncCh: make(chan interface{}, 16)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	r.syncCh <- posSaver{mysql.Position{Name: "mysql-bin.000009", Pos: 900}, true, upstream}
+	r.syncCh <- posSaver{mysql.Position{Name: "mysql-bin.000001", Pos: 100}, true, nil}
+	done := make(chan struct{})
+	r.syncCh <- syncDone{done}
+	<-done
+	r.cancel()
+	r.wg.Wait()
+	c.Assert(primary.Position().Pos, Equals, uint32(100))
+	c.Assert(upstream.Position().Name, Equals, "mysql-bin.000009")
+	c.Assert(upstream.Position().Pos, Equals, uint32(900))
+
+	// the records of the upstreams don't collide with the same positions
+	l := &ddlLog{index: "ddl_log"}
+	req, err := l.write(&ddlRecord{Schema: "test", Table: "t", BinlogFile: "mysql-bin.000001", BinlogPos: 100, Upstream: "shard2"})
+	c.Assert(err, IsNil)
+	c.Assert(req.ID, Equals, "shard2-mysql-bin.000001-100-test-t")
+}
@@ -0,0 +1,213 @@
+package river
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+const defaultVerifyRows = 100
+
+// verifyDivergence is a row whose doc in ES is missing or different.
+type verifyDivergence struct {
+	index  string
+	id     string
+	reason string
+}
+
+// verifyRules returns the rules whose docs are the plain images of the rows, which
+// can be verified by their single integer PK.
+func (r *River) verifyRules() []*Rule {
+	var rules []*Rule
+	for _, rule := range r.allRules() {
+		switch {
+		case rule.TableInfo == nil || len(rule.TableInfo.PKColumns) != 1:
+		case rule.TableInfo.GetPKColumn(0).Type != schema.TYPE_NUMBER:
+		case rule.ActionMapping[canal.InsertAction] != elastic.ActionIndex:
+		case rule.AppendOnly || rule.WebhookOnly || rule.indexMissing:
+		case len(rule.Script) > 0 || len(rule.Pipeline) > 0 || len(rule.ActionPipeline) > 0:
+		case len(rule.ILMRolloverAlias) > 0:
+		default:
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// runVerify verifies a random PK range of a rule every verify_interval if no rows are
+// read and nothing is pending in the interval, the results are dropped if any row is
+// read meanwhile, as the docs may be changed by it.
+func (r *River) runVerify(rules []*Rule) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.c.VerifyInterval.Duration)
+	defer ticker.Stop()
+
+	last := r.st.Binlog.RowNum.Get()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+
+		rows := r.st.Binlog.RowNum.Get()
+		idle := rows == last && r.st.PendingReqNum.Get() == 0 && r.st.InflightBulkNum.Get() == 0 &&
+			len(r.syncCh) == 0 && !r.paused.Get()
+		last = rows
+		if !idle {
+			continue
+		}
+
+		rule := rules[rand.Intn(len(rules))]
+		n, divergences, err := r.verifyRange(rule)
+		if err != nil {
+			log.Errorf("verify table %s.%s err %v", rule.Schema, rule.Table, err)
+			continue
+		}
+		if r.st.Binlog.RowNum.Get() != rows {
+			log.Debugf("rows are read while verifying table %s.%s, drop the results", rule.Schema, rule.Table)
+			continue
+		}
+
+		r.st.VerifyDocNum.Add(int64(n))
+		r.st.VerifyDivergeNum.Add(int64(len(divergences)))
+		for _, d := range divergences {
+			log.Warnf("verify table %s.%s, doc %s of index %s is %s", rule.Schema, rule.Table, d.id, d.index, d.reason)
+		}
+	}
+}
+
+// verifyRange selects verify_rows rows from a random PK of the rule, and compares them
+// with their docs, returns the number of the verified docs and the divergent ones.
+func (r *River) verifyRange(rule *Rule) (int, []verifyDivergence, error) {
+	pk := fmt.Sprintf("`%s`", rule.TableInfo.GetPKColumn(0).Name)
+	table := fmt.Sprintf("`%s`.`%s`", rule.Schema, rule.Table)
+
+	res, err := r.canal.Execute(fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", pk, pk, table))
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	min, _ := res.GetInt(0, 0)
+	max, _ := res.GetInt(0, 1)
+	if max < min {
+		return 0, nil, nil
+	}
+	start := min
+	if n := max - min + 1; n > 0 {
+		start += rand.Int63n(n)
+	}
+
+	limit := r.c.VerifyRows
+	if limit <= 0 {
+		limit = defaultVerifyRows
+	}
+	var buf bytes.Buffer
+	buf.WriteString("SELECT ")
+	for i, col := range rule.TableInfo.Columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(fmt.Sprintf("`%s`", col.Name))
+	}
+	buf.WriteString(fmt.Sprintf(" FROM %s WHERE %s >= ? ORDER BY %s LIMIT ?", table, pk, pk))
+
+	if res, err = r.canal.Execute(buf.String(), start, limit); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	rows := make([][]interface{}, 0, res.RowNumber())
+	for _, row := range res.Values {
+		values := make([]interface{}, len(row))
+		for i, v := range row {
+			// same as the values in dump
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			} else {
+				values[i] = v
+			}
+		}
+		rows = append(rows, values)
+	}
+	return r.verifyRows(rule, rows)
+}
+
+// verifyRows compares the checksums of the docs the rule makes from the rows with the ones
+// of the same fields of the docs in ES, the other fields in ES are not compared.
+func (r *River) verifyRows(rule *Rule, rows [][]interface{}) (int, []verifyDivergence, error) {
+	reqs := make([]*elastic.BulkRequest, 0, len(rows))
+	defer func() {
+		for _, req := range reqs {
+			elastic.ReleaseBulkData(req.Data)
+		}
+	}()
+
+	for _, values := range rows {
+		data := r.makeFieldData(rule, values)
+		if data == nil {
+			// the row doesn't match the where of the rule
+			continue
+		}
+		req := &elastic.BulkRequest{Type: rule.Type, Data: data}
+		reqs = append(reqs, req)
+		var err error
+		if req.ID, err = r.getDocID(rule, values); err != nil {
+			return 0, nil, errors.Trace(err)
+		}
+		if len(rule.Parent) > 0 {
+			if req.Parent, err = r.getParentID(rule, values, rule.Parent); err != nil {
+				return 0, nil, errors.Trace(err)
+			}
+		}
+		if req.Index, err = rule.rowIndex(values); err != nil {
+			return 0, nil, errors.Trace(err)
+		}
+		if req.Routing, err = r.getRouting(rule, values); err != nil {
+			return 0, nil, errors.Trace(err)
+		}
+	}
+	if len(reqs) == 0 {
+		return 0, nil, nil
+	}
+
+	docs, err := r.esClient(rule.Cluster).MGet(reqs)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+
+	var divergences []verifyDivergence
+	for i, req := range reqs {
+		if !docs[i].Found {
+			divergences = append(divergences, verifyDivergence{req.Index, req.ID, "missing"})
+			continue
+		}
+		data, err := normalizeShadowDoc(req.Data)
+		if err != nil {
+			return 0, nil, errors.Trace(err)
+		}
+		source := make(map[string]interface{}, len(data))
+		for field := range data {
+			if v, ok := docs[i].Source[field]; ok {
+				source[field] = v
+			}
+		}
+		if sum, esSum := verifyChecksum(data), verifyChecksum(source); sum != esSum {
+			divergences = append(divergences, verifyDivergence{req.Index, req.ID, "different"})
+		}
+	}
+	return len(reqs), divergences, nil
+}
+
+// verifyChecksum returns the checksum of the doc, the keys are encoded in order.
+func verifyChecksum(doc map[string]interface{}) [sha1.Size]byte {
+	data, _ := json.Marshal(doc)
+	return sha1.Sum(data)
+}
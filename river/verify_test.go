@@ -0,0 +1,54 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestVerifyRows(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.AddColumn("age", "int(11)", "", "")
+	ta.PKColumns = []int{0}
+
+	var bodies []string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		w.Write([]byte(`{"docs":[` +
+			`{"_index":"t","_id":"1","found":true,"_source":{"id":1,"name":"a","age":10,"extra":true}},` +
+			`{"_index":"t","_id":"2","found":true,"_source":{"id":2,"name":"b","age":21}},` +
+			`{"_index":"t","_id":"3","found":false}]}`))
+	}))
+	defer es.Close()
+
+	r := &River{c: &Config{}, st: &stat{}}
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+	r.rules = map[string]*Rule{ruleKey("test", "t"): rule}
+	c.Assert(r.verifyRules(), HasLen, 1)
+
+	rows := [][]interface{}{{int64(1), "a", int64(10)}, {int64(2), "b", int64(20)}, {int64(3), "c", int64(30)}}
+	n, divergences, err := r.verifyRows(rule, rows)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	// the fields not made by the rule like extra are not compared
+	c.Assert(divergences, DeepEquals, []verifyDivergence{{"t", "2", "different"}, {"t", "3", "missing"}})
+	c.Assert(bodies, HasLen, 1)
+
+	// the rules without a single integer PK can't be verified
+	ta.PKColumns = []int{1}
+	c.Assert(r.verifyRules(), HasLen, 0)
+	ta.PKColumns = []int{0}
+	rule.AppendOnly = true
+	c.Assert(r.verifyRules(), HasLen, 0)
+}
@@ -0,0 +1,57 @@
+package river
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// Version types for versioning docs with the binlog position.
+const (
+	VersionExternal    = "external"
+	VersionExternalGTE = "external_gte"
+)
+
+// binlogVersion makes the doc version from the binlog position, the file sequence
+// is in the high 32 bits and the event end position is in the low 32 bits,
+// so the version increases monotonically with the binlog.
+func binlogVersion(name string, pos uint32) (int64, error) {
+	seq, err := strconv.ParseInt(name[strings.LastIndex(name, ".")+1:], 10, 32)
+	if err != nil {
+		return 0, errors.Errorf("invalid binlog file name %s", name)
+	}
+	return seq<<32 | int64(pos), nil
+}
+
+// setVersion sets the version of the requests with the current binlog position,
+// update requests and the ones without id can't be versioned and are sent as they are.
+// A doc deleted and indexed again by the same event, like with update_mode delete_index,
+// is indexed with external_gte, as external rejects the same version of the delete.
+func (r *River) setVersion(reqs []*elastic.BulkRequest, pos uint32) error {
+	version, err := binlogVersion(r.syncedPosition().Name, pos)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var deleted map[docKey]bool
+	for _, req := range reqs {
+		if req.Action == elastic.ActionUpdate || len(req.ID) == 0 {
+			continue
+		}
+		req.Version = version
+		req.VersionType = r.c.VersionType
+
+		key := docKey{req.Cluster, req.Index, req.Type, req.ID, req.Parent, req.Routing}
+		if req.Action == elastic.ActionDelete {
+			if deleted == nil {
+				deleted = make(map[docKey]bool)
+			}
+			deleted[key] = true
+		} else if deleted[key] {
+			req.VersionType = VersionExternalGTE
+		}
+	}
+	return nil
+}
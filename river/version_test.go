@@ -0,0 +1,56 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestBinlogVersion(c *C) {
+	v1, err := binlogVersion("mysql-bin.000009", 4294967295)
+	c.Assert(err, IsNil)
+	v2, err := binlogVersion("mysql-bin.000010", 4)
+	c.Assert(err, IsNil)
+	c.Assert(v2 > v1, IsTrue)
+	c.Assert(v2, Equals, int64(10)<<32|4)
+
+	_, err = binlogVersion("mysql-bin", 4)
+	c.Assert(err, NotNil)
+}
+
+func (s *unitTestSuite) TestVersionDeleteIndex(c *C) {
+	ta := &schema.Table{Schema: "test", Name: "t"}
+	ta.AddColumn("id", "int(11)", "", "")
+	ta.AddColumn("name", "varchar(256)", "", "")
+	ta.PKColumns = []int{0}
+
+	r := &River{c: &Config{VersionType: VersionExternal}, st: &stat{}, replayPos: mysql.Position{Name: "mysql-bin.000002"}}
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", TableInfo: ta, UpdateMode: UpdateModeDeleteIndex}
+	c.Assert(rule.prepare(), IsNil)
+	r.setFieldMapping(rule)
+
+	reqs, err := r.makeUpdateRequest(rule, [][]interface{}{{int32(1), "a"}, {int32(1), "b"}, {int32(2), "a"}, {int32(2), "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 4)
+	c.Assert(r.setVersion(reqs, 120), IsNil)
+
+	version, err := binlogVersion("mysql-bin.000002", 120)
+	c.Assert(err, IsNil)
+	for i := 0; i < len(reqs); i += 2 {
+		del, index := reqs[i], reqs[i+1]
+		c.Assert(del.Action, Equals, elastic.ActionDelete)
+		c.Assert(del.Version, Equals, version)
+		c.Assert(del.VersionType, Equals, VersionExternal)
+		// the same version isn't greater than the one of the delete
+		c.Assert(index.Action, Equals, elastic.ActionIndex)
+		c.Assert(index.ID, Equals, del.ID)
+		c.Assert(index.Version, Equals, version)
+		c.Assert(index.VersionType, Equals, VersionExternalGTE)
+	}
+
+	// the other docs are still versioned with external
+	reqs = []*elastic.BulkRequest{{Index: "t", ID: "1", Action: elastic.ActionDelete}, {Index: "t", ID: "2", Action: elastic.ActionIndex}}
+	c.Assert(r.setVersion(reqs, 200), IsNil)
+	c.Assert(reqs[1].VersionType, Equals, VersionExternal)
+}
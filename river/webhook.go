@@ -0,0 +1,129 @@
+package river
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+// WebhookSignatureHeader is the header of the HMAC-SHA256 signature of the webhook body,
+// like "sha256=<hex>", it is only set with webhook_secret.
+const WebhookSignatureHeader = "X-River-Signature-256"
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// webhookClient posts the doc operations of the rules to their webhooks.
+type webhookClient struct {
+	c          *http.Client
+	secret     []byte
+	maxRetries int
+	// the first backoff of the retries, doubled every time
+	backoff time.Duration
+}
+
+type webhookBody struct {
+	Schema     string   `json:"schema"`
+	Table      string   `json:"table"`
+	Operations []*docOp `json:"operations"`
+}
+
+func newWebhookClient(c *Config) *webhookClient {
+	timeout := c.WebhookTimeout.Duration
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	maxRetries := c.WebhookMaxRetries
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+	return &webhookClient{
+		c:          &http.Client{Timeout: timeout},
+		secret:     []byte(c.WebhookSecret),
+		maxRetries: maxRetries,
+		backoff:    time.Second,
+	}
+}
+
+// sign returns the signature of the body, empty if no secret.
+func (w *webhookClient) sign(body []byte) string {
+	if len(w.secret) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook posts the requests of the rule to its webhook, the network errors, 429 and 5xx
+// are retried with backoff, it fails after the retries or with the other status.
+func (r *River) postWebhook(rule *Rule, reqs []*elastic.BulkRequest) error {
+	w := r.webhook
+	body := &webhookBody{Schema: rule.Schema, Table: rule.Table, Operations: make([]*docOp, 0, len(reqs))}
+	for _, req := range reqs {
+		body.Operations = append(body.Operations, newDocOp(req))
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	signature := w.sign(data)
+
+	backoff := w.backoff
+	for retry := 0; ; retry++ {
+		retryable, err := w.postOnce(r.ctx, rule.Webhook, data, signature)
+		if err == nil {
+			r.st.WebhookNum.Add(int64(len(reqs)))
+			return nil
+		} else if !retryable || retry >= w.maxRetries {
+			return errors.Annotatef(err, "post %d docs of %s.%s to webhook after %d retries", len(reqs), rule.Schema, rule.Table, retry)
+		}
+
+		r.st.WebhookRetryNum.Add(1)
+		log.Warnf("post %d docs of %s.%s to webhook err %v, retry after %s", len(reqs), rule.Schema, rule.Table, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-r.ctx.Done():
+			return errors.Trace(r.ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// postOnce returns whether the error can be retried.
+func (w *webhookClient) postOnce(ctx context.Context, url string, data []byte, signature string) (bool, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if len(signature) > 0 {
+		req.Header.Set(WebhookSignatureHeader, signature)
+	}
+
+	resp, err := w.c.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return true, errors.Errorf("webhook status %d", resp.StatusCode)
+	default:
+		return false, errors.Errorf("webhook status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,86 @@
+package river
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/siddontang/go/sync2"
+	"github.com/zeayes/go-mysql-elasticsearch/elastic"
+)
+
+func (s *unitTestSuite) TestWebhook(c *C) {
+	events := make(chan string, 16)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		events <- "es"
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer es.Close()
+
+	var fails sync2.AtomicInt64
+	fails.Set(1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		c.Check(req.Header.Get(WebhookSignatureHeader), Equals, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		if fails.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		events <- string(body)
+	}))
+	defer hook.Close()
+
+	c.Assert((&Rule{Schema: "test", Table: "t", Webhook: "cache/purge"}).prepare(), NotNil)
+	c.Assert((&Rule{Schema: "test", Table: "t", WebhookOnly: true}).prepare(), NotNil)
+	rule := &Rule{Schema: "test", Table: "t", Index: "t", Webhook: hook.URL + "/purge"}
+	c.Assert(rule.prepare(), IsNil)
+	c.Assert(rule.hasOwnBatch(), IsTrue)
+
+	cfg := &Config{BulkSize: 1, FlushBulkTime: TomlDuration{time.Hour}, WebhookSecret: "secret", Rules: []*Rule{rule}}
+	r := &River{c: cfg, st: &stat{}, limits: newRateLimits(0, 0), syncCh: make(chan interface{}, 16)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(es.URL, "http://")})
+	r.webhook = newWebhookClient(cfg)
+	r.webhook.backoff = time.Millisecond
+	r.wg.Add(1)
+	go r.syncLoop()
+	defer func() {
+		r.cancel()
+		r.wg.Wait()
+	}()
+
+	newReqs := func() []*elastic.BulkRequest {
+		return []*elastic.BulkRequest{{Action: elastic.ActionUpdate, Index: "t", ID: "1", Data: map[string]interface{}{"a": 1}}}
+	}
+	// the webhook is retried after the docs are written to ES
+	r.syncCh <- ruleRequests{rule: rule, reqs: newReqs()}
+	c.Assert(<-events, Equals, "es")
+	c.Assert(<-events, Equals, `{"schema":"test","table":"t","operations":[{"action":"update","index":"t","id":"1","doc":{"a":1}}]}`)
+
+	// not written to ES with webhook_only
+	rule.WebhookOnly = true
+	r.syncCh <- ruleRequests{rule: rule, reqs: newReqs()}
+	c.Assert(<-events, Matches, `\{"schema":"test".*`)
+	for i := 0; i < 100 && r.st.WebhookNum.Get() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(r.st.WebhookNum.Get(), Equals, int64(2))
+	c.Assert(r.st.WebhookRetryNum.Get(), Equals, int64(1))
+
+	// the other status fails without retries
+	hook.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	err := r.postWebhook(rule, newReqs())
+	c.Assert(err, NotNil)
+	c.Assert(r.st.WebhookRetryNum.Get(), Equals, int64(1))
+}